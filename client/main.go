@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -16,18 +17,115 @@ import (
 )
 
 var (
-	serverURL   = flag.String("server", "wss://localhost:8443/tunnel", "Tunnel server URL")
-	authToken   = flag.String("token", "", "Authentication token (required)")
-	clientID    = flag.String("id", "", "Client ID (optional)")
-	skipVerify  = flag.Bool("skip-verify", false, "Skip TLS verification (dev only)")
-	forward     = flag.String("forward", "", "Port forwarding config (e.g., '8080:localhost:80')")
-	useImproved = flag.Bool("improved", true, "Use improved implementation with better reliability")
-	showMetrics = flag.Bool("metrics", false, "Show connection metrics periodically")
+	serverURL    = flag.String("server", "wss://localhost:8443/tunnel", "Tunnel server URL, or a comma-separated failover list with the primary first")
+	serverSRV    = flag.String("srv", os.Getenv("TUNNEL_SERVER_SRV"), "DNS SRV name listing tunnel servers (e.g. '_tunnel._tcp.example.com')")
+	authToken    = flag.String("token", "", "Authentication token (required)")
+	clientID     = flag.String("id", "", "Client ID (optional)")
+	clientGroup  = flag.String("group", "", "Client group label for load-balanced forwarders (optional)")
+	skipVerify   = flag.Bool("skip-verify", false, "Skip TLS verification (dev only)")
+	forward      = flag.String("forward", "", "Port forwarding config (e.g., '8080:localhost:80' or '2375:unix:///var/run/docker.sock')")
+	useImproved  = flag.Bool("improved", true, "Use improved implementation with better reliability")
+	showMetrics  = flag.Bool("metrics", false, "Show connection metrics periodically")
+	configFile   = flag.String("config", os.Getenv("TUNNEL_CLIENT_CONFIG"), "Client configuration file (YAML, optional)")
+	allowTargets = flag.String("allow-targets", os.Getenv("TUNNEL_ALLOWED_TARGETS"), "Comma-separated targets the server may push (e.g. '*.svc.cluster.local:*,10.0.0.0/8:443')")
+	egress       = flag.String("egress", os.Getenv("TUNNEL_EGRESS"), "Comma-separated local listeners dialed out by the server (e.g. '8443:mirror.example.com:443' or 'unix:///run/tunnel/mirror.sock:mirror.example.com:443')")
+	socksListen  = flag.String("socks", os.Getenv("TUNNEL_SOCKS_LISTEN"), "Local SOCKS5 proxy address routed through the server (e.g. '127.0.0.1:1080')")
+	socksCreds   = flag.String("socks-credentials", os.Getenv("TUNNEL_SOCKS_CREDENTIALS"), "File of username:password lines required by the SOCKS5 proxy")
+	httpProxy    = flag.String("http-proxy", os.Getenv("TUNNEL_HTTP_PROXY_LISTEN"), "Local HTTP proxy address routed through the server (e.g. '127.0.0.1:3128')")
+	httpCreds    = flag.String("http-proxy-credentials", os.Getenv("TUNNEL_HTTP_PROXY_CREDENTIALS"), "File of username:password lines required by the HTTP proxy")
+	httpAllow    = flag.String("http-proxy-allow", os.Getenv("TUNNEL_HTTP_PROXY_ALLOW"), "Comma-separated destinations the HTTP proxy may open (e.g. '*.example.com:443')")
 )
 
+// loadFileConfig loads the client configuration file, letting explicitly set flags override it
+func loadFileConfig(path string) (*tunnel.ClientFileConfig, error) {
+	fileConfig, err := tunnel.LoadClientConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Empty values are ignored so service units may pass unset variables
+	flag.Visit(func(f *flag.Flag) {
+		switch {
+		case f.Name == "server" && *serverURL != "":
+			fileConfig.Servers = splitList(*serverURL)
+		case f.Name == "token" && *authToken != "":
+			fileConfig.Token = *authToken
+		case f.Name == "id" && *clientID != "":
+			fileConfig.ClientID = *clientID
+		case f.Name == "group" && *clientGroup != "":
+			fileConfig.ClientGroup = *clientGroup
+		case f.Name == "skip-verify" && *skipVerify:
+			fileConfig.TLS.SkipVerify = true
+		}
+	})
+
+	if *serverSRV != "" {
+		fileConfig.ServerSRV = *serverSRV
+	}
+	if *socksListen != "" {
+		fileConfig.SOCKS.Listen = *socksListen
+	}
+	if *socksCreds != "" {
+		fileConfig.SOCKS.CredentialsFile = *socksCreds
+	}
+	if *httpProxy != "" {
+		fileConfig.HTTPProxy.Listen = *httpProxy
+	}
+	if *httpCreds != "" {
+		fileConfig.HTTPProxy.CredentialsFile = *httpCreds
+	}
+	if *httpAllow != "" {
+		fileConfig.HTTPProxy.AllowedDestinations = splitList(*httpAllow)
+	}
+
+	if fileConfig.Token == "" {
+		fileConfig.Token = os.Getenv("TUNNEL_TOKEN")
+	}
+
+	if err := fileConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration in %s:\n%w", path, err)
+	}
+	return fileConfig, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
 func main() {
 	flag.Parse()
 
+	var fileConfig *tunnel.ClientFileConfig
+	if *configFile != "" {
+		var err error
+		fileConfig, err = loadFileConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*authToken = fileConfig.Token
+		*serverURL = strings.Join(fileConfig.Servers, ",")
+		*socksListen = fileConfig.SOCKS.Listen
+		*socksCreds = fileConfig.SOCKS.CredentialsFile
+		*httpProxy = fileConfig.HTTPProxy.Listen
+		*httpCreds = fileConfig.HTTPProxy.CredentialsFile
+		*httpAllow = strings.Join(fileConfig.HTTPProxy.AllowedDestinations, ",")
+	}
+
 	// Get auth token from env if not provided via flag
 	if *authToken == "" {
 		*authToken = os.Getenv("TUNNEL_TOKEN")
@@ -55,22 +153,52 @@ func main() {
 		cancel()
 	}()
 
+	// The first server is the primary; the improved client fails over to the others
+	servers := splitList(*serverURL)
+	primary := ""
+	if len(servers) > 0 {
+		primary = servers[0]
+	}
+
 	// Use improved implementation by default
 	if *useImproved {
 		logger.Info("Using improved tunnel client implementation")
 		
-		config := tunnel.DefaultImprovedClientConfig(*serverURL, *authToken, *clientID, logger)
+		config := tunnel.DefaultImprovedClientConfig(primary, *authToken, *clientID, logger)
+		config.ServerURLs = servers
+		config.ServerSRV = *serverSRV
 		config.SkipVerify = *skipVerify
+		config.ClientGroup = *clientGroup
+		
+		// Server-pushed targets are only applied when they match the allowlist
+		if *allowTargets != "" {
+			config.AllowedTargets = splitList(*allowTargets)
+			if err := tunnel.TargetAllowlist(config.AllowedTargets).Validate(); err != nil {
+				logger.Fatal("Invalid -allow-targets", zap.Error(err))
+			}
+		}
+		
+		if fileConfig != nil {
+			if err := fileConfig.Apply(&config); err != nil {
+				logger.Fatal("Failed to apply configuration file", zap.Error(err))
+			}
+			for port, target := range config.PortMappings {
+				logger.Info("Configured port mapping", 
+					zap.String("name", config.MappingOptions[port].Name),
+					zap.Int("port", port),
+					zap.String("target", target),
+					zap.Bool("tls", config.MappingOptions[port].TLS != nil))
+			}
+		}
 		
 		client := tunnel.NewImprovedClient(config)
 		
 		// Parse forward configuration for improved client
 		if *forward != "" {
-			// Parse format: "8088:target:443"
-			parts := strings.Split(*forward, ":")
-			if len(parts) == 3 {
-				if port, err := strconv.Atoi(parts[0]); err == nil {
-					target := parts[1] + ":" + parts[2]
+			// Parse format: "8088:target:443" or "8088:unix:///var/run/docker.sock"
+			portStr, target, _ := strings.Cut(*forward, ":")
+			if strings.HasPrefix(target, "unix:///") || strings.Count(target, ":") == 1 {
+				if port, err := strconv.Atoi(portStr); err == nil {
 					config.PortMappings[port] = target
 					logger.Info("Configured port mapping", 
 						zap.Int("port", port),
@@ -80,11 +208,70 @@ func main() {
 						zap.String("forward", *forward))
 				}
 			} else {
-				logger.Error("Invalid forward configuration format, expected port:host:port", 
+				logger.Error("Invalid forward configuration format, expected port:host:port or port:unix:///path", 
 					zap.String("forward", *forward))
 			}
 		}
 		
+		// Local listeners whose connections the server dials out, subject to its egress policy
+		for _, spec := range splitList(*egress) {
+			// The listener is a port or a unix:// socket path, which contains colons itself
+			rest, portStr, ok1 := cutLast(spec, ":")
+			local, host, ok2 := cutLast(rest, ":")
+			if !ok1 || !ok2 || local == "" || host == "" {
+				logger.Fatal("Invalid egress format, expected localPort:host:port or unix:///path:host:port", zap.String("egress", spec))
+			}
+			remotePort, err := strconv.Atoi(portStr)
+			if err != nil {
+				logger.Fatal("Invalid port in egress configuration", zap.String("egress", spec))
+			}
+			if socketPath, unix := strings.CutPrefix(local, "unix://"); unix {
+				err = client.AddUnixForwarder(socketPath, host, remotePort)
+			} else if localPort, convErr := strconv.Atoi(local); convErr == nil {
+				err = client.AddPortForwarder(localPort, host, remotePort)
+			} else {
+				logger.Fatal("Invalid port in egress configuration", zap.String("egress", spec))
+			}
+			if err != nil {
+				logger.Fatal("Failed to add egress listener", zap.Error(err))
+			}
+		}
+		
+		// SOCKS5 proxy whose connections and UDP associations the server dials out
+		if *socksListen != "" {
+			proxy := tunnel.NewSOCKS5Proxy(logger, client)
+			if *socksCreds != "" {
+				credentials, err := tunnel.LoadProxyCredentials(*socksCreds)
+				if err != nil {
+					logger.Fatal("Invalid SOCKS5 credentials", zap.Error(err))
+				}
+				proxy.SetCredentials(credentials)
+			}
+			if err := proxy.Listen(*socksListen); err != nil {
+				logger.Fatal("Failed to start SOCKS5 proxy", zap.Error(err))
+			}
+			defer proxy.Stop()
+		}
+		
+		// HTTP CONNECT and forward proxy for tools that only support HTTP_PROXY
+		if *httpProxy != "" {
+			proxy := tunnel.NewHTTPProxy(logger, client)
+			if *httpCreds != "" {
+				credentials, err := tunnel.LoadProxyCredentials(*httpCreds)
+				if err != nil {
+					logger.Fatal("Invalid HTTP proxy credentials", zap.Error(err))
+				}
+				proxy.SetCredentials(credentials)
+			}
+			if err := proxy.SetAllowedDestinations(splitList(*httpAllow)); err != nil {
+				logger.Fatal("Invalid -http-proxy-allow", zap.Error(err))
+			}
+			if err := proxy.Listen(*httpProxy); err != nil {
+				logger.Fatal("Failed to start HTTP proxy", zap.Error(err))
+			}
+			defer proxy.Stop()
+		}
+		
 		// Show metrics periodically if requested
 		if *showMetrics {
 			go func() {
@@ -113,7 +300,7 @@ func main() {
 		logger.Info("Using original tunnel client implementation")
 		
 		config := tunnel.ClientConfig{
-			ServerURL:  *serverURL,
+			ServerURL:  primary,
 			AuthToken:  *authToken,
 			ClientID:   *clientID,
 			SkipVerify: *skipVerify,
@@ -146,7 +333,7 @@ func main() {
 		}
 
 		// Start the client
-		logger.Info("Starting tunnel client", zap.String("server", *serverURL))
+		logger.Info("Starting tunnel client", zap.String("server", primary))
 		if err := client.Start(ctx); err != nil {
 			logger.Fatal("Failed to start client", zap.Error(err))
 		}
@@ -127,6 +127,12 @@ install_config() {
     else
         log_info "Configuration file already exists: $CONFIG_DIR/config"
     fi
+    
+    if [[ ! -f "$CONFIG_DIR/config.yaml.example" ]] && [[ -f "daemon/client/config.yaml.example" ]]; then
+        cp "daemon/client/config.yaml.example" "$CONFIG_DIR/config.yaml.example"
+        chmod 644 "$CONFIG_DIR/config.yaml.example"
+        log_info "YAML configuration example (multiple port mappings): $CONFIG_DIR/config.yaml.example"
+    fi
 }
 
 install_service() {
@@ -0,0 +1,510 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// Timezones of access windows must resolve on hosts without zoneinfo
+	_ "time/tzdata"
+
+	"go.uber.org/zap"
+)
+
+// Access control defaults
+const (
+	defaultMaxGrant     = 8 * time.Hour
+	accessCheckInterval = 15 * time.Second
+	accessAuditSize     = 200
+	maxWindowDuration   = 31 * 24 * time.Hour
+)
+
+// CloseAccessRevoked ends the sessions of a forwarder whose access period ended
+const CloseAccessRevoked = "access_revoked"
+
+// AccessConfig restricts when a forwarder accepts connections. Outside its
+// windows and grants the forwarder's listener is closed.
+type AccessConfig struct {
+	Windows      []AccessWindow `yaml:"windows"`       // Open during any of these windows
+	Timezone     string         `yaml:"timezone"`      // IANA timezone of the windows (default UTC)
+	JustInTime   bool           `yaml:"just_in_time"`  // Operators may open the forwarder through the admin API
+	MaxGrant     time.Duration  `yaml:"max_grant"`     // Longest just-in-time grant (default 8h)
+	KeepSessions bool           `yaml:"keep_sessions"` // Let sessions run past the end of an access period
+}
+
+// AccessWindow opens a forwarder at the times of a cron expression for a duration
+type AccessWindow struct {
+	Start    string        `yaml:"start"`    // "minute hour day-of-month month day-of-week", e.g. "0 22 * * SAT"
+	Duration time.Duration `yaml:"duration"` // How long the window stays open
+}
+
+// enabled reports whether the forwarder is access controlled
+func (c AccessConfig) enabled() bool {
+	return len(c.Windows) > 0 || c.JustInTime
+}
+
+// Validate checks a forwarder's access settings
+func (c AccessConfig) Validate() error {
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	for _, window := range c.Windows {
+		if _, err := parseCron(window.Start); err != nil {
+			return fmt.Errorf("access: window %q: %w", window.Start, err)
+		}
+		if window.Duration < time.Minute || window.Duration > maxWindowDuration {
+			return fmt.Errorf("access: window %q: duration must be between 1m and %s", window.Start, maxWindowDuration)
+		}
+	}
+	if c.MaxGrant < 0 {
+		return fmt.Errorf("access: max_grant must not be negative")
+	}
+	if c.MaxGrant > 0 && !c.JustInTime {
+		return fmt.Errorf("access: max_grant needs just_in_time")
+	}
+	return nil
+}
+
+// AccessGrant is a just-in-time opening of a forwarder
+type AccessGrant struct {
+	Operator  string    `json:"operator"`
+	Reason    string    `json:"reason,omitempty"`
+	GrantedAt time.Time `json:"grantedAt"`
+	Until     time.Time `json:"until"`
+}
+
+// AccessStatus reports whether an access-controlled forwarder is open
+type AccessStatus struct {
+	Forwarder  string       `json:"forwarder"`
+	Open       bool         `json:"open"`
+	OpenUntil  *time.Time   `json:"openUntil,omitempty"`
+	Window     string       `json:"window,omitempty"` // Start of the window the forwarder is open for
+	Grant      *AccessGrant `json:"grant,omitempty"`
+	JustInTime bool         `json:"justInTime"`
+}
+
+// AccessEvent is an audit entry of access control
+type AccessEvent struct {
+	Time      time.Time  `json:"time"`
+	Forwarder string     `json:"forwarder"`
+	Event     string     `json:"event"` // grant, revoke, expire, open, close
+	Operator  string     `json:"operator,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	Sessions  int        `json:"sessions,omitempty"` // Sessions closed with the forwarder
+}
+
+// accessState is the access control of one forwarder
+type accessState struct {
+	fw       ForwarderConfig
+	exists   bool // Configured forwarder, see handleTCPConnection
+	windows  []*cronSchedule
+	location *time.Location
+	grant    *AccessGrant
+	open     bool
+	until    time.Time
+	window   string
+}
+
+// AccessControl opens and closes the listeners of access-controlled forwarders
+// according to their windows and just-in-time grants. Grants are kept in
+// memory and are not shared between cluster nodes.
+type AccessControl struct {
+	server *ImprovedServer
+	logger *zap.Logger
+
+	mu         sync.Mutex
+	forwarders map[string]*accessState // forwarder name -> state
+	audit      []AccessEvent
+	started    sync.Once
+}
+
+// NewAccessControl creates the access control of a server
+func NewAccessControl(server *ImprovedServer, logger *zap.Logger) *AccessControl {
+	return &AccessControl{
+		server:     server,
+		logger:     logger,
+		forwarders: make(map[string]*accessState),
+	}
+}
+
+// manage takes over the listener of an access-controlled forwarder and opens
+// it if the forwarder is currently within a window
+func (a *AccessControl) manage(fw ForwarderConfig, exists bool) error {
+	location, err := time.LoadLocation(fw.Access.Timezone)
+	if err != nil {
+		return err
+	}
+	state := &accessState{fw: fw, exists: exists, location: location}
+	for _, window := range fw.Access.Windows {
+		schedule, err := parseCron(window.Start)
+		if err != nil {
+			return fmt.Errorf("window %q: %w", window.Start, err)
+		}
+		state.windows = append(state.windows, schedule)
+	}
+
+	a.mu.Lock()
+	a.forwarders[fw.Name] = state
+	a.evaluate(state, time.Now())
+	a.mu.Unlock()
+
+	a.started.Do(func() { go a.run() })
+	return nil
+}
+
+// run re-evaluates every forwarder until the server shuts down
+func (a *AccessControl) run() {
+	ticker := time.NewTicker(accessCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.server.ctx.Done():
+			return
+		case now := <-ticker.C:
+			a.mu.Lock()
+			for _, state := range a.forwarders {
+				a.evaluate(state, now)
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+// evaluate expires grants and opens or closes a forwarder's listener; a.mu must be held
+func (a *AccessControl) evaluate(state *accessState, now time.Time) {
+	name := state.fw.Name
+	if state.grant != nil && !now.Before(state.grant.Until) {
+		a.record(AccessEvent{Forwarder: name, Event: "expire", Operator: state.grant.Operator, Until: &state.grant.Until})
+		state.grant = nil
+	}
+
+	open, until, window := false, time.Time{}, ""
+	local := now.In(state.location)
+	for i, schedule := range state.windows {
+		duration := state.fw.Access.Windows[i].Duration
+		if start, ok := schedule.lastStart(local, duration); ok {
+			if end := start.Add(duration); end.After(until) {
+				open, until, window = true, end, state.fw.Access.Windows[i].Start
+			}
+		}
+	}
+	if state.grant != nil && state.grant.Until.After(until) {
+		open, until, window = true, state.grant.Until, ""
+	}
+	state.until, state.window = until, window
+
+	if open == state.open {
+		return
+	}
+	if open {
+		if err := a.server.startListener(state.fw, state.exists); err != nil {
+			a.logger.Error("Failed to open access-controlled forwarder", zap.String("forwarder", name), zap.Error(err))
+			return
+		}
+		state.open = true
+		cause := "window " + window
+		if window == "" {
+			cause = "grant"
+		}
+		a.record(AccessEvent{Forwarder: name, Event: "open", Reason: cause, Until: &until})
+		return
+	}
+
+	a.server.StopTCPForwarder(state.fw.Port)
+	state.open = false
+	closed := 0
+	if !state.fw.Access.KeepSessions {
+		closed = a.server.closeForwarderSessions(name, CloseAccessRevoked)
+	}
+	a.record(AccessEvent{Forwarder: name, Event: "close", Sessions: closed})
+}
+
+// record appends an audit event and logs it; a.mu must be held
+func (a *AccessControl) record(event AccessEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if len(a.audit) >= accessAuditSize {
+		a.audit = append(a.audit[:0:0], a.audit[1:]...)
+	}
+	a.audit = append(a.audit, event)
+
+	fields := []zap.Field{
+		zap.String("forwarder", event.Forwarder),
+		zap.String("event", event.Event),
+	}
+	if event.Operator != "" {
+		fields = append(fields, zap.String("operator", event.Operator))
+	}
+	if event.Reason != "" {
+		fields = append(fields, zap.String("reason", event.Reason))
+	}
+	if event.Until != nil {
+		fields = append(fields, zap.Time("until", *event.Until))
+	}
+	if event.Sessions > 0 {
+		fields = append(fields, zap.Int("sessionsClosed", event.Sessions))
+	}
+	a.logger.Info("Access audit", fields...)
+}
+
+// Grant opens a just-in-time forwarder for duration on behalf of an operator
+func (a *AccessControl) Grant(name, operator, reason string, duration time.Duration) (AccessStatus, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	state, exists := a.forwarders[name]
+	if !exists {
+		return AccessStatus{}, fmt.Errorf("forwarder %s is not access controlled", name)
+	}
+	if !state.fw.Access.JustInTime {
+		return AccessStatus{}, fmt.Errorf("forwarder %s does not allow just-in-time access", name)
+	}
+	if operator == "" {
+		return AccessStatus{}, fmt.Errorf("operator is required")
+	}
+	maxGrant := state.fw.Access.MaxGrant
+	if maxGrant <= 0 {
+		maxGrant = defaultMaxGrant
+	}
+	if duration <= 0 || duration > maxGrant {
+		return AccessStatus{}, fmt.Errorf("duration must be between 0 and %s", maxGrant)
+	}
+
+	now := time.Now()
+	state.grant = &AccessGrant{Operator: operator, Reason: reason, GrantedAt: now, Until: now.Add(duration)}
+	a.record(AccessEvent{Forwarder: name, Event: "grant", Operator: operator, Reason: reason, Until: &state.grant.Until})
+	a.evaluate(state, now)
+	return a.status(state), nil
+}
+
+// Revoke ends the just-in-time grant of a forwarder
+func (a *AccessControl) Revoke(name, operator, reason string) (AccessStatus, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	state, exists := a.forwarders[name]
+	if !exists {
+		return AccessStatus{}, fmt.Errorf("forwarder %s is not access controlled", name)
+	}
+	if state.grant == nil {
+		return AccessStatus{}, fmt.Errorf("forwarder %s has no active grant", name)
+	}
+	state.grant = nil
+	a.record(AccessEvent{Forwarder: name, Event: "revoke", Operator: operator, Reason: reason})
+	a.evaluate(state, time.Now())
+	return a.status(state), nil
+}
+
+// Status reports every access-controlled forwarder
+func (a *AccessControl) Status() []AccessStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make([]AccessStatus, 0, len(a.forwarders))
+	for _, state := range a.forwarders {
+		result = append(result, a.status(state))
+	}
+	return result
+}
+
+// statusOf reports one forwarder, if it is access controlled
+func (a *AccessControl) statusOf(name string) (AccessStatus, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	state, exists := a.forwarders[name]
+	if !exists {
+		return AccessStatus{}, false
+	}
+	return a.status(state), true
+}
+
+// status reports a forwarder; a.mu must be held
+func (a *AccessControl) status(state *accessState) AccessStatus {
+	status := AccessStatus{
+		Forwarder:  state.fw.Name,
+		Open:       state.open,
+		Window:     state.window,
+		JustInTime: state.fw.Access.JustInTime,
+	}
+	if state.open {
+		until := state.until
+		status.OpenUntil = &until
+	}
+	if state.grant != nil {
+		grant := *state.grant
+		status.Grant = &grant
+	}
+	return status
+}
+
+// Audit returns the recent access events, oldest first
+func (a *AccessControl) Audit() []AccessEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AccessEvent(nil), a.audit...)
+}
+
+// cronSchedule is a parsed five-field cron expression
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of allowed values
+	domAny, dowAny                bool
+}
+
+var cronMonths = map[string]int{"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12}
+var cronDays = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+
+// parseCron parses "minute hour day-of-month month day-of-week" with *,
+// lists, ranges, steps and month and weekday names
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField parses one field into a bit set of values within [min, max]
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(s string) (int, error) {
+		if n, ok := names[strings.ToUpper(s)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangeSpec, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rangeSpec, step = part[:i], n
+		}
+
+		low, high := min, max
+		if rangeSpec != "*" {
+			bounds := strings.SplitN(rangeSpec, "-", 2)
+			var err error
+			if low, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				high = max
+			}
+			if high < low {
+				return 0, fmt.Errorf("invalid range %q", rangeSpec)
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the schedule fires at the minute of t
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute&(1<<uint(t.Minute())) != 0 && c.hour&(1<<uint(t.Hour())) != 0 && c.matchesDay(t)
+}
+
+// matchesDay reports whether the schedule fires on the day of t
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	if c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	// Like cron, a restricted day of month or day of week is enough when both are set
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// lastStart returns the most recent start of the schedule within duration
+// before t, if any. It walks back over days and hours and skips those the
+// schedule does not fire in, so even the longest window takes a few
+// thousand steps at most.
+func (c *cronSchedule) lastStart(t time.Time, duration time.Duration) (time.Time, bool) {
+	now := t.Truncate(time.Minute)
+	earliest := now.Add(-duration) // Starts must be after this
+	year, month, day := t.Date()
+	for back := 0; ; back++ {
+		date := time.Date(year, month, day-back, 0, 0, 0, 0, t.Location())
+		if !date.AddDate(0, 0, 1).After(earliest) {
+			return time.Time{}, false
+		}
+		if !c.matchesDay(date) {
+			continue
+		}
+		lastHour := 23
+		if back == 0 {
+			lastHour = t.Hour()
+		}
+		for hour := lastHour; hour >= 0; hour-- {
+			if c.hour&(1<<uint(hour)) == 0 {
+				continue
+			}
+			lastMinute := 59
+			if back == 0 && hour == t.Hour() {
+				lastMinute = t.Minute()
+			}
+			for minute := lastMinute; minute >= 0; minute-- {
+				if c.minute&(1<<uint(minute)) == 0 {
+					continue
+				}
+				start := time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, t.Location())
+				if start.After(now) {
+					// A wall clock time repeated by a daylight saving change
+					continue
+				}
+				if !start.After(earliest) {
+					return time.Time{}, false
+				}
+				return start, true
+			}
+		}
+	}
+}
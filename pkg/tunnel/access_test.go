@@ -0,0 +1,198 @@
+package tunnel
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 22 * * SAT", true},
+		{"30 2 1 * *", true},
+		{"*/15 8-18 * * MON-FRI", true},
+		{"0 0 1,15 JAN,jul *", true},
+		{"5/10 * * * *", true},
+		{"0 0 * * 7", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"* * * * FUN", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"10-5 * * * *", false},
+		{"1,,2 * * * *", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			_, err := parseCron(tt.spec)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// 2024-06-01 is a Saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.June, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		spec  string
+		time  time.Time
+		match bool
+	}{
+		{"every minute", "* * * * *", at(3, 12, 34), true},
+		{"weekday by name", "0 22 * * SAT", at(1, 22, 0), true},
+		{"other weekday", "0 22 * * SAT", at(2, 22, 0), false},
+		{"other minute", "0 22 * * SAT", at(1, 22, 1), false},
+		{"Sunday as 7", "0 0 * * 7", at(2, 0, 0), true},
+		{"Sunday as 0", "0 0 * * 0", at(2, 0, 0), true},
+		{"step", "*/15 * * * *", at(3, 9, 45), true},
+		{"step miss", "*/15 * * * *", at(3, 9, 50), false},
+		{"step from start", "5/20 * * * *", at(3, 9, 45), true},
+		{"hour range", "0 8-18 * * MON-FRI", at(3, 18, 0), true},
+		{"hour range weekend", "0 8-18 * * MON-FRI", at(1, 12, 0), false},
+		{"month name", "0 0 1 JUN *", at(1, 0, 0), true},
+		{"other month", "0 0 1 JUL *", at(1, 0, 0), false},
+		{"day of month or weekday", "0 0 15 * MON", at(3, 0, 0), true},
+		{"day of month or weekday, day matches", "0 0 1 * MON", at(1, 0, 0), true},
+		{"day of month or weekday, neither", "0 0 15 * MON", at(4, 0, 0), false},
+		{"day of month only", "0 0 15 * *", at(3, 0, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := schedule.matches(tt.time); got != tt.match {
+				t.Errorf("matches(%s) = %v, want %v", tt.time, got, tt.match)
+			}
+		})
+	}
+}
+
+func TestCronLastStart(t *testing.T) {
+	at := func(day, hour, minute, second int) time.Time {
+		return time.Date(2024, time.June, day, hour, minute, second, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		spec     string
+		now      time.Time
+		duration time.Duration
+		start    time.Time // Zero if no window is open
+	}{
+		{"at the start", "0 22 * * SAT", at(1, 22, 0, 0), 2 * time.Hour, at(1, 22, 0, 0)},
+		{"inside the window", "0 22 * * SAT", at(1, 23, 59, 30), 2 * time.Hour, at(1, 22, 0, 0)},
+		{"across midnight", "0 22 * * SAT", at(2, 0, 30, 0), 4 * time.Hour, at(1, 22, 0, 0)},
+		{"window ended", "0 22 * * SAT", at(2, 0, 0, 0), 2 * time.Hour, time.Time{}},
+		{"before the start", "0 22 * * SAT", at(1, 21, 59, 59), 2 * time.Hour, time.Time{}},
+		{"most recent start", "*/15 * * * *", at(3, 10, 20, 0), time.Hour, at(3, 10, 15, 0)},
+		{"zero duration", "* * * * *", at(3, 10, 20, 0), 0, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule, err := parseCron(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, open := schedule.lastStart(tt.now, tt.duration)
+			if open != !tt.start.IsZero() || !start.Equal(tt.start) {
+				t.Errorf("lastStart = %v, %v; want %v", start, open, tt.start)
+			}
+		})
+	}
+}
+
+func TestCronLastStartMatchesScan(t *testing.T) {
+	// scan is the minute by minute search lastStart replaces
+	scan := func(c *cronSchedule, now time.Time, duration time.Duration) (time.Time, bool) {
+		minute := now.Truncate(time.Minute)
+		for back := time.Duration(0); back < duration; back += time.Minute {
+			if start := minute.Add(-back); c.matches(start) {
+				return start, true
+			}
+		}
+		return time.Time{}, false
+	}
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	specs := []string{"0 22 * * SAT", "*/15 8-18 * * MON-FRI", "30 2 1 * *", "0 0 29 2 *", "5 4 13 * FRI", "0 3 * 3,10 SUN"}
+	durations := []time.Duration{time.Minute, 90 * time.Minute, 26 * time.Hour, maxWindowDuration}
+	rng := rand.New(rand.NewSource(1))
+	for _, spec := range specs {
+		schedule, err := parseCron(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Random times and the daylight saving changes
+		times := []time.Time{
+			time.Date(2024, time.March, 31, 3, 30, 0, 0, berlin),
+			time.Date(2024, time.October, 27, 2, 30, 0, 0, berlin),
+			time.Date(2024, time.October, 27, 4, 0, 0, 0, berlin),
+		}
+		for len(times) < 40 {
+			times = append(times, time.Date(2024, time.January, 1, 0, 0, 0, 0, berlin).Add(time.Duration(rng.Int63n(int64(366*24*time.Hour)))))
+		}
+		for i, now := range times {
+			duration := durations[i%len(durations)]
+			start, ok := schedule.lastStart(now, duration)
+			want, wantOK := scan(schedule, now, duration)
+			if ok != wantOK || !start.Equal(want) {
+				t.Errorf("%q at %v for %v: got %v, %v; want %v, %v", spec, now, duration, start, ok, want, wantOK)
+			}
+		}
+	}
+}
+
+func TestAccessConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config AccessConfig
+		valid  bool
+	}{
+		{"disabled", AccessConfig{}, true},
+		{"window", AccessConfig{Windows: []AccessWindow{{Start: "0 22 * * SAT", Duration: 4 * time.Hour}}}, true},
+		{"timezone", AccessConfig{Timezone: "Europe/Berlin", Windows: []AccessWindow{{Start: "0 22 * * SAT", Duration: time.Hour}}}, true},
+		{"just in time", AccessConfig{JustInTime: true, MaxGrant: time.Hour}, true},
+		{"unknown timezone", AccessConfig{Timezone: "Mars/Olympus", JustInTime: true}, false},
+		{"invalid schedule", AccessConfig{Windows: []AccessWindow{{Start: "0 25 * * *", Duration: time.Hour}}}, false},
+		{"no duration", AccessConfig{Windows: []AccessWindow{{Start: "0 22 * * SAT"}}}, false},
+		{"max grant without just in time", AccessConfig{MaxGrant: time.Hour}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AdminAPI serves administrative endpoints of the improved server.
+// Every request must carry the admin token as a bearer token.
+type AdminAPI struct {
+	server *ImprovedServer
+	token  string
+	logger *zap.Logger
+}
+
+// NewAdminAPI creates the admin API for a server
+func NewAdminAPI(server *ImprovedServer, token string, logger *zap.Logger) *AdminAPI {
+	return &AdminAPI{
+		server: server,
+		token:  token,
+		logger: logger,
+	}
+}
+
+// Handler returns the HTTP handler to mount under /admin/
+func (a *AdminAPI) Handler() http.Handler {
+	return a.authorize(a.routes())
+}
+
+// LocalHandler returns the admin API without the token check, for listeners
+// whose access is restricted otherwise, such as a Unix socket only its
+// owner and group may connect to
+func (a *AdminAPI) LocalHandler() http.Handler {
+	return a.routes()
+}
+
+// routes maps the admin endpoints to their handlers
+func (a *AdminAPI) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/dynamic-forwarders", a.handleDynamicForwarders)
+	mux.HandleFunc("/admin/dynamic-forwarders/", a.handleDynamicForwarderAction)
+	mux.HandleFunc("/admin/access", a.handleAccess)
+	mux.HandleFunc("/admin/access/", a.handleAccessAction)
+	mux.HandleFunc("/admin/shares", a.handleShares)
+	mux.HandleFunc("/admin/shares/", a.handleShareAction)
+	return mux
+}
+
+// authorize rejects requests without the admin token
+func (a *AdminAPI) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleDynamicForwarders lists client-announced forwarders
+// GET /admin/dynamic-forwarders
+func (a *AdminAPI) handleDynamicForwarders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"forwarders": a.server.DynamicForwarders(),
+	})
+}
+
+// handleDynamicForwarderAction approves or rejects an announced service
+// POST /admin/dynamic-forwarders/{clientID}/{name}/approve
+// POST /admin/dynamic-forwarders/{clientID}/{name}/reject
+func (a *AdminAPI) handleDynamicForwarderAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/dynamic-forwarders/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	clientID, name, action := parts[0], parts[1], parts[2]
+
+	var err error
+	var status string
+	switch action {
+	case "approve":
+		err = a.server.ApproveService(clientID, name)
+		status = ServiceActive
+	case "reject":
+		err = a.server.RejectService(clientID, name)
+		status = ServiceRejected
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action"})
+		return
+	}
+
+	a.logger.Info("Admin action on announced service",
+		zap.String("action", action),
+		zap.String("clientID", clientID),
+		zap.String("service", name),
+		zap.Error(err))
+
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// handleAccess lists access-controlled forwarders and recent access events
+// GET /admin/access
+func (a *AdminAPI) handleAccess(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"forwarders": a.server.access.Status(),
+		"audit":      a.server.access.Audit(),
+	})
+}
+
+// accessRequest is the body of a grant or revocation
+type accessRequest struct {
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // e.g. "2h", grants only
+}
+
+// handleAccessAction opens or closes a just-in-time forwarder
+// POST /admin/access/{forwarder}/grant   {"operator": "...", "reason": "...", "duration": "2h"}
+// POST /admin/access/{forwarder}/revoke  {"operator": "...", "reason": "..."}
+func (a *AdminAPI) handleAccessAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin/access/")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	name, action := path[:i], path[i+1:]
+
+	var request accessRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+
+	var status AccessStatus
+	var err error
+	switch action {
+	case "grant":
+		duration, parseErr := time.ParseDuration(request.Duration)
+		if parseErr != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+			return
+		}
+		status, err = a.server.access.Grant(name, request.Operator, request.Reason, duration)
+	case "revoke":
+		status, err = a.server.access.Revoke(name, request.Operator, request.Reason)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown action"})
+		return
+	}
+
+	a.logger.Info("Admin action on forwarder access",
+		zap.String("action", action),
+		zap.String("forwarder", name),
+		zap.String("operator", request.Operator),
+		zap.Error(err))
+
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleShares lists or creates temporary shares
+// GET  /admin/shares
+// POST /admin/shares  {"forwarder": "ssh", "ttl": "1h", "allowedIps": ["203.0.113.7"], "operator": "..."}
+func (a *AdminAPI) handleShares(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"shares": a.server.Shares(),
+		})
+	case http.MethodPost:
+		var request ShareRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+		share, err := a.server.CreateShare(request)
+		if err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, share)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// handleShareAction removes a share before its TTL ends
+// DELETE /admin/shares/{id}
+func (a *AdminAPI) handleShareAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/admin/shares/")
+	if err := a.server.RemoveShare(id); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	a.logger.Info("Admin action on share", zap.String("action", "remove"), zap.String("share", id))
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
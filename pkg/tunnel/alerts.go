@@ -0,0 +1,301 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ClientAvailability tracks when clients and client groups were last connected
+type ClientAvailability struct {
+	startTime time.Time
+	up        map[string]int // key -> connected clients
+	downSince map[string]time.Time
+	mu        sync.RWMutex
+}
+
+// NewClientAvailability creates a tracker where every client starts out offline
+func NewClientAvailability() *ClientAvailability {
+	return &ClientAvailability{
+		startTime: time.Now(),
+		up:        make(map[string]int),
+		downSince: make(map[string]time.Time),
+	}
+}
+
+// MarkUp records that a client has connected under the given keys
+func (ca *ClientAvailability) MarkUp(keys ...string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for _, key := range keys {
+		ca.up[key]++
+		delete(ca.downSince, key)
+	}
+}
+
+// MarkDown records that a client has disconnected under the given keys
+func (ca *ClientAvailability) MarkDown(keys ...string) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for _, key := range keys {
+		if ca.up[key] == 0 {
+			continue
+		}
+		ca.up[key]--
+		if ca.up[key] == 0 {
+			delete(ca.up, key)
+			ca.downSince[key] = time.Now()
+		}
+	}
+}
+
+// DownSince returns when the last of the given keys went offline, or false if any is connected.
+// Keys never seen since startup are considered down since the tracker started.
+func (ca *ClientAvailability) DownSince(keys ...string) (time.Time, bool) {
+	ca.mu.RLock()
+	defer ca.mu.RUnlock()
+	
+	since := ca.startTime
+	for _, key := range keys {
+		if ca.up[key] > 0 {
+			return time.Time{}, false
+		}
+		if downSince, exists := ca.downSince[key]; exists && downSince.After(since) {
+			since = downSince
+		}
+	}
+	return since, true
+}
+
+// ForwarderHealth represents the client availability of a forwarder
+type ForwarderHealth struct {
+	Name            string     `json:"name"`
+	Port            int        `json:"port"`
+	ClientID        string     `json:"clientId"`
+	ClientGroup     string     `json:"clientGroup,omitempty"`
+	Clients         []string   `json:"clients,omitempty"` // Connected clients able to serve the forwarder
+	Critical        bool       `json:"critical"`
+	ClientConnected bool       `json:"clientConnected"`
+	RemoteNode      string     `json:"remoteNode,omitempty"` // Cluster peer serving the forwarder
+	DownSince       *time.Time `json:"downSince,omitempty"`
+	DownFor         string     `json:"downFor,omitempty"`
+
+	Bandwidth *BandwidthUsage `json:"bandwidth,omitempty"` // Traffic of forwarders with limits or quotas
+	Access    *AccessStatus   `json:"access,omitempty"`    // Windows and grants of access-controlled forwarders
+}
+
+// GetForwarderHealth reports client availability for every enabled forwarder
+func (s *ImprovedServer) GetForwarderHealth() []ForwarderHealth {
+	forwarders := s.forwarderList()
+	result := make([]ForwarderHealth, 0, len(forwarders))
+	for _, fw := range forwarders {
+		health := ForwarderHealth{
+			Name:            fw.Name,
+			Port:            fw.Port,
+			ClientID:        fw.ClientID,
+			ClientGroup:     fw.ClientGroup,
+			Critical:        fw.Critical,
+			ClientConnected: true,
+		}
+		for _, client := range s.candidatesFor(fw) {
+			health.Clients = append(health.Clients, client.ID)
+		}
+		if len(health.Clients) == 0 {
+			health.RemoteNode, _ = s.remoteNodeFor(fw)
+		}
+		if since, down := s.availability.DownSince(fw.availabilityKeys()...); down && health.RemoteNode == "" {
+			health.ClientConnected = false
+			health.DownSince = &since
+			health.DownFor = time.Since(since).Round(time.Second).String()
+		}
+		if usage, limited := s.bandwidth.Usage(fw); limited {
+			health.Bandwidth = &usage
+		}
+		if access, controlled := s.access.statusOf(fw.Name); controlled {
+			health.Access = &access
+		}
+		result = append(result, health)
+	}
+	return result
+}
+
+// AlertConfig configures alerts for critical forwarders whose client is offline
+type AlertConfig struct {
+	Webhooks      []WebhookConfig `yaml:"webhooks"`
+	Threshold     time.Duration   `yaml:"threshold"`      // How long a critical client may be offline before alerting
+	CheckInterval time.Duration   `yaml:"check_interval"` // How often forwarders are evaluated
+	Timeout       time.Duration   `yaml:"timeout"`        // Per-request webhook timeout
+}
+
+// WebhookConfig describes a single alert receiver
+type WebhookConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// DefaultAlertConfig returns default alert configuration
+func DefaultAlertConfig() AlertConfig {
+	return AlertConfig{
+		Threshold:     2 * time.Minute,
+		CheckInterval: 15 * time.Second,
+		Timeout:       5 * time.Second,
+	}
+}
+
+// AlertEvent is the JSON payload posted to webhooks
+type AlertEvent struct {
+	Type      string    `json:"type"` // "critical_client_down" or "critical_client_recovered"
+	Forwarder string    `json:"forwarder"`
+	Port      int       `json:"port"`
+	ClientID  string    `json:"clientId"`
+	DownSince time.Time `json:"downSince"`
+	Duration  string    `json:"duration"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AlertManager fires webhooks when critical forwarders lose their client
+type AlertManager struct {
+	server     *ImprovedServer
+	config     AlertConfig
+	httpClient *http.Client
+	logger     *zap.Logger
+	alerted    map[string]time.Time // forwarder name -> downSince that was alerted
+	mu         sync.Mutex
+}
+
+// NewAlertManager creates an alert manager for the given server
+func NewAlertManager(server *ImprovedServer, config AlertConfig, logger *zap.Logger) *AlertManager {
+	defaults := DefaultAlertConfig()
+	if config.Threshold <= 0 {
+		config.Threshold = defaults.Threshold
+	}
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaults.CheckInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaults.Timeout
+	}
+
+	return &AlertManager{
+		server:     server,
+		config:     config,
+		httpClient: &http.Client{Timeout: config.Timeout},
+		logger:     logger,
+		alerted:    make(map[string]time.Time),
+	}
+}
+
+// Start evaluates critical forwarders periodically until ctx is cancelled
+func (am *AlertManager) Start(ctx context.Context) {
+	ticker := time.NewTicker(am.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			am.Check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check evaluates critical forwarders once and fires any pending alerts
+func (am *AlertManager) Check() {
+	for _, fw := range am.server.GetForwarderHealth() {
+		if !fw.Critical {
+			continue
+		}
+
+		am.mu.Lock()
+		alertedSince, alerted := am.alerted[fw.Name]
+		am.mu.Unlock()
+
+		switch {
+		case !fw.ClientConnected && !alerted:
+			downFor := time.Since(*fw.DownSince)
+			if downFor < am.config.Threshold {
+				continue
+			}
+			am.mu.Lock()
+			am.alerted[fw.Name] = *fw.DownSince
+			am.mu.Unlock()
+			am.server.metrics.alertsTotal.Add(1)
+			am.fire(AlertEvent{
+				Type:      "critical_client_down",
+				Forwarder: fw.Name,
+				Port:      fw.Port,
+				ClientID:  fw.ClientID,
+				DownSince: *fw.DownSince,
+				Duration:  downFor.Round(time.Second).String(),
+				Timestamp: time.Now(),
+			})
+
+		case fw.ClientConnected && alerted:
+			am.mu.Lock()
+			delete(am.alerted, fw.Name)
+			am.mu.Unlock()
+			am.fire(AlertEvent{
+				Type:      "critical_client_recovered",
+				Forwarder: fw.Name,
+				Port:      fw.Port,
+				ClientID:  fw.ClientID,
+				DownSince: alertedSince,
+				Duration:  time.Since(alertedSince).Round(time.Second).String(),
+				Timestamp: time.Now(),
+			})
+		}
+	}
+}
+
+// fire delivers an event to every configured webhook
+func (am *AlertManager) fire(event AlertEvent) {
+	am.logger.Warn("Forwarder alert",
+		zap.String("type", event.Type),
+		zap.String("forwarder", event.Forwarder),
+		zap.String("clientID", event.ClientID),
+		zap.String("duration", event.Duration))
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		am.logger.Error("Failed to marshal alert", zap.Error(err))
+		return
+	}
+
+	for _, webhook := range am.config.Webhooks {
+		if err := am.post(webhook, payload); err != nil {
+			am.logger.Error("Failed to deliver alert webhook",
+				zap.String("url", webhook.URL),
+				zap.Error(err))
+		}
+	}
+}
+
+// post sends a payload to a single webhook
+func (am *AlertManager) post(webhook WebhookConfig, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range webhook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := am.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// webhookRecorder collects the alerts posted to a test webhook
+type webhookRecorder struct {
+	events []AlertEvent
+	header http.Header
+	mu     sync.Mutex
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event AlertEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.events = append(wr.events, event)
+	wr.header = r.Header.Clone()
+}
+
+func (wr *webhookRecorder) types() []string {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	types := make([]string, 0, len(wr.events))
+	for _, event := range wr.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestAlertManager(t *testing.T) {
+	recorder := &webhookRecorder{}
+	webhook := httptest.NewServer(recorder)
+	defer webhook.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+		{Name: "db", Port: 15432, ClientID: "c1", Enabled: true, Critical: true},
+		{Name: "web", Port: 18080, ClientID: "c2", Enabled: true},
+	})
+	tunnelServer := httptest.NewServer(http.HandlerFunc(server.HandleTunnel))
+	defer tunnelServer.Close()
+
+	threshold := 100 * time.Millisecond
+	alerts := NewAlertManager(server, AlertConfig{
+		Threshold: threshold,
+		Webhooks: []WebhookConfig{
+			// A failing receiver does not keep the others from being notified
+			{URL: failing.URL},
+			{URL: webhook.URL, Headers: map[string]string{"X-Alert-Token": "abc"}},
+		},
+	}, zap.NewNop())
+
+	// Below the threshold nothing fires
+	alerts.Check()
+	if types := recorder.types(); len(types) != 0 {
+		t.Fatalf("alerted before the threshold: %v", types)
+	}
+
+	// Past the threshold the critical forwarder fires once
+	time.Sleep(threshold)
+	alerts.Check()
+	alerts.Check()
+	if types := recorder.types(); len(types) != 1 || types[0] != "critical_client_down" {
+		t.Fatalf("got alerts %v, want one critical_client_down", types)
+	}
+	recorder.mu.Lock()
+	down := recorder.events[0]
+	header := recorder.header
+	recorder.mu.Unlock()
+	if down.Forwarder != "db" || down.Port != 15432 || down.ClientID != "c1" {
+		t.Errorf("unexpected alert %+v", down)
+	}
+	if got := header.Get("X-Alert-Token"); got != "abc" {
+		t.Errorf("X-Alert-Token = %q, want abc", got)
+	}
+	if got := header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if fired := server.metrics.alertsTotal.Load(); fired != 1 {
+		t.Errorf("alertsTotal = %d, want 1", fired)
+	}
+
+	// The client coming back resolves the alert
+	startTestClient(t, server, tunnelServer.URL, "c1", map[int]string{15432: "127.0.0.1:5432"})
+	alerts.Check()
+	alerts.Check()
+	types := recorder.types()
+	if len(types) != 2 || types[1] != "critical_client_recovered" {
+		t.Fatalf("got alerts %v, want critical_client_down then critical_client_recovered", types)
+	}
+	recorder.mu.Lock()
+	recovered := recorder.events[1]
+	recorder.mu.Unlock()
+	if recovered.Forwarder != "db" || !recovered.DownSince.Equal(down.DownSince) {
+		t.Errorf("unexpected recovery %+v, down since %v", recovered, down.DownSince)
+	}
+}
+
+func TestNewAlertManagerDefaults(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	alerts := NewAlertManager(server, AlertConfig{}, zap.NewNop())
+	defaults := DefaultAlertConfig()
+	if alerts.config.Threshold != defaults.Threshold ||
+		alerts.config.CheckInterval != defaults.CheckInterval ||
+		alerts.config.Timeout != defaults.Timeout {
+		t.Errorf("got %+v, want the defaults %+v", alerts.config, defaults)
+	}
+	if alerts.httpClient.Timeout != defaults.Timeout {
+		t.Errorf("webhook timeout %v, want %v", alerts.httpClient.Timeout, defaults.Timeout)
+	}
+}
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"sort"
+	"sync"
+)
+
+// Load balancing policies for forwarders served by several clients
+const (
+	BalanceRoundRobin    = "round-robin"
+	BalanceLeastSessions = "least-sessions"
+	BalancePriority      = "priority"
+)
+
+// clientIDs returns the explicitly listed clients of a forwarder in priority order
+func (fw ForwarderConfig) clientIDs() []string {
+	ids := make([]string, 0, len(fw.ClientIDs)+1)
+	seen := make(map[string]bool)
+	if fw.ClientID != "" {
+		ids = append(ids, fw.ClientID)
+		seen[fw.ClientID] = true
+	}
+	for _, id := range fw.ClientIDs {
+		if id != "" && !seen[id] {
+			ids = append(ids, id)
+			seen[id] = true
+		}
+	}
+	return ids
+}
+
+// availabilityKeys returns the keys tracked by ClientAvailability for a forwarder
+func (fw ForwarderConfig) availabilityKeys() []string {
+	keys := fw.clientIDs()
+	if fw.ClientGroup != "" {
+		keys = append(keys, groupKey(fw.ClientGroup))
+	}
+	return keys
+}
+
+// serves reports whether a connected client may serve the forwarder
+func (fw ForwarderConfig) serves(client *ImprovedServerClient) bool {
+	if fw.ClientGroup != "" && client.Group == fw.ClientGroup {
+		return true
+	}
+	for _, id := range fw.clientIDs() {
+		if id == client.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// groupKey returns the availability key of a client group
+func groupKey(group string) string {
+	return "group:" + group
+}
+
+// ClientBalancer orders the connected clients of a forwarder by its balancing policy
+type ClientBalancer struct {
+	counters map[string]uint64 // forwarder name -> round-robin position
+	mu       sync.Mutex
+}
+
+// NewClientBalancer creates a new balancer
+func NewClientBalancer() *ClientBalancer {
+	return &ClientBalancer{
+		counters: make(map[string]uint64),
+	}
+}
+
+// Order returns candidates in the order they should be tried for a new session.
+// Candidates must be given in priority order.
+func (b *ClientBalancer) Order(fw ForwarderConfig, candidates []*ImprovedServerClient, sessionCounts map[string]int) []*ImprovedServerClient {
+	if len(candidates) < 2 {
+		return candidates
+	}
+
+	ordered := make([]*ImprovedServerClient, len(candidates))
+	copy(ordered, candidates)
+
+	switch fw.Balance {
+	case BalancePriority:
+		// Candidates are already in priority order
+
+	case BalanceLeastSessions:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return sessionCounts[ordered[i].ID] < sessionCounts[ordered[j].ID]
+		})
+
+	default: // BalanceRoundRobin
+		b.mu.Lock()
+		start := int(b.counters[fw.Name] % uint64(len(ordered)))
+		b.counters[fw.Name]++
+		b.mu.Unlock()
+		ordered = append(ordered[start:], ordered[:start]...)
+	}
+
+	return ordered
+}
+
+// candidatesFor returns connected clients able to serve a forwarder in priority order:
+// listed client IDs first, then group members sorted by ID
+func (s *ImprovedServer) candidatesFor(fw ForwarderConfig) []*ImprovedServerClient {
+	var candidates []*ImprovedServerClient
+	seen := make(map[string]bool)
+
+	for _, id := range fw.clientIDs() {
+		if client, exists := s.clients.Get(id); exists {
+			candidates = append(candidates, client)
+			seen[id] = true
+		}
+	}
+
+	if fw.ClientGroup != "" {
+		for _, client := range s.clients.Matching(func(c *ImprovedServerClient) bool {
+			return c.Group == fw.ClientGroup && !seen[c.ID]
+		}) {
+			candidates = append(candidates, client)
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,387 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Flow control of sessions whose external side reads slower than the client
+// sends: the client is asked to pause reading its service when the write
+// queue fills up and to resume once it has drained
+const (
+	writeQueueHighWater = 192
+	writeQueueLowWater  = 64
+)
+
+// ByteSize is a number of bytes, written in YAML as an integer or with a
+// unit such as "512KiB", "10MB" or "1.5GiB". Rates may add "/s".
+type ByteSize int64
+
+// UnmarshalYAML parses a byte size with an optional decimal or binary unit
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// ParseByteSize parses sizes such as "1024", "64KiB", "10MB/s" or "2GB"
+func ParseByteSize(s string) (ByteSize, error) {
+	text := strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	number := strings.TrimRightFunc(text, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(text[len(number):]))
+
+	multiplier := float64(1)
+	switch strings.TrimSuffix(unit, "B") {
+	case "":
+	case "K":
+		multiplier = 1e3
+	case "M":
+		multiplier = 1e6
+	case "G":
+		multiplier = 1e9
+	case "T":
+		multiplier = 1e12
+	case "KI":
+		multiplier = 1 << 10
+	case "MI":
+		multiplier = 1 << 20
+	case "GI":
+		multiplier = 1 << 30
+	case "TI":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return ByteSize(value * multiplier), nil
+}
+
+// RateLimit caps the throughput of one direction of traffic in bytes per second
+type RateLimit struct {
+	Upload   ByteSize `yaml:"upload"`   // External clients to the service
+	Download ByteSize `yaml:"download"` // Service to external clients
+}
+
+// BandwidthConfig limits the traffic of a forwarder. Rates of zero are unlimited.
+type BandwidthConfig struct {
+	Forwarder    RateLimit `yaml:"forwarder"`     // Shared by every session of the forwarder
+	Client       RateLimit `yaml:"client"`        // Shared by the forwarder's sessions through one client
+	Session      RateLimit `yaml:"session"`       // Each session on its own
+	DailyQuota   ByteSize  `yaml:"daily_quota"`   // Bytes per UTC day, both directions
+	MonthlyQuota ByteSize  `yaml:"monthly_quota"` // Bytes per UTC calendar month, both directions
+}
+
+// enabled reports whether any limit or quota is configured
+func (c BandwidthConfig) enabled() bool {
+	return c != BandwidthConfig{}
+}
+
+// Validate checks a forwarder's bandwidth settings
+func (c BandwidthConfig) Validate() error {
+	for _, size := range []ByteSize{
+		c.Forwarder.Upload, c.Forwarder.Download,
+		c.Client.Upload, c.Client.Download,
+		c.Session.Upload, c.Session.Download,
+		c.DailyQuota, c.MonthlyQuota,
+	} {
+		if size < 0 {
+			return fmt.Errorf("bandwidth: limits must not be negative")
+		}
+	}
+	return nil
+}
+
+// BandwidthUsage reports a forwarder's traffic against its limits
+type BandwidthUsage struct {
+	BytesIn          int64  `json:"bytesIn"`  // From external clients since startup
+	BytesOut         int64  `json:"bytesOut"` // To external clients since startup
+	Today            int64  `json:"today"`
+	ThisMonth        int64  `json:"thisMonth"`
+	DailyQuota       int64  `json:"dailyQuota,omitempty"`
+	MonthlyQuota     int64  `json:"monthlyQuota,omitempty"`
+	QuotaExceeded    bool   `json:"quotaExceeded,omitempty"`
+	SessionsRejected int64  `json:"sessionsRejected,omitempty"` // Refused because a quota was reached
+	Throttled        string `json:"throttled,omitempty"`        // Total time sessions waited on rate limits
+}
+
+// tokenBucket is a rate limiter that lets a transfer borrow tokens and wait
+// until the debt has been paid back. It holds at most one second of tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket that is full at now, or nil for an unlimited rate
+func newTokenBucket(rate ByteSize, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take removes n tokens at now and returns how long to wait before sending them
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// clientBuckets are the rate limits of one client of a forwarder
+type clientBuckets struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// forwarderUsage tracks the traffic, quotas and shared rate limits of a forwarder
+type forwarderUsage struct {
+	config   BandwidthConfig
+	upload   *tokenBucket
+	download *tokenBucket
+	now      func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*clientBuckets
+	day       string // UTC date the daily counter belongs to
+	month     string
+	today     int64
+	thisMonth int64
+	bytesIn   int64
+	bytesOut  int64
+	rejected  int64
+	throttled time.Duration
+}
+
+// rollover resets the counters of a period that has ended; mu must be held
+func (u *forwarderUsage) rollover(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); day != u.day {
+		u.day, u.today = day, 0
+	}
+	if month := now.Format("2006-01"); month != u.month {
+		u.month, u.thisMonth = month, 0
+	}
+}
+
+// exceeded reports which quota, if any, has been reached; mu must be held
+func (u *forwarderUsage) exceeded() string {
+	if u.config.DailyQuota > 0 && u.today >= int64(u.config.DailyQuota) {
+		return "daily"
+	}
+	if u.config.MonthlyQuota > 0 && u.thisMonth >= int64(u.config.MonthlyQuota) {
+		return "monthly"
+	}
+	return ""
+}
+
+// account adds transferred bytes to the forwarder's counters
+func (u *forwarderUsage) account(in, out int, waited time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(u.now())
+	u.bytesIn += int64(in)
+	u.bytesOut += int64(out)
+	u.today += int64(in + out)
+	u.thisMonth += int64(in + out)
+	u.throttled += waited
+}
+
+// snapshot returns the forwarder's usage for health output
+func (u *forwarderUsage) snapshot() BandwidthUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(u.now())
+	usage := BandwidthUsage{
+		BytesIn:          u.bytesIn,
+		BytesOut:         u.bytesOut,
+		Today:            u.today,
+		ThisMonth:        u.thisMonth,
+		DailyQuota:       int64(u.config.DailyQuota),
+		MonthlyQuota:     int64(u.config.MonthlyQuota),
+		QuotaExceeded:    u.exceeded() != "",
+		SessionsRejected: u.rejected,
+	}
+	if u.throttled > 0 {
+		usage.Throttled = u.throttled.Round(time.Millisecond).String()
+	}
+	return usage
+}
+
+// Bandwidth enforces the rate limits and quotas of forwarders. Counters are
+// kept in memory and start over when the server restarts.
+type Bandwidth struct {
+	mu         sync.Mutex
+	forwarders map[string]*forwarderUsage // forwarder name -> usage
+	metrics    *MetricsStore
+	now        func() time.Time // Clock for rates and quota periods, replaced in tests
+}
+
+// NewBandwidth creates an empty bandwidth tracker
+func NewBandwidth(metrics *MetricsStore) *Bandwidth {
+	return &Bandwidth{
+		forwarders: make(map[string]*forwarderUsage),
+		metrics:    metrics,
+		now:        time.Now,
+	}
+}
+
+// usageName is the forwarder a session's traffic counts against; the routes
+// of HTTP and TLS forwarders share the limits of their forwarder
+func (fw ForwarderConfig) usageName() string {
+	if fw.owner != "" {
+		return fw.owner
+	}
+	return fw.Name
+}
+
+// usage returns the tracker of a forwarder, or nil if it has no limits
+func (b *Bandwidth) usage(fw ForwarderConfig) *forwarderUsage {
+	if !fw.Bandwidth.enabled() {
+		return nil
+	}
+	name := fw.usageName()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u, exists := b.forwarders[name]
+	if !exists {
+		now := b.now()
+		u = &forwarderUsage{
+			config:   fw.Bandwidth,
+			upload:   newTokenBucket(fw.Bandwidth.Forwarder.Upload, now),
+			download: newTokenBucket(fw.Bandwidth.Forwarder.Download, now),
+			now:      b.now,
+			clients:  make(map[string]*clientBuckets),
+		}
+		b.forwarders[name] = u
+	}
+	return u
+}
+
+// admit reports whether a forwarder may open a new session; sessions are
+// refused once its daily or monthly quota has been reached
+func (b *Bandwidth) admit(fw ForwarderConfig) (bool, string) {
+	u := b.usage(fw)
+	if u == nil {
+		return true, ""
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(u.now())
+	if quota := u.exceeded(); quota != "" {
+		u.rejected++
+		b.metrics.quotaRejected.Add(1)
+		return false, quota
+	}
+	return true, ""
+}
+
+// throttle returns the limits a session through client is subject to, or
+// nil if the forwarder has none
+func (b *Bandwidth) throttle(fw ForwarderConfig, clientID string) *sessionThrottle {
+	u := b.usage(fw)
+	if u == nil {
+		return nil
+	}
+	now := u.now()
+	u.mu.Lock()
+	client, exists := u.clients[clientID]
+	if !exists {
+		client = &clientBuckets{
+			upload:   newTokenBucket(u.config.Client.Upload, now),
+			download: newTokenBucket(u.config.Client.Download, now),
+		}
+		u.clients[clientID] = client
+	}
+	u.mu.Unlock()
+
+	return &sessionThrottle{
+		usage:    u,
+		metrics:  b.metrics,
+		upload:   []*tokenBucket{u.upload, client.upload, newTokenBucket(u.config.Session.Upload, now)},
+		download: []*tokenBucket{u.download, client.download, newTokenBucket(u.config.Session.Download, now)},
+	}
+}
+
+// Usage reports the traffic of a forwarder with limits
+func (b *Bandwidth) Usage(fw ForwarderConfig) (BandwidthUsage, bool) {
+	if !fw.Bandwidth.enabled() {
+		return BandwidthUsage{}, false
+	}
+	return b.usage(fw).snapshot(), true
+}
+
+// sessionThrottle applies the forwarder, client and session rate limits to
+// the traffic of one session and accounts it against the forwarder's quotas
+type sessionThrottle struct {
+	usage    *forwarderUsage
+	metrics  *MetricsStore
+	upload   []*tokenBucket
+	download []*tokenBucket
+}
+
+// waitUpload blocks until n bytes from the external client may be sent on
+func (t *sessionThrottle) waitUpload(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	return t.wait(ctx, t.upload, n, 0)
+}
+
+// waitDownload blocks until n bytes from the service may be delivered
+func (t *sessionThrottle) waitDownload(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	return t.wait(ctx, t.download, 0, n)
+}
+
+func (t *sessionThrottle) wait(ctx context.Context, buckets []*tokenBucket, in, out int) error {
+	var delay time.Duration
+	now := t.usage.now()
+	for _, bucket := range buckets {
+		if d := bucket.take(in+out, now); d > delay {
+			delay = d
+		}
+	}
+	t.usage.account(in, out, delay)
+	if delay == 0 {
+		return nil
+	}
+	t.metrics.bandwidthThrottled.Add(1)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
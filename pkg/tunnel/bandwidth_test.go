@@ -0,0 +1,266 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  ByteSize
+		valid bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"512B", 512, true},
+		{"64KiB", 64 << 10, true},
+		{"64kib", 64 << 10, true},
+		{"10MB", 10e6, true},
+		{"10MB/s", 10e6, true},
+		{"10 MiB/s", 10 << 20, true},
+		{"1.5GiB", 3 << 29, true},
+		{"2GB", 2e9, true},
+		{"1T", 1e12, true},
+		{"1TiB", 1 << 40, true},
+		{" 5K ", 5000, true},
+		{"", 0, false},
+		{"MB", 0, false},
+		{"-5MB", 0, false},
+		{"10XB", 0, false},
+		{"ten", 0, false},
+		{"1.2.3KB", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseByteSize(tt.input)
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("got %d, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestByteSizeYAML(t *testing.T) {
+	var config BandwidthConfig
+	input := "forwarder:\n  upload: 1MiB/s\n  download: 2048\ndaily_quota: 10GB\n"
+	if err := yaml.Unmarshal([]byte(input), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Forwarder.Upload != 1<<20 || config.Forwarder.Download != 2048 || config.DailyQuota != 10e9 {
+		t.Errorf("got %+v", config)
+	}
+
+	if err := yaml.Unmarshal([]byte("daily_quota: lots\n"), &config); err == nil {
+		t.Error("expected an error for an invalid size")
+	}
+}
+
+// fakeClock is a settable clock for rate limits and quota periods
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)
+	bucket := newTokenBucket(1000, start)
+
+	steps := []struct {
+		name    string
+		elapsed time.Duration // Since start
+		take    int
+		wait    time.Duration
+	}{
+		{"full bucket", 0, 1000, 0},
+		{"borrow", 0, 500, 500 * time.Millisecond},
+		{"debt repaid", 500 * time.Millisecond, 0, 0},
+		{"refill", time.Second, 250, 0},
+		{"at most one second of tokens", time.Minute, 1500, 500 * time.Millisecond},
+		{"partial refill", time.Minute + 250*time.Millisecond, 500, 750 * time.Millisecond},
+	}
+	for _, step := range steps {
+		if got := bucket.take(step.take, start.Add(step.elapsed)); got != step.wait {
+			t.Errorf("%s: wait %v, want %v", step.name, got, step.wait)
+		}
+	}
+
+	unlimited := newTokenBucket(0, start)
+	if unlimited != nil || unlimited.take(1<<30, start) != 0 {
+		t.Error("a zero rate must not limit")
+	}
+}
+
+func TestSessionThrottle(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, time.June, 1, 12, 0, 0, 0, time.UTC)}
+	bandwidth := NewBandwidth(NewMetricsStore())
+	bandwidth.now = clock.Now
+	fw := ForwarderConfig{Name: "web", Bandwidth: BandwidthConfig{
+		Forwarder: RateLimit{Download: 2000},
+		Client:    RateLimit{Download: 1500},
+		Session:   RateLimit{Download: 1000},
+	}}
+	sessions := []*sessionThrottle{
+		bandwidth.throttle(fw, "a"),
+		bandwidth.throttle(fw, "a"),
+		bandwidth.throttle(fw, "b"),
+		bandwidth.throttle(fw, "b"),
+	}
+
+	// A cancelled context makes any delay visible as an error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	steps := []struct {
+		name    string
+		session int
+		elapsed time.Duration
+		bytes   int
+		delayed bool
+	}{
+		{"within all limits", 0, 0, 1000, false},
+		{"session limit", 0, 0, 1, true},
+		{"client limit shared by sessions", 1, 0, 600, true},
+		{"other client", 2, 0, 300, false},
+		{"forwarder limit shared by clients", 3, 0, 200, true},
+		{"refilled", 3, time.Second, 200, false},
+	}
+	start := clock.now
+	for _, step := range steps {
+		clock.now = start.Add(step.elapsed)
+		err := sessions[step.session].waitDownload(ctx, step.bytes)
+		if delayed := err != nil; delayed != step.delayed {
+			t.Errorf("%s: delayed %v, want %v", step.name, delayed, step.delayed)
+		}
+	}
+
+	if err := sessions[0].waitUpload(ctx, 1<<20); err != nil {
+		t.Errorf("upload throttled without an upload limit: %v", err)
+	}
+	usage, ok := bandwidth.Usage(fw)
+	if !ok || usage.BytesIn != 1<<20 || usage.BytesOut != 2301 || usage.Throttled == "" {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestBandwidthQuotas(t *testing.T) {
+	clock := &fakeClock{}
+	bandwidth := NewBandwidth(NewMetricsStore())
+	bandwidth.now = clock.Now
+	fw := ForwarderConfig{Name: "db", Bandwidth: BandwidthConfig{DailyQuota: 1000, MonthlyQuota: 1500}}
+
+	steps := []struct {
+		name     string
+		now      time.Time
+		transfer int // Bytes sent before checking admission
+		admitted bool
+		quota    string
+		today    int64
+		month    int64
+	}{
+		{"fresh", time.Date(2024, time.June, 29, 10, 0, 0, 0, time.UTC), 0, true, "", 0, 0},
+		{"below the daily quota", time.Date(2024, time.June, 29, 11, 0, 0, 0, time.UTC), 999, true, "", 999, 999},
+		{"daily quota reached", time.Date(2024, time.June, 29, 23, 59, 0, 0, time.UTC), 1, false, "daily", 1000, 1000},
+		{"next day", time.Date(2024, time.June, 30, 0, 0, 0, 0, time.UTC), 0, true, "", 0, 1000},
+		{"monthly quota reached", time.Date(2024, time.June, 30, 8, 0, 0, 0, time.UTC), 500, false, "monthly", 500, 1500},
+		{"next month", time.Date(2024, time.July, 1, 0, 0, 0, 0, time.UTC), 0, true, "", 0, 0},
+	}
+	for _, step := range steps {
+		clock.now = step.now
+		if step.transfer > 0 {
+			throttle := bandwidth.throttle(fw, "a")
+			if err := throttle.waitUpload(context.Background(), step.transfer); err != nil {
+				t.Fatal(err)
+			}
+		}
+		admitted, quota := bandwidth.admit(fw)
+		if admitted != step.admitted || quota != step.quota {
+			t.Errorf("%s: admit = %v, %q; want %v, %q", step.name, admitted, quota, step.admitted, step.quota)
+		}
+		usage, _ := bandwidth.Usage(fw)
+		if usage.Today != step.today || usage.ThisMonth != step.month || usage.QuotaExceeded == step.admitted {
+			t.Errorf("%s: usage %+v", step.name, usage)
+		}
+	}
+
+	if usage, _ := bandwidth.Usage(fw); usage.SessionsRejected != 2 {
+		t.Errorf("%d sessions rejected, want 2", usage.SessionsRejected)
+	}
+	if bandwidth.metrics.quotaRejected.Load() != 2 {
+		t.Errorf("quotaRejected metric %d, want 2", bandwidth.metrics.quotaRejected.Load())
+	}
+
+	unlimited := ForwarderConfig{Name: "open"}
+	if admitted, _ := bandwidth.admit(unlimited); !admitted || bandwidth.throttle(unlimited, "a") != nil {
+		t.Error("a forwarder without limits was restricted")
+	}
+	if _, ok := bandwidth.Usage(unlimited); ok {
+		t.Error("usage reported for a forwarder without limits")
+	}
+}
+
+func TestSessionWriteAfterClose(t *testing.T) {
+	// Writes racing a close must fail cleanly rather than send on a closed channel
+	for i := 0; i < 100; i++ {
+		client, server := net.Pipe()
+		go io.Copy(io.Discard, client)
+		session := NewSessionManager(zap.NewNop()).Create("s", "c", "t", server, zap.NewNop())
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 50; k++ {
+					session.Write([]byte("x"))
+				}
+			}()
+		}
+		if i%2 == 0 {
+			session.CloseAfterWrites()
+		} else {
+			session.Close()
+		}
+		wg.Wait()
+		if session.Write([]byte("x")) == nil {
+			t.Fatal("write to a closed session succeeded")
+		}
+		session.Close()
+		client.Close()
+	}
+}
+
+func TestSessionCloseAfterWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	session := NewSessionManager(zap.NewNop()).Create("s", "c", "t", server, zap.NewNop())
+	for _, chunk := range []string{"queued ", "before ", "close"} {
+		if err := session.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session.CloseAfterWrites()
+
+	data, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "queued before close" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -0,0 +1,396 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClientFileConfig is the YAML configuration file of the tunnel client
+type ClientFileConfig struct {
+	Servers     []string             `yaml:"servers"`      // Tunnel server URLs, in order of preference
+	ServerSRV   string               `yaml:"server_srv"`   // DNS SRV name resolved into servers ahead of the list
+	SRVResolver string               `yaml:"srv_resolver"` // DNS server for the SRV lookup (host[:port])
+	Failover    ClientFailoverConfig `yaml:"failover"`
+	Token       string               `yaml:"token"`
+	ClientID    string               `yaml:"client_id"`
+	ClientGroup string               `yaml:"client_group"`
+	TLS         ClientTLSConfig      `yaml:"tls"`
+	Mappings    []PortMappingConfig  `yaml:"mappings"`
+
+	// Targets the server may push for its forwarders, e.g. "*.svc.cluster.local:*"
+	AllowedTargets []string `yaml:"allowed_targets"`
+
+	// Local SOCKS5 and HTTP proxies whose connections the server dials out
+	SOCKS     ClientSOCKSConfig     `yaml:"socks"`
+	HTTPProxy ClientHTTPProxyConfig `yaml:"http_proxy"`
+}
+
+// ClientSOCKSConfig configures the local SOCKS5 proxy
+type ClientSOCKSConfig struct {
+	Listen          string `yaml:"listen"`           // e.g. "127.0.0.1:1080"; empty disables the proxy
+	CredentialsFile string `yaml:"credentials_file"` // "username:password" lines; enables RFC 1929 authentication
+}
+
+// ClientHTTPProxyConfig configures the local HTTP CONNECT and forward proxy
+type ClientHTTPProxyConfig struct {
+	Listen              string   `yaml:"listen"`               // e.g. "127.0.0.1:3128"; empty disables the proxy
+	CredentialsFile     string   `yaml:"credentials_file"`     // "username:password" lines; enables Basic proxy authentication
+	AllowedDestinations []string `yaml:"allowed_destinations"` // Same syntax as allowed_targets; empty allows all
+}
+
+// ClientFailoverConfig controls switching between servers
+type ClientFailoverConfig struct {
+	After            int            `yaml:"after"`             // Failed attempts before trying the next server
+	FailbackInterval *time.Duration `yaml:"failback_interval"` // Primary health check interval; 0s disables failback
+}
+
+// ClientTLSConfig configures TLS for the connection to the tunnel server
+type ClientTLSConfig struct {
+	SkipVerify bool   `yaml:"skip_verify"`
+	CAFile     string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"` // Client certificate for mutual TLS
+	KeyFile    string `yaml:"key_file"`
+	ServerName string `yaml:"server_name"`
+}
+
+// PortMappingConfig maps a server forwarder port to a local target
+type PortMappingConfig struct {
+	Name          string           `yaml:"name"`
+	Port          int              `yaml:"port"`   // Server forwarder port
+	Target        string           `yaml:"target"` // host:port or unix:///path reachable from the client
+	DialTimeout   time.Duration    `yaml:"dial_timeout"`
+	TLS           *TargetTLSConfig `yaml:"tls"`            // Originate TLS to the target
+	Protocol      string           `yaml:"protocol"`       // "postgres" negotiates TLS with SSLRequest
+	ProxyProtocol string           `yaml:"proxy_protocol"` // "v1" or "v2": send the original client address to the target
+	Announce      bool             `yaml:"announce"`       // Ask the server to create a forwarder for this mapping
+	Description   string           `yaml:"description"`
+}
+
+// TargetTLSConfig configures TLS origination from the client to a target
+type TargetTLSConfig struct {
+	CAFile     string `yaml:"ca_file"`
+	ServerName string `yaml:"server_name"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	SkipVerify bool   `yaml:"skip_verify"`
+}
+
+// MappingOptions holds per-port options for an entry in PortMappings
+type MappingOptions struct {
+	Name          string
+	DialTimeout   time.Duration
+	TLS           *tls.Config // Wrap the local connection in TLS when set
+	Protocol      string      // "postgres" negotiates TLS in-band instead of a direct handshake
+	ProxyProtocol string      // PROXY protocol version sent before any data; empty sends none
+	Announce      bool        // Announce the mapping as a service during registration
+	Description   string
+}
+
+// defaultDialTimeout is used for mappings without a dial timeout
+const defaultDialTimeout = 10 * time.Second
+
+// LoadClientConfig reads a client configuration file and expands environment variables
+func LoadClientConfig(path string) (*ClientFileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	config := &ClientFileConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	// Expand environment variables
+	for i := range config.Servers {
+		config.Servers[i] = os.ExpandEnv(config.Servers[i])
+	}
+	config.Token = os.ExpandEnv(config.Token)
+	config.ClientID = os.ExpandEnv(config.ClientID)
+	config.ClientGroup = os.ExpandEnv(config.ClientGroup)
+	config.ServerSRV = os.ExpandEnv(config.ServerSRV)
+	config.SRVResolver = os.ExpandEnv(config.SRVResolver)
+	config.TLS.CAFile = os.ExpandEnv(config.TLS.CAFile)
+	config.TLS.CertFile = os.ExpandEnv(config.TLS.CertFile)
+	config.TLS.KeyFile = os.ExpandEnv(config.TLS.KeyFile)
+	config.TLS.ServerName = os.ExpandEnv(config.TLS.ServerName)
+	for i := range config.AllowedTargets {
+		config.AllowedTargets[i] = os.ExpandEnv(config.AllowedTargets[i])
+	}
+	config.SOCKS.Listen = os.ExpandEnv(config.SOCKS.Listen)
+	config.SOCKS.CredentialsFile = os.ExpandEnv(config.SOCKS.CredentialsFile)
+	config.HTTPProxy.Listen = os.ExpandEnv(config.HTTPProxy.Listen)
+	config.HTTPProxy.CredentialsFile = os.ExpandEnv(config.HTTPProxy.CredentialsFile)
+
+	for i := range config.Mappings {
+		mapping := &config.Mappings[i]
+		mapping.Target = os.ExpandEnv(mapping.Target)
+		if mapping.TLS != nil {
+			mapping.TLS.CAFile = os.ExpandEnv(mapping.TLS.CAFile)
+			mapping.TLS.ServerName = os.ExpandEnv(mapping.TLS.ServerName)
+			mapping.TLS.CertFile = os.ExpandEnv(mapping.TLS.CertFile)
+			mapping.TLS.KeyFile = os.ExpandEnv(mapping.TLS.KeyFile)
+		}
+	}
+
+	return config, nil
+}
+
+// Validate checks the configuration and reports all problems at once
+func (c *ClientFileConfig) Validate() error {
+	var errs []error
+
+	if len(c.Servers) == 0 && c.ServerSRV == "" {
+		errs = append(errs, fmt.Errorf("servers: at least one server URL or server_srv is required"))
+	}
+	if c.Failover.After < 0 {
+		errs = append(errs, fmt.Errorf("failover.after must not be negative"))
+	}
+	if c.Failover.FailbackInterval != nil && *c.Failover.FailbackInterval < 0 {
+		errs = append(errs, fmt.Errorf("failover.failback_interval must not be negative"))
+	}
+	for i, server := range c.Servers {
+		u, err := url.Parse(server)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("servers[%d]: %q is not a ws:// or wss:// URL", i, server))
+		}
+	}
+
+	if c.Token == "" {
+		errs = append(errs, fmt.Errorf("token: authentication token is required"))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls: cert_file and key_file must be set together"))
+	}
+	errs = append(errs, checkFile("tls.ca_file", c.TLS.CAFile), checkFile("tls.cert_file", c.TLS.CertFile), checkFile("tls.key_file", c.TLS.KeyFile))
+
+	if err := TargetAllowlist(c.AllowedTargets).Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("allowed_targets: %w", err))
+	}
+
+	if c.SOCKS.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.SOCKS.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("socks.listen: %w", err))
+		}
+	} else if c.SOCKS.CredentialsFile != "" {
+		errs = append(errs, fmt.Errorf("socks.credentials_file is set but socks.listen is empty"))
+	}
+	errs = append(errs, checkFile("socks.credentials_file", c.SOCKS.CredentialsFile))
+
+	if c.HTTPProxy.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPProxy.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("http_proxy.listen: %w", err))
+		}
+	} else if c.HTTPProxy.CredentialsFile != "" || len(c.HTTPProxy.AllowedDestinations) > 0 {
+		errs = append(errs, fmt.Errorf("http_proxy is configured but http_proxy.listen is empty"))
+	}
+	errs = append(errs, checkFile("http_proxy.credentials_file", c.HTTPProxy.CredentialsFile))
+	if err := TargetAllowlist(c.HTTPProxy.AllowedDestinations).Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("http_proxy.allowed_destinations: %w", err))
+	}
+
+	ports := make(map[int]string)
+	names := make(map[string]bool)
+	for i, mapping := range c.Mappings {
+		field := fmt.Sprintf("mappings[%d]", i)
+		if mapping.Name != "" {
+			field = fmt.Sprintf("mappings[%d] (%s)", i, mapping.Name)
+			if names[mapping.Name] {
+				errs = append(errs, fmt.Errorf("%s: duplicate name", field))
+			}
+			names[mapping.Name] = true
+		}
+
+		if mapping.Port < 1 || mapping.Port > 65535 {
+			errs = append(errs, fmt.Errorf("%s: port %d is out of valid range (1-65535)", field, mapping.Port))
+		} else if other, exists := ports[mapping.Port]; exists {
+			errs = append(errs, fmt.Errorf("%s: port %d already mapped by %s", field, mapping.Port, other))
+		} else {
+			ports[mapping.Port] = field
+		}
+
+		if err := validateTarget(mapping.Target); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+
+		if mapping.Announce && mapping.Name == "" {
+			errs = append(errs, fmt.Errorf("%s: announced mappings need a name", field))
+		}
+
+		switch mapping.Protocol {
+		case "", ProtocolPostgres:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown protocol %q", field, mapping.Protocol))
+		}
+
+		switch mapping.ProxyProtocol {
+		case "", ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			errs = append(errs, fmt.Errorf("%s: proxy_protocol must be v1 or v2", field))
+		}
+
+		if mapping.DialTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: dial_timeout must not be negative", field))
+		}
+
+		if mapping.TLS != nil {
+			// Socket paths give no name to verify the certificate against
+			if _, unix := unixSocketPath(mapping.Target); unix && mapping.TLS.ServerName == "" && !mapping.TLS.SkipVerify {
+				errs = append(errs, fmt.Errorf("%s: tls server_name is required for unix socket targets", field))
+			}
+			if (mapping.TLS.CertFile == "") != (mapping.TLS.KeyFile == "") {
+				errs = append(errs, fmt.Errorf("%s: tls cert_file and key_file must be set together", field))
+			}
+			errs = append(errs,
+				checkFile(field+" tls.ca_file", mapping.TLS.CAFile),
+				checkFile(field+" tls.cert_file", mapping.TLS.CertFile),
+				checkFile(field+" tls.key_file", mapping.TLS.KeyFile))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Apply copies the file configuration onto an improved client configuration
+func (c *ClientFileConfig) Apply(config *ImprovedClientConfig) error {
+	if len(c.Servers) > 0 {
+		config.ServerURL = c.Servers[0]
+	}
+	config.ServerURLs = c.Servers
+	config.ServerSRV = c.ServerSRV
+	config.SRVResolver = c.SRVResolver
+	if c.Failover.After > 0 {
+		config.FailoverAfter = c.Failover.After
+	}
+	if c.Failover.FailbackInterval != nil {
+		config.FailbackInterval = *c.Failover.FailbackInterval
+	}
+	config.AuthToken = c.Token
+	if c.ClientID != "" {
+		config.ClientID = c.ClientID
+	}
+	if c.ClientGroup != "" {
+		config.ClientGroup = c.ClientGroup
+	}
+	config.SkipVerify = c.TLS.SkipVerify
+	config.AllowedTargets = append(config.AllowedTargets, c.AllowedTargets...)
+
+	if c.TLS.CAFile != "" || c.TLS.CertFile != "" || c.TLS.ServerName != "" {
+		tlsConfig, err := buildTLSConfig(c.TLS.CAFile, c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ServerName, c.TLS.SkipVerify)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		config.TLSConfig = tlsConfig
+	}
+
+	if config.PortMappings == nil {
+		config.PortMappings = make(map[int]string)
+	}
+	if config.MappingOptions == nil {
+		config.MappingOptions = make(map[int]MappingOptions)
+	}
+
+	for _, mapping := range c.Mappings {
+		options := MappingOptions{
+			Name:          mapping.Name,
+			DialTimeout:   mapping.DialTimeout,
+			Announce:      mapping.Announce,
+			Description:   mapping.Description,
+			Protocol:      mapping.Protocol,
+			ProxyProtocol: mapping.ProxyProtocol,
+		}
+
+		if mapping.TLS != nil {
+			serverName := mapping.TLS.ServerName
+			if serverName == "" {
+				serverName, _, _ = net.SplitHostPort(mapping.Target)
+			}
+			tlsConfig, err := buildTLSConfig(mapping.TLS.CAFile, mapping.TLS.CertFile, mapping.TLS.KeyFile, serverName, mapping.TLS.SkipVerify)
+			if err != nil {
+				return fmt.Errorf("mapping %d: tls: %w", mapping.Port, err)
+			}
+			options.TLS = tlsConfig
+		}
+
+		config.PortMappings[mapping.Port] = mapping.Target
+		config.MappingOptions[mapping.Port] = options
+	}
+
+	return nil
+}
+
+// validateTarget checks that a target is a host:port or unix:///path address
+func validateTarget(target string) error {
+	if target == "" {
+		return fmt.Errorf("target is required")
+	}
+	if _, unix := unixSocketPath(target); unix {
+		if err := validateSocketPath(target); err != nil {
+			return fmt.Errorf("target %w", err)
+		}
+		return nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("target %q: %w", target, err)
+	}
+	if host == "" {
+		return fmt.Errorf("target %q: missing host", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("target %q: invalid port", target)
+	}
+	return nil
+}
+
+// checkFile reports an error if a configured file does not exist
+func checkFile(field, path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+// buildTLSConfig creates a TLS client configuration from files
+func buildTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadClientConfig(t *testing.T) {
+	t.Setenv("TUNNEL_TOKEN", "secret")
+	t.Setenv("DB_HOST", "db.internal")
+	path := filepath.Join(t.TempDir(), "client.yaml")
+	data := `
+servers:
+  - wss://primary.example.com/tunnel
+  - wss://backup.example.com/tunnel
+token: ${TUNNEL_TOKEN}
+client_id: office
+mappings:
+  - name: postgres
+    port: 5432
+    target: ${DB_HOST}:5432
+    dial_timeout: 3s
+  - port: 8080
+    target: localhost:80
+    tls:
+      skip_verify: true
+`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadClientConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Token != "secret" || config.Mappings[0].Target != "db.internal:5432" {
+		t.Errorf("environment not expanded: token %q, target %q", config.Token, config.Mappings[0].Target)
+	}
+
+	var client ImprovedClientConfig
+	if err := config.Apply(&client); err != nil {
+		t.Fatal(err)
+	}
+	if client.ServerURL != "wss://primary.example.com/tunnel" || client.AuthToken != "secret" || client.ClientID != "office" {
+		t.Errorf("client config = %+v", client)
+	}
+	if len(client.PortMappings) != 2 || client.PortMappings[5432] != "db.internal:5432" || client.PortMappings[8080] != "localhost:80" {
+		t.Errorf("port mappings = %v", client.PortMappings)
+	}
+	if options := client.MappingOptions[5432]; options.Name != "postgres" || options.DialTimeout != 3*time.Second || options.TLS != nil {
+		t.Errorf("postgres options = %+v", options)
+	}
+	if options := client.MappingOptions[8080]; options.TLS == nil || options.TLS.ServerName != "localhost" || !options.TLS.InsecureSkipVerify {
+		t.Errorf("TLS options = %+v", options)
+	}
+
+	if _, err := LoadClientConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestClientFileConfigValidate(t *testing.T) {
+	valid := func() ClientFileConfig {
+		return ClientFileConfig{
+			Servers: []string{"wss://tunnel.example.com/tunnel"},
+			Token:   "secret",
+			Mappings: []PortMappingConfig{
+				{Name: "db", Port: 5432, Target: "localhost:5432"},
+				{Name: "web", Port: 8080, Target: "10.0.0.2:80"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*ClientFileConfig)
+		valid  bool
+	}{
+		{"valid", func(*ClientFileConfig) {}, true},
+		{"no mappings", func(c *ClientFileConfig) { c.Mappings = nil }, true},
+		{"no servers", func(c *ClientFileConfig) { c.Servers = nil }, false},
+		{"http server URL", func(c *ClientFileConfig) { c.Servers = []string{"https://tunnel.example.com"} }, false},
+		{"no token", func(c *ClientFileConfig) { c.Token = "" }, false},
+		{"certificate without key", func(c *ClientFileConfig) { c.TLS.CertFile = "/etc/tunnel/client.crt" }, false},
+		{"missing CA file", func(c *ClientFileConfig) { c.TLS.CAFile = "/nonexistent/ca.pem" }, false},
+		{"port out of range", func(c *ClientFileConfig) { c.Mappings[0].Port = 70000 }, false},
+		{"duplicate port", func(c *ClientFileConfig) { c.Mappings[1].Port = 5432 }, false},
+		{"duplicate name", func(c *ClientFileConfig) { c.Mappings[1].Name = "db" }, false},
+		{"missing target", func(c *ClientFileConfig) { c.Mappings[0].Target = "" }, false},
+		{"target without port", func(c *ClientFileConfig) { c.Mappings[0].Target = "localhost" }, false},
+		{"target without host", func(c *ClientFileConfig) { c.Mappings[0].Target = ":5432" }, false},
+		{"negative dial timeout", func(c *ClientFileConfig) { c.Mappings[0].DialTimeout = -time.Second }, false},
+		{"target TLS key without certificate", func(c *ClientFileConfig) {
+			c.Mappings[0].TLS = &TargetTLSConfig{KeyFile: "/etc/tunnel/db.key"}
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := valid()
+			tt.modify(&config)
+			err := config.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,9 +22,16 @@ import (
 // ImprovedClientConfig holds configuration for the improved client
 type ImprovedClientConfig struct {
 	ServerURL          string
+	ServerURLs         []string      // Ordered server URLs, the first is the primary (defaults to ServerURL)
+	ServerSRV          string        // DNS SRV name resolved into servers, e.g. "_tunnel._tcp.example.com"
+	SRVResolver        string        // DNS server for SRV lookups (host[:port]); system resolver when empty
+	FailoverAfter      int           // Failed attempts before moving to the next server
+	FailbackInterval   time.Duration // How often to check whether the primary is back (0 disables failback)
 	AuthToken          string
 	ClientID           string
+	ClientGroup        string // Optional group label for forwarders served by several clients
 	SkipVerify         bool
+	TLSConfig          *tls.Config // Optional TLS settings for the server connection (CA, client certificate)
 	Logger             *zap.Logger
 	ReconnectInterval  time.Duration
 	MaxReconnectDelay  time.Duration
@@ -34,6 +42,8 @@ type ImprovedClientConfig struct {
 	WriteBufferSize    int
 	EnableCompression  bool
 	PortMappings       map[int]string // port -> target mapping
+	MappingOptions     map[int]MappingOptions // port -> per-mapping options
+	AllowedTargets     []string               // Targets the server may push (see TargetAllowlist); empty accepts none
 }
 
 // DefaultImprovedClientConfig returns default client configuration
@@ -45,6 +55,8 @@ func DefaultImprovedClientConfig(serverURL, authToken, clientID string, logger *
 		Logger:            logger,
 		ReconnectInterval: 5 * time.Second,
 		MaxReconnectDelay: 2 * time.Minute,
+		FailoverAfter:     3,
+		FailbackInterval:  time.Minute,
 		PingInterval:      30 * time.Second,
 		PongTimeout:       60 * time.Second,
 		WriteTimeout:      10 * time.Second,
@@ -52,6 +64,7 @@ func DefaultImprovedClientConfig(serverURL, authToken, clientID string, logger *
 		WriteBufferSize:   1024 * 1024, // 1MB
 		EnableCompression: true,
 		PortMappings:      make(map[int]string), // Initialize empty mapping
+		MappingOptions:    make(map[int]MappingOptions),
 	}
 }
 
@@ -70,6 +83,14 @@ type ImprovedClient struct {
 	isConnected     atomic.Bool
 	lastError       atomic.Value
 	metrics         *ClientMetrics
+	serverGoingAway atomic.Bool // Set when the server announced a graceful shutdown
+	servers         *ServerPool
+	failingBack     atomic.Bool  // Set when the connection is closed to return to the primary
+	mappingsMu      sync.RWMutex // Guards config.PortMappings and config.MappingOptions
+	managedPorts    map[int]bool // Ports whose mapping was pushed by the server
+	dialsMu         sync.Mutex
+	replies         map[string]chan ForwardMessage // sessionID -> dial waiting for "connected"
+	datagrams       map[string]*DatagramSession
 }
 
 // ClientMetrics tracks client performance metrics
@@ -100,16 +121,22 @@ type ClientSession struct {
 	closed     atomic.Bool
 	client     *ImprovedClient
 	logger     *zap.Logger
+	paused     atomic.Bool   // The server asked to stop sending until its queue drains
+	resumed    chan struct{} // Wakes the local reader when the server resumes the session
+
+	idleTimeout time.Duration // How long the service may stay quiet (default 5m)
+	lastWrite   atomic.Int64  // unix nanoseconds of the last write to the service
 }
 
 // PortForwarder manages port forwarding configuration
 type PortForwarder struct {
-	LocalPort  int
-	RemoteHost string
-	RemotePort int
-	listener   net.Listener
-	ctx        context.Context
-	cancel     context.CancelFunc
+	LocalPort   int
+	LocalSocket string // Unix socket path of socket forwarders
+	RemoteHost  string
+	RemotePort  int
+	listener    net.Listener
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 // NewImprovedClient creates a new improved tunnel client
@@ -129,6 +156,10 @@ func NewImprovedClient(config ImprovedClientConfig) *ImprovedClient {
 		cancel:         cancel,
 		reconnectDelay: config.ReconnectInterval,
 		metrics:        &ClientMetrics{},
+		managedPorts:   make(map[int]bool),
+		servers:        NewServerPool(config),
+		replies:        make(map[string]chan ForwardMessage),
+		datagrams:      make(map[string]*DatagramSession),
 	}
 
 	return client
@@ -166,10 +197,21 @@ func (c *ImprovedClient) Start(ctx context.Context) error {
 		}
 
 		c.metrics.connectAttempts.Add(1)
+		c.servers.Refresh(clientCtx)
 		
 		err := c.connect(clientCtx)
 		if err != nil {
 			c.lastError.Store(err)
+			
+			// Try the next server without backing off, unless every server
+			// has been tried in this cycle
+			if c.servers.Failed() {
+				c.config.Logger.Warn("Failing over to next server",
+					zap.Error(err),
+					zap.String("server", c.servers.Current()))
+				continue
+			}
+			
 			c.config.Logger.Error("Connection failed", 
 				zap.Error(err),
 				zap.Duration("nextRetry", c.reconnectDelay))
@@ -190,9 +232,30 @@ func (c *ImprovedClient) Start(ctx context.Context) error {
 		// Reset delay on successful connection
 		c.reconnectDelay = c.config.ReconnectInterval
 		c.metrics.successfulConnects.Add(1)
+		c.servers.Connected()
+		
+		// Return to the primary once it is healthy again
+		connCtx, connCancel := context.WithCancel(clientCtx)
+		if !c.servers.IsPrimary() && c.config.FailbackInterval > 0 {
+			go c.failback(connCtx)
+		}
 		
 		// Wait for disconnection
 		<-c.waitForDisconnect()
+		connCancel()
+		c.closeDatagramSessions()
+		
+		if c.failingBack.Swap(false) {
+			continue
+		}
+		
+		// A draining server expects us to move to another instance right away
+		if c.serverGoingAway.Swap(false) {
+			c.servers.Skip()
+			c.config.Logger.Info("Server shut down, reconnecting to another instance...",
+				zap.String("server", c.servers.Current()))
+			continue
+		}
 		
 		c.config.Logger.Info("Connection lost, attempting to reconnect...")
 		time.Sleep(1 * time.Second)
@@ -202,9 +265,7 @@ func (c *ImprovedClient) Start(ctx context.Context) error {
 // connect establishes a WebSocket connection to the server
 func (c *ImprovedClient) connect(ctx context.Context) error {
 	dialer := websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: c.config.SkipVerify,
-		},
+		TLSClientConfig: c.tlsConfig(),
 		ReadBufferSize:    c.config.ReadBufferSize,
 		WriteBufferSize:   c.config.WriteBufferSize,
 		EnableCompression: c.config.EnableCompression,
@@ -214,8 +275,11 @@ func (c *ImprovedClient) connect(ctx context.Context) error {
 	header := http.Header{}
 	header.Set("Authorization", "Bearer "+c.config.AuthToken)
 	header.Set("X-Client-ID", c.config.ClientID)
+	if c.config.ClientGroup != "" {
+		header.Set("X-Client-Group", c.config.ClientGroup)
+	}
 
-	u, err := url.Parse(c.config.ServerURL)
+	u, err := url.Parse(c.servers.Current())
 	if err != nil {
 		return fmt.Errorf("invalid server URL: %w", err)
 	}
@@ -246,6 +310,9 @@ func (c *ImprovedClient) connect(ctx context.Context) error {
 		Type: "register",
 		ID:   c.config.ClientID,
 	}
+	if services := c.announcedServices(); len(services) > 0 {
+		regMsg.Data, _ = json.Marshal(Registration{Services: services})
+	}
 	if err := c.sendMessage(regMsg); err != nil {
 		conn.Close()
 		return fmt.Errorf("registration failed: %w", err)
@@ -261,6 +328,21 @@ func (c *ImprovedClient) connect(ctx context.Context) error {
 	return nil
 }
 
+// tlsConfig returns the TLS settings for connections to the server
+func (c *ImprovedClient) tlsConfig() *tls.Config {
+	return clientTLSConfig(c.config)
+}
+
+// clientTLSConfig builds the TLS settings for connections to the server
+func clientTLSConfig(config ImprovedClientConfig) *tls.Config {
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	tlsConfig.InsecureSkipVerify = tlsConfig.InsecureSkipVerify || config.SkipVerify
+	return tlsConfig
+}
+
 // waitForDisconnect returns a channel that closes when disconnected
 func (c *ImprovedClient) waitForDisconnect() <-chan struct{} {
 	ch := make(chan struct{})
@@ -313,6 +395,47 @@ func (c *ImprovedClient) AddPortForwarder(localPort int, remoteHost string, remo
 	return nil
 }
 
+// AddUnixForwarder adds a forwarder that listens on a Unix domain socket,
+// for local tools that connect to a socket path instead of a port
+func (c *ImprovedClient) AddUnixForwarder(socketPath, remoteHost string, remotePort int) error {
+	key := fmt.Sprintf("%s%s:%s:%d", unixScheme, socketPath, remoteHost, remotePort)
+
+	c.forwardersMu.Lock()
+	defer c.forwardersMu.Unlock()
+
+	if _, exists := c.forwarders[key]; exists {
+		return fmt.Errorf("forwarder already exists for %s", key)
+	}
+
+	// Only the owner and group of the socket may connect
+	listener, err := ListenUnix(socketPath, 0660)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socketPath, err)
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	forwarder := &PortForwarder{
+		LocalSocket: socketPath,
+		RemoteHost:  remoteHost,
+		RemotePort:  remotePort,
+		listener:    listener,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+
+	c.forwarders[key] = forwarder
+
+	go c.acceptConnections(forwarder)
+
+	c.config.Logger.Info("Added Unix socket forwarder",
+		zap.String("socket", socketPath),
+		zap.String("remoteHost", remoteHost),
+		zap.Int("remotePort", remotePort))
+
+	return nil
+}
+
 // acceptConnections accepts incoming connections for a forwarder
 func (c *ImprovedClient) acceptConnections(forwarder *PortForwarder) {
 	defer forwarder.listener.Close()
@@ -379,6 +502,7 @@ func (csm *ClientSessionManager) Create(sessionID string, conn net.Conn, target
 		writeQueue: make(chan []byte, 256),
 		client:     client,
 		logger:     client.config.Logger,
+		resumed:    make(chan struct{}, 1),
 	}
 
 	csm.mu.Lock()
@@ -388,6 +512,13 @@ func (csm *ClientSessionManager) Create(sessionID string, conn net.Conn, target
 	return session
 }
 
+// Count returns the number of open sessions
+func (csm *ClientSessionManager) Count() int {
+	csm.mu.RLock()
+	defer csm.mu.RUnlock()
+	return len(csm.sessions)
+}
+
 // Get retrieves a session by ID
 func (csm *ClientSessionManager) Get(sessionID string) (*ClientSession, bool) {
 	csm.mu.RLock()
@@ -452,6 +583,11 @@ func (s *ClientSession) Write(data []byte) error {
 func (s *ClientSession) readFromLocal() {
 	defer s.Close()
 
+	idleTimeout := s.idleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = 5 * time.Minute
+	}
+
 	buffer := make([]byte, 32*1024)
 	for {
 		select {
@@ -460,9 +596,22 @@ func (s *ClientSession) readFromLocal() {
 		default:
 		}
 
-		s.LocalConn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		// Stop reading the service while the server is paused
+		for s.paused.Load() {
+			select {
+			case <-s.resumed:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		s.LocalConn.SetReadDeadline(time.Now().Add(idleTimeout))
 		n, err := s.LocalConn.Read(buffer)
 		if err != nil {
+			// Data still flowing towards the service keeps a quiet service open
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && time.Since(time.Unix(0, s.lastWrite.Load())) < idleTimeout {
+				continue
+			}
 			if err != io.EOF && !isTemporaryError(err) {
 				s.logger.Debug("Local read error", zap.Error(err))
 			}
@@ -500,6 +649,7 @@ func (s *ClientSession) writePump() {
 				s.logger.Error("Local write error", zap.Error(err))
 				return
 			}
+			s.lastWrite.Store(time.Now().UnixNano())
 
 		case <-s.ctx.Done():
 			return
@@ -616,10 +766,40 @@ func (c *ImprovedClient) handleMessage(msg *Message) {
 	switch msg.Type {
 	case "registered":
 		c.config.Logger.Info("Registration confirmed")
+		if len(msg.Data) > 0 {
+			var result RegistrationResult
+			if err := json.Unmarshal(msg.Data, &result); err == nil {
+				for _, status := range result.Services {
+					c.logServiceStatus(status)
+				}
+			}
+		}
+
+	case "mappings":
+		var update MappingsUpdate
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			c.config.Logger.Error("Invalid mappings update", zap.Error(err))
+			return
+		}
+		c.applyManagedMappings(update)
+
+	case "service_status":
+		var status ServiceStatus
+		if err := json.Unmarshal(msg.Data, &status); err == nil {
+			c.logServiceStatus(status)
+		}
 
 	case "pong":
 		// Keepalive response
 
+	case "shutdown":
+		var notice ShutdownNotice
+		json.Unmarshal(msg.Data, &notice)
+		c.serverGoingAway.Store(true)
+		c.config.Logger.Info("Server is draining, will reconnect when it closes the connection",
+			zap.String("reason", notice.Reason),
+			zap.Time("deadline", notice.Deadline))
+
 	case "forward":
 		c.handleForwardMessage(msg.Data)
 
@@ -628,6 +808,44 @@ func (c *ImprovedClient) handleMessage(msg *Message) {
 	}
 }
 
+// announcedServices returns the mappings announced to the server, sorted by port
+func (c *ImprovedClient) announcedServices() []ServiceAnnouncement {
+	c.mappingsMu.RLock()
+	defer c.mappingsMu.RUnlock()
+
+	var services []ServiceAnnouncement
+	for port, options := range c.config.MappingOptions {
+		if options.Announce {
+			services = append(services, ServiceAnnouncement{
+				Name:        options.Name,
+				Port:        port,
+				Description: options.Description,
+			})
+		}
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Port < services[j].Port
+	})
+	return services
+}
+
+// logServiceStatus reports what the server did with an announced service
+func (c *ImprovedClient) logServiceStatus(status ServiceStatus) {
+	fields := []zap.Field{
+		zap.String("service", status.Name),
+		zap.Int("port", status.Port),
+		zap.String("status", status.Status),
+	}
+	if status.Reason != "" {
+		fields = append(fields, zap.String("reason", status.Reason))
+	}
+	if status.Status == ServiceRejected {
+		c.config.Logger.Warn("Announced service rejected by server", fields...)
+		return
+	}
+	c.config.Logger.Info("Announced service status", fields...)
+}
+
 // handleForwardMessage handles forward messages from server
 func (c *ImprovedClient) handleForwardMessage(data json.RawMessage) {
 	var msg ForwardMessage
@@ -646,10 +864,29 @@ func (c *ImprovedClient) handleForwardMessage(data json.RawMessage) {
 	case "disconnect":
 		c.handleRemoteDisconnect(&msg)
 
+	case "connected":
+		// Reply to a session opened with DialTunnel or OpenDatagramSession
+		c.deliverReply(&msg)
+
+	case "datagram":
+		c.handleRemoteDatagram(&msg)
+
+	case "pause", "resume":
+		// Flow control of a session whose external side is slow or rate limited
+		if session, exists := c.sessions.Get(msg.SessionID); exists {
+			session.paused.Store(msg.Type == "pause")
+			select {
+			case session.resumed <- struct{}{}:
+			default:
+			}
+		}
+
 	case "error":
 		c.config.Logger.Error("Forward error",
 			zap.String("sessionID", msg.SessionID),
+			zap.String("code", msg.Code),
 			zap.String("error", msg.Error))
+		c.deliverReply(&msg)
 		c.sessions.Remove(msg.SessionID)
 	}
 }
@@ -657,7 +894,7 @@ func (c *ImprovedClient) handleForwardMessage(data json.RawMessage) {
 // handleRemoteConnect handles connection request from server
 func (c *ImprovedClient) handleRemoteConnect(msg *ForwardMessage) {
 	// Determine target based on port mapping configured by client
-	target, exists := c.config.PortMappings[msg.Port]
+	target, options, exists := c.lookupMapping(msg.Port)
 	if !exists {
 		c.config.Logger.Error("No target configured for port",
 			zap.Int("port", msg.Port),
@@ -675,11 +912,12 @@ func (c *ImprovedClient) handleRemoteConnect(msg *ForwardMessage) {
 
 	c.config.Logger.Info("Connecting to local service",
 		zap.Int("port", msg.Port),
+		zap.String("mapping", options.Name),
 		zap.String("target", target),
 		zap.String("sessionID", msg.SessionID))
 
 	// Connect to local service
-	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	conn, err := dialTarget(target, options, msg.Source, msg.Destination)
 	if err != nil {
 		c.config.Logger.Error("Failed to connect to local service",
 			zap.String("target", target),
@@ -697,10 +935,14 @@ func (c *ImprovedClient) handleRemoteConnect(msg *ForwardMessage) {
 
 	// Create session
 	session := c.sessions.Create(msg.SessionID, conn, target, c)
+	session.idleTimeout = msg.IdleTimeout
 
-	c.config.Logger.Info("Connected to local service",
-		zap.String("sessionID", msg.SessionID),
-		zap.String("target", target))
+	fields := []zap.Field{zap.String("sessionID", msg.SessionID), zap.String("target", target)}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		fields = append(fields, zap.String("tlsVersion", tls.VersionName(state.Version)), zap.String("serverName", state.ServerName))
+	}
+	c.config.Logger.Info("Connected to local service", fields...)
 
 	// Send success response
 	successMsg := ForwardMessage{
@@ -713,6 +955,55 @@ func (c *ImprovedClient) handleRemoteConnect(msg *ForwardMessage) {
 	go session.Start()
 }
 
+// dialTarget connects to a mapping target, sending a PROXY header for the
+// external connection from source to destination and originating TLS if
+// configured
+func dialTarget(target string, options MappingOptions, source, destination string) (net.Conn, error) {
+	timeout := options.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultDialTimeout
+	}
+
+	network, address := targetNetwork(target)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ProxyProtocol != "" {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		_, err := conn.Write(formatProxyHeader(options.ProxyProtocol, source, destination))
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to send PROXY header to %s: %w", target, err)
+		}
+	}
+
+	if options.TLS == nil {
+		return conn, nil
+	}
+
+	// PostgreSQL negotiates TLS in-band
+	if options.Protocol == ProtocolPostgres {
+		tlsConn, err := startPostgresTLS(conn, options.TLS, timeout)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS negotiation with %s failed: %w", target, err)
+		}
+		return tlsConn, nil
+	}
+
+	tlsConn := tls.Client(conn, options.TLS)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %w", target, err)
+	}
+	return tlsConn, nil
+}
+
 // handleRemoteData handles data from server
 func (c *ImprovedClient) handleRemoteData(msg *ForwardMessage) {
 	c.config.Logger.Info("Received data from server", zap.String("sessionID", msg.SessionID), zap.Int("dataLen", len(msg.Data)))
@@ -742,6 +1033,9 @@ func (c *ImprovedClient) handleRemoteData(msg *ForwardMessage) {
 
 // handleRemoteDisconnect handles disconnect from server
 func (c *ImprovedClient) handleRemoteDisconnect(msg *ForwardMessage) {
+	if c.removeDatagramSession(msg.SessionID) {
+		return
+	}
 	c.sessions.Remove(msg.SessionID)
 }
 
@@ -791,6 +1085,8 @@ func (c *ImprovedClient) GetMetrics() map[string]interface{} {
 		"bytesTransferred":   c.metrics.bytesTransferred.Load(),
 		"activeSessions":     c.metrics.activeSessions.Load(),
 		"isConnected":        c.isConnected.Load(),
+		"currentServer":      c.servers.Current(),
+		"servers":            c.servers.Status(),
 	}
 }
 
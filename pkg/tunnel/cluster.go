@@ -0,0 +1,516 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// ClusterConfig configures active-active clustering of tunnel servers
+type ClusterConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	NodeID            string        `yaml:"node_id"`            // Unique per server (defaults to the hostname)
+	AdvertiseURL      string        `yaml:"advertise_url"`      // Base URL peers use to reach this node, e.g. "wss://10.0.0.5:8443"
+	Token             string        `yaml:"token"`              // Shared secret for the inter-server link (defaults to server.token)
+	Registry          string        `yaml:"registry"`           // "file" (default), the only supported registry
+	RegistryPath      string        `yaml:"registry_path"`      // Shared directory for the file registry
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"` // How often the node state is published
+	NodeTTL           time.Duration `yaml:"node_ttl"`           // Peers not seen for this long are ignored
+	SkipVerify        bool          `yaml:"skip_verify"`        // Skip TLS verification of peers (dev only)
+	CAFile            string        `yaml:"ca_file"`            // CA bundle for peer certificates
+}
+
+// DefaultClusterConfig returns default cluster configuration
+func DefaultClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		Registry:          "file",
+		HeartbeatInterval: 5 * time.Second,
+		NodeTTL:           20 * time.Second,
+	}
+}
+
+// ClusterNode is the state a server publishes to the registry
+type ClusterNode struct {
+	ID        string          `json:"id"`
+	URL       string          `json:"url"`
+	Clients   []ClusterClient `json:"clients"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// ClusterClient is a client attached to a cluster node
+type ClusterClient struct {
+	ID    string `json:"id"`
+	Group string `json:"group,omitempty"`
+}
+
+// ClusterRegistry shares which clients are attached to which server
+type ClusterRegistry interface {
+	Publish(ctx context.Context, node ClusterNode) error
+	Nodes(ctx context.Context) ([]ClusterNode, error)
+	Remove(ctx context.Context, nodeID string) error
+}
+
+// MemoryRegistry is a registry shared by servers in the same process, for tests
+type MemoryRegistry struct {
+	nodes map[string]ClusterNode
+	mu    sync.RWMutex
+}
+
+// NewMemoryRegistry creates an empty in-memory registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{nodes: make(map[string]ClusterNode)}
+}
+
+// Publish stores the state of a node
+func (r *MemoryRegistry) Publish(ctx context.Context, node ClusterNode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nodes[node.ID] = node
+	return nil
+}
+
+// Nodes returns the state of every node
+func (r *MemoryRegistry) Nodes(ctx context.Context) ([]ClusterNode, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]ClusterNode, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Remove deletes the state of a node
+func (r *MemoryRegistry) Remove(ctx context.Context, nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodes, nodeID)
+	return nil
+}
+
+// FileRegistry keeps one JSON file per node in a directory shared by all servers
+type FileRegistry struct {
+	dir string
+}
+
+// NewFileRegistry creates a registry in dir, creating the directory if needed
+func NewFileRegistry(dir string) (*FileRegistry, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("registry path is required")
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create registry directory: %w", err)
+	}
+	return &FileRegistry{dir: dir}, nil
+}
+
+// Publish atomically replaces the file of a node
+func (r *FileRegistry) Publish(ctx context.Context, node ClusterNode) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(r.dir, ".node-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path(node.ID))
+}
+
+// Nodes reads the files of every node, skipping unreadable ones
+func (r *FileRegistry) Nodes(ctx context.Context) ([]ClusterNode, error) {
+	files, err := filepath.Glob(filepath.Join(r.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var nodes []ClusterNode
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var node ClusterNode
+		if err := json.Unmarshal(data, &node); err != nil {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// Remove deletes the file of a node
+func (r *FileRegistry) Remove(ctx context.Context, nodeID string) error {
+	err := os.Remove(r.path(nodeID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// path returns the file of a node
+func (r *FileRegistry) path(nodeID string) string {
+	return filepath.Join(r.dir, strings.ReplaceAll(nodeID, string(filepath.Separator), "_")+".json")
+}
+
+// Cluster publishes the clients attached to a server and relays sessions to
+// peers when a forwarder's client is connected to another server
+type Cluster struct {
+	server   *ImprovedServer
+	config   ClusterConfig
+	registry ClusterRegistry
+	dialer   websocket.Dialer
+	logger   *zap.Logger
+
+	peers []ClusterNode // live peers, refreshed on every heartbeat
+	mu    sync.RWMutex
+}
+
+// NewCluster attaches a cluster to a server. Register HandleRelay at /cluster/relay
+// and run Start to begin publishing.
+func NewCluster(server *ImprovedServer, config ClusterConfig, registry ClusterRegistry) (*Cluster, error) {
+	defaults := DefaultClusterConfig()
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	if config.NodeTTL <= 0 {
+		config.NodeTTL = defaults.NodeTTL
+	}
+	if config.NodeID == "" {
+		return nil, fmt.Errorf("node_id is required")
+	}
+	if config.AdvertiseURL == "" {
+		return nil, fmt.Errorf("advertise_url is required")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+
+	tlsConfig, err := buildTLSConfig(config.CAFile, "", "", "", config.SkipVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := &Cluster{
+		server:   server,
+		config:   config,
+		registry: registry,
+		logger:   server.logger,
+		dialer: websocket.Dialer{
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: 10 * time.Second,
+		},
+	}
+	server.cluster = cluster
+	return cluster, nil
+}
+
+// Start publishes this node and refreshes peers until ctx is cancelled,
+// then removes the node from the registry
+func (c *Cluster) Start(ctx context.Context) {
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	c.sync(ctx)
+	for {
+		select {
+		case <-ticker.C:
+			c.sync(ctx)
+		case <-ctx.Done():
+			removeCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := c.registry.Remove(removeCtx, c.config.NodeID); err != nil {
+				c.logger.Warn("Failed to leave cluster registry", zap.Error(err))
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// sync publishes the local clients and reloads the live peers
+func (c *Cluster) sync(ctx context.Context) {
+	node := ClusterNode{
+		ID:        c.config.NodeID,
+		URL:       c.config.AdvertiseURL,
+		Clients:   []ClusterClient{},
+		UpdatedAt: time.Now(),
+	}
+	// A draining node stops attracting relayed sessions
+	if !c.server.IsDraining() {
+		for _, client := range c.server.clients.Matching(func(*ImprovedServerClient) bool { return true }) {
+			node.Clients = append(node.Clients, ClusterClient{ID: client.ID, Group: client.Group})
+		}
+	}
+	if err := c.registry.Publish(ctx, node); err != nil {
+		c.logger.Warn("Failed to publish cluster state", zap.Error(err))
+	}
+
+	nodes, err := c.registry.Nodes(ctx)
+	if err != nil {
+		c.logger.Warn("Failed to read cluster registry", zap.Error(err))
+		return
+	}
+	var peers []ClusterNode
+	for _, n := range nodes {
+		if n.ID != c.config.NodeID && time.Since(n.UpdatedAt) <= c.config.NodeTTL {
+			peers = append(peers, n)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+
+	c.mu.Lock()
+	c.peers = peers
+	c.mu.Unlock()
+}
+
+// Peers returns the live peers and their clients
+func (c *Cluster) Peers() []ClusterNode {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]ClusterNode(nil), c.peers...)
+}
+
+// nodeFor returns a peer with a client able to serve the forwarder, preferring
+// listed client IDs in order, then group members
+func (c *Cluster) nodeFor(fw ForwarderConfig) (ClusterNode, bool) {
+	peers := c.Peers()
+	for _, id := range fw.clientIDs() {
+		if node, exists := nodeWith(peers, func(client ClusterClient) bool { return client.ID == id }); exists {
+			return node, true
+		}
+	}
+	if fw.ClientGroup != "" {
+		return nodeWith(peers, func(client ClusterClient) bool { return client.Group == fw.ClientGroup })
+	}
+	return ClusterNode{}, false
+}
+
+// nodeWith returns the first node with a client accepted by match
+func nodeWith(nodes []ClusterNode, match func(ClusterClient) bool) (ClusterNode, bool) {
+	for _, node := range nodes {
+		for _, client := range node.Clients {
+			if match(client) {
+				return node, true
+			}
+		}
+	}
+	return ClusterNode{}, false
+}
+
+// relay hands a forwarder connection to the peer serving its client and copies
+// data until either side closes. It returns false if no peer took the connection.
+func (c *Cluster) relay(conn net.Conn, fw ForwarderConfig) bool {
+	node, exists := c.nodeFor(fw)
+	if !exists {
+		return false
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+c.config.Token)
+	header.Set("X-Cluster-Node", c.config.NodeID)
+	// The peer reports the original addresses to its client
+	header.Set("X-Relay-Source", conn.RemoteAddr().String())
+	header.Set("X-Relay-Destination", conn.LocalAddr().String())
+
+	target := strings.TrimSuffix(node.URL, "/") + "/cluster/relay?port=" + strconv.Itoa(fw.Port)
+	ws, _, err := c.dialer.DialContext(c.server.ctx, target, header)
+	if err != nil {
+		c.logger.Warn("Failed to relay connection to peer",
+			zap.String("node", node.ID),
+			zap.String("forwarder", fw.Name),
+			zap.Error(err))
+		return false
+	}
+
+	c.server.metrics.sessionsRelayedOut.Add(1)
+	c.logger.Info("Relaying connection to peer",
+		zap.String("node", node.ID),
+		zap.String("forwarder", fw.Name),
+		zap.Int("port", fw.Port))
+
+	peer := newWSConn(ws)
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(peer, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, peer)
+		done <- struct{}{}
+	}()
+	<-done
+	peer.Close()
+	conn.Close()
+	return true
+}
+
+// HandleRelay accepts a session relayed by a peer and serves it with a local client
+func (c *Cluster) HandleRelay(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if c.server.IsDraining() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil {
+		http.Error(w, "Invalid port", http.StatusBadRequest)
+		return
+	}
+	fw, exists := c.server.forwarderForPort(port)
+	if !exists {
+		http.Error(w, "Unknown forwarder", http.StatusNotFound)
+		return
+	}
+	if len(c.server.candidatesFor(fw)) == 0 {
+		http.Error(w, "Client not connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	ws, err := c.server.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		c.logger.Error("Failed to upgrade relay connection", zap.Error(err))
+		return
+	}
+
+	c.server.metrics.sessionsRelayedIn.Add(1)
+	c.logger.Info("Accepted relayed connection",
+		zap.String("fromNode", r.Header.Get("X-Cluster-Node")),
+		zap.String("forwarder", fw.Name),
+		zap.Int("port", port))
+	conn := newWSConn(ws)
+	if source, err := net.ResolveTCPAddr("tcp", r.Header.Get("X-Relay-Source")); err == nil {
+		conn.remote = source
+	}
+	if destination, err := net.ResolveTCPAddr("tcp", r.Header.Get("X-Relay-Destination")); err == nil {
+		conn.local = destination
+	}
+	c.server.handleTCPConnection(conn, fw, true)
+}
+
+// remoteNodeFor reports the peer serving a forwarder whose client is not connected locally
+func (s *ImprovedServer) remoteNodeFor(fw ForwarderConfig) (string, bool) {
+	if s.cluster == nil {
+		return "", false
+	}
+	node, exists := s.cluster.nodeFor(fw)
+	return node.ID, exists
+}
+
+// remoteClientNode reports the peer a client is connected to
+func (s *ImprovedServer) remoteClientNode(clientID string) (string, bool) {
+	if s.cluster == nil {
+		return "", false
+	}
+	node, exists := nodeWith(s.cluster.Peers(), func(client ClusterClient) bool { return client.ID == clientID })
+	return node.ID, exists
+}
+
+// wsConn adapts a WebSocket carrying binary messages to net.Conn
+type wsConn struct {
+	ws      *websocket.Conn
+	reader  io.Reader
+	writeMu sync.Mutex
+	remote  net.Addr // Addresses of the relayed forwarder connection, if known
+	local   net.Addr
+}
+
+// newWSConn wraps a WebSocket connection
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a close frame and closes the underlying connection
+func (c *wsConn) Close() error {
+	c.writeMu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.ws.LocalAddr()
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.ws.RemoteAddr()
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,209 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func testRegistry(t *testing.T, registry ClusterRegistry) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, node := range []ClusterNode{
+		{ID: "a", URL: "wss://a:8443", Clients: []ClusterClient{{ID: "c1"}}, UpdatedAt: now},
+		{ID: "b", URL: "wss://b:8443", Clients: []ClusterClient{}, UpdatedAt: now},
+		{ID: "b", URL: "wss://b:8443", Clients: []ClusterClient{{ID: "c2", Group: "web"}}, UpdatedAt: now},
+	} {
+		if err := registry.Publish(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nodes, err := registry.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("got %d nodes, want 2", len(nodes))
+	}
+	byID := make(map[string]ClusterNode)
+	for _, node := range nodes {
+		byID[node.ID] = node
+	}
+	if clients := byID["b"].Clients; len(clients) != 1 || clients[0].ID != "c2" || clients[0].Group != "web" {
+		t.Errorf("node b was not replaced: %+v", byID["b"])
+	}
+	if !byID["a"].UpdatedAt.Equal(now) {
+		t.Errorf("node a updated at %v, want %v", byID["a"].UpdatedAt, now)
+	}
+
+	if err := registry.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Remove(ctx, "missing"); err != nil {
+		t.Errorf("removing an unknown node: %v", err)
+	}
+	nodes, err = registry.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].ID != "b" {
+		t.Errorf("got %+v after removal, want only node b", nodes)
+	}
+}
+
+func TestMemoryRegistry(t *testing.T) {
+	testRegistry(t, NewMemoryRegistry())
+}
+
+func TestFileRegistry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cluster")
+	registry, err := NewFileRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRegistry(t, registry)
+
+	// Node IDs cannot escape the directory and no temporary files are left
+	if err := registry.Publish(context.Background(), ClusterNode{ID: "../x/y"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != ".._x_y.json,b.json" {
+		t.Errorf("registry files: %v", names)
+	}
+
+	// Unreadable files are skipped
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := registry.Nodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("got %d nodes, want 2", len(nodes))
+	}
+
+	if _, err := NewFileRegistry(""); err == nil {
+		t.Error("expected an error without a registry path")
+	}
+}
+
+func TestClusterRelay(t *testing.T) {
+	port := freePort(t)
+	target := startEchoServer(t)
+	registry := NewMemoryRegistry()
+
+	// startNode runs a server with the forwarder on port and joins it to the cluster
+	startNode := func(id string, maxSessions int) (*ImprovedServer, *Cluster, *httptest.Server) {
+		server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+			{Name: "echo", Port: port, ClientID: "c1", Enabled: true, MaxSessions: maxSessions},
+		})
+		mux := http.NewServeMux()
+		web := httptest.NewServer(mux)
+		t.Cleanup(web.Close)
+		cluster, err := NewCluster(server, ClusterConfig{
+			NodeID:       id,
+			AdvertiseURL: "ws" + strings.TrimPrefix(web.URL, "http"),
+			Token:        "cluster-secret",
+		}, registry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.HandleFunc("/tunnel", server.HandleTunnel)
+		mux.HandleFunc("/cluster/relay", cluster.HandleRelay)
+		return server, cluster, web
+	}
+
+	// The connection arrives at a, whose limit of one session must not
+	// apply to sessions relayed to b
+	a, clusterA, _ := startNode("a", 1)
+	b, clusterB, webB := startNode("b", 0)
+	startTestClient(t, b, webB.URL, "c1", map[int]string{port: target})
+
+	if err := a.StartTCPForwarder(port, "c1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.StopTCPForwarder(port) })
+
+	ctx := context.Background()
+	clusterB.sync(ctx)
+	clusterA.sync(ctx)
+	if peers := clusterA.Peers(); len(peers) != 1 || peers[0].ID != "b" {
+		t.Fatalf("peers of a: %+v", peers)
+	}
+	if node, exists := a.remoteClientNode("c1"); !exists || node != "b" {
+		t.Fatalf("c1 found on %q, want b", node)
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		echo(t, conn, "hello "+strconv.Itoa(i))
+	}
+	for _, conn := range conns {
+		echo(t, conn, "again")
+	}
+
+	if relayed := a.metrics.sessionsRelayedOut.Load(); relayed != 2 {
+		t.Errorf("a relayed %d sessions, want 2", relayed)
+	}
+	if accepted := b.metrics.sessionsRelayedIn.Load(); accepted != 2 {
+		t.Errorf("b accepted %d sessions, want 2", accepted)
+	}
+}
+
+func TestHandleRelayRefusals(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	cluster, err := NewCluster(server, ClusterConfig{NodeID: "a", AdvertiseURL: "ws://a", Token: "cluster-secret"}, NewMemoryRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		query  string
+		status int
+	}{
+		{"no token", "", "port=1", http.StatusUnauthorized},
+		{"wrong token", "secret", "port=1", http.StatusUnauthorized},
+		{"invalid port", "cluster-secret", "port=x", http.StatusBadRequest},
+		{"unknown forwarder", "cluster-secret", "port=1", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/cluster/relay?"+tc.query, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			recorder := httptest.NewRecorder()
+			cluster.HandleRelay(recorder, req)
+			if recorder.Code != tc.status {
+				t.Errorf("got status %d, want %d", recorder.Code, tc.status)
+			}
+		})
+	}
+}
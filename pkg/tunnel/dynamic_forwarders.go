@@ -0,0 +1,435 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DynamicForwarderPolicy controls which services announced by clients get a forwarder
+type DynamicForwarderPolicy struct {
+	Enabled         bool     `yaml:"enabled"`
+	PortRanges      []string `yaml:"port_ranges"`      // e.g. "20000-20999" or "8081"
+	NamePatterns    []string `yaml:"name_patterns"`    // Shell patterns such as "web-*"; empty allows any name
+	Clients         []string `yaml:"clients"`          // Clients allowed to announce services; empty allows all
+	RequireApproval bool     `yaml:"require_approval"` // Hold new services until approved via the admin API
+}
+
+// Dynamic forwarder states reported to clients and the admin API
+const (
+	ServiceActive   = "active"
+	ServicePending  = "pending"
+	ServiceRejected = "rejected"
+)
+
+// ServiceAnnouncement is a service a client offers to expose on the server
+type ServiceAnnouncement struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"` // Requested server port
+	Description string `json:"description,omitempty"`
+}
+
+// Registration is the payload of a "register" message
+type Registration struct {
+	Services []ServiceAnnouncement `json:"services,omitempty"`
+}
+
+// ServiceStatus tells a client what happened to one of its announced services
+type ServiceStatus struct {
+	Name   string `json:"name"`
+	Port   int    `json:"port"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// RegistrationResult is the payload of a "registered" message
+type RegistrationResult struct {
+	Services []ServiceStatus `json:"services,omitempty"`
+}
+
+// DynamicForwarder is a forwarder announced by a client
+type DynamicForwarder struct {
+	ClientID    string    `json:"clientId"`
+	Name        string    `json:"name"`
+	Port        int       `json:"port"`
+	Description string    `json:"description,omitempty"`
+	Status      string    `json:"status"`
+	AnnouncedAt time.Time `json:"announcedAt"`
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	first, last int
+}
+
+// DynamicForwarders tracks client-announced forwarders and admin approvals
+type DynamicForwarders struct {
+	policy   DynamicForwarderPolicy
+	ports    []portRange
+	entries  map[string]*DynamicForwarder // clientID/name -> forwarder
+	approved map[string]int               // clientID/name -> approved port, kept across reconnects
+	mu       sync.Mutex
+}
+
+// NewDynamicForwarders creates a tracker with client-declared forwarders disabled
+func NewDynamicForwarders() *DynamicForwarders {
+	return &DynamicForwarders{
+		entries:  make(map[string]*DynamicForwarder),
+		approved: make(map[string]int),
+	}
+}
+
+// dynamicKey identifies a service announced by a client
+func dynamicKey(clientID, name string) string {
+	return clientID + "/" + name
+}
+
+// parsePortRanges parses entries such as "8081" or "20000-20999"
+func parsePortRanges(specs []string) ([]portRange, error) {
+	var ranges []portRange
+	for _, spec := range specs {
+		first, last, isRange := strings.Cut(strings.TrimSpace(spec), "-")
+		if !isRange {
+			last = first
+		}
+		from, err1 := strconv.Atoi(strings.TrimSpace(first))
+		to, err2 := strconv.Atoi(strings.TrimSpace(last))
+		if err1 != nil || err2 != nil || from < 1 || to > 65535 || from > to {
+			return nil, fmt.Errorf("invalid port range %q", spec)
+		}
+		ranges = append(ranges, portRange{first: from, last: to})
+	}
+	return ranges, nil
+}
+
+// SetDynamicForwarderPolicy sets the policy applied to services announced by clients
+func (s *ImprovedServer) SetDynamicForwarderPolicy(policy DynamicForwarderPolicy) error {
+	ports, err := parsePortRanges(policy.PortRanges)
+	if err != nil {
+		return err
+	}
+	if policy.Enabled && len(ports) == 0 {
+		return fmt.Errorf("at least one port range is required")
+	}
+	for _, pattern := range policy.NamePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid name pattern %q: %w", pattern, err)
+		}
+	}
+
+	s.dynamic.mu.Lock()
+	defer s.dynamic.mu.Unlock()
+	s.dynamic.policy = policy
+	s.dynamic.ports = ports
+	return nil
+}
+
+// DynamicForwarders returns all client-announced forwarders sorted by client and name
+func (s *ImprovedServer) DynamicForwarders() []DynamicForwarder {
+	s.dynamic.mu.Lock()
+	defer s.dynamic.mu.Unlock()
+
+	result := make([]DynamicForwarder, 0, len(s.dynamic.entries))
+	for _, entry := range s.dynamic.entries {
+		result = append(result, *entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ClientID != result[j].ClientID {
+			return result[i].ClientID < result[j].ClientID
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// registerServices applies the policy to the services announced by a client
+// and withdraws services it no longer announces
+func (s *ImprovedServer) registerServices(client *ImprovedServerClient, services []ServiceAnnouncement) []ServiceStatus {
+	var statuses []ServiceStatus
+	announced := make(map[string]bool)
+	for _, service := range services {
+		announced[dynamicKey(client.ID, service.Name)] = true
+		statuses = append(statuses, s.announceService(client.ID, service))
+	}
+
+	for _, entry := range s.servicesOf(client.ID) {
+		if !announced[dynamicKey(entry.ClientID, entry.Name)] {
+			s.withdrawService(entry)
+		}
+	}
+	return statuses
+}
+
+// announceService creates, queues or rejects a single announced service
+func (s *ImprovedServer) announceService(clientID string, service ServiceAnnouncement) ServiceStatus {
+	status := ServiceStatus{Name: service.Name, Port: service.Port}
+	key := dynamicKey(clientID, service.Name)
+
+	if reason := s.checkService(clientID, service); reason != "" {
+		s.logger.Warn("Rejected announced service",
+			zap.String("clientID", clientID),
+			zap.String("service", service.Name),
+			zap.Int("port", service.Port),
+			zap.String("reason", reason))
+		status.Status = ServiceRejected
+		status.Reason = reason
+		return status
+	}
+
+	s.dynamic.mu.Lock()
+	existing := s.dynamic.entries[key]
+	s.dynamic.mu.Unlock()
+
+	if existing != nil {
+		if existing.Port == service.Port {
+			// Re-announced after a reconnect
+			status.Status = existing.Status
+			return status
+		}
+		s.withdrawService(existing)
+	}
+
+	entry := &DynamicForwarder{
+		ClientID:    clientID,
+		Name:        service.Name,
+		Port:        service.Port,
+		Description: service.Description,
+		Status:      ServicePending,
+		AnnouncedAt: time.Now(),
+	}
+
+	s.dynamic.mu.Lock()
+	s.dynamic.entries[key] = entry
+	needsApproval := s.dynamic.policy.RequireApproval && s.dynamic.approved[key] != service.Port
+	s.dynamic.mu.Unlock()
+
+	if needsApproval {
+		s.logger.Info("Announced service awaiting approval",
+			zap.String("clientID", clientID),
+			zap.String("service", service.Name),
+			zap.Int("port", service.Port))
+		status.Status = ServicePending
+		status.Reason = "awaiting administrator approval"
+		return status
+	}
+
+	if err := s.activateService(entry); err != nil {
+		s.withdrawService(entry)
+		status.Status = ServiceRejected
+		status.Reason = err.Error()
+		return status
+	}
+	status.Status = ServiceActive
+	return status
+}
+
+// checkService returns why the policy refuses a service, or "" if it is allowed
+func (s *ImprovedServer) checkService(clientID string, service ServiceAnnouncement) string {
+	s.dynamic.mu.Lock()
+	policy := s.dynamic.policy
+	ports := s.dynamic.ports
+	var claimedBy string
+	for _, entry := range s.dynamic.entries {
+		if entry.Port == service.Port && entry.ClientID != clientID {
+			claimedBy = entry.ClientID
+		}
+	}
+	s.dynamic.mu.Unlock()
+
+	if !policy.Enabled {
+		return "client-declared forwarders are disabled"
+	}
+	if service.Name == "" || strings.Contains(service.Name, "/") {
+		return "service name must be set and must not contain '/'"
+	}
+
+	if len(policy.Clients) > 0 {
+		allowed := false
+		for _, id := range policy.Clients {
+			if id == clientID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "client is not allowed to announce services"
+		}
+	}
+
+	if len(policy.NamePatterns) > 0 {
+		matched := false
+		for _, pattern := range policy.NamePatterns {
+			if ok, _ := path.Match(pattern, service.Name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Sprintf("name %q does not match an allowed pattern", service.Name)
+		}
+	}
+
+	inRange := false
+	for _, r := range ports {
+		if service.Port >= r.first && service.Port <= r.last {
+			inRange = true
+			break
+		}
+	}
+	if !inRange {
+		return fmt.Sprintf("port %d is outside the allowed ranges", service.Port)
+	}
+
+	if claimedBy != "" {
+		return fmt.Sprintf("port %d is claimed by client %s", service.Port, claimedBy)
+	}
+	if fw, exists := s.forwarderForPort(service.Port); exists && fw.Name != dynamicKey(clientID, service.Name) {
+		return fmt.Sprintf("port %d is used by forwarder %s", service.Port, fw.Name)
+	}
+	return ""
+}
+
+// activateService adds a forwarder for an allowed service and starts its listener
+func (s *ImprovedServer) activateService(entry *DynamicForwarder) error {
+	fw := ForwarderConfig{
+		Name:        dynamicKey(entry.ClientID, entry.Name),
+		Port:        entry.Port,
+		ClientID:    entry.ClientID,
+		Enabled:     true,
+		Description: entry.Description,
+	}
+
+	s.forwardersMu.Lock()
+	s.forwarders = append(s.forwarders, fw)
+	s.forwardersMu.Unlock()
+
+	if err := s.StartTCPForwarder(fw.Port, fw.ClientID); err != nil {
+		s.removeForwarder(fw.Name)
+		s.logger.Error("Failed to start announced service",
+			zap.String("forwarder", fw.Name),
+			zap.Int("port", fw.Port),
+			zap.Error(err))
+		return err
+	}
+
+	s.dynamic.mu.Lock()
+	entry.Status = ServiceActive
+	s.dynamic.mu.Unlock()
+
+	s.logger.Info("Started forwarder for announced service",
+		zap.String("forwarder", fw.Name),
+		zap.Int("port", fw.Port))
+	return nil
+}
+
+// withdrawService stops the forwarder of a service and forgets it
+func (s *ImprovedServer) withdrawService(entry *DynamicForwarder) {
+	key := dynamicKey(entry.ClientID, entry.Name)
+
+	s.dynamic.mu.Lock()
+	active := entry.Status == ServiceActive
+	if s.dynamic.entries[key] == entry {
+		delete(s.dynamic.entries, key)
+	}
+	s.dynamic.mu.Unlock()
+
+	if !active {
+		return
+	}
+	s.StopTCPForwarder(entry.Port)
+	s.removeForwarder(key)
+	s.logger.Info("Removed forwarder for announced service",
+		zap.String("forwarder", key),
+		zap.Int("port", entry.Port))
+}
+
+// servicesOf returns the services announced by a client
+func (s *ImprovedServer) servicesOf(clientID string) []*DynamicForwarder {
+	s.dynamic.mu.Lock()
+	defer s.dynamic.mu.Unlock()
+
+	var result []*DynamicForwarder
+	for _, entry := range s.dynamic.entries {
+		if entry.ClientID == clientID {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// releaseServices tears down the forwarders of a client that has left
+func (s *ImprovedServer) releaseServices(client *ImprovedServerClient) {
+	// A reconnected client keeps its services
+	if current, exists := s.clients.Get(client.ID); exists && current != client {
+		return
+	}
+	for _, entry := range s.servicesOf(client.ID) {
+		s.withdrawService(entry)
+	}
+}
+
+// ApproveService activates a pending service; approval is remembered for later reconnects
+func (s *ImprovedServer) ApproveService(clientID, name string) error {
+	key := dynamicKey(clientID, name)
+
+	s.dynamic.mu.Lock()
+	entry, exists := s.dynamic.entries[key]
+	if !exists || entry.Status != ServicePending {
+		s.dynamic.mu.Unlock()
+		return fmt.Errorf("no pending service %s", key)
+	}
+	s.dynamic.approved[key] = entry.Port
+	s.dynamic.mu.Unlock()
+
+	status := ServiceStatus{Name: name, Port: entry.Port, Status: ServiceActive}
+	err := s.activateService(entry)
+	if err != nil {
+		s.withdrawService(entry)
+		status.Status = ServiceRejected
+		status.Reason = err.Error()
+	}
+	s.notifyServiceStatus(clientID, status)
+	return err
+}
+
+// RejectService refuses a pending service or revokes an active one
+func (s *ImprovedServer) RejectService(clientID, name string) error {
+	key := dynamicKey(clientID, name)
+
+	s.dynamic.mu.Lock()
+	entry, exists := s.dynamic.entries[key]
+	delete(s.dynamic.approved, key)
+	s.dynamic.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("no service %s", key)
+	}
+	s.withdrawService(entry)
+	s.notifyServiceStatus(clientID, ServiceStatus{
+		Name:   name,
+		Port:   entry.Port,
+		Status: ServiceRejected,
+		Reason: "rejected by administrator",
+	})
+	return nil
+}
+
+// notifyServiceStatus tells a connected client about a change to one of its services
+func (s *ImprovedServer) notifyServiceStatus(clientID string, status ServiceStatus) {
+	client, exists := s.clients.Get(clientID)
+	if !exists {
+		return
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	s.sendMessageToClient(client, Message{Type: "service_status", Data: data})
+}
@@ -0,0 +1,170 @@
+package tunnel
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestParsePortRanges(t *testing.T) {
+	tests := []struct {
+		specs  []string
+		ranges []portRange
+		valid  bool
+	}{
+		{nil, nil, true},
+		{[]string{"8081"}, []portRange{{8081, 8081}}, true},
+		{[]string{"20000-20999", " 8081 "}, []portRange{{20000, 20999}, {8081, 8081}}, true},
+		{[]string{"1-65535"}, []portRange{{1, 65535}}, true},
+		{[]string{"0"}, nil, false},
+		{[]string{"65536"}, nil, false},
+		{[]string{"200-100"}, nil, false},
+		{[]string{"web"}, nil, false},
+		{[]string{"100-"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		ranges, err := parsePortRanges(tt.specs)
+		if tt.valid && (err != nil || !reflect.DeepEqual(ranges, tt.ranges)) {
+			t.Errorf("parsePortRanges(%q) = %v, %v; want %v", tt.specs, ranges, err, tt.ranges)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("parsePortRanges(%q) succeeded", tt.specs)
+		}
+	}
+}
+
+func TestSetDynamicForwarderPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy DynamicForwarderPolicy
+		valid  bool
+	}{
+		{"disabled", DynamicForwarderPolicy{}, true},
+		{"enabled", DynamicForwarderPolicy{Enabled: true, PortRanges: []string{"20000-20999"}, NamePatterns: []string{"web-*"}}, true},
+		{"enabled without ports", DynamicForwarderPolicy{Enabled: true}, false},
+		{"invalid port range", DynamicForwarderPolicy{Enabled: true, PortRanges: []string{"x"}}, false},
+		{"invalid name pattern", DynamicForwarderPolicy{Enabled: true, PortRanges: []string{"8081"}, NamePatterns: []string{"web-["}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewImprovedServer(zap.NewNop(), "secret", nil)
+			err := server.SetDynamicForwarderPolicy(tt.policy)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAnnounceService(t *testing.T) {
+	port := freePort(t)
+	ports := []string{strconv.Itoa(port)}
+
+	tests := []struct {
+		name    string
+		policy  DynamicForwarderPolicy
+		client  string
+		service ServiceAnnouncement
+		status  string
+	}{
+		{"allowed", DynamicForwarderPolicy{Enabled: true, PortRanges: ports}, "c1", ServiceAnnouncement{Name: "web", Port: port}, ServiceActive},
+		{"disabled", DynamicForwarderPolicy{PortRanges: ports}, "c1", ServiceAnnouncement{Name: "web", Port: port}, ServiceRejected},
+		{"no name", DynamicForwarderPolicy{Enabled: true, PortRanges: ports}, "c1", ServiceAnnouncement{Port: port}, ServiceRejected},
+		{"slash in name", DynamicForwarderPolicy{Enabled: true, PortRanges: ports}, "c1", ServiceAnnouncement{Name: "a/b", Port: port}, ServiceRejected},
+		{"client allowed", DynamicForwarderPolicy{Enabled: true, PortRanges: ports, Clients: []string{"c1"}}, "c1", ServiceAnnouncement{Name: "web", Port: port}, ServiceActive},
+		{"client not allowed", DynamicForwarderPolicy{Enabled: true, PortRanges: ports, Clients: []string{"c2"}}, "c1", ServiceAnnouncement{Name: "web", Port: port}, ServiceRejected},
+		{"name matches", DynamicForwarderPolicy{Enabled: true, PortRanges: ports, NamePatterns: []string{"web-*"}}, "c1", ServiceAnnouncement{Name: "web-1", Port: port}, ServiceActive},
+		{"name does not match", DynamicForwarderPolicy{Enabled: true, PortRanges: ports, NamePatterns: []string{"web-*"}}, "c1", ServiceAnnouncement{Name: "db", Port: port}, ServiceRejected},
+		{"port outside ranges", DynamicForwarderPolicy{Enabled: true, PortRanges: ports}, "c1", ServiceAnnouncement{Name: "web", Port: port + 1}, ServiceRejected},
+		{"approval required", DynamicForwarderPolicy{Enabled: true, PortRanges: ports, RequireApproval: true}, "c1", ServiceAnnouncement{Name: "web", Port: port}, ServicePending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewImprovedServer(zap.NewNop(), "secret", nil)
+			if err := server.SetDynamicForwarderPolicy(tt.policy); err != nil {
+				t.Fatal(err)
+			}
+			status := server.announceService(tt.client, tt.service)
+			defer server.StopTCPForwarder(tt.service.Port)
+			if status.Status != tt.status {
+				t.Fatalf("status %q (%s), want %q", status.Status, status.Reason, tt.status)
+			}
+
+			listening := false
+			if conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(tt.service.Port)); err == nil {
+				conn.Close()
+				listening = true
+			}
+			if listening != (tt.status == ServiceActive) {
+				t.Errorf("forwarder listening: %v", listening)
+			}
+			if _, exists := server.forwarderForPort(tt.service.Port); exists != (tt.status == ServiceActive) {
+				t.Errorf("forwarder configured: %v", exists)
+			}
+		})
+	}
+}
+
+func TestServiceApproval(t *testing.T) {
+	port := freePort(t)
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	if err := server.SetDynamicForwarderPolicy(DynamicForwarderPolicy{
+		Enabled:         true,
+		PortRanges:      []string{strconv.Itoa(port)},
+		RequireApproval: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	service := ServiceAnnouncement{Name: "web", Port: port}
+	if status := server.announceService("c1", service); status.Status != ServicePending {
+		t.Fatalf("announced service is %q", status.Status)
+	}
+	if status := server.announceService("c2", ServiceAnnouncement{Name: "web", Port: port}); status.Status != ServiceRejected {
+		t.Errorf("port claimed by another client is %q", status.Status)
+	}
+	if err := server.ApproveService("c1", "missing"); err == nil {
+		t.Error("approved an unknown service")
+	}
+	if err := server.ApproveService("c1", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if forwarders := server.DynamicForwarders(); len(forwarders) != 1 || forwarders[0].Status != ServiceActive {
+		t.Fatalf("forwarders after approval: %+v", forwarders)
+	}
+	if err := server.ApproveService("c1", "web"); err == nil {
+		t.Error("approved an active service again")
+	}
+
+	// Approval outlives the entry, so a reconnecting client is not queued again
+	server.withdrawService(server.servicesOf("c1")[0])
+	if status := server.announceService("c1", service); status.Status != ServiceActive {
+		t.Errorf("re-announced approved service is %q", status.Status)
+	}
+
+	if err := server.RejectService("c1", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if forwarders := server.DynamicForwarders(); len(forwarders) != 0 {
+		t.Errorf("forwarders after rejection: %+v", forwarders)
+	}
+	if _, exists := server.forwarderForPort(port); exists {
+		t.Error("rejected service still has a forwarder")
+	}
+	if status := server.announceService("c1", service); status.Status != ServicePending {
+		t.Errorf("announced service after revocation is %q", status.Status)
+	}
+	if err := server.RejectService("c1", "missing"); err == nil {
+		t.Error("rejected an unknown service")
+	}
+}
@@ -0,0 +1,462 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultEgressDialTimeout bounds resolving and dialing an egress destination
+const defaultEgressDialTimeout = 10 * time.Second
+
+// maxPendingEgressChunks bounds the data buffered while a destination is dialed
+const maxPendingEgressChunks = 256
+
+// EgressPolicy controls which external destinations clients may reach through
+// the server. Client-initiated connections are refused unless a rule allows them.
+type EgressPolicy struct {
+	Enabled     bool          `yaml:"enabled"`
+	Rules       []EgressRule  `yaml:"rules"`
+	DNS         EgressDNS     `yaml:"dns"`
+	DialTimeout time.Duration `yaml:"dial_timeout"` // Default 10s, includes resolution
+}
+
+// EgressRule allows a set of clients to reach a set of destinations
+type EgressRule struct {
+	Clients      []string        `yaml:"clients"`      // Client IDs or shell patterns; empty with no groups allows all
+	Groups       []string        `yaml:"groups"`       // Client groups
+	Destinations TargetAllowlist `yaml:"destinations"` // Same syntax as a client's allowed_targets
+}
+
+// EgressDNS controls how destination names are resolved on the server
+type EgressDNS struct {
+	Resolver        string   `yaml:"resolver"`         // DNS server address; the system resolver by default
+	DenyPrivate     bool     `yaml:"deny_private"`     // Refuse names resolving to private, loopback or link-local addresses
+	BlockedNetworks []string `yaml:"blocked_networks"` // Addresses never dialed, whatever the rules say
+}
+
+// Validate checks the policy and returns every problem found
+func (p EgressPolicy) Validate() error {
+	var errs []error
+	if p.Enabled && len(p.Rules) == 0 {
+		errs = append(errs, fmt.Errorf("egress: at least one rule is required"))
+	}
+	for i, rule := range p.Rules {
+		if len(rule.Destinations) == 0 {
+			errs = append(errs, fmt.Errorf("egress rule %d: destinations are required", i))
+		}
+		if err := rule.Destinations.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("egress rule %d: %w", i, err))
+		}
+		for _, pattern := range rule.Clients {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("egress rule %d: invalid client pattern %q: %w", i, pattern, err))
+			}
+		}
+	}
+	if _, err := parseNetworks(p.DNS.BlockedNetworks); err != nil {
+		errs = append(errs, fmt.Errorf("egress: %w", err))
+	}
+	if p.DialTimeout < 0 {
+		errs = append(errs, fmt.Errorf("egress: dial_timeout must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// matches reports whether a rule applies to a client
+func (r EgressRule) matches(client *ImprovedServerClient) bool {
+	if len(r.Clients) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	for _, pattern := range r.Clients {
+		if ok, _ := path.Match(pattern, client.ID); ok {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		if client.Group != "" && client.Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a list of CIDRs
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Egress routes client-initiated connections to external destinations
+type Egress struct {
+	policy   EgressPolicy
+	blocked  []*net.IPNet
+	resolver *net.Resolver
+	pending  map[string]*pendingEgress        // sessionID -> session being dialed
+	sessions map[string]*ImprovedServerClient // sessionID -> owning client connection
+	udp      map[string]*udpAssociation       // sessionID -> datagram session
+	mu       sync.Mutex
+}
+
+// pendingEgress holds data a client sent before its destination was dialed
+type pendingEgress struct {
+	client *ImprovedServerClient
+	chunks [][]byte
+	cancel context.CancelFunc
+}
+
+// NewEgress creates an egress router with egress disabled
+func NewEgress() *Egress {
+	return &Egress{
+		resolver: net.DefaultResolver,
+		pending:  make(map[string]*pendingEgress),
+		sessions: make(map[string]*ImprovedServerClient),
+		udp:      make(map[string]*udpAssociation),
+	}
+}
+
+// SetEgressPolicy sets the policy applied to client-initiated connections
+func (s *ImprovedServer) SetEgressPolicy(policy EgressPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	blocked, _ := parseNetworks(policy.DNS.BlockedNetworks)
+	if policy.DialTimeout == 0 {
+		policy.DialTimeout = defaultEgressDialTimeout
+	}
+
+	s.egress.mu.Lock()
+	defer s.egress.mu.Unlock()
+	s.egress.policy = policy
+	s.egress.blocked = blocked
+	s.egress.resolver = newSRVResolver(policy.DNS.Resolver)
+	return nil
+}
+
+// destinationsFor returns the destinations a client may reach
+func (e *Egress) destinationsFor(client *ImprovedServerClient) (TargetAllowlist, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.policy.Enabled {
+		return nil, false
+	}
+	var allowed TargetAllowlist
+	for _, rule := range e.policy.Rules {
+		if rule.matches(client) {
+			allowed = append(allowed, rule.Destinations...)
+		}
+	}
+	return allowed, true
+}
+
+// isPrivate reports whether an address is loopback, private, link-local or unspecified
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// resolve checks a target against the client's destinations and returns the
+// addresses that may be dialed. A name matching a host pattern may resolve to
+// any address that is not blocked; private addresses are only accepted when
+// deny_private is off or a CIDR destination allows them explicitly.
+func (e *Egress) resolve(ctx context.Context, allowed TargetAllowlist, target string) ([]string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	nameAllowed := allowed.Allows(target)
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if !nameAllowed {
+			return nil, &TunnelError{Code: ErrCodeNotAllowed, Message: fmt.Sprintf("destination %s not allowed", target)}
+		}
+		e.mu.Lock()
+		resolver := e.resolver
+		e.mu.Unlock()
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, &TunnelError{Code: ErrCodeHostUnreachable, Message: fmt.Sprintf("resolve %s: %v", host, err)}
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	e.mu.Lock()
+	blocked := e.blocked
+	denyPrivate := e.policy.DNS.DenyPrivate
+	e.mu.Unlock()
+
+	var addresses []string
+	var reason string
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), port)
+		explicit := allowed.Allows(address)
+		switch {
+		case !explicit && !nameAllowed:
+			reason = fmt.Sprintf("destination %s not allowed", target)
+		case containsIP(blocked, ip):
+			reason = fmt.Sprintf("destination %s resolves to blocked address %s", target, ip)
+		case denyPrivate && isPrivate(ip) && !explicitNetwork(allowed, address):
+			reason = fmt.Sprintf("destination %s resolves to private address %s", target, ip)
+		default:
+			addresses = append(addresses, address)
+		}
+	}
+	if len(addresses) == 0 {
+		if reason == "" {
+			return nil, &TunnelError{Code: ErrCodeHostUnreachable, Message: fmt.Sprintf("destination %s has no addresses", target)}
+		}
+		return nil, &TunnelError{Code: ErrCodeNotAllowed, Message: reason}
+	}
+	return addresses, nil
+}
+
+// containsIP reports whether an address is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// explicitNetwork reports whether an address is allowed by a CIDR or IP destination
+func explicitNetwork(allowed TargetAllowlist, address string) bool {
+	var explicit TargetAllowlist
+	for _, entry := range allowed {
+		host, _, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(host); err == nil || net.ParseIP(host) != nil {
+			explicit = append(explicit, entry)
+		}
+	}
+	return explicit.Allows(address)
+}
+
+// handleEgressConnect starts a client-initiated session to an external destination,
+// or a datagram session for Network "udp". Data the client sends while the
+// destination is dialed is buffered.
+func (s *ImprovedServer) handleEgressConnect(client *ImprovedServerClient, msg *ForwardMessage) {
+	fields := []zap.Field{
+		zap.String("sessionID", msg.SessionID),
+		zap.String("clientID", client.ID),
+		zap.String("target", msg.Target),
+	}
+
+	allowed, enabled := s.egress.destinationsFor(client)
+	if !enabled {
+		s.rejectEgress(client, msg.SessionID, &TunnelError{Code: ErrCodeUnavailable, Message: "egress is not enabled on this server"}, fields)
+		return
+	}
+	if msg.Network == "udp" {
+		s.openEgressAssociation(client, msg.SessionID, allowed, fields)
+		return
+	}
+	if err := validateTarget(msg.Target); err != nil {
+		s.rejectEgress(client, msg.SessionID, &TunnelError{Code: ErrCodeHostUnreachable, Message: err.Error()}, fields)
+		return
+	}
+	if _, exists := s.sessions.Get(msg.SessionID); exists {
+		s.rejectEgress(client, msg.SessionID, fmt.Errorf("session already exists"), fields)
+		return
+	}
+
+	s.egress.mu.Lock()
+	if _, exists := s.egress.pending[msg.SessionID]; exists {
+		s.egress.mu.Unlock()
+		s.rejectEgress(client, msg.SessionID, fmt.Errorf("session already exists"), fields)
+		return
+	}
+	ctx, cancel := context.WithTimeout(client.ctx, s.egress.policy.DialTimeout)
+	s.egress.pending[msg.SessionID] = &pendingEgress{client: client, cancel: cancel}
+	s.egress.mu.Unlock()
+
+	go s.dialEgress(ctx, cancel, client, msg.SessionID, msg.Target, allowed, fields)
+}
+
+// dialEgress resolves and dials a destination, then runs the session
+func (s *ImprovedServer) dialEgress(ctx context.Context, cancel context.CancelFunc, client *ImprovedServerClient,
+	sessionID, target string, allowed TargetAllowlist, fields []zap.Field) {
+	defer cancel()
+
+	addresses, err := s.egress.resolve(ctx, allowed, target)
+	if err != nil {
+		// A session dropped while it was dialed needs no answer
+		if s.egress.dropPending(sessionID) {
+			s.rejectEgress(client, sessionID, err, fields)
+		}
+		return
+	}
+
+	// Dial the resolved addresses so the policy check cannot be bypassed by
+	// the name resolving differently a second time
+	var conn net.Conn
+	var dialer net.Dialer
+	for _, address := range addresses {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if !s.egress.dropPending(sessionID) {
+			return
+		}
+		s.metrics.egressFailed.Add(1)
+		s.logger.Warn("Egress dial failed", append(fields, zap.Error(err))...)
+		s.sendForwardMessageToClient(client, ForwardMessage{
+			Type:      "error",
+			SessionID: sessionID,
+			Error:     fmt.Sprintf("dial %s: %v", target, err),
+			Code:      dialErrorCode(err),
+		})
+		return
+	}
+
+	// Register the session and replay the buffered data. A session cancelled
+	// while it was dialed has left the pending map.
+	s.egress.mu.Lock()
+	pending, exists := s.egress.pending[sessionID]
+	if !exists {
+		s.egress.mu.Unlock()
+		conn.Close()
+		return
+	}
+	session := s.sessions.Create(sessionID, client.ID, target, conn, s.logger)
+	for _, chunk := range pending.chunks {
+		session.Write(chunk)
+	}
+	delete(s.egress.pending, sessionID)
+	s.egress.sessions[sessionID] = client
+	s.egress.mu.Unlock()
+
+	s.metrics.egressSessions.Add(1)
+	s.logger.Info("Egress session established", append(fields, zap.String("address", conn.RemoteAddr().String()))...)
+	s.sendForwardMessageToClient(client, ForwardMessage{
+		Type:      "connected",
+		SessionID: sessionID,
+		Address:   conn.LocalAddr().String(),
+	})
+
+	session.established.Store(true)
+	go s.readFromTCPConnection(session, client)
+
+	<-session.ctx.Done()
+	s.sessions.Remove(sessionID)
+
+	s.egress.mu.Lock()
+	delete(s.egress.sessions, sessionID)
+	s.egress.mu.Unlock()
+}
+
+// rejectEgress refuses a client-initiated connection
+func (s *ImprovedServer) rejectEgress(client *ImprovedServerClient, sessionID string, err error, fields []zap.Field) {
+	s.metrics.egressDenied.Add(1)
+	s.logger.Warn("Egress connection refused", append(fields, zap.Error(err))...)
+	s.sendForwardMessageToClient(client, ForwardMessage{
+		Type:      "error",
+		SessionID: sessionID,
+		Error:     err.Error(),
+		Code:      errorCode(err),
+	})
+}
+
+// bufferData keeps data for a session that is still being dialed. It reports
+// false if the session is not pending.
+func (e *Egress) bufferData(sessionID string, data []byte) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pending, exists := e.pending[sessionID]
+	if !exists {
+		return false, nil
+	}
+	if len(pending.chunks) >= maxPendingEgressChunks {
+		return true, fmt.Errorf("too much data before destination connected")
+	}
+	pending.chunks = append(pending.chunks, data)
+	return true, nil
+}
+
+// dropPending cancels a session that is still being dialed
+func (e *Egress) dropPending(sessionID string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pending, exists := e.pending[sessionID]
+	if exists {
+		pending.cancel()
+		delete(e.pending, sessionID)
+	}
+	return exists
+}
+
+// closeEgressSessions ends the egress sessions of a client connection that went away
+func (s *ImprovedServer) closeEgressSessions(client *ImprovedServerClient) {
+	var sessionIDs []string
+	s.egress.mu.Lock()
+	for sessionID, pending := range s.egress.pending {
+		if pending.client == client {
+			pending.cancel()
+			delete(s.egress.pending, sessionID)
+		}
+	}
+	for sessionID, owner := range s.egress.sessions {
+		if owner == client {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	var associations []*udpAssociation
+	for _, association := range s.egress.udp {
+		if association.client == client {
+			associations = append(associations, association)
+		}
+	}
+	s.egress.mu.Unlock()
+
+	for _, association := range associations {
+		s.closeEgressAssociation(association.id)
+	}
+
+	for _, sessionID := range sessionIDs {
+		s.sessions.Remove(sessionID)
+	}
+	if len(sessionIDs) > 0 || len(associations) > 0 {
+		s.logger.Info("Closed egress sessions of disconnected client",
+			zap.String("clientID", client.ID),
+			zap.Int("sessions", len(sessionIDs)),
+			zap.Int("datagramSessions", len(associations)))
+	}
+}
+
+// EgressSessions returns the number of open egress and datagram sessions per client
+func (s *ImprovedServer) EgressSessions() map[string]int {
+	s.egress.mu.Lock()
+	defer s.egress.mu.Unlock()
+	counts := make(map[string]int)
+	for _, client := range s.egress.sessions {
+		counts[client.ID]++
+	}
+	for _, association := range s.egress.udp {
+		counts[association.client.ID]++
+	}
+	return counts
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestEgressPolicyValidate(t *testing.T) {
+	destinations := TargetAllowlist{"*.example.com:443"}
+
+	tests := []struct {
+		name   string
+		policy EgressPolicy
+		valid  bool
+	}{
+		{"disabled", EgressPolicy{}, true},
+		{"rule", EgressPolicy{Enabled: true, Rules: []EgressRule{{Clients: []string{"office-*"}, Destinations: destinations}}}, true},
+		{"blocked networks", EgressPolicy{Enabled: true, Rules: []EgressRule{{Destinations: destinations}}, DNS: EgressDNS{BlockedNetworks: []string{"169.254.0.0/16"}}}, true},
+		{"enabled without rules", EgressPolicy{Enabled: true}, false},
+		{"rule without destinations", EgressPolicy{Enabled: true, Rules: []EgressRule{{Clients: []string{"c1"}}}}, false},
+		{"invalid destination", EgressPolicy{Enabled: true, Rules: []EgressRule{{Destinations: TargetAllowlist{"example.com"}}}}, false},
+		{"invalid client pattern", EgressPolicy{Enabled: true, Rules: []EgressRule{{Clients: []string{"["}, Destinations: destinations}}}, false},
+		{"invalid blocked network", EgressPolicy{Enabled: true, Rules: []EgressRule{{Destinations: destinations}}, DNS: EgressDNS{BlockedNetworks: []string{"10.0.0.0"}}}, false},
+		{"negative dial timeout", EgressPolicy{Enabled: true, Rules: []EgressRule{{Destinations: destinations}}, DialTimeout: -1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEgressDestinations(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	client := &ImprovedServerClient{ID: "office-1", Group: "office"}
+	if _, enabled := server.egress.destinationsFor(client); enabled {
+		t.Error("egress enabled by default")
+	}
+
+	if err := server.SetEgressPolicy(EgressPolicy{Enabled: true, Rules: []EgressRule{
+		{Destinations: TargetAllowlist{"everyone.example.com:443"}},
+		{Clients: []string{"office-*"}, Destinations: TargetAllowlist{"office.example.com:443"}},
+		{Groups: []string{"office"}, Destinations: TargetAllowlist{"group.example.com:443"}},
+		{Clients: []string{"lab-*"}, Groups: []string{"lab"}, Destinations: TargetAllowlist{"lab.example.com:443"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		client *ImprovedServerClient
+		want   TargetAllowlist
+	}{
+		{client, TargetAllowlist{"everyone.example.com:443", "office.example.com:443", "group.example.com:443"}},
+		{&ImprovedServerClient{ID: "office-2"}, TargetAllowlist{"everyone.example.com:443", "office.example.com:443"}},
+		{&ImprovedServerClient{ID: "lab-1", Group: "office"}, TargetAllowlist{"everyone.example.com:443", "group.example.com:443", "lab.example.com:443"}},
+		{&ImprovedServerClient{ID: "other"}, TargetAllowlist{"everyone.example.com:443"}},
+	}
+
+	for _, tt := range tests {
+		allowed, enabled := server.egress.destinationsFor(tt.client)
+		if !enabled || !reflect.DeepEqual(allowed, tt.want) {
+			t.Errorf("destinations for %s (%s) = %v, want %v", tt.client.ID, tt.client.Group, allowed, tt.want)
+		}
+	}
+}
+
+func TestEgressResolve(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   TargetAllowlist
+		dns       EgressDNS
+		target    string
+		addresses []string // Nil if refused
+	}{
+		{"address allowed", TargetAllowlist{"93.184.216.0/24:443"}, EgressDNS{}, "93.184.216.34:443", []string{"93.184.216.34:443"}},
+		{"address not allowed", TargetAllowlist{"93.184.216.0/24:443"}, EgressDNS{}, "93.184.217.34:443", nil},
+		{"port not allowed", TargetAllowlist{"93.184.216.0/24:443"}, EgressDNS{}, "93.184.216.34:80", nil},
+		{"name not allowed", TargetAllowlist{"*.example.com:443"}, EgressDNS{}, "localhost:443", nil},
+		{"name allowed", TargetAllowlist{"localhost:443"}, EgressDNS{}, "localhost:443", []string{"127.0.0.1:443"}},
+		{"name resolving to a private address", TargetAllowlist{"localhost:443"}, EgressDNS{DenyPrivate: true}, "localhost:443", nil},
+		{"private address allowed explicitly", TargetAllowlist{"localhost:443", "127.0.0.0/8:443"}, EgressDNS{DenyPrivate: true}, "localhost:443", []string{"127.0.0.1:443"}},
+		{"blocked address", TargetAllowlist{"10.0.0.0/8:*"}, EgressDNS{BlockedNetworks: []string{"10.1.0.0/16"}}, "10.1.2.3:443", nil},
+		{"address next to a blocked network", TargetAllowlist{"10.0.0.0/8:*"}, EgressDNS{BlockedNetworks: []string{"10.1.0.0/16"}}, "10.2.2.3:443", []string{"10.2.2.3:443"}},
+		{"no port", TargetAllowlist{"*:*"}, EgressDNS{}, "localhost", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewImprovedServer(zap.NewNop(), "secret", nil)
+			if err := server.SetEgressPolicy(EgressPolicy{Enabled: true, Rules: []EgressRule{{Destinations: tt.allowed}}, DNS: tt.dns}); err != nil {
+				t.Fatal(err)
+			}
+			addresses, err := server.egress.resolve(context.Background(), tt.allowed, tt.target)
+			// localhost may also resolve to ::1
+			var ipv4 []string
+			for _, address := range addresses {
+				if host, _, _ := net.SplitHostPort(address); net.ParseIP(host).To4() != nil {
+					ipv4 = append(ipv4, address)
+				}
+			}
+			if tt.addresses == nil && err == nil {
+				t.Errorf("resolve allowed %v", addresses)
+			}
+			if tt.addresses != nil && (err != nil || !reflect.DeepEqual(ipv4, tt.addresses)) {
+				t.Errorf("resolve = %v, %v; want %v", addresses, err, tt.addresses)
+			}
+		})
+	}
+}
+
+func TestContainsIP(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		contains bool
+	}{
+		{"10.1.2.3", true},
+		{"11.1.2.3", false},
+		{"fd12::1", true},
+		{"fe80::1", false},
+		{"::ffff:10.1.2.3", true},
+	}
+
+	for _, tt := range tests {
+		if got := containsIP(networks, net.ParseIP(tt.ip)); got != tt.contains {
+			t.Errorf("containsIP(%s) = %v, want %v", tt.ip, got, tt.contains)
+		}
+	}
+	if _, err := parseNetworks([]string{"10.0.0.0/8", "10.0.0.1"}); err == nil {
+		t.Error("parsed an address without a prefix length")
+	}
+}
@@ -0,0 +1,190 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// udpIdleTimeout closes datagram sessions that have not seen traffic for a while
+const udpIdleTimeout = 5 * time.Minute
+
+// udpAssociation is a server UDP socket relaying datagrams for a client
+type udpAssociation struct {
+	id      string
+	client  *ImprovedServerClient
+	conn    *net.UDPConn
+	allowed TargetAllowlist
+	targets map[string]*net.UDPAddr // Destinations that passed the policy check
+	mu      sync.Mutex
+}
+
+// openEgressAssociation opens a UDP socket for a client's datagram session.
+// Every destination is checked against the egress policy like a TCP target.
+func (s *ImprovedServer) openEgressAssociation(client *ImprovedServerClient, sessionID string, allowed TargetAllowlist, fields []zap.Field) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		s.metrics.egressFailed.Add(1)
+		s.logger.Warn("Failed to open egress UDP socket", append(fields, zap.Error(err))...)
+		s.sendForwardMessageToClient(client, ForwardMessage{Type: "error", SessionID: sessionID, Error: err.Error()})
+		return
+	}
+
+	association := &udpAssociation{
+		id:      sessionID,
+		client:  client,
+		conn:    conn,
+		allowed: allowed,
+		targets: make(map[string]*net.UDPAddr),
+	}
+
+	s.egress.mu.Lock()
+	if _, exists := s.egress.udp[sessionID]; exists {
+		s.egress.mu.Unlock()
+		conn.Close()
+		s.rejectEgress(client, sessionID, &TunnelError{Message: "session already exists"}, fields)
+		return
+	}
+	s.egress.udp[sessionID] = association
+	s.egress.mu.Unlock()
+
+	s.metrics.egressSessions.Add(1)
+	s.logger.Info("Egress datagram session opened", append(fields, zap.String("address", conn.LocalAddr().String()))...)
+	s.sendForwardMessageToClient(client, ForwardMessage{
+		Type:      "connected",
+		SessionID: sessionID,
+		Network:   "udp",
+		Address:   conn.LocalAddr().String(),
+	})
+
+	go s.readEgressDatagrams(association)
+}
+
+// readEgressDatagrams forwards datagrams received by the socket to the client
+func (s *ImprovedServer) readEgressDatagrams(association *udpAssociation) {
+	defer func() {
+		if s.closeEgressAssociation(association.id) {
+			s.sendForwardMessageToClient(association.client, ForwardMessage{Type: "disconnect", SessionID: association.id})
+		}
+	}()
+
+	buffer := make([]byte, 64*1024)
+	for {
+		association.conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, source, err := association.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		// Only answers from destinations the client has sent to are relayed
+		association.mu.Lock()
+		_, known := association.targets[source.String()]
+		association.mu.Unlock()
+		if !known {
+			continue
+		}
+
+		s.metrics.bytesTransferred.Add(int64(n))
+		msg := ForwardMessage{
+			Type:      "datagram",
+			SessionID: association.id,
+			Target:    source.String(),
+			Data:      base64.StdEncoding.EncodeToString(buffer[:n]),
+		}
+		if err := s.sendForwardMessageToClient(association.client, msg); err != nil {
+			return
+		}
+	}
+}
+
+// handleEgressDatagram sends a client's datagram to its destination
+func (s *ImprovedServer) handleEgressDatagram(client *ImprovedServerClient, msg *ForwardMessage) {
+	s.egress.mu.Lock()
+	association, exists := s.egress.udp[msg.SessionID]
+	s.egress.mu.Unlock()
+	if !exists || association.client != client {
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		s.logger.Error("Failed to decode datagram", zap.Error(err))
+		return
+	}
+
+	association.mu.Lock()
+	destination, checked := association.targets[msg.Target]
+	association.mu.Unlock()
+	if checked {
+		s.writeEgressDatagram(association, destination, data)
+		return
+	}
+
+	// Resolving may take a while; keep the client's message loop going
+	go func() {
+		destination, err := s.egressDatagramTarget(association, msg.Target)
+		if err != nil {
+			s.metrics.egressDenied.Add(1)
+			s.logger.Debug("Egress datagram refused",
+				zap.String("sessionID", association.id),
+				zap.String("target", msg.Target),
+				zap.Error(err))
+			return
+		}
+		s.writeEgressDatagram(association, destination, data)
+	}()
+}
+
+// writeEgressDatagram sends a datagram from the session's socket
+func (s *ImprovedServer) writeEgressDatagram(association *udpAssociation, destination *net.UDPAddr, data []byte) {
+	s.metrics.bytesTransferred.Add(int64(len(data)))
+	if _, err := association.conn.WriteToUDP(data, destination); err != nil {
+		s.logger.Debug("Egress datagram write failed", zap.String("sessionID", association.id), zap.Error(err))
+	}
+}
+
+// egressDatagramTarget checks and resolves a datagram destination once per session
+func (s *ImprovedServer) egressDatagramTarget(association *udpAssociation, target string) (*net.UDPAddr, error) {
+	if err := validateTarget(target); err != nil {
+		return nil, err
+	}
+
+	s.egress.mu.Lock()
+	timeout := s.egress.policy.DialTimeout
+	s.egress.mu.Unlock()
+	ctx, cancel := context.WithTimeout(association.client.ctx, timeout)
+	defer cancel()
+
+	addresses, err := s.egress.resolve(ctx, association.allowed, target)
+	if err != nil {
+		return nil, err
+	}
+	destination, err := net.ResolveUDPAddr("udp", addresses[0])
+	if err != nil {
+		return nil, err
+	}
+
+	association.mu.Lock()
+	association.targets[target] = destination
+	association.targets[destination.String()] = destination
+	association.mu.Unlock()
+	return destination, nil
+}
+
+// closeEgressAssociation closes a datagram session and reports whether it was open
+func (s *ImprovedServer) closeEgressAssociation(sessionID string) bool {
+	s.egress.mu.Lock()
+	association, exists := s.egress.udp[sessionID]
+	delete(s.egress.udp, sessionID)
+	s.egress.mu.Unlock()
+
+	if exists {
+		association.conn.Close()
+		s.logger.Debug("Egress datagram session closed", zap.String("sessionID", sessionID))
+	}
+	return exists
+}
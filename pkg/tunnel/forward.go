@@ -19,6 +19,17 @@ type ForwardMessage struct {
 	Port      int    `json:"port"`
 	Data      string `json:"data,omitempty"` // base64 encoded
 	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`    // Error class, see TunnelError
+	Network   string `json:"network,omitempty"` // "udp" for datagram sessions, TCP otherwise
+	Address   string `json:"address,omitempty"` // Address bound by the server, in "connected"
+
+	// Addresses of the external connection to a forwarder, in "connect"
+	Source      string `json:"source,omitempty"`
+	Destination string `json:"destination,omitempty"`
+
+	// Idle timeout of the session, in "connect"; the client keeps a quiet
+	// service open as long as the server does
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
 }
 
 type Session struct {
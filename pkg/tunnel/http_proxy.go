@@ -0,0 +1,315 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hopHeaders are connection-specific headers a proxy must not forward (RFC 9110)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxy is an HTTP proxy that opens its connections through the tunnel.
+// It handles CONNECT requests and plain HTTP requests with absolute URIs.
+type HTTPProxy struct {
+	logger       *zap.Logger
+	tunnelClient *ImprovedClient
+	server       *http.Server
+	transport    *http.Transport
+	credentials  map[string]string // username -> password; nil disables authentication
+	allowed      TargetAllowlist   // Destinations the proxy may open; empty allows all
+}
+
+// NewHTTPProxy creates an HTTP proxy routed through a tunnel client
+func NewHTTPProxy(logger *zap.Logger, tunnelClient *ImprovedClient) *HTTPProxy {
+	p := &HTTPProxy{
+		logger:       logger,
+		tunnelClient: tunnelClient,
+	}
+	p.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return p.dial(ctx, address)
+		},
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return p
+}
+
+// SetCredentials requires Basic proxy authentication with the given accounts
+func (p *HTTPProxy) SetCredentials(credentials map[string]string) {
+	p.credentials = credentials
+}
+
+// SetAllowedDestinations restricts the destinations clients may reach.
+// Entries use the same syntax as allowed targets.
+func (p *HTTPProxy) SetAllowedDestinations(allowed []string) error {
+	if err := TargetAllowlist(allowed).Validate(); err != nil {
+		return err
+	}
+	p.allowed = allowed
+	return nil
+}
+
+// Listen starts the proxy on a host:port address
+func (p *HTTPProxy) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP proxy listener: %w", err)
+	}
+
+	p.server = &http.Server{
+		Handler:           p,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	p.logger.Info("HTTP proxy started",
+		zap.String("address", listener.Addr().String()),
+		zap.Bool("authentication", p.credentials != nil),
+		zap.Strings("allowedDestinations", p.allowed))
+
+	go func() {
+		if err := p.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			p.logger.Error("HTTP proxy stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Stop closes the listener and all proxied connections
+func (p *HTTPProxy) Stop() {
+	if p.server != nil {
+		p.server.Close()
+	}
+	p.transport.CloseIdleConnections()
+}
+
+// ServeHTTP handles a proxy request
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := &proxyAccess{start: time.Now(), request: r}
+
+	user, ok := p.authenticate(r)
+	entry.user = user
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="tunnel"`)
+		http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+		entry.status = http.StatusProxyAuthRequired
+		p.logAccess(entry)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r, entry)
+	} else {
+		p.handleForward(w, r, entry)
+	}
+	p.logAccess(entry)
+}
+
+// authenticate checks the Proxy-Authorization header and returns the user name
+func (p *HTTPProxy) authenticate(r *http.Request) (string, bool) {
+	if p.credentials == nil {
+		return "", true
+	}
+	encoded, found := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !found {
+		return "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	username, password, _ := strings.Cut(string(decoded), ":")
+	expected, exists := p.credentials[username]
+	if !exists || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+		return username, false
+	}
+	return username, true
+}
+
+// handleConnect opens a tunnel session and relays the hijacked connection
+func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request, entry *proxyAccess) {
+	target := r.Host
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "443")
+	}
+	entry.target = target
+
+	ctx, cancel := context.WithTimeout(r.Context(), socksConnectTimeout)
+	tunnelConn, err := p.dial(ctx, target)
+	cancel()
+	if err != nil {
+		entry.status = proxyErrorStatus(err)
+		entry.err = err
+		http.Error(w, err.Error(), entry.status)
+		return
+	}
+	defer tunnelConn.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		entry.status = http.StatusInternalServerError
+		http.Error(w, "Hijacking not supported", entry.status)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		entry.status = http.StatusInternalServerError
+		entry.err = err
+		return
+	}
+	defer conn.Close()
+
+	entry.status = http.StatusOK
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		entry.err = err
+		return
+	}
+
+	// Bytes the client sent right after the request may already be buffered
+	var sent atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, _ := io.Copy(tunnelConn, io.MultiReader(io.LimitReader(buffered, int64(buffered.Reader.Buffered())), conn))
+		sent.Store(n)
+		tunnelConn.Close()
+	}()
+	received, _ := io.Copy(conn, tunnelConn)
+	conn.Close()
+	<-done
+
+	entry.bytesIn = sent.Load()
+	entry.bytesOut = received
+}
+
+// handleForward proxies a plain HTTP request with an absolute URI
+func (p *HTTPProxy) handleForward(w http.ResponseWriter, r *http.Request, entry *proxyAccess) {
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		entry.status = http.StatusBadRequest
+		http.Error(w, "Absolute URI required", entry.status)
+		return
+	}
+	entry.target = r.URL.Host
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	if r.ContentLength == 0 {
+		out.Body = nil
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		entry.status = proxyErrorStatus(err)
+		entry.err = err
+		http.Error(w, err.Error(), entry.status)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	entry.status = resp.StatusCode
+	entry.bytesOut, _ = io.Copy(w, resp.Body)
+	entry.bytesIn = r.ContentLength
+}
+
+// dial checks the destination and opens a tunnel session to it
+func (p *HTTPProxy) dial(ctx context.Context, target string) (net.Conn, error) {
+	if len(p.allowed) > 0 && !p.allowed.Allows(target) {
+		return nil, &TunnelError{Code: ErrCodeNotAllowed, Message: fmt.Sprintf("destination %s not allowed by proxy", target)}
+	}
+	conn, err := p.tunnelClient.DialTunnel(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// removeHopHeaders drops connection-specific headers and those named in Connection
+func removeHopHeaders(header http.Header) {
+	for _, field := range strings.Split(header.Get("Connection"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			header.Del(field)
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// proxyErrorStatus maps a tunnel error to an HTTP status code
+func proxyErrorStatus(err error) int {
+	switch errorCode(err) {
+	case ErrCodeNotAllowed:
+		return http.StatusForbidden
+	case ErrCodeTimeout:
+		return http.StatusGatewayTimeout
+	case ErrCodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// proxyAccess collects the fields of an access log entry
+type proxyAccess struct {
+	start    time.Time
+	request  *http.Request
+	user     string
+	target   string
+	status   int
+	bytesIn  int64
+	bytesOut int64
+	err      error
+}
+
+// logAccess writes an access log entry for a finished request
+func (p *HTTPProxy) logAccess(entry *proxyAccess) {
+	fields := []zap.Field{
+		zap.String("remote", entry.request.RemoteAddr),
+		zap.String("method", entry.request.Method),
+		zap.String("target", entry.target),
+		zap.Int("status", entry.status),
+		zap.Int64("bytesIn", entry.bytesIn),
+		zap.Int64("bytesOut", entry.bytesOut),
+		zap.Duration("duration", time.Since(entry.start)),
+	}
+	if entry.request.Method != http.MethodConnect {
+		fields = append(fields, zap.String("url", entry.request.URL.String()))
+	}
+	if entry.user != "" {
+		fields = append(fields, zap.String("user", entry.user))
+	}
+	if entry.err != nil {
+		fields = append(fields, zap.Error(entry.err))
+	}
+	p.logger.Info("HTTP proxy access", fields...)
+}
@@ -0,0 +1,237 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLoadProxyCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		credentials map[string]string
+	}{
+		{"accounts", "# proxy users\nalice:secret\n\n  bob:pa:ss  \n", map[string]string{"alice": "secret", "bob": "pa:ss"}},
+		{"empty password", "alice:\n", map[string]string{"alice": ""}},
+		{"no separator", "alice\n", nil},
+		{"no username", ":secret\n", nil},
+		{"only comments", "# nobody\n", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "credentials")
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			credentials, err := LoadProxyCredentials(path)
+			if tt.credentials == nil {
+				if err == nil {
+					t.Errorf("loaded %v", credentials)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(credentials, tt.credentials) {
+				t.Errorf("LoadProxyCredentials = %v, %v; want %v", credentials, err, tt.credentials)
+			}
+		})
+	}
+
+	if _, err := LoadProxyCredentials(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestHTTPProxyAuthenticate(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	tests := []struct {
+		name        string
+		credentials map[string]string
+		header      string
+		user        string
+		ok          bool
+	}{
+		{"no authentication", nil, "", "", true},
+		{"valid", map[string]string{"alice": "secret"}, basic("alice:secret"), "alice", true},
+		{"wrong password", map[string]string{"alice": "secret"}, basic("alice:wrong"), "alice", false},
+		{"unknown user", map[string]string{"alice": "secret"}, basic("bob:secret"), "bob", false},
+		{"missing", map[string]string{"alice": "secret"}, "", "", false},
+		{"not basic", map[string]string{"alice": "secret"}, "Bearer secret", "", false},
+		{"invalid encoding", map[string]string{"alice": "secret"}, "Basic !!!", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := NewHTTPProxy(zap.NewNop(), nil)
+			proxy.SetCredentials(tt.credentials)
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.header != "" {
+				req.Header.Set("Proxy-Authorization", tt.header)
+			}
+			user, ok := proxy.authenticate(req)
+			if user != tt.user || ok != tt.ok {
+				t.Errorf("authenticate = %q, %v; want %q, %v", user, ok, tt.user, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":          {"keep-alive, X-Hop"},
+		"X-Hop":               {"1"},
+		"Proxy-Authorization": {"Basic x"},
+		"Transfer-Encoding":   {"chunked"},
+		"Content-Type":        {"text/plain"},
+	}
+	removeHopHeaders(header)
+	want := http.Header{"Content-Type": {"text/plain"}}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("headers = %v, want %v", header, want)
+	}
+}
+
+func TestProxyErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{&TunnelError{Code: ErrCodeNotAllowed}, http.StatusForbidden},
+		{&TunnelError{Code: ErrCodeTimeout}, http.StatusGatewayTimeout},
+		{&TunnelError{Code: ErrCodeUnavailable}, http.StatusServiceUnavailable},
+		{&TunnelError{Code: ErrCodeConnectionRefused}, http.StatusBadGateway},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{io.EOF, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		if got := proxyErrorStatus(tt.err); got != tt.status {
+			t.Errorf("proxyErrorStatus(%v) = %d, want %d", tt.err, got, tt.status)
+		}
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Error("proxy credentials forwarded to the service")
+		}
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+	defer service.Close()
+	serviceAddr := service.Listener.Addr().String()
+
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	if err := server.SetEgressPolicy(EgressPolicy{Enabled: true, Rules: []EgressRule{
+		{Destinations: TargetAllowlist{"127.0.0.1:*"}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	client := startTestClient(t, server, web.URL, "c1", map[int]string{})
+	for deadline := time.Now().Add(5 * time.Second); !client.isConnected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not connect")
+		}
+	}
+
+	proxy := NewHTTPProxy(zap.NewNop(), client)
+	proxy.SetCredentials(map[string]string{"alice": "secret"})
+	if err := proxy.SetAllowedDestinations([]string{echoAddr, serviceAddr}); err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := "127.0.0.1:" + strconv.Itoa(freePort(t))
+	if err := proxy.Listen(proxyAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Stop()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+
+	t.Run("forward", func(t *testing.T) {
+		proxyURL, _ := url.Parse("http://alice:secret@" + proxyAddr)
+		httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := httpClient.Get(service.URL + "/path")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || string(body) != "GET /path" {
+			t.Errorf("response %d %q", resp.StatusCode, body)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		auth   string
+		status int
+	}{
+		{"connect", echoAddr, auth, http.StatusOK},
+		{"not authenticated", echoAddr, "", http.StatusProxyAuthRequired},
+		{"destination not allowed", "127.0.0.1:1", auth, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			request := "CONNECT " + tt.target + " HTTP/1.1\r\nHost: " + tt.target + "\r\n"
+			if tt.auth != "" {
+				request += "Proxy-Authorization: " + tt.auth + "\r\n"
+			}
+			fmt.Fprint(conn, request+"\r\n")
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("no Proxy-Authenticate challenge")
+			}
+			if tt.status == http.StatusOK {
+				echo(t, &bufferedConn{Conn: conn, reader: reader}, "through the proxy")
+			}
+		})
+	}
+}
+
+// bufferedConn reads through a reader that may hold bytes already read from Conn
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
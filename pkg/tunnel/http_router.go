@@ -0,0 +1,283 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Forwarder types
+const (
+	ForwarderTCP  = "tcp"
+	ForwarderHTTP = "http"
+	ForwarderTLS  = "tls"
+)
+
+// defaultRouteTimeout bounds the wait for response headers when a route sets no timeout
+const defaultRouteTimeout = 60 * time.Second
+
+// HTTPRoute sends requests matching a host and path prefix to a client mapping.
+// TLS forwarders use the same routes, matching the SNI hostname only.
+type HTTPRoute struct {
+	Host        string        `yaml:"host"`        // Host header; "*.example.com" matches subdomains, empty matches any
+	PathPrefix  string        `yaml:"path_prefix"` // e.g. "/api/"; empty matches every path
+	ClientID    string        `yaml:"client_id"`
+	ClientIDs   []string      `yaml:"client_ids"`
+	ClientGroup string        `yaml:"client_group"`
+	Balance     string        `yaml:"balance"`
+	Port        int           `yaml:"port"`    // Client mapping port the route connects to
+	Timeout     time.Duration `yaml:"timeout"` // How long the service may take to send response headers
+}
+
+// Validate checks a route of an HTTP forwarder
+func (r HTTPRoute) Validate() error {
+	if r.ClientID == "" && len(r.ClientIDs) == 0 && r.ClientGroup == "" {
+		return fmt.Errorf("route %s: no client_id, client_ids or client_group", r)
+	}
+	if r.Port < 1 || r.Port > 65535 {
+		return fmt.Errorf("route %s: port %d is out of valid range (1-65535)", r, r.Port)
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(r.PathPrefix, "/") {
+		return fmt.Errorf("route %s: path_prefix must start with /", r)
+	}
+	if strings.Contains(strings.TrimPrefix(r.Host, "*."), "*") {
+		return fmt.Errorf("route %s: only a leading *. wildcard is supported", r)
+	}
+	switch r.Balance {
+	case "", BalanceRoundRobin, BalanceLeastSessions, BalancePriority:
+	default:
+		return fmt.Errorf("route %s: unknown balance policy %q", r, r.Balance)
+	}
+	if r.Timeout < 0 {
+		return fmt.Errorf("route %s: timeout must not be negative", r)
+	}
+	return nil
+}
+
+// String returns the host and path prefix of the route
+func (r HTTPRoute) String() string {
+	host := r.Host
+	if host == "" {
+		host = "*"
+	}
+	return host + r.PathPrefix
+}
+
+// matches scores how well a request matches the route; 0 means no match.
+// Exact hosts beat wildcards and longer path prefixes beat shorter ones.
+func (r HTTPRoute) matches(host, path string) int {
+	if !strings.HasPrefix(path, r.PathPrefix) {
+		return 0
+	}
+	score := 1 + len(r.PathPrefix)
+	switch {
+	case r.Host == "":
+	case strings.HasPrefix(r.Host, "*."):
+		if !strings.HasSuffix(host, strings.ToLower(r.Host[1:])) {
+			return 0
+		}
+		score += 1 << 16
+	case strings.EqualFold(r.Host, host):
+		score += 2 << 16
+	default:
+		return 0
+	}
+	return score
+}
+
+// httpRoute is a route with the forwarder its sessions are opened for
+type httpRoute struct {
+	HTTPRoute
+	upstream ForwarderConfig
+	proxy    *httputil.ReverseProxy
+}
+
+// routeForwarder returns the forwarder sessions of a route are opened for;
+// routes reuse the client selection of TCP forwarders
+func routeForwarder(fw ForwarderConfig, r HTTPRoute) ForwarderConfig {
+	return ForwarderConfig{
+		Name:             fw.Name + "/" + r.String(),
+		Type:             fw.Type,
+		Port:             r.Port,
+		ClientID:         r.ClientID,
+		ClientIDs:        r.ClientIDs,
+		ClientGroup:      r.ClientGroup,
+		Balance:          r.Balance,
+		Enabled:          true,
+		ReconnectWait:    fw.ReconnectWait,
+		ReconnectQueue:   fw.ReconnectQueue,
+		Bandwidth:        fw.Bandwidth,
+		MaxSessions:      fw.MaxSessions,
+		MaxSessionsPerIP: fw.MaxSessionsPerIP,
+		IdleTimeout:      fw.IdleTimeout,
+		MaxDuration:      fw.MaxDuration,
+		ConnectTimeout:   fw.ConnectTimeout,
+		owner:            fw.Name,
+	}
+}
+
+// httpRouter dispatches the requests of an HTTP forwarder to its routes
+type httpRouter struct {
+	server    *ImprovedServer
+	forwarder ForwarderConfig
+	routes    []*httpRoute
+}
+
+// newHTTPRouter builds the reverse proxies of an HTTP forwarder's routes
+func (s *ImprovedServer) newHTTPRouter(fw ForwarderConfig) *httpRouter {
+	router := &httpRouter{server: s, forwarder: fw}
+	for _, r := range fw.Routes {
+		route := &httpRoute{HTTPRoute: r, upstream: routeForwarder(fw, r)}
+
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = defaultRouteTimeout
+		}
+		upstream := route.upstream
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				peer, _ := ctx.Value(routePeerKey{}).(routePeer)
+				return s.dialForwarder(upstream, peer.remote, peer.local), nil
+			},
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+		}
+
+		route.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				// The service sees the original Host. The dial ignores the URL
+				// host, which keeps the pooled sessions of each external client
+				// apart so they carry its address.
+				host := pr.In.Host
+				if peer, ok := requestPeer(pr.In); ok {
+					host = peer.remote.String()
+					pr.Out = pr.Out.WithContext(context.WithValue(pr.Out.Context(), routePeerKey{}, peer))
+				}
+				pr.SetURL(&url.URL{Scheme: "http", Host: host})
+				pr.Out.Host = pr.In.Host
+				pr.SetXForwarded()
+			},
+			Transport: transport,
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				s.logger.Warn("HTTP route failed",
+					zap.String("forwarder", fw.Name),
+					zap.String("route", route.String()),
+					zap.String("host", req.Host),
+					zap.String("path", req.URL.Path),
+					zap.Error(err))
+				if entry, ok := req.Context().Value(captureKey{}).(*CapturedRequest); ok {
+					entry.Error = err.Error()
+				}
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}
+		router.routes = append(router.routes, route)
+	}
+	return router
+}
+
+// ServeHTTP proxies a request through the best matching route
+func (r *httpRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var best *httpRoute
+	bestScore := 0
+	for _, route := range r.routes {
+		if score := route.matches(host, req.URL.Path); score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	if r.forwarder.Inspect && r.server.inspector != nil {
+		r.server.inspector.capture(w, req, r, best)
+		return
+	}
+	if best == nil {
+		r.notFound(w, req)
+		return
+	}
+	best.proxy.ServeHTTP(w, req)
+}
+
+// notFound answers a request no route matches
+func (r *httpRouter) notFound(w http.ResponseWriter, req *http.Request) {
+	r.server.logger.Debug("No HTTP route for request",
+		zap.String("forwarder", r.forwarder.Name),
+		zap.String("host", req.Host),
+		zap.String("path", req.URL.Path))
+	http.Error(w, "no route for "+req.Host+req.URL.Path, http.StatusNotFound)
+}
+
+// serveHTTPForwarder serves an HTTP forwarder on its listener until it is closed
+func (s *ImprovedServer) serveHTTPForwarder(listener net.Listener, fw ForwarderConfig) {
+	router := s.newHTTPRouter(fw)
+	if fw.Inspect && s.inspector != nil {
+		s.inspector.register(router)
+	}
+	server := &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: 30 * time.Second,
+		ErrorLog:          zap.NewStdLog(s.logger),
+	}
+
+	s.logger.Info("HTTP forwarder started",
+		zap.Int("port", fw.Port),
+		zap.String("forwarder", fw.Name),
+		zap.Int("routes", len(fw.Routes)))
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		s.logger.Error("HTTP forwarder failed", zap.Int("port", fw.Port), zap.Error(err))
+		return
+	}
+	s.logger.Info("HTTP forwarder stopped", zap.Int("port", fw.Port))
+}
+
+// routePeerKey is the context key of the routePeer a request came from
+type routePeerKey struct{}
+
+// routePeer holds the addresses of the external connection a request came in
+// on, which the routed session reports as its own
+type routePeer struct {
+	remote net.Addr
+	local  net.Addr
+}
+
+// requestPeer returns the addresses of the connection a request came in on;
+// replayed requests have none
+func requestPeer(req *http.Request) (routePeer, bool) {
+	remote, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return routePeer{}, false
+	}
+	peer := routePeer{remote: net.TCPAddrFromAddrPort(remote)}
+	peer.local, _ = req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return peer, true
+}
+
+// dialForwarder opens a session to a forwarder's client and returns the local
+// end of it. The session reports remote and local as its addresses when
+// remote is set. A session that cannot be established closes the connection.
+func (s *ImprovedServer) dialForwarder(fw ForwarderConfig, remote, local net.Addr) net.Conn {
+	serverEnd, proxyEnd := net.Pipe()
+	var conn net.Conn = serverEnd
+	if remote != nil {
+		if local == nil {
+			local = serverEnd.LocalAddr()
+		}
+		conn = &addrConn{Conn: serverEnd, remote: remote, local: local}
+	}
+	go s.handleTCPConnection(conn, fw, true)
+	return proxyEnd
+}
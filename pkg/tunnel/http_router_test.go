@@ -0,0 +1,144 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestHTTPRouteValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		route HTTPRoute
+		valid bool
+	}{
+		{"client", HTTPRoute{Host: "app.example.com", ClientID: "c1", Port: 8080}, true},
+		{"group and prefix", HTTPRoute{Host: "*.example.com", PathPrefix: "/api/", ClientGroup: "web", Port: 8080, Balance: BalanceLeastSessions}, true},
+		{"any host", HTTPRoute{ClientIDs: []string{"c1", "c2"}, Port: 8080}, true},
+		{"no client", HTTPRoute{Host: "app.example.com", Port: 8080}, false},
+		{"no port", HTTPRoute{Host: "app.example.com", ClientID: "c1"}, false},
+		{"relative prefix", HTTPRoute{PathPrefix: "api/", ClientID: "c1", Port: 8080}, false},
+		{"inner wildcard", HTTPRoute{Host: "app.*.example.com", ClientID: "c1", Port: 8080}, false},
+		{"unknown balance", HTTPRoute{ClientID: "c1", Port: 8080, Balance: "random"}, false},
+		{"negative timeout", HTTPRoute{ClientID: "c1", Port: 8080, Timeout: -1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.route.Validate()
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestHTTPRouteMatches(t *testing.T) {
+	exact := HTTPRoute{Host: "app.example.com"}
+	wildcard := HTTPRoute{Host: "*.example.com"}
+	api := HTTPRoute{Host: "app.example.com", PathPrefix: "/api/"}
+	anyHost := HTTPRoute{}
+
+	tests := []struct {
+		host, path string
+		route      HTTPRoute
+		match      bool
+	}{
+		{"app.example.com", "/", exact, true},
+		{"other.example.com", "/", exact, false},
+		{"app.example.com", "/", HTTPRoute{Host: "App.Example.com"}, true},
+		{"app.example.com", "/", wildcard, true},
+		{"example.com", "/", wildcard, false},
+		{"app.example.org", "/", wildcard, false},
+		{"app.example.com", "/api/users", api, true},
+		{"app.example.com", "/apidocs", api, false},
+		{"anything", "/", anyHost, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.route.matches(tt.host, tt.path) > 0; got != tt.match {
+			t.Errorf("%s matches %s%s = %v, want %v", tt.route, tt.host, tt.path, got, tt.match)
+		}
+	}
+
+	// Exact hosts beat wildcards and longer prefixes beat shorter ones
+	ranked := []HTTPRoute{api, exact, wildcard, anyHost}
+	for i := 1; i < len(ranked); i++ {
+		better, worse := ranked[i-1].matches("app.example.com", "/api/x"), ranked[i].matches("app.example.com", "/api/x")
+		if better <= worse {
+			t.Errorf("%s scores %d, not above %s with %d", ranked[i-1], better, ranked[i], worse)
+		}
+	}
+}
+
+func TestHTTPRouter(t *testing.T) {
+	service := func(name string) string {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s %s", name, r.Host, r.URL.Path)
+		}))
+		t.Cleanup(s.Close)
+		return s.Listener.Addr().String()
+	}
+	port, appPort, apiPort := freePort(t), freePort(t), freePort(t)
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:    "web",
+		Type:    ForwarderHTTP,
+		Port:    port,
+		Enabled: true,
+		Routes: []HTTPRoute{
+			{Host: "*.example.com", ClientID: "c1", Port: appPort},
+			{Host: "app.example.com", PathPrefix: "/api/", ClientID: "c1", Port: apiPort},
+		},
+	}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	startTestClient(t, server, web.URL, "c1", map[int]string{appPort: service("app"), apiPort: service("api")})
+	if err := server.StartTCPForwarder(port, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	tests := []struct {
+		host, path string
+		status     int
+		body       string
+	}{
+		{"app.example.com", "/", http.StatusOK, "app app.example.com /"},
+		{"app.example.com", "/api/users", http.StatusOK, "api app.example.com /api/users"},
+		{"www.example.com:" + strconv.Itoa(port), "/api/users", http.StatusOK, "app www.example.com:" + strconv.Itoa(port) + " /api/users"},
+		{"example.org", "/", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:"+strconv.Itoa(port)+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = tt.host
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,518 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Inspector defaults
+const (
+	defaultInspectorCapacity = 200
+	defaultInspectorMaxBody  = 64 * 1024
+)
+
+// redactedValue replaces credential header values in captured requests
+const redactedValue = "[redacted]"
+
+// credentialHeaders are redacted from captured requests and responses unless
+// show_credentials is set
+var credentialHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Auth-Token",
+}
+
+// InspectorConfig configures request capture for HTTP forwarders with inspect set
+type InspectorConfig struct {
+	Listen   string `yaml:"listen"`   // Address of the web UI and JSON API, e.g. "127.0.0.1:4040"; empty disables capture
+	Capacity int    `yaml:"capacity"` // Requests kept, oldest dropped first (default 200)
+	MaxBody  int    `yaml:"max_body"` // Bytes of each request and response body kept (default 64KiB)
+
+	AllowedHosts    []string `yaml:"allowed_hosts"`    // Host names the UI may be reached by besides localhost and IP addresses
+	ShowCredentials bool     `yaml:"show_credentials"` // Keep Authorization, Cookie and similar headers in captures
+}
+
+// CapturedRequest is a request seen by an HTTP forwarder and its response
+type CapturedRequest struct {
+	ID        int64     `json:"id"`
+	ReplayOf  int64     `json:"replayOf,omitempty"` // ID of the captured request this one replays
+	Forwarder string    `json:"forwarder"`
+	Route     string    `json:"route,omitempty"`
+	Time      time.Time `json:"time"`
+	Duration  string    `json:"duration"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Status    int       `json:"status"`
+	Error     string    `json:"error,omitempty"`
+
+	RequestHeaders        http.Header `json:"requestHeaders"`
+	RequestBody           []byte      `json:"requestBody,omitempty"`
+	RequestBodyTruncated  bool        `json:"requestBodyTruncated,omitempty"`
+	ResponseHeaders       http.Header `json:"responseHeaders,omitempty"`
+	ResponseBody          []byte      `json:"responseBody,omitempty"`
+	ResponseBodyTruncated bool        `json:"responseBodyTruncated,omitempty"`
+
+	replayHeaders http.Header // Request headers before redaction; never served
+}
+
+// Inspector keeps recent requests of inspected HTTP forwarders in a ring
+// buffer and serves them with a web UI and JSON API
+type Inspector struct {
+	server   *ImprovedServer
+	logger   *zap.Logger
+	capacity int
+	maxBody  int
+	hosts    map[string]bool // Allowed host names besides localhost and IP addresses
+	redact   bool
+
+	mu      sync.RWMutex
+	entries []*CapturedRequest // Ring buffer, oldest at head once full
+	head    int
+	nextID  int64
+	routers map[string]*httpRouter // forwarder name -> router, for replay
+}
+
+// NewInspector creates the inspector of a server; HTTP forwarders with
+// inspect set record their requests into it
+func NewInspector(server *ImprovedServer, config InspectorConfig, logger *zap.Logger) *Inspector {
+	if config.Capacity <= 0 {
+		config.Capacity = defaultInspectorCapacity
+	}
+	if config.MaxBody <= 0 {
+		config.MaxBody = defaultInspectorMaxBody
+	}
+	inspector := &Inspector{
+		server:   server,
+		logger:   logger,
+		capacity: config.Capacity,
+		maxBody:  config.MaxBody,
+		hosts:    make(map[string]bool),
+		redact:   !config.ShowCredentials,
+		routers:  make(map[string]*httpRouter),
+	}
+	for _, host := range config.AllowedHosts {
+		inspector.hosts[strings.ToLower(host)] = true
+	}
+	server.inspector = inspector
+	return inspector
+}
+
+// register makes a router's forwarder available for replay
+func (i *Inspector) register(router *httpRouter) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.routers[router.forwarder.Name] = router
+}
+
+// add stores a captured request, dropping the oldest when full
+func (i *Inspector) add(entry *CapturedRequest) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.nextID++
+	entry.ID = i.nextID
+	if len(i.entries) < i.capacity {
+		i.entries = append(i.entries, entry)
+		return
+	}
+	i.entries[i.head] = entry
+	i.head = (i.head + 1) % i.capacity
+}
+
+// List returns the captured requests, newest first
+func (i *Inspector) List() []*CapturedRequest {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	result := make([]*CapturedRequest, 0, len(i.entries))
+	for n := len(i.entries) - 1; n >= 0; n-- {
+		result = append(result, i.entries[(i.head+n)%len(i.entries)])
+	}
+	return result
+}
+
+// Get returns a captured request by ID
+func (i *Inspector) Get(id int64) (*CapturedRequest, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	for _, entry := range i.entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// capture serves a request through a route and records it
+func (i *Inspector) capture(w http.ResponseWriter, req *http.Request, router *httpRouter, route *httpRoute) {
+	start := time.Now()
+	entry := &CapturedRequest{
+		Forwarder:      router.forwarder.Name,
+		Time:           start,
+		Remote:         req.RemoteAddr,
+		Method:         req.Method,
+		Host:           req.Host,
+		URI:            req.URL.RequestURI(),
+		RequestHeaders: req.Header.Clone(),
+	}
+	if replayOf, ok := req.Context().Value(replayKey{}).(int64); ok {
+		entry.ReplayOf = replayOf
+	}
+
+	requestBody := &boundedBuffer{limit: i.maxBody}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(req.Body, requestBody), req.Body}
+	}
+	recorder := &captureWriter{ResponseWriter: w, body: &boundedBuffer{limit: i.maxBody}}
+
+	if route == nil {
+		router.notFound(recorder, req)
+	} else {
+		entry.Route = route.String()
+		route.proxy.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), captureKey{}, entry)))
+	}
+
+	entry.Duration = time.Since(start).Round(time.Microsecond).String()
+	entry.RequestBody, entry.RequestBodyTruncated = requestBody.Bytes(), requestBody.truncated
+	entry.Status = recorder.status
+	if entry.Status == 0 {
+		entry.Status = http.StatusOK
+	}
+	entry.ResponseHeaders = recorder.Header().Clone()
+	entry.ResponseBody, entry.ResponseBodyTruncated = recorder.body.Bytes(), recorder.body.truncated
+	entry.replayHeaders = entry.RequestHeaders
+	if i.redact {
+		entry.RequestHeaders = redactHeaders(entry.RequestHeaders)
+		entry.ResponseHeaders = redactHeaders(entry.ResponseHeaders)
+	}
+	i.add(entry)
+}
+
+// redactHeaders returns a copy of header with credential values replaced
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range credentialHeaders {
+		for n := range redacted[name] {
+			redacted[name][n] = redactedValue
+		}
+	}
+	return redacted
+}
+
+// Replay sends a captured request through its forwarder again and returns
+// the new capture
+func (i *Inspector) Replay(id int64) (*CapturedRequest, error) {
+	original, exists := i.Get(id)
+	if !exists {
+		return nil, fmt.Errorf("request %d not found", id)
+	}
+	if original.RequestBodyTruncated {
+		return nil, fmt.Errorf("request %d body was truncated and cannot be replayed", id)
+	}
+	i.mu.RLock()
+	router, exists := i.routers[original.Forwarder]
+	i.mu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("forwarder %s is not running", original.Forwarder)
+	}
+
+	ctx := context.WithValue(i.server.ctx, replayKey{}, id)
+	req, err := http.NewRequestWithContext(ctx, original.Method, "http://"+original.Host+original.URI, bytes.NewReader(original.RequestBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = original.replayHeaders.Clone()
+	req.Host = original.Host
+	req.RemoteAddr = "replay"
+	req.RequestURI = original.URI
+
+	writer := &discardWriter{header: make(http.Header)}
+	router.ServeHTTP(writer, req)
+
+	// The replay is the newest entry that refers to the original
+	for _, entry := range i.List() {
+		if entry.ReplayOf == id {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("replay of request %d was not captured", id)
+}
+
+// Handler serves the web UI at / and the JSON API under /api/requests. The
+// API requires token as a bearer token; the UI asks for it. Requests for
+// foreign hosts or from foreign origins are refused.
+func (i *Inspector) Handler(token string) http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("/api/requests", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"requests": i.List()})
+		case http.MethodDelete:
+			i.clear()
+			writeJSON(w, http.StatusOK, map[string]string{"status": "cleared"})
+		default:
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		}
+	})
+	api.HandleFunc("/api/requests/", i.handleRequest)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, inspectorPage)
+	})
+	mux.Handle("/api/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		api.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !i.sameOrigin(r) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether a request is for a host the inspector serves
+// and, if a browser sent an Origin, comes from a page of that host. Host
+// names other than localhost must be allowed explicitly so that DNS
+// rebinding cannot reach the UI.
+func (i *Inspector) sameOrigin(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host != "localhost" && net.ParseIP(host) == nil && !i.hosts[host] {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// handleRequest returns or replays one captured request
+// GET /api/requests/{id}
+// POST /api/requests/{id}/replay
+func (i *Inspector) handleRequest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/requests/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "replay") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		entry, exists := i.Get(id)
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	entry, err := i.Replay(id)
+	i.logger.Info("Replayed captured request", zap.Int64("id", id), zap.Error(err))
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+// clear drops every captured request
+func (i *Inspector) clear() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries = nil
+	i.head = 0
+}
+
+// Context keys of inspected requests
+type (
+	captureKey struct{} // *CapturedRequest being recorded
+	replayKey  struct{} // ID of the request being replayed
+)
+
+// boundedBuffer keeps the first limit bytes written to it
+type boundedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// captureWriter records the status and body written to a response
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   *boundedBuffer
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap exposes the connection for flushing and WebSocket upgrades
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter is the response writer of a replayed request, which is only
+// recorded by the inspector
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// inspectorPage is the web UI of the inspector
+const inspectorPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tunnel request inspector</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { width: 45%; overflow: auto; border-right: 1px solid #ccc; }
+#detail { flex: 1; overflow: auto; padding: 0 1em; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+td, th { padding: 4px 6px; text-align: left; border-bottom: 1px solid #eee; white-space: nowrap; }
+tr.entry { cursor: pointer; }
+tr.entry:hover, tr.selected { background: #eef; }
+pre { background: #f6f6f6; padding: 8px; white-space: pre-wrap; word-break: break-all; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<div id="list">
+<p style="padding: 0 6px">
+<button onclick="load()">Refresh</button>
+<button onclick="clearAll()">Clear</button>
+<label><input type="checkbox" id="auto" checked> Auto refresh</label>
+</p>
+<table>
+<thead><tr><th>#</th><th>Time</th><th>Method</th><th>Host</th><th>URI</th><th>Status</th><th>Duration</th></tr></thead>
+<tbody id="rows"></tbody>
+</table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+let selected = null;
+let token = sessionStorage.getItem('token') || '';
+function api(path, options) {
+  options = options || {};
+  options.headers = { 'Authorization': 'Bearer ' + token };
+  return fetch(path, options).then(res => {
+    if (res.status === 401) {
+      token = prompt('Admin token') || '';
+      sessionStorage.setItem('token', token);
+      if (!token) document.getElementById('auto').checked = false;
+    }
+    return res;
+  });
+}
+function esc(s) { const d = document.createElement('div'); d.textContent = s == null ? '' : String(s); return d.innerHTML; }
+function headers(h) { return Object.keys(h || {}).sort().map(k => h[k].map(v => k + ': ' + v).join('\n')).join('\n'); }
+function body(b, truncated) { if (!b) return ''; let s; try { s = atob(b); } catch (e) { s = b; } return s + (truncated ? '\n[truncated]' : ''); }
+async function load() {
+  const res = await api('api/requests');
+  if (!res.ok) return;
+  const data = await res.json();
+  document.getElementById('rows').innerHTML = data.requests.map(r =>
+    '<tr class="entry' + (r.id === selected ? ' selected' : '') + '" onclick="show(' + r.id + ')">' +
+    '<td>' + r.id + (r.replayOf ? ' (replay of ' + r.replayOf + ')' : '') + '</td><td>' + esc(new Date(r.time).toLocaleTimeString()) + '</td>' +
+    '<td>' + esc(r.method) + '</td><td>' + esc(r.host) + '</td><td>' + esc(r.uri) + '</td>' +
+    '<td' + (r.status >= 400 ? ' class="error"' : '') + '>' + r.status + '</td><td>' + esc(r.duration) + '</td></tr>').join('');
+}
+async function show(id) {
+  selected = id;
+  const res = await api('api/requests/' + id);
+  if (!res.ok) { document.getElementById('detail').innerHTML = '<p class="error">Request ' + id + ' is no longer captured.</p>'; return; }
+  const r = await res.json();
+  document.getElementById('detail').innerHTML =
+    '<h3>' + esc(r.method) + ' ' + esc(r.host) + esc(r.uri) + '</h3>' +
+    '<p>Forwarder ' + esc(r.forwarder) + (r.route ? ', route ' + esc(r.route) : '') + ', from ' + esc(r.remote) + ', ' + esc(r.duration) + '</p>' +
+    (r.error ? '<p class="error">' + esc(r.error) + '</p>' : '') +
+    '<button onclick="replay(' + r.id + ')"' + (r.requestBodyTruncated ? ' disabled' : '') + '>Replay</button>' +
+    '<h4>Request</h4><pre>' + esc(headers(r.requestHeaders)) + '</pre><pre>' + esc(body(r.requestBody, r.requestBodyTruncated)) + '</pre>' +
+    '<h4>Response ' + r.status + '</h4><pre>' + esc(headers(r.responseHeaders)) + '</pre><pre>' + esc(body(r.responseBody, r.responseBodyTruncated)) + '</pre>';
+  load();
+}
+async function replay(id) {
+  const res = await api('api/requests/' + id + '/replay', { method: 'POST' });
+  const r = await res.json();
+  if (!res.ok) { alert(r.error); return; }
+  show(r.id);
+}
+async function clearAll() { await api('api/requests', { method: 'DELETE' }); selected = null; load(); }
+setInterval(() => { if (document.getElementById('auto').checked) load(); }, 2000);
+load();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"a=1", "b=2"},
+		"X-Api-Key":     {"key"},
+		"Content-Type":  {"text/plain"},
+	}
+	redacted := redactHeaders(header)
+
+	want := http.Header{
+		"Authorization": {redactedValue},
+		"Cookie":        {redactedValue, redactedValue},
+		"X-Api-Key":     {redactedValue},
+		"Content-Type":  {"text/plain"},
+	}
+	if !reflect.DeepEqual(redacted, want) {
+		t.Errorf("redacted = %v, want %v", redacted, want)
+	}
+	if header.Get("Authorization") != "Bearer secret" {
+		t.Error("original headers modified")
+	}
+}
+
+func TestInspectorSameOrigin(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	inspector := NewInspector(server, InspectorConfig{AllowedHosts: []string{"Inspect.Example.com"}}, zap.NewNop())
+
+	tests := []struct {
+		host   string
+		origin string
+		ok     bool
+	}{
+		{"localhost:4040", "", true},
+		{"127.0.0.1:4040", "", true},
+		{"[::1]:4040", "", true},
+		{"inspect.example.com", "", true},
+		{"attacker.example.com:4040", "", false},
+		{"localhost:4040", "http://localhost:4040", true},
+		{"localhost:4040", "http://attacker.example.com", false},
+		{"localhost:4040", "http://localhost:8080", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = tt.host
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := inspector.sameOrigin(req); got != tt.ok {
+			t.Errorf("sameOrigin(host %s, origin %q) = %v, want %v", tt.host, tt.origin, got, tt.ok)
+		}
+	}
+}
+
+func TestInspectorCapacity(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	inspector := NewInspector(server, InspectorConfig{Capacity: 2}, zap.NewNop())
+	for n := 0; n < 3; n++ {
+		inspector.add(&CapturedRequest{URI: "/" + strconv.Itoa(n)})
+	}
+
+	var ids []int64
+	for _, entry := range inspector.List() {
+		ids = append(ids, entry.ID)
+	}
+	if !reflect.DeepEqual(ids, []int64{3, 2}) {
+		t.Errorf("listed %v, want [3 2]", ids)
+	}
+	if _, exists := inspector.Get(1); exists {
+		t.Error("oldest request kept past capacity")
+	}
+	if entry, exists := inspector.Get(3); !exists || entry.URI != "/2" {
+		t.Errorf("Get(3) = %v, %v", entry, exists)
+	}
+
+	inspector.clear()
+	if entries := inspector.List(); len(entries) != 0 {
+		t.Errorf("%d requests after clear", len(entries))
+	}
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	tests := []struct {
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{[]string{"abc"}, "abc", false},
+		{[]string{"abcd"}, "abcd", false},
+		{[]string{"ab", "cdef"}, "abcd", true},
+		{[]string{"abcd", "e"}, "abcd", true},
+	}
+
+	for _, tt := range tests {
+		buffer := &boundedBuffer{limit: 4}
+		for _, write := range tt.writes {
+			if n, err := buffer.Write([]byte(write)); n != len(write) || err != nil {
+				t.Errorf("Write(%q) = %d, %v", write, n, err)
+			}
+		}
+		if buffer.String() != tt.want || buffer.truncated != tt.truncated {
+			t.Errorf("%v kept %q (truncated %v), want %q (%v)", tt.writes, buffer.String(), buffer.truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestInspectorHandler(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	inspector := NewInspector(server, InspectorConfig{}, zap.NewNop())
+	inspector.add(&CapturedRequest{Method: http.MethodGet, URI: "/"})
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		host   string
+		auth   string
+		status int
+	}{
+		{"page", "admin", http.MethodGet, "/", "localhost", "", http.StatusOK},
+		{"list", "admin", http.MethodGet, "/api/requests", "localhost", "admin", http.StatusOK},
+		{"get", "admin", http.MethodGet, "/api/requests/1", "localhost", "admin", http.StatusOK},
+		{"missing", "admin", http.MethodGet, "/api/requests/2", "localhost", "admin", http.StatusNotFound},
+		{"replay missing", "admin", http.MethodPost, "/api/requests/2/replay", "localhost", "admin", http.StatusConflict},
+		{"no token", "admin", http.MethodGet, "/api/requests", "localhost", "", http.StatusUnauthorized},
+		{"wrong token", "admin", http.MethodGet, "/api/requests", "localhost", "wrong", http.StatusUnauthorized},
+		{"no token configured", "", http.MethodGet, "/api/requests", "localhost", "", http.StatusUnauthorized},
+		{"foreign host", "admin", http.MethodGet, "/api/requests", "attacker.example.com", "admin", http.StatusForbidden},
+		{"foreign host page", "admin", http.MethodGet, "/", "attacker.example.com", "", http.StatusForbidden},
+		{"clear", "admin", http.MethodDelete, "/api/requests", "localhost", "admin", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.Host = tt.host
+			if tt.auth != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.auth)
+			}
+			w := httptest.NewRecorder()
+			inspector.Handler(tt.token).ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+
+	if entries := inspector.List(); len(entries) != 0 {
+		t.Errorf("%d requests after clear", len(entries))
+	}
+}
+
+func TestInspectorCapture(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Set-Cookie", "session=1")
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer service.Close()
+	port, servicePort := freePort(t), freePort(t)
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:    "web",
+		Type:    ForwarderHTTP,
+		Port:    port,
+		Enabled: true,
+		Inspect: true,
+		Routes:  []HTTPRoute{{ClientID: "c1", Port: servicePort}},
+	}})
+	inspector := NewInspector(server, InspectorConfig{MaxBody: 16}, zap.NewNop())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	startTestClient(t, server, web.URL, "c1", map[int]string{servicePort: service.Listener.Addr().String()})
+	if err := server.StartTCPForwarder(port, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	post := func(path, body string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:"+strconv.Itoa(port)+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer user")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	post("/small", "body")
+	post("/large", "a body longer than the limit")
+
+	// Requests are recorded once their response has been written
+	entries := inspector.List()
+	for deadline := time.Now().Add(5 * time.Second); len(entries) < 2; entries = inspector.List() {
+		if time.Now().After(deadline) {
+			t.Fatalf("captured %d requests, want 2", len(entries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	small, large := entries[1], entries[0]
+	if small.URI == "/large" {
+		small, large = large, small
+	}
+	if small.Method != http.MethodPost || small.URI != "/small" || small.Status != http.StatusOK || small.Forwarder != "web" {
+		t.Errorf("captured %s %s %d on %s", small.Method, small.URI, small.Status, small.Forwarder)
+	}
+	if string(small.RequestBody) != "body" || small.RequestBodyTruncated {
+		t.Errorf("request body %q (truncated %v)", small.RequestBody, small.RequestBodyTruncated)
+	}
+	if small.RequestHeaders.Get("Authorization") != redactedValue || small.ResponseHeaders.Get("Set-Cookie") != redactedValue {
+		t.Errorf("credentials captured: %v %v", small.RequestHeaders, small.ResponseHeaders)
+	}
+	if string(large.RequestBody) != "a body longer th" || !large.RequestBodyTruncated {
+		t.Errorf("request body %q (truncated %v)", large.RequestBody, large.RequestBodyTruncated)
+	}
+
+	// The API never shows the credentials a replay is sent with
+	handler := inspector.Handler("admin")
+	replay := func(id int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/requests/"+strconv.FormatInt(id, 10)+"/replay", nil)
+		req.Host = "localhost"
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	w := replay(small.ID)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Bearer user") {
+		t.Fatalf("replay: %d %s", w.Code, w.Body)
+	}
+	var replayed CapturedRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &replayed); err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ReplayOf != small.ID || replayed.Forwarder != "web" {
+		t.Errorf("replay of %d on %s", replayed.ReplayOf, replayed.Forwarder)
+	}
+	if entry, _ := inspector.Get(replayed.ID); string(entry.ResponseBody) != "Bearer user" {
+		t.Errorf("replay response %q", entry.ResponseBody)
+	}
+
+	if w := replay(large.ID); w.Code != http.StatusConflict {
+		t.Errorf("replayed a truncated request: %d %s", w.Code, w.Body)
+	}
+}
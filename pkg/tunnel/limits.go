@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Session defaults of forwarders that leave them unset
+const (
+	defaultIdleTimeout    = 5 * time.Minute
+	defaultConnectTimeout = 10 * time.Second
+)
+
+// Reasons a forwarder session ended or was refused, recorded in the session
+// audit entry and counted in the sessionCloseReasons metric
+const (
+	CloseExternalClosed   = "external_closed"     // The external client closed or reset its connection
+	CloseServiceClosed    = "service_closed"      // The client's service closed the connection
+	CloseClientError      = "client_error"        // The client reported an error on the session
+	CloseNoClient         = "no_client"           // No client could serve the session
+	CloseConnectTimeout   = "connect_timeout"     // The client did not confirm the connection in time
+	CloseIdleTimeout      = "idle_timeout"        // No data in either direction for the idle timeout
+	CloseMaxDuration      = "max_duration"        // The session reached its maximum lifetime
+	CloseMaxSessions      = "max_sessions"        // The forwarder had as many sessions as allowed
+	CloseMaxSessionsPerIP = "max_sessions_per_ip" // The source address had as many sessions as allowed
+	CloseQuotaExceeded    = "quota_exceeded"      // The forwarder's bandwidth quota was used up
+	CloseShutdown         = "shutdown"            // The server cut the session at the end of its drain
+)
+
+// setCloseReason records why a session ends; the first reason wins
+func (s *TCPSession) setCloseReason(reason string) {
+	s.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// CloseReason returns why the session ended, or "" while it is open
+func (s *TCPSession) CloseReason() string {
+	if reason := s.closeReason.Load(); reason != nil {
+		return *reason
+	}
+	return ""
+}
+
+// sessionLimits counts the open sessions of forwarders in total and per
+// source address
+type sessionLimits struct {
+	mu     sync.Mutex
+	active map[string]int // forwarder -> sessions
+	perIP  map[string]int // forwarder and source IP -> sessions
+}
+
+func newSessionLimits() *sessionLimits {
+	return &sessionLimits{
+		active: make(map[string]int),
+		perIP:  make(map[string]int),
+	}
+}
+
+// acquire reserves a session of a forwarder for a connection from remote.
+// It returns the reason the session is refused, or a release function.
+func (l *sessionLimits) acquire(fw ForwarderConfig, remote net.Addr) (func(), string) {
+	if fw.MaxSessions <= 0 && fw.MaxSessionsPerIP <= 0 {
+		return func() {}, ""
+	}
+	name := fw.usageName()
+	ipKey := name + "\x00" + remoteIP(remote)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if fw.MaxSessions > 0 && l.active[name] >= fw.MaxSessions {
+		return nil, CloseMaxSessions
+	}
+	if fw.MaxSessionsPerIP > 0 && l.perIP[ipKey] >= fw.MaxSessionsPerIP {
+		return nil, CloseMaxSessionsPerIP
+	}
+	l.active[name]++
+	l.perIP[ipKey]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.active[name]--; l.active[name] <= 0 {
+				delete(l.active, name)
+			}
+			if l.perIP[ipKey]--; l.perIP[ipKey] <= 0 {
+				delete(l.perIP, ipKey)
+			}
+		})
+	}, ""
+}
+
+// remoteIP returns the host part of a connection's remote address
+func remoteIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// watchSession closes a session once it has been idle for its idle timeout
+// or has reached its maximum duration
+func (s *ImprovedServer) watchSession(session *TCPSession) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-session.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		next := session.LastActivity().Add(session.idleTimeout)
+		reason := CloseIdleTimeout
+		if session.maxDuration > 0 {
+			if end := session.CreatedAt.Add(session.maxDuration); end.Before(next) {
+				next, reason = end, CloseMaxDuration
+			}
+		}
+		if now.Before(next) {
+			timer.Reset(next.Sub(now))
+			continue
+		}
+
+		s.logger.Info("Closing session at its limit",
+			zap.String("sessionID", session.ID),
+			zap.String("reason", reason),
+			zap.Duration("age", now.Sub(session.CreatedAt).Round(time.Second)))
+		session.setCloseReason(reason)
+		session.Close()
+		return
+	}
+}
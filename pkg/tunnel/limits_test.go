@@ -0,0 +1,173 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSessionLimitsAcquire(t *testing.T) {
+	addr := func(s string) net.Addr {
+		a, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	web := ForwarderConfig{Name: "web", MaxSessions: 3, MaxSessionsPerIP: 2}
+	route := ForwarderConfig{Name: "web/app.example.com", MaxSessions: 3, MaxSessionsPerIP: 2, owner: "web"}
+	unlimited := ForwarderConfig{Name: "open"}
+
+	limits := newSessionLimits()
+	releases := make(map[string]func())
+	steps := []struct {
+		name    string
+		fw      ForwarderConfig
+		remote  string
+		release string // Earlier step to release instead of acquiring
+		refused string
+	}{
+		{name: "first", fw: web, remote: "192.0.2.1:1000"},
+		{name: "same address, other port", fw: web, remote: "192.0.2.1:1001"},
+		{name: "per address limit", fw: web, remote: "192.0.2.1:1002", refused: CloseMaxSessionsPerIP},
+		{name: "route counts against its forwarder", fw: route, remote: "192.0.2.2:1000"},
+		{name: "forwarder limit", fw: web, remote: "192.0.2.3:1000", refused: CloseMaxSessions},
+		{name: "release", release: "first"},
+		{name: "released twice", release: "first"},
+		{name: "slot freed", fw: web, remote: "192.0.2.1:1003"},
+		{name: "forwarder limit again", fw: route, remote: "[2001:db8::1]:1000", refused: CloseMaxSessions},
+		{name: "no limits", fw: unlimited, remote: "192.0.2.1:1004"},
+	}
+	for _, step := range steps {
+		if step.release != "" {
+			releases[step.release]()
+			continue
+		}
+		release, refused := limits.acquire(step.fw, addr(step.remote))
+		if refused != step.refused {
+			t.Fatalf("%s: refused %q, want %q", step.name, refused, step.refused)
+		}
+		if refused == "" {
+			releases[step.name] = release
+		}
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	if len(limits.active) != 0 || len(limits.perIP) != 0 {
+		t.Errorf("counters left after release: %v %v", limits.active, limits.perIP)
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		maxDuration time.Duration
+		activity    bool // Keep data flowing until the session closes
+		reason      string
+	}{
+		{"idle", 50 * time.Millisecond, 0, false, CloseIdleTimeout},
+		{"lifetime", time.Second, 150 * time.Millisecond, true, CloseMaxDuration},
+		{"lifetime before idle", 100 * time.Millisecond, 50 * time.Millisecond, false, CloseMaxDuration},
+	}
+
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := net.Pipe()
+			defer client.Close()
+			session := server.sessions.Create("s-"+tt.name, "c", "t", conn, zap.NewNop())
+			session.idleTimeout = tt.idleTimeout
+			session.maxDuration = tt.maxDuration
+			go server.watchSession(session)
+
+			deadline := time.After(5 * time.Second)
+			tick := time.NewTicker(10 * time.Millisecond)
+			defer tick.Stop()
+			for session.CloseReason() == "" {
+				select {
+				case <-deadline:
+					t.Fatal("session was not closed")
+				case <-tick.C:
+					if tt.activity {
+						session.recordIn(1)
+					}
+				}
+			}
+			if reason := session.CloseReason(); reason != tt.reason {
+				t.Errorf("closed for %q, want %q", reason, tt.reason)
+			}
+			limit := tt.idleTimeout
+			if tt.reason == CloseMaxDuration {
+				limit = tt.maxDuration
+			}
+			if age := time.Since(session.CreatedAt); age < limit {
+				t.Errorf("closed after %v, before its limit of %v", age, limit)
+			}
+		})
+	}
+}
+
+func TestHTTPRouteSessionsPerIP(t *testing.T) {
+	port, routePort := freePort(t), freePort(t)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer service.Close()
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:             "web",
+		Type:             ForwarderHTTP,
+		Port:             port,
+		Enabled:          true,
+		MaxSessionsPerIP: 1,
+		Routes:           []HTTPRoute{{ClientID: "c1", Port: routePort}},
+	}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	startTestClient(t, server, web.URL, "c1", map[int]string{routePort: service.Listener.Addr().String()})
+	if err := server.StartTCPForwarder(port, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	// get sends a request on its own connection and returns the status
+	get := func() (int, net.Conn) {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, conn
+	}
+
+	// The first connection's session stays open for reuse and takes the
+	// address's only slot
+	status, first := get()
+	defer first.Close()
+	if status != http.StatusOK {
+		t.Fatalf("first request: status %d", status)
+	}
+	status, second := get()
+	defer second.Close()
+	if status != http.StatusBadGateway {
+		t.Errorf("second session from the address: status %d, want %d", status, http.StatusBadGateway)
+	}
+}
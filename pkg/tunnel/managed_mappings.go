@@ -0,0 +1,220 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// ManagedMapping is a forwarder target pushed by the server
+type ManagedMapping struct {
+	Name   string `json:"name"`
+	Port   int    `json:"port"`   // Server forwarder port
+	Target string `json:"target"` // host:port or unix:///path to dial from the client
+}
+
+// MappingsUpdate is the payload of a "mappings" message. It replaces every
+// mapping previously pushed to the client.
+type MappingsUpdate struct {
+	Mappings []ManagedMapping `json:"mappings"`
+}
+
+// TargetAllowlist lists the targets a client accepts from the server.
+// Entries are "host:port" where host is a shell pattern ("*.svc.cluster.local")
+// or a CIDR ("10.0.0.0/8") and port is a number, a range ("8000-8999") or "*".
+// Unix socket targets need entries of their own such as "unix:///run/postgresql/*".
+type TargetAllowlist []string
+
+// Validate checks the syntax of every allowlist entry
+func (a TargetAllowlist) Validate() error {
+	for _, entry := range a {
+		if pattern, unix := unixSocketPath(entry); unix {
+			if _, err := path.Match(pattern, ""); err != nil || validateSocketPath(entry) != nil {
+				return fmt.Errorf("allowed target %q: invalid socket path pattern", entry)
+			}
+			continue
+		}
+		host, ports, err := net.SplitHostPort(entry)
+		if err != nil {
+			return fmt.Errorf("allowed target %q: %w", entry, err)
+		}
+		if strings.Contains(host, "/") {
+			if _, _, err := net.ParseCIDR(host); err != nil {
+				return fmt.Errorf("allowed target %q: %w", entry, err)
+			}
+		} else if _, err := path.Match(host, ""); err != nil {
+			return fmt.Errorf("allowed target %q: %w", entry, err)
+		}
+		if ports != "*" {
+			if _, err := parsePortRanges([]string{ports}); err != nil {
+				return fmt.Errorf("allowed target %q: %w", entry, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether a target matches an allowlist entry
+func (a TargetAllowlist) Allows(target string) bool {
+	if socketPath, unix := unixSocketPath(target); unix {
+		for _, entry := range a {
+			if pattern, ok := unixSocketPath(entry); ok {
+				if matched, _ := path.Match(pattern, path.Clean(socketPath)); matched {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+
+	for _, entry := range a {
+		entryHost, entryPorts, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if entryPorts != "*" {
+			ranges, err := parsePortRanges([]string{entryPorts})
+			if err != nil || port < ranges[0].first || port > ranges[0].last {
+				continue
+			}
+		}
+		if strings.Contains(entryHost, "/") {
+			_, network, err := net.ParseCIDR(entryHost)
+			ip := net.ParseIP(host)
+			if err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(entryHost), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyManagedMappings replaces the mappings pushed by the server with an update.
+// Locally configured mappings always take precedence.
+func (c *ImprovedClient) applyManagedMappings(update MappingsUpdate) {
+	allowlist := TargetAllowlist(c.config.AllowedTargets)
+
+	c.mappingsMu.Lock()
+	defer c.mappingsMu.Unlock()
+
+	pushed := make(map[int]bool)
+	for _, mapping := range update.Mappings {
+		fields := []zap.Field{
+			zap.String("name", mapping.Name),
+			zap.Int("port", mapping.Port),
+			zap.String("target", mapping.Target),
+		}
+
+		if _, local := c.config.PortMappings[mapping.Port]; local && !c.managedPorts[mapping.Port] {
+			c.config.Logger.Info("Ignoring server mapping for locally configured port", fields...)
+			continue
+		}
+		if err := validateTarget(mapping.Target); err != nil {
+			c.config.Logger.Warn("Ignoring invalid server mapping", append(fields, zap.Error(err))...)
+			continue
+		}
+		if !allowlist.Allows(mapping.Target) {
+			c.config.Logger.Warn("Server mapping not in allowed targets", fields...)
+			continue
+		}
+
+		if c.config.PortMappings[mapping.Port] != mapping.Target {
+			c.config.Logger.Info("Applied server mapping", fields...)
+		}
+		c.config.PortMappings[mapping.Port] = mapping.Target
+		c.config.MappingOptions[mapping.Port] = MappingOptions{Name: mapping.Name}
+		c.managedPorts[mapping.Port] = true
+		pushed[mapping.Port] = true
+	}
+
+	// Mappings the server no longer pushes are dropped
+	for port := range c.managedPorts {
+		if !pushed[port] {
+			c.config.Logger.Info("Removed server mapping",
+				zap.Int("port", port),
+				zap.String("target", c.config.PortMappings[port]))
+			delete(c.config.PortMappings, port)
+			delete(c.config.MappingOptions, port)
+			delete(c.managedPorts, port)
+		}
+	}
+}
+
+// lookupMapping returns the target and options for a server port
+func (c *ImprovedClient) lookupMapping(port int) (string, MappingOptions, bool) {
+	c.mappingsMu.RLock()
+	defer c.mappingsMu.RUnlock()
+	target, exists := c.config.PortMappings[port]
+	return target, c.config.MappingOptions[port], exists
+}
+
+// managedMappingsFor returns the targets the server pushes to a client, sorted by port
+func (s *ImprovedServer) managedMappingsFor(client *ImprovedServerClient) []ManagedMapping {
+	mappings := []ManagedMapping{}
+	for _, fw := range s.forwarderList() {
+		if fw.Target != "" && fw.serves(client) {
+			mappings = append(mappings, ManagedMapping{Name: fw.Name, Port: fw.Port, Target: fw.Target})
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].Port < mappings[j].Port
+	})
+	return mappings
+}
+
+// pushMappings sends a client the targets of the forwarders it serves
+func (s *ImprovedServer) pushMappings(client *ImprovedServerClient) {
+	data, err := json.Marshal(MappingsUpdate{Mappings: s.managedMappingsFor(client)})
+	if err != nil {
+		return
+	}
+	if err := s.sendMessageToClient(client, Message{Type: "mappings", Data: data}); err != nil {
+		s.logger.Warn("Failed to push mappings", zap.String("clientID", client.ID), zap.Error(err))
+	}
+}
+
+// UpdateTargets applies the targets of reloaded forwarder configurations, matched by
+// name, and pushes the result to every connected client. It returns the number of
+// forwarders whose target changed.
+func (s *ImprovedServer) UpdateTargets(forwarders []ForwarderConfig) int {
+	targets := make(map[string]string)
+	for _, fw := range forwarders {
+		targets[fw.Name] = fw.Target
+	}
+
+	changed := 0
+	s.forwardersMu.Lock()
+	for i := range s.forwarders {
+		target, exists := targets[s.forwarders[i].Name]
+		if exists && s.forwarders[i].Target != target {
+			s.forwarders[i].Target = target
+			changed++
+		}
+	}
+	s.forwardersMu.Unlock()
+
+	for _, client := range s.clients.Matching(func(*ImprovedServerClient) bool { return true }) {
+		s.pushMappings(client)
+	}
+	return changed
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestTargetAllowlistValidate(t *testing.T) {
+	tests := []struct {
+		entry string
+		valid bool
+	}{
+		{"*.svc.cluster.local:*", true},
+		{"db.internal:5432", true},
+		{"10.0.0.0/8:8000-8999", true},
+		{"[fd00::/8]:443", true},
+		{"unix:///run/postgresql/*", true},
+		{"localhost", false},
+		{"10.0.0.0/33:80", false},
+		{"web-[:80", false},
+		{"db.internal:0", false},
+		{"db.internal:9000-8000", false},
+		{"unix://run/postgresql/*", false},
+		{"unix:///run/[", false},
+	}
+
+	for _, tt := range tests {
+		err := TargetAllowlist{tt.entry}.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.entry, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%q: expected an error", tt.entry)
+		}
+	}
+}
+
+func TestTargetAllowlistAllows(t *testing.T) {
+	allowlist := TargetAllowlist{
+		"*.svc.cluster.local:*",
+		"db.internal:5432",
+		"10.0.0.0/8:8000-8999",
+		"unix:///run/postgresql/*",
+	}
+
+	tests := []struct {
+		target string
+		allows bool
+	}{
+		{"web.default.svc.cluster.local:80", true},
+		{"WEB.default.svc.cluster.local:443", true},
+		{"db.internal:5432", true},
+		{"db.internal:5433", false},
+		{"10.1.2.3:8080", true},
+		{"10.1.2.3:9000", false},
+		{"11.1.2.3:8080", false},
+		{"svc.cluster.local.evil.com:80", false},
+		{"db.internal", false},
+		{"db.internal:http", false},
+		{"unix:///run/postgresql/.s.PGSQL.5432", true},
+		{"unix:///run/postgresql/../docker.sock", false},
+		{"unix:///var/run/docker.sock", false},
+	}
+
+	for _, tt := range tests {
+		if got := allowlist.Allows(tt.target); got != tt.allows {
+			t.Errorf("Allows(%q) = %v, want %v", tt.target, got, tt.allows)
+		}
+	}
+	if (TargetAllowlist{}).Allows("db.internal:5432") {
+		t.Error("an empty allowlist allows targets")
+	}
+}
+
+func TestApplyManagedMappings(t *testing.T) {
+	client := NewImprovedClient(ImprovedClientConfig{
+		ClientID:       "c1",
+		Logger:         zap.NewNop(),
+		PortMappings:   map[int]string{8080: "localhost:80"},
+		MappingOptions: map[int]MappingOptions{8080: {Name: "local"}},
+		AllowedTargets: []string{"*.internal:*", "localhost:*"},
+	})
+
+	client.applyManagedMappings(MappingsUpdate{Mappings: []ManagedMapping{
+		{Name: "db", Port: 5432, Target: "db.internal:5432"},
+		{Name: "web", Port: 8080, Target: "web.internal:80"},    // Configured locally
+		{Name: "cache", Port: 6379, Target: "cache.other:6379"}, // Not allowed
+		{Name: "broken", Port: 9000, Target: "web.internal"},    // Invalid
+	}})
+	want := map[int]string{8080: "localhost:80", 5432: "db.internal:5432"}
+	if !reflect.DeepEqual(client.config.PortMappings, want) {
+		t.Errorf("mappings = %v, want %v", client.config.PortMappings, want)
+	}
+	if target, options, exists := client.lookupMapping(5432); !exists || target != "db.internal:5432" || options.Name != "db" {
+		t.Errorf("lookupMapping(5432) = %q, %+v, %v", target, options, exists)
+	}
+
+	// A later update replaces the pushed mappings and keeps local ones
+	client.applyManagedMappings(MappingsUpdate{Mappings: []ManagedMapping{
+		{Name: "db", Port: 5433, Target: "db.internal:5433"},
+	}})
+	want = map[int]string{8080: "localhost:80", 5433: "db.internal:5433"}
+	if !reflect.DeepEqual(client.config.PortMappings, want) {
+		t.Errorf("mappings after update = %v, want %v", client.config.PortMappings, want)
+	}
+	if _, options, _ := client.lookupMapping(8080); options.Name != "local" {
+		t.Errorf("local mapping options replaced: %+v", options)
+	}
+
+	client.applyManagedMappings(MappingsUpdate{})
+	want = map[int]string{8080: "localhost:80"}
+	if !reflect.DeepEqual(client.config.PortMappings, want) {
+		t.Errorf("mappings after an empty update = %v, want %v", client.config.PortMappings, want)
+	}
+}
+
+func TestUpdateTargets(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+		{Name: "db", Port: 5432, ClientID: "c1", Enabled: true, Target: "db.internal:5432"},
+		{Name: "web", Port: 8080, ClientID: "c1", Enabled: true},
+		{Name: "other", Port: 9000, ClientID: "c2", Enabled: true, Target: "other.internal:9000"},
+	})
+	client := &ImprovedServerClient{ID: "c1", server: server}
+
+	want := []ManagedMapping{{Name: "db", Port: 5432, Target: "db.internal:5432"}}
+	if got := server.managedMappingsFor(client); !reflect.DeepEqual(got, want) {
+		t.Errorf("mappings = %+v, want %+v", got, want)
+	}
+
+	changed := server.UpdateTargets([]ForwarderConfig{
+		{Name: "db", Target: "db.internal:5432"},
+		{Name: "web", Target: "web.internal:80"},
+		{Name: "unknown", Target: "unknown.internal:80"},
+	})
+	if changed != 1 {
+		t.Errorf("changed %d targets, want 1", changed)
+	}
+	want = []ManagedMapping{
+		{Name: "db", Port: 5432, Target: "db.internal:5432"},
+		{Name: "web", Port: 8080, Target: "web.internal:80"},
+	}
+	if got := server.managedMappingsFor(client); !reflect.DeepEqual(got, want) {
+		t.Errorf("mappings after update = %+v, want %+v", got, want)
+	}
+}
@@ -2,48 +2,66 @@ package tunnel
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 )
 
-// MongoDBProxy provides transparent TCP tunneling for MongoDB connections
+// mongoConnectTimeout bounds how long the server may take to reach a member
+const mongoConnectTimeout = 30 * time.Second
+
+// MongoDBProxy tunnels MongoDB connections to a replica set. Every member
+// gets its own local port, and hello/isMaster replies are rewritten so that
+// drivers discovering the topology connect to those ports instead of the
+// members' internal addresses.
 type MongoDBProxy struct {
-	logger          *zap.Logger
-	tunnelClient    *ImprovedClient
-	localListener   net.Listener
-	mongoTarget     string   // Single MongoDB target for transparent proxy
+	logger         *zap.Logger
+	tunnelClient   *ImprovedClient
+	localListener  net.Listener
+	mongoTargets   []string // Seed members, tried in order when the primary is unknown
+	replicaSetName string   // Expected set name; empty accepts any
+	advertiseHost  string   // Host written into rewritten member addresses
 	ctx            context.Context
 	cancel         context.CancelFunc
+
+	mu      sync.Mutex
+	members map[string]*mongoMember // Internal member address -> local listener
+	primary string                  // Internal address of the last reported primary
 }
 
-// Removed MongoDBMessage struct as transparent proxy doesn't need protocol parsing
+// mongoMember is the local listener tunnelling to one replica set member
+type mongoMember struct {
+	address  string
+	listener net.Listener
+	port     int
+}
 
 func NewMongoDBProxy(logger *zap.Logger, tunnelClient *ImprovedClient, localPort int, mongoTargets []string, replicaSetName string) *MongoDBProxy {
 	ctx, cancel := context.WithCancel(context.Background())
-	
-	// Use first target for transparent proxy
-	var target string
-	if len(mongoTargets) > 0 {
-		target = mongoTargets[0]
-	}
-	
+
 	return &MongoDBProxy{
 		logger:         logger,
 		tunnelClient:   tunnelClient,
-		mongoTarget:    target,
-		ctx:           ctx,
-		cancel:        cancel,
+		mongoTargets:   mongoTargets,
+		replicaSetName: replicaSetName,
+		advertiseHost:  "localhost",
+		members:        make(map[string]*mongoMember),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
-// SetTunnelHost is kept for compatibility but not used in transparent mode
+// SetTunnelHost sets the host drivers use to reach the proxy; it replaces
+// member hostnames in rewritten topology replies
 func (p *MongoDBProxy) SetTunnelHost(host string) {
-	// No-op in transparent proxy mode
+	p.advertiseHost = host
 }
 
 func (p *MongoDBProxy) Start(port int) error {
@@ -51,124 +69,269 @@ func (p *MongoDBProxy) Start(port int) error {
 	if err != nil {
 		return fmt.Errorf("failed to create MongoDB proxy listener: %w", err)
 	}
-	
+
 	p.localListener = listener
-	p.logger.Info("MongoDB proxy started", zap.Int("port", port))
-	
-	go p.acceptConnections()
+	p.logger.Info("MongoDB proxy started",
+		zap.Int("port", port),
+		zap.String("replicaSet", p.replicaSetName),
+		zap.Strings("seeds", p.mongoTargets))
+
+	// Seeds are reachable on their own ports before the first hello
+	for _, target := range p.mongoTargets {
+		if _, err := p.memberPort(target); err != nil {
+			p.logger.Warn("Failed to open MongoDB member listener", zap.String("member", target), zap.Error(err))
+		}
+	}
+
+	go p.acceptConnections(listener, p.seedCandidates)
 	return nil
 }
 
-func (p *MongoDBProxy) acceptConnections() {
+// seedCandidates returns the members the main port connects to: the current
+// primary first, then the configured seeds
+func (p *MongoDBProxy) seedCandidates() []string {
+	p.mu.Lock()
+	primary := p.primary
+	p.mu.Unlock()
+
+	candidates := make([]string, 0, len(p.mongoTargets)+1)
+	if primary != "" {
+		candidates = append(candidates, primary)
+	}
+	for _, target := range p.mongoTargets {
+		if !strings.EqualFold(target, primary) {
+			candidates = append(candidates, target)
+		}
+	}
+	return candidates
+}
+
+func (p *MongoDBProxy) acceptConnections(listener net.Listener, candidates func() []string) {
 	for {
 		select {
 		case <-p.ctx.Done():
 			return
 		default:
-			conn, err := p.localListener.Accept()
+			conn, err := listener.Accept()
 			if err != nil {
+				if p.ctx.Err() != nil {
+					return
+				}
 				p.logger.Error("Accept failed", zap.Error(err))
 				continue
 			}
-			
-			go p.handleConnection(conn)
+
+			go p.handleConnection(conn, candidates())
 		}
 	}
 }
 
-func (p *MongoDBProxy) handleConnection(clientConn net.Conn) {
+func (p *MongoDBProxy) handleConnection(clientConn net.Conn, candidates []string) {
 	defer clientConn.Close()
-	
-	// Request tunnel connection to MongoDB target
-	mongoConn, err := p.connectToMongoDB(p.mongoTarget)
+
+	mongoConn, target, err := p.connectToMongoDB(candidates)
 	if err != nil {
-		p.logger.Error("Failed to connect to MongoDB through tunnel", 
-			zap.String("target", p.mongoTarget),
+		p.logger.Error("Failed to connect to MongoDB through tunnel",
+			zap.Strings("targets", candidates),
 			zap.Error(err))
 		return
 	}
 	defer mongoConn.Close()
-	
-	p.logger.Info("Established tunnel connection", 
-		zap.String("target", p.mongoTarget))
-	
-	// Start transparent bidirectional forwarding
-	var wg sync.WaitGroup
-	wg.Add(2)
-	
+
+	p.logger.Info("Established tunnel connection",
+		zap.String("target", target))
+
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
-		defer wg.Done()
-		p.forwardTraffic(clientConn, mongoConn, "client->mongo")
+		select {
+		case <-p.ctx.Done():
+			clientConn.Close()
+			mongoConn.Close()
+		case <-done:
+		}
 	}()
-	
+
+	// Requests pass through untouched; replies are parsed for topology
 	go func() {
-		defer wg.Done()
-		p.forwardTraffic(mongoConn, clientConn, "mongo->client")
+		io.Copy(mongoConn, clientConn)
+		mongoConn.Close()
 	}()
-	
-	wg.Wait()
+	p.relayReplies(mongoConn, clientConn, target)
 }
 
-func (p *MongoDBProxy) connectToMongoDB(target string) (net.Conn, error) {
+// connectToMongoDB opens a tunnel session to the first reachable candidate
+func (p *MongoDBProxy) connectToMongoDB(candidates []string) (net.Conn, string, error) {
 	if p.tunnelClient == nil {
-		return nil, fmt.Errorf("tunnel client not available")
+		return nil, "", fmt.Errorf("tunnel client not available")
 	}
-	
-	// Create a new tunnel session for the MongoDB connection
-	// This will be handled by the tunnel client's session management
-	sessionConn, err := p.tunnelClient.CreateTunnelSession(target)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tunnel session: %w", err)
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("no MongoDB targets configured")
+	}
+
+	var lastErr error
+	for _, target := range candidates {
+		ctx, cancel := context.WithTimeout(p.ctx, mongoConnectTimeout)
+		conn, err := p.tunnelClient.DialTunnel(ctx, target)
+		cancel()
+		if err == nil {
+			return conn, target, nil
+		}
+		p.logger.Debug("MongoDB member unreachable", zap.String("target", target), zap.Error(err))
+		lastErr = err
 	}
-	
-	return sessionConn, nil
+	return nil, "", lastErr
 }
 
-// forwardTraffic provides transparent TCP forwarding without protocol parsing
-func (p *MongoDBProxy) forwardTraffic(src, dst net.Conn, direction string) {
-	buffer := make([]byte, 32*1024) // 32KB buffer
-	
+// relayReplies copies server messages to the driver, rewriting topology
+// information in hello and isMaster replies
+func (p *MongoDBProxy) relayReplies(src, dst net.Conn, target string) {
 	for {
-		select {
-		case <-p.ctx.Done():
+		message, err := readMongoMessage(src)
+		if err != nil {
+			if err != io.EOF {
+				p.logger.Debug("Read failed",
+					zap.Error(err),
+					zap.String("target", target))
+			}
 			return
-		default:
-			// Set read timeout to allow context cancellation
-			src.SetReadDeadline(time.Now().Add(30 * time.Second))
-			
-			n, err := src.Read(buffer)
-			if err != nil {
-				if err != io.EOF {
-					p.logger.Debug("Read failed", 
-						zap.Error(err), 
-						zap.String("direction", direction))
-				}
-				return
+		}
+
+		message = rewriteMongoReply(message, p.rewriteTopology)
+		if _, err := dst.Write(message); err != nil {
+			p.logger.Debug("Write failed",
+				zap.Error(err),
+				zap.String("target", target))
+			return
+		}
+	}
+}
+
+// rewriteTopology replaces member addresses in a replica set hello reply
+// with the proxy's member ports and records the current primary. Replies
+// without a setName are not topology replies and are left alone.
+func (p *MongoDBProxy) rewriteTopology(doc []byte) ([]byte, bool) {
+	elements, err := bsonElements(doc)
+	if err != nil {
+		return nil, false
+	}
+
+	var setName string
+	for _, element := range elements {
+		if element.name == "setName" && element.kind == 0x02 {
+			setName, _ = bsonString(element.value)
+		}
+	}
+	if setName == "" {
+		return nil, false
+	}
+	if p.replicaSetName != "" && setName != p.replicaSetName {
+		p.logger.Warn("MongoDB member reports an unexpected replica set",
+			zap.String("expected", p.replicaSetName),
+			zap.String("reported", setName))
+		return nil, false
+	}
+
+	out := []byte{0, 0, 0, 0}
+	for _, element := range elements {
+		switch {
+		case element.kind == 0x04 && (element.name == "hosts" || element.name == "passives" || element.name == "arbiters"):
+			hosts, ok := bsonStrings(element.value)
+			if !ok {
+				out = append(out, element.raw...)
+				continue
 			}
-			
-			if n > 0 {
-				_, err = dst.Write(buffer[:n])
-				if err != nil {
-					p.logger.Debug("Write failed", 
-						zap.Error(err), 
-						zap.String("direction", direction))
-					return
-				}
-				
-				p.logger.Debug("Forwarded data", 
-					zap.Int("bytes", n), 
-					zap.String("direction", direction))
+			for i, host := range hosts {
+				hosts[i] = p.localAddress(host)
+			}
+			out = appendBSONStrings(out, element.name, hosts)
+
+		case element.kind == 0x02 && (element.name == "primary" || element.name == "me"):
+			address, _ := bsonString(element.value)
+			if element.name == "primary" {
+				p.setPrimary(address)
 			}
+			out = appendBSONString(out, element.name, p.localAddress(address))
+
+		case element.name == "compression":
+			// Compressed messages cannot be inspected; keep the driver on OP_MSG
+			continue
+
+		default:
+			out = append(out, element.raw...)
 		}
 	}
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out, true
+}
+
+// setPrimary records the member new connections to the main port go to
+func (p *MongoDBProxy) setPrimary(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if strings.EqualFold(p.primary, address) {
+		return
+	}
+	p.logger.Info("MongoDB primary changed",
+		zap.String("previous", p.primary),
+		zap.String("primary", address))
+	p.primary = address
+}
+
+// localAddress returns the address drivers use to reach a member through
+// the proxy. The member's own address is kept if no listener can be opened.
+func (p *MongoDBProxy) localAddress(member string) string {
+	port, err := p.memberPort(member)
+	if err != nil {
+		p.logger.Warn("Failed to open MongoDB member listener", zap.String("member", member), zap.Error(err))
+		return member
+	}
+	return net.JoinHostPort(p.advertiseHost, strconv.Itoa(port))
 }
 
-// Removed MongoDB-specific message processing for transparent proxy mode
-// All MongoDB protocol handling is done transparently without modification
+// memberPort returns the local port tunnelling to a member, opening it on
+// first use
+func (p *MongoDBProxy) memberPort(address string) (int, error) {
+	key := strings.ToLower(address)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if member, exists := p.members[key]; exists {
+		return member.port, nil
+	}
+	if p.ctx.Err() != nil {
+		return 0, fmt.Errorf("proxy stopped")
+	}
+
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	member := &mongoMember{
+		address:  address,
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+	}
+	p.members[key] = member
+
+	p.logger.Info("MongoDB member listener started",
+		zap.String("member", address),
+		zap.Int("port", member.port))
+
+	go p.acceptConnections(listener, func() []string { return []string{address} })
+	return member.port, nil
+}
 
 func (p *MongoDBProxy) Stop() {
 	p.cancel()
 	if p.localListener != nil {
 		p.localListener.Close()
 	}
-}
\ No newline at end of file
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, member := range p.members {
+		member.listener.Close()
+	}
+}
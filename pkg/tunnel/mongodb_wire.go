@@ -0,0 +1,251 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MongoDB wire protocol opcodes
+const (
+	mongoOpReply = 1
+	mongoOpMsg   = 2013
+
+	mongoHeaderLen     = 16
+	mongoMaxMessageLen = 48 * 1000 * 1000 // maxMessageSizeBytes default
+
+	mongoMsgChecksumPresent = 1 << 0
+)
+
+// readMongoMessage reads one length-prefixed wire protocol message
+func readMongoMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, mongoHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(int32(binary.LittleEndian.Uint32(header)))
+	if length < mongoHeaderLen || length > mongoMaxMessageLen {
+		return nil, fmt.Errorf("invalid message length %d", length)
+	}
+	message := make([]byte, length)
+	copy(message, header)
+	if _, err := io.ReadFull(r, message[mongoHeaderLen:]); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// rewriteMongoReply applies rewrite to the body document of an OP_MSG or
+// OP_REPLY message. It returns the message unchanged when rewrite declines.
+func rewriteMongoReply(message []byte, rewrite func(doc []byte) ([]byte, bool)) []byte {
+	opCode := binary.LittleEndian.Uint32(message[12:16])
+	switch opCode {
+	case mongoOpMsg:
+		// flagBits, then sections; the body is the kind 0 section
+		if len(message) < mongoHeaderLen+5 {
+			return message
+		}
+		flags := binary.LittleEndian.Uint32(message[16:20])
+		end := len(message)
+		if flags&mongoMsgChecksumPresent != 0 {
+			end -= 4
+		}
+		offset := 20
+		for offset < end {
+			kind := message[offset]
+			size, ok := bsonLength(message[offset+1 : end])
+			if !ok {
+				return message
+			}
+			if kind == 1 {
+				// Document sequences are passed through
+				offset += 1 + size
+				continue
+			}
+			doc := message[offset+1 : offset+1+size]
+			rewritten, changed := rewrite(doc)
+			if !changed {
+				return message
+			}
+			var out bytes.Buffer
+			out.Write(message[:offset+1])
+			out.Write(rewritten)
+			out.Write(message[offset+1+size : end])
+			result := out.Bytes()
+			// The checksum no longer matches; drop it
+			binary.LittleEndian.PutUint32(result[16:20], flags&^mongoMsgChecksumPresent)
+			binary.LittleEndian.PutUint32(result[0:4], uint32(len(result)))
+			return result
+		}
+
+	case mongoOpReply:
+		// responseFlags, cursorID, startingFrom, numberReturned, documents
+		const docsOffset = mongoHeaderLen + 20
+		if len(message) <= docsOffset || binary.LittleEndian.Uint32(message[32:36]) != 1 {
+			return message
+		}
+		size, ok := bsonLength(message[docsOffset:])
+		if !ok {
+			return message
+		}
+		rewritten, changed := rewrite(message[docsOffset : docsOffset+size])
+		if !changed {
+			return message
+		}
+		result := append(append(append([]byte(nil), message[:docsOffset]...), rewritten...), message[docsOffset+size:]...)
+		binary.LittleEndian.PutUint32(result[0:4], uint32(len(result)))
+		return result
+	}
+	return message
+}
+
+// bsonLength returns the length of the BSON document at the start of data
+func bsonLength(data []byte) (int, bool) {
+	if len(data) < 5 {
+		return 0, false
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 5 || size > len(data) {
+		return 0, false
+	}
+	return size, true
+}
+
+// bsonElement is a top-level element of a BSON document
+type bsonElement struct {
+	kind  byte
+	name  string
+	value []byte
+	raw   []byte // The complete encoded element
+}
+
+// bsonElements splits a document into its top-level elements
+func bsonElements(doc []byte) ([]bsonElement, error) {
+	size, ok := bsonLength(doc)
+	if !ok {
+		return nil, fmt.Errorf("invalid document length")
+	}
+	var elements []bsonElement
+	offset := 4
+	for offset < size-1 {
+		start := offset
+		kind := doc[offset]
+		nameEnd := bytes.IndexByte(doc[offset+1:size], 0)
+		if nameEnd < 0 {
+			return nil, fmt.Errorf("unterminated element name")
+		}
+		name := string(doc[offset+1 : offset+1+nameEnd])
+		offset += 2 + nameEnd
+
+		valueLen, err := bsonValueLength(kind, doc[offset:size])
+		if err != nil {
+			return nil, fmt.Errorf("element %q: %w", name, err)
+		}
+		elements = append(elements, bsonElement{
+			kind:  kind,
+			name:  name,
+			value: doc[offset : offset+valueLen],
+			raw:   doc[start : offset+valueLen],
+		})
+		offset += valueLen
+	}
+	return elements, nil
+}
+
+// bsonValueLength returns the encoded length of a value of the given type
+func bsonValueLength(kind byte, data []byte) (int, error) {
+	fixed := map[byte]int{
+		0x01: 8, 0x06: 0, 0x07: 12, 0x08: 1, 0x09: 8, 0x0A: 0,
+		0x10: 4, 0x11: 8, 0x12: 8, 0x13: 16, 0xFF: 0, 0x7F: 0,
+	}
+	var n int
+	switch kind {
+	case 0x02, 0x0D, 0x0E: // string, JavaScript, symbol
+		if len(data) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = 4 + int(int32(binary.LittleEndian.Uint32(data)))
+	case 0x03, 0x04, 0x0F: // document, array, code with scope
+		if len(data) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = int(int32(binary.LittleEndian.Uint32(data)))
+	case 0x05: // binary
+		if len(data) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = 5 + int(int32(binary.LittleEndian.Uint32(data)))
+	case 0x0B: // regular expression: two cstrings
+		first := bytes.IndexByte(data, 0)
+		if first < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		second := bytes.IndexByte(data[first+1:], 0)
+		if second < 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = first + second + 2
+	case 0x0C: // DBPointer: string and ObjectId
+		if len(data) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		n = 4 + int(int32(binary.LittleEndian.Uint32(data))) + 12
+	default:
+		size, known := fixed[kind]
+		if !known {
+			return 0, fmt.Errorf("unknown type 0x%02x", kind)
+		}
+		n = size
+	}
+	if n < 0 || n > len(data) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// bsonString decodes a string value
+func bsonString(value []byte) (string, bool) {
+	if len(value) < 5 {
+		return "", false
+	}
+	return string(value[4 : len(value)-1]), true
+}
+
+// bsonStrings decodes an array of strings
+func bsonStrings(value []byte) ([]string, bool) {
+	elements, err := bsonElements(value)
+	if err != nil {
+		return nil, false
+	}
+	values := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element.kind != 0x02 {
+			return nil, false
+		}
+		s, ok := bsonString(element.value)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, s)
+	}
+	return values, true
+}
+
+// appendBSONString appends a string element
+func appendBSONString(buf []byte, name, value string) []byte {
+	buf = append(append(append(buf, 0x02), name...), 0)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)+1))
+	return append(append(buf, value...), 0)
+}
+
+// appendBSONStrings appends an array of strings
+func appendBSONStrings(buf []byte, name string, values []string) []byte {
+	array := []byte{0, 0, 0, 0}
+	for i, value := range values {
+		array = appendBSONString(array, fmt.Sprint(i), value)
+	}
+	array = append(array, 0)
+	binary.LittleEndian.PutUint32(array, uint32(len(array)))
+	return append(append(append(append(buf, 0x04), name...), 0), array...)
+}
@@ -0,0 +1,226 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// bsonDoc encodes a document from encoded elements
+func bsonDoc(elements ...[]byte) []byte {
+	doc := []byte{0, 0, 0, 0}
+	for _, element := range elements {
+		doc = append(doc, element...)
+	}
+	doc = append(doc, 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+	return doc
+}
+
+// bsonRaw encodes a single element of any type
+func bsonRaw(kind byte, name string, value []byte) []byte {
+	return append(append(append([]byte{kind}, name...), 0), value...)
+}
+
+// mongoMessage encodes a wire protocol message with the given opcode and body
+func mongoMessage(opCode uint32, body ...[]byte) []byte {
+	message := make([]byte, mongoHeaderLen)
+	binary.LittleEndian.PutUint32(message[4:8], 7) // requestID
+	binary.LittleEndian.PutUint32(message[12:16], opCode)
+	for _, part := range body {
+		message = append(message, part...)
+	}
+	binary.LittleEndian.PutUint32(message[0:4], uint32(len(message)))
+	return message
+}
+
+// le32 encodes a little-endian int32
+func le32(n uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, n)
+}
+
+func TestBSONElements(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   []byte
+		kinds []byte // Expected element types; nil if the document is invalid
+	}{
+		{"empty", bsonDoc(), []byte{}},
+		{"string and int32", bsonDoc(appendBSONString(nil, "me", "db0:27017"), bsonRaw(0x10, "n", le32(1))), []byte{0x02, 0x10}},
+		{"double, bool and null", bsonDoc(bsonRaw(0x01, "ok", make([]byte, 8)), bsonRaw(0x08, "primary", []byte{1}), bsonRaw(0x0A, "x", nil)), []byte{0x01, 0x08, 0x0A}},
+		{"nested document", bsonDoc(bsonRaw(0x03, "topologyVersion", bsonDoc(bsonRaw(0x12, "counter", make([]byte, 8))))), []byte{0x03}},
+		{"array", bsonDoc(appendBSONStrings(nil, "hosts", []string{"a:1", "b:2"})), []byte{0x04}},
+		{"binary", bsonDoc(bsonRaw(0x05, "bin", append(le32(3), 0, 'a', 'b', 'c'))), []byte{0x05}},
+		{"regex", bsonDoc(bsonRaw(0x0B, "re", []byte("^a\x00i\x00"))), []byte{0x0B}},
+		{"object ID and timestamp", bsonDoc(bsonRaw(0x07, "_id", make([]byte, 12)), bsonRaw(0x11, "ts", make([]byte, 8))), []byte{0x07, 0x11}},
+		{"unknown type", bsonDoc(bsonRaw(0x20, "x", nil)), nil},
+		{"truncated value", bsonDoc(bsonRaw(0x12, "n", make([]byte, 4))), nil},
+		{"string longer than document", bsonDoc(bsonRaw(0x02, "s", le32(100))), nil},
+		{"unterminated name", append(le32(8), 0x02, 'a', 'b', 'c'), nil},
+		{"length beyond data", le32(64), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements, err := bsonElements(tt.doc)
+			if tt.kinds == nil {
+				if err == nil {
+					t.Errorf("got %d elements, want an error", len(elements))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(elements) != len(tt.kinds) {
+				t.Fatalf("got %d elements, want %d", len(elements), len(tt.kinds))
+			}
+			// Re-encoding the raw elements gives the original document
+			var raws [][]byte
+			for i, element := range elements {
+				if element.kind != tt.kinds[i] {
+					t.Errorf("element %d has type 0x%02x, want 0x%02x", i, element.kind, tt.kinds[i])
+				}
+				raws = append(raws, element.raw)
+			}
+			if !bytes.Equal(bsonDoc(raws...), tt.doc) {
+				t.Error("raw elements do not cover the document")
+			}
+		})
+	}
+}
+
+func TestBSONStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+	}{
+		{"empty", []string{}},
+		{"one", []string{"db0.internal:27017"}},
+		{"several", []string{"a:1", "b:2", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements, err := bsonElements(bsonDoc(appendBSONStrings(nil, "hosts", tt.values)))
+			if err != nil || len(elements) != 1 || elements[0].name != "hosts" {
+				t.Fatalf("got %+v, %v", elements, err)
+			}
+			values, ok := bsonStrings(elements[0].value)
+			if !ok || len(values) != len(tt.values) {
+				t.Fatalf("got %q, want %q", values, tt.values)
+			}
+			for i := range values {
+				if values[i] != tt.values[i] {
+					t.Errorf("value %d = %q, want %q", i, values[i], tt.values[i])
+				}
+			}
+		})
+	}
+
+	if _, ok := bsonStrings(bsonDoc(bsonRaw(0x10, "0", le32(1)))); ok {
+		t.Error("an array of numbers decoded as strings")
+	}
+}
+
+func TestRewriteMongoReply(t *testing.T) {
+	original := bsonDoc(appendBSONString(nil, "me", "db0.internal:27017"))
+	replaced := bsonDoc(appendBSONString(nil, "me", "localhost:27017"))
+	rewrite := func(doc []byte) ([]byte, bool) {
+		if !bytes.Equal(doc, original) {
+			return nil, false
+		}
+		return replaced, true
+	}
+	sequence := append([]byte{1}, append(le32(uint32(4+len("documents\x00")+len(original))), append([]byte("documents\x00"), original...)...)...)
+
+	tests := []struct {
+		name    string
+		message []byte
+		want    []byte // nil if the message is returned unchanged
+	}{
+		{
+			name:    "OP_MSG body",
+			message: mongoMessage(mongoOpMsg, le32(0), []byte{0}, original),
+			want:    mongoMessage(mongoOpMsg, le32(0), []byte{0}, replaced),
+		},
+		{
+			name:    "OP_MSG checksum dropped",
+			message: mongoMessage(mongoOpMsg, le32(mongoMsgChecksumPresent), []byte{0}, original, le32(0xdeadbeef)),
+			want:    mongoMessage(mongoOpMsg, le32(0), []byte{0}, replaced),
+		},
+		{
+			name:    "OP_MSG after a document sequence",
+			message: mongoMessage(mongoOpMsg, le32(0), sequence, []byte{0}, original),
+			want:    mongoMessage(mongoOpMsg, le32(0), sequence, []byte{0}, replaced),
+		},
+		{
+			name:    "OP_MSG declined",
+			message: mongoMessage(mongoOpMsg, le32(0), []byte{0}, replaced),
+		},
+		{
+			name:    "OP_MSG truncated body",
+			message: mongoMessage(mongoOpMsg, le32(0), []byte{0}, original[:len(original)-2]),
+		},
+		{
+			name:    "OP_REPLY single document",
+			message: mongoMessage(mongoOpReply, le32(0), make([]byte, 8), le32(0), le32(1), original),
+			want:    mongoMessage(mongoOpReply, le32(0), make([]byte, 8), le32(0), le32(1), replaced),
+		},
+		{
+			name:    "OP_REPLY several documents",
+			message: mongoMessage(mongoOpReply, le32(0), make([]byte, 8), le32(0), le32(2), original, original),
+		},
+		{
+			name:    "other opcode",
+			message: mongoMessage(2004, original),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rewriteMongoReply(tt.message, rewrite)
+			want := tt.want
+			if want == nil {
+				want = tt.message
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("got  %x\nwant %x", got, want)
+			}
+		})
+	}
+}
+
+func TestReadMongoMessage(t *testing.T) {
+	valid := mongoMessage(mongoOpMsg, le32(0), []byte{0}, bsonDoc())
+
+	tests := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"message", valid, true},
+		{"length below header", append(le32(8), make([]byte, 12)...), false},
+		{"length above maximum", append(le32(mongoMaxMessageLen+1), make([]byte, 12)...), false},
+		{"negative length", append(le32(0xFFFFFFFF), make([]byte, 12)...), false},
+		{"truncated header", valid[:10], false},
+		{"truncated body", valid[:len(valid)-1], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := readMongoMessage(bytes.NewReader(tt.input))
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("got %x, want an error", message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(message, tt.input) {
+				t.Errorf("got %x, want %x", message, tt.input)
+			}
+		})
+	}
+}
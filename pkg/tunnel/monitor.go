@@ -21,6 +21,8 @@ type HealthStatus struct {
 	Metrics        map[string]interface{} `json:"metrics"`
 	Clients        []ClientHealth         `json:"clients,omitempty"`
 	Sessions       []SessionHealth        `json:"sessions,omitempty"`
+	Forwarders     []ForwarderHealth      `json:"forwarders,omitempty"`
+	Peers          []ClusterNode          `json:"peers,omitempty"` // Cluster peers and their clients
 	Errors         []ErrorInfo            `json:"errors,omitempty"`
 }
 
@@ -34,13 +36,14 @@ type ClientHealth struct {
 
 // SessionHealth represents health information for an active session
 type SessionHealth struct {
-	ID            string    `json:"id"`
-	ClientID      string    `json:"clientId"`
-	Target        string    `json:"target"`
-	CreatedAt     time.Time `json:"createdAt"`
-	BytesIn       int64     `json:"bytesIn"`
-	BytesOut      int64     `json:"bytesOut"`
-	LastActivity  time.Time `json:"lastActivity"`
+	ID           string           `json:"id"`
+	ClientID     string           `json:"clientId"`
+	Target       string           `json:"target"`
+	CreatedAt    time.Time        `json:"createdAt"`
+	BytesIn      int64            `json:"bytesIn"`
+	BytesOut     int64            `json:"bytesOut"`
+	LastActivity time.Time        `json:"lastActivity"`
+	Metadata     *SessionMetadata `json:"metadata,omitempty"` // Set for protocol-aware forwarders
 }
 
 // ErrorInfo represents recent error information
@@ -124,8 +127,20 @@ type MetricsStore struct {
 	reconnectsTotal     atomic.Int64
 	sessionsTotal       atomic.Int64
 	sessionsActive      atomic.Int32
+	alertsTotal         atomic.Int64
+	connectionsParked   atomic.Int32
+	sessionsRelayedOut  atomic.Int64 // Sessions relayed to a cluster peer
+	sessionsRelayedIn   atomic.Int64 // Sessions accepted from a cluster peer
+	egressSessions      atomic.Int64 // Client-initiated sessions to external destinations
+	egressDenied        atomic.Int64 // Client-initiated connections refused by the egress policy
+	egressFailed        atomic.Int64 // Allowed egress connections that could not be dialed
+	bandwidthThrottled  atomic.Int64 // Transfers delayed by a forwarder rate limit
+	quotaRejected       atomic.Int64 // Sessions refused because a forwarder quota was reached
 	lastError           atomic.Value
 	lastErrorTime       atomic.Value
+
+	closeReasons   map[string]int64 // Forwarder sessions ended or refused, by reason
+	closeReasonsMu sync.Mutex
 }
 
 func NewMetricsStore() *MetricsStore {
@@ -151,7 +166,42 @@ func (ms *MetricsStore) GetMetrics() map[string]interface{} {
 		"reconnectsTotal":   ms.reconnectsTotal.Load(),
 		"sessionsTotal":     ms.sessionsTotal.Load(),
 		"sessionsActive":    ms.sessionsActive.Load(),
+		"alertsTotal":       ms.alertsTotal.Load(),
+		"connectionsParked": ms.connectionsParked.Load(),
+		"sessionsRelayedOut": ms.sessionsRelayedOut.Load(),
+		"sessionsRelayedIn":  ms.sessionsRelayedIn.Load(),
+		"egressSessions":     ms.egressSessions.Load(),
+		"egressDenied":       ms.egressDenied.Load(),
+		"egressFailed":       ms.egressFailed.Load(),
+		"bandwidthThrottled": ms.bandwidthThrottled.Load(),
+		"quotaRejected":      ms.quotaRejected.Load(),
+
+		"sessionCloseReasons": ms.closeReasonCounts(),
+	}
+}
+
+// recordClose counts a forwarder session that ended or was refused for reason
+func (ms *MetricsStore) recordClose(reason string) {
+	if reason == "" {
+		return
+	}
+	ms.closeReasonsMu.Lock()
+	defer ms.closeReasonsMu.Unlock()
+	if ms.closeReasons == nil {
+		ms.closeReasons = make(map[string]int64)
+	}
+	ms.closeReasons[reason]++
+}
+
+// closeReasonCounts returns a copy of the session close reason counters
+func (ms *MetricsStore) closeReasonCounts() map[string]int64 {
+	ms.closeReasonsMu.Lock()
+	defer ms.closeReasonsMu.Unlock()
+	counts := make(map[string]int64, len(ms.closeReasons))
+	for reason, count := range ms.closeReasons {
+		counts[reason] = count
 	}
+	return counts
 }
 
 // RecordError records an error occurrence
@@ -213,23 +263,149 @@ func (m *Monitor) HTTPHealthHandler() http.HandlerFunc {
 	}
 }
 
+// ReadinessStatus reports whether the server can serve its forwarders
+type ReadinessStatus struct {
+	Ready             bool     `json:"ready"`
+	MissingClients    []string `json:"missingClients,omitempty"`
+	MissingForwarders []string `json:"missingForwarders,omitempty"` // Critical forwarders without any client
+	Draining          bool     `json:"draining,omitempty"`
+}
+
 // ImprovedServerMonitor extends Monitor for the improved server
 type ImprovedServerMonitor struct {
 	*Monitor
-	server *ImprovedServer
+	server          *ImprovedServer
+	requiredClients []string
+	mu              sync.RWMutex
 }
 
 func NewImprovedServerMonitor(server *ImprovedServer) *ImprovedServerMonitor {
+	monitor := NewMonitor("improved-server", server.logger)
+	// Share the server's counters so health reflects real traffic
+	monitor.metricsStore = server.metrics
+
 	return &ImprovedServerMonitor{
-		Monitor: NewMonitor("improved-server", server.logger),
+		Monitor: monitor,
 		server:  server,
 	}
 }
 
+// SetRequiredClients sets the client IDs that must be connected for readiness
+func (ism *ImprovedServerMonitor) SetRequiredClients(clientIDs []string) {
+	ism.mu.Lock()
+	defer ism.mu.Unlock()
+	ism.requiredClients = append([]string(nil), clientIDs...)
+}
+
+// GetReadiness reports readiness based on required clients being connected
+func (ism *ImprovedServerMonitor) GetReadiness() ReadinessStatus {
+	ism.mu.RLock()
+	required := append([]string(nil), ism.requiredClients...)
+	ism.mu.RUnlock()
+
+	status := ReadinessStatus{Ready: true}
+	if ism.server.IsDraining() {
+		status.Ready = false
+		status.Draining = true
+	}
+	for _, clientID := range required {
+		_, local := ism.server.clients.Get(clientID)
+		_, remote := ism.server.remoteClientNode(clientID)
+		if !local && !remote {
+			status.Ready = false
+			status.MissingClients = append(status.MissingClients, clientID)
+		}
+	}
+
+	// Critical forwarders need at least one of their clients
+	for _, fw := range ism.server.forwarderList() {
+		if fw.Critical && len(ism.server.candidatesFor(fw)) == 0 {
+			if _, remote := ism.server.remoteNodeFor(fw); remote {
+				continue
+			}
+			status.Ready = false
+			status.MissingForwarders = append(status.MissingForwarders, fw.Name)
+		}
+	}
+
+	return status
+}
+
+// HTTPHealthHandler returns an HTTP handler serving detailed server health
+func (ism *ImprovedServerMonitor) HTTPHealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		health := ism.GetHealth()
+		
+		w.Header().Set("Content-Type", "application/json")
+		
+		statusCode := http.StatusOK
+		if health.Status == "unhealthy" {
+			statusCode = http.StatusServiceUnavailable
+		}
+		
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(health)
+	}
+}
+
+// HTTPLivenessHandler returns an HTTP handler that succeeds while the process serves requests
+func (ism *ImprovedServerMonitor) HTTPLivenessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "alive",
+			"uptime": fmt.Sprintf("%v", time.Since(ism.startTime).Round(time.Second)),
+		})
+	}
+}
+
+// HTTPReadinessHandler returns an HTTP handler that fails until required clients are connected
+func (ism *ImprovedServerMonitor) HTTPReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readiness := ism.GetReadiness()
+		
+		w.Header().Set("Content-Type", "application/json")
+		
+		statusCode := http.StatusOK
+		if !readiness.Ready {
+			statusCode = http.StatusServiceUnavailable
+		}
+		
+		w.WriteHeader(statusCode)
+		json.NewEncoder(w).Encode(readiness)
+	}
+}
+
 // GetHealth returns detailed health status for improved server
 func (ism *ImprovedServerMonitor) GetHealth() HealthStatus {
 	health := ism.Monitor.GetHealth()
 	
+	// An idle server is healthy; it is only degraded when required clients are missing
+	if health.Status == "degraded" {
+		health.Status = "healthy"
+	}
+	if health.Status == "healthy" && !ism.GetReadiness().Ready {
+		health.Status = "degraded"
+	}
+	
+	// Add forwarder availability
+	health.Forwarders = ism.server.GetForwarderHealth()
+	if ism.server.cluster != nil {
+		health.Peers = ism.server.cluster.Peers()
+	}
+	withoutClient, criticalDown := 0, 0
+	for _, fw := range health.Forwarders {
+		if !fw.ClientConnected {
+			withoutClient++
+			if fw.Critical {
+				criticalDown++
+			}
+		}
+	}
+	health.Metrics["forwardersWithoutClient"] = withoutClient
+	health.Metrics["criticalForwardersDown"] = criticalDown
+	
 	// Add client information
 	ism.server.clients.mu.RLock()
 	defer ism.server.clients.mu.RUnlock()
@@ -267,10 +443,17 @@ func (ism *ImprovedServerMonitor) GetHealth() HealthStatus {
 		
 		if !session.closed.Load() {
 			sessionHealth := SessionHealth{
-				ID:        session.ID,
-				ClientID:  session.ClientID,
-				Target:    session.Target,
-				CreatedAt: time.Now(), // Would need to track this
+				ID:           session.ID,
+				ClientID:     session.ClientID,
+				Target:       session.Target,
+				CreatedAt:    session.CreatedAt,
+				BytesIn:      session.BytesIn(),
+				BytesOut:     session.BytesOut(),
+				LastActivity: session.LastActivity(),
+			}
+			if session.Metadata.Protocol != "" {
+				metadata := session.Metadata
+				sessionHealth.Metadata = &metadata
 			}
 			health.Sessions = append(health.Sessions, sessionHealth)
 			count++
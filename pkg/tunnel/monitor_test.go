@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestServerReadiness(t *testing.T) {
+	tests := []struct {
+		name      string
+		required  []string
+		connected []string
+		ready     bool
+		missing   []string
+	}{
+		{"nothing required", nil, nil, true, nil},
+		{"required client connected", []string{"db"}, []string{"db", "web"}, true, nil},
+		{"required client missing", []string{"db", "web"}, []string{"web"}, false, []string{"db"}},
+		{"all required clients missing", []string{"db", "web"}, nil, false, []string{"db", "web"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewImprovedServer(zap.NewNop(), "token", nil)
+			for _, id := range tt.connected {
+				server.clients.Add(&ImprovedServerClient{ID: id, server: server})
+			}
+			monitor := NewImprovedServerMonitor(server)
+			monitor.SetRequiredClients(tt.required)
+
+			readiness := monitor.GetReadiness()
+			if readiness.Ready != tt.ready || !reflect.DeepEqual(readiness.MissingClients, tt.missing) {
+				t.Errorf("readiness = %+v, want ready %v missing %v", readiness, tt.ready, tt.missing)
+			}
+
+			recorder := httptest.NewRecorder()
+			monitor.HTTPReadinessHandler()(recorder, httptest.NewRequest(http.MethodGet, "/health/ready", nil))
+			want := http.StatusOK
+			if !tt.ready {
+				want = http.StatusServiceUnavailable
+			}
+			if recorder.Code != want {
+				t.Errorf("readiness status %d, want %d", recorder.Code, want)
+			}
+
+			// Missing clients degrade health without failing liveness
+			recorder = httptest.NewRecorder()
+			monitor.HTTPHealthHandler()(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+			var health HealthStatus
+			if err := json.NewDecoder(recorder.Body).Decode(&health); err != nil {
+				t.Fatal(err)
+			}
+			wantStatus := "healthy"
+			if !tt.ready {
+				wantStatus = "degraded"
+			}
+			if recorder.Code != http.StatusOK || health.Status != wantStatus {
+				t.Errorf("health %d %q, want 200 %q", recorder.Code, health.Status, wantStatus)
+			}
+			if len(health.Clients) != len(tt.connected) {
+				t.Errorf("health lists %d clients, want %d", len(health.Clients), len(tt.connected))
+			}
+
+			recorder = httptest.NewRecorder()
+			monitor.HTTPLivenessHandler()(recorder, httptest.NewRequest(http.MethodGet, "/health/live", nil))
+			if recorder.Code != http.StatusOK {
+				t.Errorf("liveness status %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestServerHealthSessions(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "token", nil)
+	server.clients.Add(&ImprovedServerClient{ID: "db", server: server})
+	external, internal := net.Pipe()
+	defer external.Close()
+	session := server.sessions.Create("s1", "db", "localhost:5432", internal, zap.NewNop())
+	defer session.Close()
+	session.recordIn(10)
+	session.recordOut(25)
+
+	health := NewImprovedServerMonitor(server).GetHealth()
+	if len(health.Clients) != 1 || health.Clients[0].ActiveSessions != 1 {
+		t.Fatalf("clients = %+v", health.Clients)
+	}
+	if len(health.Sessions) != 1 {
+		t.Fatalf("sessions = %+v", health.Sessions)
+	}
+	got := health.Sessions[0]
+	if got.ID != "s1" || got.Target != "localhost:5432" || got.BytesIn != 10 || got.BytesOut != 25 {
+		t.Errorf("session = %+v", got)
+	}
+	if got.CreatedAt.IsZero() || got.LastActivity.Before(got.CreatedAt) {
+		t.Errorf("session times created %v, last activity %v", got.CreatedAt, got.LastActivity)
+	}
+
+	session.Close()
+	if health := NewImprovedServerMonitor(server).GetHealth(); len(health.Sessions) != 0 {
+		t.Errorf("closed session reported: %+v", health.Sessions)
+	}
+}
@@ -0,0 +1,249 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ProtocolPostgres enables PostgreSQL-aware handling of a forwarder or mapping
+const ProtocolPostgres = "postgres"
+
+// PostgreSQL startup codes (protocol 3.0, "Message Formats")
+const (
+	pgProtocolV3        = 196608
+	pgCancelRequestCode = 80877102
+	pgSSLRequestCode    = 80877103
+	pgGSSENCRequestCode = 80877104
+
+	pgMaxStartupLen = 10000 // MAX_STARTUP_PACKET_LENGTH of the server
+)
+
+// pgNegotiationTimeout bounds the startup exchange with an external client
+const pgNegotiationTimeout = 30 * time.Second
+
+// PostgresConfig configures a forwarder with protocol "postgres"
+type PostgresConfig struct {
+	TLSCert    string `yaml:"tls_cert"` // Terminate client TLS on the server with this certificate
+	TLSKey     string `yaml:"tls_key"`
+	RequireTLS bool   `yaml:"require_tls"` // Refuse clients that do not request TLS
+}
+
+// Validate checks a forwarder's PostgreSQL settings
+func (c PostgresConfig) Validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("postgres: tls_cert and tls_key must be set together")
+	}
+	if c.RequireTLS && c.TLSCert == "" {
+		return fmt.Errorf("postgres: require_tls needs tls_cert and tls_key")
+	}
+	if c.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey); err != nil {
+			return fmt.Errorf("postgres: %w", err)
+		}
+	}
+	return nil
+}
+
+// SessionMetadata describes a session as seen by a protocol-aware forwarder.
+// Only connection parameters are recorded, never query contents.
+type SessionMetadata struct {
+	Protocol    string `json:"protocol,omitempty"`
+	User        string `json:"user,omitempty"`
+	Database    string `json:"database,omitempty"`
+	Application string `json:"application,omitempty"`
+	TLS         bool   `json:"tls,omitempty"`    // The external client connection is TLS
+	Cancel      bool   `json:"cancel,omitempty"` // Query cancellation request
+}
+
+// fields returns the metadata as log fields
+func (m SessionMetadata) fields() []zap.Field {
+	if m.Protocol == "" {
+		return nil
+	}
+	fields := []zap.Field{zap.String("protocol", m.Protocol), zap.Bool("tls", m.TLS)}
+	if m.Cancel {
+		return append(fields, zap.Bool("cancel", true))
+	}
+	fields = append(fields, zap.String("user", m.User), zap.String("database", m.Database))
+	if m.Application != "" {
+		fields = append(fields, zap.String("application", m.Application))
+	}
+	return fields
+}
+
+// acceptPostgres runs the startup exchange with an external PostgreSQL
+// client. SSLRequest is answered by the server, terminating TLS if the
+// forwarder has a certificate, and GSSENCRequest is declined. The returned
+// connection replays the startup packet to the database.
+func (s *ImprovedServer) acceptPostgres(conn net.Conn, fw ForwarderConfig) (net.Conn, SessionMetadata, error) {
+	meta := SessionMetadata{Protocol: ProtocolPostgres}
+
+	conn.SetDeadline(time.Now().Add(pgNegotiationTimeout))
+	defer func() { conn.SetDeadline(time.Time{}) }()
+
+	for {
+		packet, err := readPostgresStartup(conn)
+		if err != nil {
+			return nil, meta, fmt.Errorf("failed to read startup packet: %w", err)
+		}
+
+		switch code := binary.BigEndian.Uint32(packet[4:8]); code {
+		case pgSSLRequestCode:
+			if meta.TLS {
+				return nil, meta, fmt.Errorf("SSLRequest received inside TLS")
+			}
+			tlsConfig, err := s.postgresTLS(fw.Postgres)
+			if err != nil || tlsConfig == nil {
+				if err != nil {
+					s.logger.Error("PostgreSQL TLS unavailable", zap.String("forwarder", fw.Name), zap.Error(err))
+				}
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return nil, meta, err
+				}
+				continue
+			}
+			if _, err := conn.Write([]byte{'S'}); err != nil {
+				return nil, meta, err
+			}
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, meta, fmt.Errorf("TLS handshake failed: %w", err)
+			}
+			conn = tlsConn
+			meta.TLS = true
+
+		case pgGSSENCRequestCode:
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return nil, meta, err
+			}
+
+		case pgCancelRequestCode:
+			meta.Cancel = true
+			return &prefixedConn{Conn: conn, pending: packet}, meta, nil
+
+		case pgProtocolV3:
+			if fw.Postgres.RequireTLS && !meta.TLS {
+				conn.Write(pgFatalError("28000", "SSL connection is required"))
+				return nil, meta, fmt.Errorf("client did not request TLS")
+			}
+			params := parsePostgresParameters(packet[8:])
+			meta.User = params["user"]
+			meta.Database = params["database"]
+			if meta.Database == "" {
+				meta.Database = meta.User
+			}
+			meta.Application = params["application_name"]
+			return &prefixedConn{Conn: conn, pending: packet}, meta, nil
+
+		default:
+			conn.Write(pgFatalError("08P01", fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xFFFF)))
+			return nil, meta, fmt.Errorf("unsupported startup code %d", code)
+		}
+	}
+}
+
+// postgresTLS returns the server TLS configuration of a forwarder, or nil if
+// it does not terminate TLS
+func (s *ImprovedServer) postgresTLS(config PostgresConfig) (*tls.Config, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	return s.serverTLS(config.TLSCert, config.TLSKey)
+}
+
+// readPostgresStartup reads a length-prefixed startup packet
+func readPostgresStartup(r io.Reader) ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length < 8 || length > pgMaxStartupLen {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+	packet := make([]byte, length)
+	copy(packet, header)
+	if _, err := io.ReadFull(r, packet[8:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// parsePostgresParameters decodes the name/value pairs of a startup message
+func parsePostgresParameters(data []byte) map[string]string {
+	params := make(map[string]string)
+	fields := bytes.Split(data, []byte{0})
+	for i := 0; i+1 < len(fields) && len(fields[i]) > 0; i += 2 {
+		params[string(fields[i])] = string(fields[i+1])
+	}
+	return params
+}
+
+// pgFatalError encodes an ErrorResponse with FATAL severity
+func pgFatalError(code, message string) []byte {
+	var body []byte
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{{'S', "FATAL"}, {'V', "FATAL"}, {'C', code}, {'M', message}} {
+		body = append(append(append(body, field.kind), field.value...), 0)
+	}
+	body = append(body, 0)
+
+	msg := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// startPostgresTLS negotiates TLS with a PostgreSQL server by sending
+// SSLRequest before the handshake
+func startPostgresTLS(conn net.Conn, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], pgSSLRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, fmt.Errorf("failed to read SSLRequest reply: %w", err)
+	}
+	if reply[0] != 'S' {
+		return nil, fmt.Errorf("server does not support TLS")
+	}
+
+	tlsConn := tls.Client(conn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// prefixedConn returns buffered bytes before reading from the connection
+type prefixedConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
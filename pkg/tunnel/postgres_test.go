@@ -0,0 +1,228 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// pgPacket encodes a startup packet with a code and name/value parameters
+func pgPacket(code uint32, params ...string) []byte {
+	packet := make([]byte, 8)
+	binary.BigEndian.PutUint32(packet[4:8], code)
+	for _, param := range params {
+		packet = append(append(packet, param...), 0)
+	}
+	if len(params) > 0 {
+		packet = append(packet, 0)
+	}
+	binary.BigEndian.PutUint32(packet[0:4], uint32(len(packet)))
+	return packet
+}
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestAcceptPostgres(t *testing.T) {
+	startup := pgPacket(pgProtocolV3, "user", "alice", "database", "orders", "application_name", "psql")
+	cancel := make([]byte, 16)
+	binary.BigEndian.PutUint32(cancel[0:4], 16)
+	binary.BigEndian.PutUint32(cancel[4:8], pgCancelRequestCode)
+
+	tests := []struct {
+		name     string
+		postgres PostgresConfig
+		packets  [][]byte
+		replies  string // Bytes the server answers before the startup packet
+		meta     SessionMetadata
+		replayed []byte // Packet passed on to the database; nil if refused
+	}{
+		{
+			name:     "startup",
+			packets:  [][]byte{startup},
+			meta:     SessionMetadata{Protocol: ProtocolPostgres, User: "alice", Database: "orders", Application: "psql"},
+			replayed: startup,
+		},
+		{
+			name:     "database defaults to user",
+			packets:  [][]byte{pgPacket(pgProtocolV3, "user", "bob")},
+			meta:     SessionMetadata{Protocol: ProtocolPostgres, User: "bob", Database: "bob"},
+			replayed: pgPacket(pgProtocolV3, "user", "bob"),
+		},
+		{
+			name:     "TLS declined without a certificate",
+			packets:  [][]byte{pgPacket(pgSSLRequestCode), startup},
+			replies:  "N",
+			meta:     SessionMetadata{Protocol: ProtocolPostgres, User: "alice", Database: "orders", Application: "psql"},
+			replayed: startup,
+		},
+		{
+			name:     "GSS encryption declined",
+			packets:  [][]byte{pgPacket(pgGSSENCRequestCode), pgPacket(pgSSLRequestCode), startup},
+			replies:  "NN",
+			meta:     SessionMetadata{Protocol: ProtocolPostgres, User: "alice", Database: "orders", Application: "psql"},
+			replayed: startup,
+		},
+		{
+			name:     "cancel request",
+			packets:  [][]byte{cancel},
+			meta:     SessionMetadata{Protocol: ProtocolPostgres, Cancel: true},
+			replayed: cancel,
+		},
+		{
+			name:     "TLS required",
+			postgres: PostgresConfig{RequireTLS: true},
+			packets:  [][]byte{startup},
+			replies:  string(pgFatalError("28000", "SSL connection is required")),
+		},
+		{
+			name:    "unsupported protocol",
+			packets: [][]byte{pgPacket(2 << 16)},
+			replies: string(pgFatalError("08P01", "unsupported frontend protocol 2.0")),
+		},
+	}
+
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			for _, packet := range tt.packets {
+				if _, err := client.Write(packet); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			accepted, meta, err := server.acceptPostgres(conn, ForwarderConfig{Name: "db", Postgres: tt.postgres})
+			if tt.replayed == nil {
+				if err == nil {
+					t.Fatal("expected the startup to be refused")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			replies := make([]byte, len(tt.replies))
+			if _, err := io.ReadFull(client, replies); err != nil {
+				t.Fatal(err)
+			}
+			if string(replies) != tt.replies {
+				t.Errorf("replies %q, want %q", replies, tt.replies)
+			}
+			if tt.replayed == nil {
+				return
+			}
+
+			if meta != tt.meta {
+				t.Errorf("metadata %+v, want %+v", meta, tt.meta)
+			}
+			replayed := make([]byte, len(tt.replayed))
+			if _, err := io.ReadFull(accepted, replayed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(replayed, tt.replayed) {
+				t.Errorf("replayed %q, want %q", replayed, tt.replayed)
+			}
+		})
+	}
+}
+
+func TestReadPostgresStartup(t *testing.T) {
+	length := func(n uint32) []byte {
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, n)
+		return header
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"SSLRequest", pgPacket(pgSSLRequestCode), true},
+		{"startup", pgPacket(pgProtocolV3, "user", "alice"), true},
+		{"too short", length(4), false},
+		{"too long", length(pgMaxStartupLen + 1), false},
+		{"truncated header", []byte{0, 0, 0}, false},
+		{"truncated body", pgPacket(pgProtocolV3, "user", "alice")[:12], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packet, err := readPostgresStartup(bytes.NewReader(tt.input))
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("got %q, want an error", packet)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(packet, tt.input) {
+				t.Errorf("got %q, want %q", packet, tt.input)
+			}
+		})
+	}
+}
+
+func TestParsePostgresParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want map[string]string
+	}{
+		{"empty", nil, map[string]string{}},
+		{"terminated", []byte("user\x00alice\x00database\x00orders\x00\x00"), map[string]string{"user": "alice", "database": "orders"}},
+		{"empty value", []byte("user\x00alice\x00options\x00\x00\x00"), map[string]string{"user": "alice", "options": ""}},
+		{"missing terminator", []byte("user\x00alice"), map[string]string{"user": "alice"}},
+		{"stops at empty name", []byte("user\x00alice\x00\x00database\x00orders\x00"), map[string]string{"user": "alice"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePostgresParameters(tt.data)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, value := range tt.want {
+				if got[name] != value {
+					t.Errorf("%s = %q, want %q", name, got[name], value)
+				}
+			}
+		})
+	}
+}
+
+func TestPgFatalError(t *testing.T) {
+	msg := pgFatalError("28000", "no")
+	want := "E\x00\x00\x00\x1eSFATAL\x00VFATAL\x00C28000\x00Mno\x00\x00"
+	if string(msg) != want {
+		t.Errorf("got %q, want %q", msg, want)
+	}
+}
@@ -0,0 +1,248 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PROXY protocol versions a mapping can emit
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// proxyHeaderTimeout bounds how long a load balancer may take to send the header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the longest v1 header, including CRLF
+const proxyV1MaxLen = 107
+
+// formatProxyHeader encodes a PROXY protocol header for a connection from
+// source to destination. Addresses that are not TCP endpoints of the same
+// family are sent as UNKNOWN (v1) or LOCAL (v2).
+func formatProxyHeader(version, source, destination string) []byte {
+	src, srcErr := net.ResolveTCPAddr("tcp", source)
+	dst, dstErr := net.ResolveTCPAddr("tcp", destination)
+	known := srcErr == nil && dstErr == nil && src.IP != nil && dst.IP != nil &&
+		(src.IP.To4() == nil) == (dst.IP.To4() == nil)
+
+	if version == ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if src.IP.To4() != nil {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port))
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	if !known {
+		return append(header, 0x20, 0x00, 0x00, 0x00) // LOCAL, UNSPEC
+	}
+	var addresses []byte
+	family := byte(0x21) // TCP over IPv6
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil {
+		family = 0x11 // TCP over IPv4
+		addresses = append(append(addresses, src4...), dst4...)
+	} else {
+		addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(src.Port))
+	addresses = binary.BigEndian.AppendUint16(addresses, uint16(dst.Port))
+
+	header = append(header, 0x21, family) // PROXY command
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header without consuming
+// any data after it. Source and destination are nil for LOCAL and UNKNOWN
+// headers, whose connection addresses should be used as they are.
+func readProxyHeader(r io.Reader) (source, destination net.Addr, err error) {
+	prefix := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return nil, nil, fmt.Errorf("missing PROXY protocol header")
+	}
+
+	// v1: read up to CRLF one byte at a time so no payload is consumed
+	line := prefix
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, nil, fmt.Errorf("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseProxyV1(strings.TrimSuffix(string(line), "\r\n"))
+}
+
+// parseProxyV1 decodes a v1 header line without its CRLF
+func parseProxyV1(line string) (net.Addr, net.Addr, error) {
+	fields := strings.Fields(line)
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyV2 decodes the rest of a v2 header after its signature
+func readProxyV2(r io.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version %d", head[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[2:4]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections (health checks) keep their own addresses
+	if head[0]&0x0F == 0x00 {
+		return nil, nil, nil
+	}
+	switch head[1] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, nil, fmt.Errorf("short PROXY v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))},
+			&net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, nil, fmt.Errorf("short PROXY v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))},
+			&net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}, nil
+	}
+	// Other families are accepted but carry no usable address
+	return nil, nil, nil
+}
+
+// addrConn reports the addresses announced by a PROXY protocol header
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+
+// proxyProtocolListener reads the PROXY header of every accepted connection
+// before handing it out. Connections from outside the trusted networks or
+// without a valid header are closed.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	logger  *zap.Logger
+	conns   chan net.Conn
+	done    chan struct{}
+	err     error
+	once    sync.Once
+}
+
+// newProxyProtocolListener wraps a forwarder listener behind a load balancer
+func newProxyProtocolListener(listener net.Listener, trusted []*net.IPNet, logger *zap.Logger) *proxyProtocolListener {
+	l := &proxyProtocolListener{
+		Listener: listener,
+		trusted:  trusted,
+		logger:   logger,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop accepts connections and reads their headers concurrently, so a
+// slow peer cannot hold up the others
+func (l *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			l.err = err
+			l.once.Do(func() { close(l.done) })
+			return
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyProtocolListener) readHeader(conn net.Conn) {
+	// Only the load balancers may announce addresses
+	if peer, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !containsIP(l.trusted, peer.IP) {
+		l.logger.Warn("Rejecting PROXY protocol connection from an untrusted address",
+			zap.String("remote", conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	source, destination, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		l.logger.Warn("Rejecting connection without a valid PROXY header",
+			zap.String("remote", conn.RemoteAddr().String()),
+			zap.Error(err))
+		conn.Close()
+		return
+	}
+
+	if source != nil {
+		conn = &addrConn{Conn: conn, remote: source, local: destination}
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next connection whose header has been read
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
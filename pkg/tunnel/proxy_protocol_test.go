@@ -0,0 +1,246 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     string
+		source      string
+		destination string
+		header      string // Expected header for v1
+		known       bool
+	}{
+		{"v1 ipv4", ProxyProtocolV1, "192.0.2.10:51000", "198.51.100.1:443", "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n", true},
+		{"v1 ipv6", ProxyProtocolV1, "[2001:db8::1]:51000", "[2001:db8::2]:443", "PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n", true},
+		{"v1 mixed families", ProxyProtocolV1, "192.0.2.10:51000", "[2001:db8::2]:443", "PROXY UNKNOWN\r\n", false},
+		{"v1 unix source", ProxyProtocolV1, "@", "198.51.100.1:443", "PROXY UNKNOWN\r\n", false},
+		{"v2 ipv4", ProxyProtocolV2, "192.0.2.10:51000", "198.51.100.1:443", "", true},
+		{"v2 ipv6", ProxyProtocolV2, "[2001:db8::1]:51000", "[2001:db8::2]:443", "", true},
+		{"v2 mixed families", ProxyProtocolV2, "[2001:db8::1]:51000", "198.51.100.1:443", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := formatProxyHeader(tt.version, tt.source, tt.destination)
+			if tt.header != "" && string(header) != tt.header {
+				t.Errorf("header %q, want %q", header, tt.header)
+			}
+
+			// The payload after the header must not be consumed
+			r := bytes.NewReader(append(header, "payload"...))
+			source, destination, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+				t.Errorf("remaining data %q, want payload", rest)
+			}
+
+			if !tt.known {
+				if source != nil || destination != nil {
+					t.Errorf("got %v -> %v, want no addresses", source, destination)
+				}
+				return
+			}
+			if source == nil || source.String() != tt.source {
+				t.Errorf("source %v, want %s", source, tt.source)
+			}
+			if destination == nil || destination.String() != tt.destination {
+				t.Errorf("destination %v, want %s", destination, tt.destination)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	v2 := func(versionCommand byte, family byte, body ...byte) string {
+		header := append([]byte(nil), proxyV2Signature...)
+		header = append(header, versionCommand, family, 0, byte(len(body)))
+		return string(append(header, body...))
+	}
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"no header", "GET / HTTP/1.1\r\n\r\n"},
+		{"short input", "PROXY"},
+		{"v1 unknown family", "PROXY UDP4 192.0.2.10 198.51.100.1 51000 443\r\n"},
+		{"v1 missing port", "PROXY TCP4 192.0.2.10 198.51.100.1 51000\r\n"},
+		{"v1 invalid address", "PROXY TCP4 192.0.2.300 198.51.100.1 51000 443\r\n"},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.10 198.51.100.1 65536 443\r\n"},
+		{"v1 too long", "PROXY TCP4 " + string(bytes.Repeat([]byte("1"), proxyV1MaxLen)) + "\r\n"},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443"},
+		{"v2 version 1", v2(0x11, 0x11, make([]byte, 12)...)},
+		{"v2 short ipv4", v2(0x21, 0x11, make([]byte, 8)...)},
+		{"v2 short ipv6", v2(0x21, 0x21, make([]byte, 12)...)},
+		{"v2 truncated body", v2(0x21, 0x11, make([]byte, 12)...)[:len(proxyV2Signature)+8]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if source, destination, err := readProxyHeader(bytes.NewReader([]byte(tt.input))); err == nil {
+				t.Errorf("got %v -> %v, want an error", source, destination)
+			}
+		})
+	}
+}
+
+func TestReadProxyV2Local(t *testing.T) {
+	// LOCAL headers from health checks and unsupported families carry no addresses
+	for _, header := range [][]byte{
+		append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00),
+		append(append([]byte(nil), proxyV2Signature...), 0x21, 0x31, 0x00, 0x02, 'x', 'y'),
+	} {
+		source, destination, err := readProxyHeader(bytes.NewReader(header))
+		if err != nil || source != nil || destination != nil {
+			t.Errorf("%x: got %v -> %v, %v", header, source, destination, err)
+		}
+	}
+}
+
+func TestProxyProtocolListenerTrust(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		header  string
+		remote  string // Address the accepted connection reports; empty if rejected
+	}{
+		{"trusted load balancer", []string{"127.0.0.0/8"}, "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n", "192.0.2.10:51000"},
+		{"untrusted peer", []string{"192.0.2.0/24"}, "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n", ""},
+		{"no trusted networks", nil, "PROXY TCP4 192.0.2.10 198.51.100.1 51000 443\r\n", ""},
+		{"invalid header", []string{"127.0.0.0/8"}, "GET / HTTP/1.1\r\n\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trusted, err := parseNetworks(tt.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener := newProxyProtocolListener(inner, trusted, zap.NewNop())
+			defer listener.Close()
+
+			conn, err := net.Dial("tcp", inner.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte(tt.header)); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.remote == "" {
+				// The connection is closed without being handed out
+				if n, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Fatalf("read %d bytes from a rejected connection", n)
+				}
+				return
+			}
+			accepted, err := listener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer accepted.Close()
+			if accepted.RemoteAddr().String() != tt.remote {
+				t.Errorf("remote %v, want %s", accepted.RemoteAddr(), tt.remote)
+			}
+		})
+	}
+}
+
+func TestHTTPRouteProxyHeader(t *testing.T) {
+	// The service reports the addresses its PROXY header announced
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			conn, err := service.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				source, destination, err := readProxyHeader(reader)
+				if err != nil {
+					return
+				}
+				for {
+					req, err := http.ReadRequest(reader)
+					if err != nil {
+						return
+					}
+					req.Body.Close()
+					body := fmt.Sprintf("%v %v", source, destination)
+					fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+				}
+			}()
+		}
+	}()
+
+	port, routePort := freePort(t), freePort(t)
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:    "web",
+		Type:    ForwarderHTTP,
+		Port:    port,
+		Enabled: true,
+		Routes:  []HTTPRoute{{ClientID: "c1", Port: routePort}},
+	}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	startTestClientOptions(t, server, web.URL, "c1",
+		map[int]string{routePort: service.Addr().String()},
+		map[int]MappingOptions{routePort: {ProxyProtocol: ProxyProtocolV1}})
+	if err := server.StartTCPForwarder(port, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	// Each external connection gets its own session with its own address
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		for j := 0; j < 2; j++ {
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n")
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if want := conn.LocalAddr().String() + " " + conn.RemoteAddr().String(); string(body) != want {
+				t.Errorf("service saw %q, want %q", body, want)
+			}
+		}
+	}
+}
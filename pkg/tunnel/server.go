@@ -39,6 +39,13 @@ type Message struct {
 	Data    json.RawMessage `json:"data,omitempty"`
 }
 
+// ShutdownNotice is the payload of a "shutdown" message telling a client that
+// the server is draining and it should reconnect to another instance
+type ShutdownNotice struct {
+	Reason   string    `json:"reason"`
+	Deadline time.Time `json:"deadline,omitempty"`
+}
+
 func NewServer(logger *zap.Logger, authToken string) *Server {
 	return &Server{
 		logger:         logger,
@@ -2,12 +2,15 @@ package tunnel
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,20 +24,86 @@ type ForwarderConfig struct {
 	Name          string `yaml:"name"`
 	Port          int    `yaml:"port"`
 	ClientID      string `yaml:"client_id"`
+	Target        string `yaml:"target"` // Pushed to clients that allow it; empty leaves the target to the client
+	ClientIDs     []string `yaml:"client_ids"`   // Additional clients serving this forwarder
+	ClientGroup   string   `yaml:"client_group"` // Any client registered with this group label
+	Balance       string   `yaml:"balance"`      // round-robin (default), least-sessions or priority
 	Enabled       bool   `yaml:"enabled"`
 	Description   string `yaml:"description"`
 	WarningOnFail bool   `yaml:"warning_on_fail"`
+	Critical      bool   `yaml:"critical"` // Alert and fail readiness when the client is offline
+
+	// HTTP forwarders route requests on one port by Host header and path
+	Type    string      `yaml:"type"` // "tcp" (default) or "http"
+	Routes  []HTTPRoute `yaml:"routes"`
+	Inspect bool        `yaml:"inspect"` // Capture requests for the inspector (http only)
+
+	// Expect a PROXY protocol v1/v2 header from a load balancer on every connection
+	AcceptProxyProtocol bool     `yaml:"accept_proxy_protocol"`
+	TrustedProxies      []string `yaml:"trusted_proxies"` // CIDRs of the load balancers; other peers are rejected
+
+	// Terminate TLS from external users; sessions to the client carry plaintext
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// Protocol-aware handling; empty forwards raw TCP
+	Protocol string         `yaml:"protocol"` // "postgres"
+	Postgres PostgresConfig `yaml:"postgres"`
+
+	// Hold incoming connections while the client reconnects
+	ReconnectWait  time.Duration `yaml:"reconnect_wait"`  // How long to park a connection (0 disables)
+	ReconnectQueue int           `yaml:"reconnect_queue"` // Max parked connections (default 32)
+
+	// Rate limits and byte quotas
+	Bandwidth BandwidthConfig `yaml:"bandwidth"`
+
+	// Session limits; zero leaves them unlimited or at their defaults
+	MaxSessions      int           `yaml:"max_sessions"`        // Concurrent sessions of the forwarder
+	MaxSessionsPerIP int           `yaml:"max_sessions_per_ip"` // Concurrent sessions from one source address
+	IdleTimeout      time.Duration `yaml:"idle_timeout"`        // No data in either direction (default 5m)
+	MaxDuration      time.Duration `yaml:"max_duration"`        // Absolute session lifetime
+	ConnectTimeout   time.Duration `yaml:"connect_timeout"`     // Time for the client to reach its service (default 10s)
+
+	// Maintenance windows and just-in-time access; the listener is closed otherwise
+	Access AccessConfig `yaml:"access"`
+
+	owner string // Forwarder a route belongs to; its limits apply to the route's sessions
 }
 
+// defaultReconnectQueue bounds parked connections when ReconnectQueue is unset
+const defaultReconnectQueue = 32
+
 // ImprovedServer handles WebSocket tunnel connections with improved reliability
 type ImprovedServer struct {
-	logger     *zap.Logger
-	authToken  string
-	clients    *ClientManager
-	sessions   *SessionManager
-	upgrader   websocket.Upgrader
-	config     ServerConfig
-	clientPorts map[string]bool // clientID -> enabled mapping
+	logger       *zap.Logger
+	authToken    string
+	clients      *ClientManager
+	sessions     *SessionManager
+	upgrader     websocket.Upgrader
+	config       ServerConfig
+	clientPorts  map[string]bool // clientID -> enabled mapping
+	metrics      *MetricsStore
+	forwarders   []ForwarderConfig // enabled forwarders
+	forwardersMu sync.RWMutex
+	dynamic      *DynamicForwarders
+	egress       *Egress
+	cluster      *Cluster // nil unless cluster mode is enabled
+	availability *ClientAvailability
+	parked       map[int]int // port -> connections waiting for a client
+	parkedMu     sync.Mutex
+	balancer     *ClientBalancer
+	listeners    map[int]net.Listener // port -> forwarder listener
+	listenersMu  sync.Mutex
+	certs        map[string]*certificate // certificate and key path -> certificate of forwarders terminating TLS
+	certsMu      sync.Mutex
+	inspector    *Inspector // nil unless the request inspector is enabled
+	bandwidth    *Bandwidth
+	limits       *sessionLimits
+	access       *AccessControl
+	shares       *Shares
+	draining     atomic.Bool
+	ctx          context.Context // cancelled when shutdown begins
+	cancel       context.CancelFunc
 }
 
 // ServerConfig holds server configuration
@@ -63,14 +132,19 @@ func DefaultServerConfig() ServerConfig {
 
 // ClientManager handles client connections with thread-safe operations
 type ClientManager struct {
-	clients map[string]*ImprovedServerClient
-	mu      sync.RWMutex
-	logger  *zap.Logger
+	clients      map[string]*ImprovedServerClient
+	mu           sync.RWMutex
+	logger       *zap.Logger
+	metrics      *MetricsStore
+	availability *ClientAvailability
+	joined       chan struct{}                // closed and replaced whenever a client connects
+	onRemove     func(*ImprovedServerClient) // called after a client has left
 }
 
 func NewClientManager(logger *zap.Logger) *ClientManager {
 	return &ClientManager{
 		clients: make(map[string]*ImprovedServerClient),
+		joined:  make(chan struct{}),
 		logger:  logger,
 	}
 }
@@ -78,18 +152,104 @@ func NewClientManager(logger *zap.Logger) *ClientManager {
 func (cm *ClientManager) Add(client *ImprovedServerClient) {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
+	
+	// A reconnecting client replaces its stale connection
+	if old, exists := cm.clients[client.ID]; exists && old != client {
+		old.Close()
+		if cm.metrics != nil {
+			cm.metrics.DecrementConnections()
+		}
+		if cm.availability != nil {
+			cm.availability.MarkDown(old.availabilityKeys()...)
+		}
+		cm.logger.Info("Replacing stale client connection", zap.String("clientID", client.ID))
+	}
+	
 	cm.clients[client.ID] = client
-	cm.logger.Info("Client added", zap.String("clientID", client.ID))
+	if cm.metrics != nil {
+		cm.metrics.IncrementConnections()
+	}
+	if cm.availability != nil {
+		cm.availability.MarkUp(client.availabilityKeys()...)
+	}
+	
+	// Wake connections waiting for a client to join
+	close(cm.joined)
+	cm.joined = make(chan struct{})
+	
+	cm.logger.Info("Client added", zap.String("clientID", client.ID), zap.String("group", client.Group))
+}
+
+// RemoveClient removes a client only if it is still the registered connection for its ID
+func (cm *ClientManager) RemoveClient(client *ImprovedServerClient) {
+	cm.mu.RLock()
+	current, exists := cm.clients[client.ID]
+	cm.mu.RUnlock()
+	
+	if exists && current == client {
+		cm.Remove(client.ID)
+		return
+	}
+	client.Close()
+}
+
+// Matching returns connected clients accepted by match, sorted by ID
+func (cm *ClientManager) Matching(match func(*ImprovedServerClient) bool) []*ImprovedServerClient {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	
+	var result []*ImprovedServerClient
+	for _, client := range cm.clients {
+		if match(client) {
+			result = append(result, client)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+// WaitFor blocks until a client accepted by match is connected or ctx is done
+func (cm *ClientManager) WaitFor(ctx context.Context, match func(*ImprovedServerClient) bool) (*ImprovedServerClient, bool) {
+	for {
+		cm.mu.RLock()
+		joined := cm.joined
+		for _, client := range cm.clients {
+			if match(client) {
+				cm.mu.RUnlock()
+				return client, true
+			}
+		}
+		cm.mu.RUnlock()
+		
+		select {
+		case <-joined:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
 }
 
 func (cm *ClientManager) Remove(clientID string) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	if client, exists := cm.clients[clientID]; exists {
+	client, exists := cm.clients[clientID]
+	if exists {
 		client.Close()
 		delete(cm.clients, clientID)
+		if cm.metrics != nil {
+			cm.metrics.DecrementConnections()
+		}
+		if cm.availability != nil {
+			cm.availability.MarkDown(client.availabilityKeys()...)
+		}
 		cm.logger.Info("Client removed", zap.String("clientID", clientID))
 	}
+	cm.mu.Unlock()
+	
+	if exists && cm.onRemove != nil {
+		cm.onRemove(client)
+	}
 }
 
 func (cm *ClientManager) Get(clientID string) (*ImprovedServerClient, bool) {
@@ -104,6 +264,7 @@ type SessionManager struct {
 	sessions map[string]*TCPSession
 	mu       sync.RWMutex
 	logger   *zap.Logger
+	metrics  *MetricsStore
 }
 
 func NewSessionManager(logger *zap.Logger) *SessionManager {
@@ -117,14 +278,33 @@ func NewSessionManager(logger *zap.Logger) *SessionManager {
 type TCPSession struct {
 	ID         string
 	ClientID   string
+	Forwarder  string // Empty for egress sessions
+	route      string // Forwarder the session came in through, when it counts against another
 	Conn       net.Conn
 	Target     string
+	CreatedAt  time.Time
+	Metadata   SessionMetadata // Set by protocol-aware forwarders
 	ctx        context.Context
 	cancel     context.CancelFunc
 	writeQueue chan []byte
 	closed     atomic.Bool
+	done       chan struct{} // Closed when the session stops taking writes; the queue is never closed
 	ready      chan struct{}  // Signals when client has connected to local service
+	connectErr chan string    // Signals when client failed to connect to local service
+	established atomic.Bool   // Set once data flow has started
 	logger     *zap.Logger
+
+	bytesIn      atomic.Int64 // bytes read from the external connection
+	bytesOut     atomic.Int64 // bytes written to the external connection
+	lastActivity atomic.Int64 // unix nanoseconds of the last transfer
+
+	throttle atomic.Pointer[sessionThrottle]      // Rate limits of the forwarder and the client serving the session
+	pausedBy atomic.Pointer[ImprovedServerClient] // Client asked to stop sending until the write queue drains
+	resume   func(client *ImprovedServerClient)   // Lets a paused client send again; nil for egress sessions
+
+	idleTimeout time.Duration          // Close after no data in either direction for this long
+	maxDuration time.Duration          // Close after this long regardless of activity; 0 is unlimited
+	closeReason atomic.Pointer[string] // Why the session ended, see CloseReason
 }
 
 func (sm *SessionManager) Create(sessionID, clientID, target string, conn net.Conn, logger *zap.Logger) *TCPSession {
@@ -134,16 +314,26 @@ func (sm *SessionManager) Create(sessionID, clientID, target string, conn net.Co
 		ClientID:   clientID,
 		Conn:       conn,
 		Target:     target,
+		CreatedAt:  time.Now(),
 		ctx:        ctx,
 		cancel:     cancel,
 		writeQueue: make(chan []byte, 256),
+		done:       make(chan struct{}),
 		ready:      make(chan struct{}, 1),
+		connectErr: make(chan string, 1),
 		logger:     logger,
+		idleTimeout: defaultIdleTimeout,
 	}
+	session.lastActivity.Store(session.CreatedAt.UnixNano())
 	
 	sm.mu.Lock()
 	sm.sessions[sessionID] = session
 	sm.mu.Unlock()
+
+	if sm.metrics != nil {
+		sm.metrics.sessionsTotal.Add(1)
+		sm.metrics.sessionsActive.Add(1)
+	}
 	
 	// Start write pump for the session
 	go session.writePump()
@@ -165,26 +355,162 @@ func (sm *SessionManager) Remove(sessionID string) {
 	if session, exists := sm.sessions[sessionID]; exists {
 		session.Close()
 		delete(sm.sessions, sessionID)
+		if sm.metrics != nil {
+			sm.metrics.sessionsActive.Add(-1)
+		}
 		sm.logger.Debug("Session removed", zap.String("sessionID", sessionID))
 	}
 }
 
+// GetOwned retrieves a session only if it is currently assigned to clientID
+func (sm *SessionManager) GetOwned(sessionID, clientID string) (*TCPSession, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	session, exists := sm.sessions[sessionID]
+	if !exists || session.ClientID != clientID {
+		return nil, false
+	}
+	return session, true
+}
+
+// Assign hands a session over to another client and returns fresh channels
+// for its connect reply, so a late reply from an earlier candidate is never
+// taken for the new client's
+func (sm *SessionManager) Assign(session *TCPSession, clientID string) (ready chan struct{}, connectErr chan string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	session.ClientID = clientID
+	session.ready = make(chan struct{}, 1)
+	session.connectErr = make(chan string, 1)
+	return session.ready, session.connectErr
+}
+
+// signalReady passes on a client's confirmation that it connected a session,
+// if the client still owns it
+func (sm *SessionManager) signalReady(sessionID, clientID string) bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	session, exists := sm.sessions[sessionID]
+	if !exists || session.ClientID != clientID {
+		return false
+	}
+	select {
+	case session.ready <- struct{}{}:
+	default:
+		// Already signalled
+	}
+	return true
+}
+
+// signalConnectError passes on a client's failure to connect a session, if
+// the client still owns it
+func (sm *SessionManager) signalConnectError(sessionID, clientID, reason string) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	session, exists := sm.sessions[sessionID]
+	if !exists || session.ClientID != clientID {
+		return
+	}
+	select {
+	case session.connectErr <- reason:
+	default:
+	}
+}
+
+// closeForwarderSessions ends the open sessions of a forwarder, including
+// those of routes counting against it, and returns how many there were
+func (s *ImprovedServer) closeForwarderSessions(name, reason string) int {
+	s.sessions.mu.RLock()
+	var sessions []*TCPSession
+	for _, session := range s.sessions.sessions {
+		if session.Forwarder == name || session.route == name {
+			sessions = append(sessions, session)
+		}
+	}
+	s.sessions.mu.RUnlock()
+
+	for _, session := range sessions {
+		session.setCloseReason(reason)
+		session.Close()
+	}
+	return len(sessions)
+}
+
+// Count returns the number of open sessions
+func (sm *SessionManager) Count() int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return len(sm.sessions)
+}
+
+// IDs returns the IDs of all open sessions
+func (sm *SessionManager) IDs() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	ids := make([]string, 0, len(sm.sessions))
+	for id := range sm.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// CountByClient returns the number of open sessions per client
+func (sm *SessionManager) CountByClient() map[string]int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, session := range sm.sessions {
+		if !session.closed.Load() {
+			counts[session.ClientID]++
+		}
+	}
+	return counts
+}
+
+// LastActivity returns the time data last flowed through the session
+func (s *TCPSession) LastActivity() time.Time {
+	return time.Unix(0, s.lastActivity.Load())
+}
+
+// BytesIn returns the number of bytes read from the external connection
+func (s *TCPSession) BytesIn() int64 {
+	return s.bytesIn.Load()
+}
+
+// BytesOut returns the number of bytes written to the external connection
+func (s *TCPSession) BytesOut() int64 {
+	return s.bytesOut.Load()
+}
+
+// recordIn accounts for n bytes received from the external connection
+func (s *TCPSession) recordIn(n int) {
+	s.bytesIn.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// recordOut accounts for n bytes delivered to the external connection
+func (s *TCPSession) recordOut(n int) {
+	s.bytesOut.Add(int64(n))
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
 // Close safely closes the TCP session
 func (s *TCPSession) Close() {
 	if s.closed.CompareAndSwap(false, true) {
-		s.cancel()
-		close(s.writeQueue)
-		
-		// Close ready channel if not already closed
-		select {
-		case <-s.ready:
-		default:
-			close(s.ready)
-		}
-		
-		s.Conn.Close()
+		close(s.done)
 		s.logger.Debug("Session closed", zap.String("sessionID", s.ID))
 	}
+	// A session closing after its writes may still be running
+	s.cancel()
+	s.Conn.Close()
+}
+
+// CloseAfterWrites closes the session once data already queued has been
+// written, which may take a while on a rate limited session
+func (s *TCPSession) CloseAfterWrites() {
+	if s.closed.CompareAndSwap(false, true) {
+		close(s.done)
+	}
 }
 
 // Write queues data for writing to the TCP connection
@@ -209,15 +535,23 @@ func (s *TCPSession) writePump() {
 	
 	for {
 		select {
-		case data, ok := <-s.writeQueue:
-			if !ok {
+		case data := <-s.writeQueue:
+			if !s.writeData(data) {
 				return
 			}
 			
-			s.Conn.SetWriteDeadline(time.Now().Add(1 * time.Minute))
-			if _, err := s.Conn.Write(data); err != nil {
-				s.logger.Error("TCP write error", zap.String("sessionID", s.ID), zap.Error(err))
-				return
+		case <-s.done:
+			// Flush what was queued before the close, then stop
+			for {
+				select {
+				case data := <-s.writeQueue:
+					if !s.writeData(data) {
+						return
+					}
+				default:
+					s.cancel()
+					return
+				}
 			}
 			
 		case <-s.ctx.Done():
@@ -226,9 +560,29 @@ func (s *TCPSession) writePump() {
 	}
 }
 
+// writeData writes one queued chunk to the TCP connection and reports
+// whether the pump should continue
+func (s *TCPSession) writeData(data []byte) bool {
+	if err := s.throttle.Load().waitDownload(s.ctx, len(data)); err != nil {
+		return false
+	}
+	s.Conn.SetWriteDeadline(time.Now().Add(1 * time.Minute))
+	n, err := s.Conn.Write(data)
+	s.recordOut(n)
+	if err != nil {
+		s.logger.Error("TCP write error", zap.String("sessionID", s.ID), zap.Error(err))
+		return false
+	}
+	if client := s.pausedBy.Load(); client != nil && len(s.writeQueue) <= writeQueueLowWater && s.pausedBy.CompareAndSwap(client, nil) {
+		s.resume(client)
+	}
+	return true
+}
+
 // ImprovedServerClient represents a connected tunnel client
 type ImprovedServerClient struct {
 	ID          string
+	Group       string // Optional client group label used by forwarders
 	Conn        *websocket.Conn
 	Send        chan []byte
 	server      *ImprovedServer
@@ -238,25 +592,61 @@ type ImprovedServerClient struct {
 	closeOnce   sync.Once
 }
 
+// availabilityKeys returns the keys under which the client is tracked as available
+func (c *ImprovedServerClient) availabilityKeys() []string {
+	if c.Group != "" {
+		return []string{c.ID, groupKey(c.Group)}
+	}
+	return []string{c.ID}
+}
+
 // NewImprovedServer creates a new improved tunnel server
 func NewImprovedServer(logger *zap.Logger, authToken string, forwarders []ForwarderConfig) *ImprovedServer {
 	config := DefaultServerConfig()
 	
 	// Build client permissions mapping
 	clientPorts := make(map[string]bool)
+	var enabled []ForwarderConfig
 	for _, fw := range forwarders {
 		if fw.Enabled {
-			clientPorts[fw.ClientID] = true
+			for _, id := range fw.clientIDs() {
+				clientPorts[id] = true
+			}
+			enabled = append(enabled, fw)
 		}
 	}
 	
-	return &ImprovedServer{
-		logger:      logger,
-		authToken:   authToken,
-		clients:     NewClientManager(logger),
-		sessions:    NewSessionManager(logger),
-		config:      config,
-		clientPorts: clientPorts,
+	metrics := NewMetricsStore()
+	availability := NewClientAvailability()
+	clients := NewClientManager(logger)
+	clients.metrics = metrics
+	clients.availability = availability
+	sessions := NewSessionManager(logger)
+	sessions.metrics = metrics
+	
+	ctx, cancel := context.WithCancel(context.Background())
+	
+	s := &ImprovedServer{
+		logger:       logger,
+		authToken:    authToken,
+		clients:      clients,
+		sessions:     sessions,
+		config:       config,
+		clientPorts:  clientPorts,
+		metrics:      metrics,
+		forwarders:   enabled,
+		dynamic:      NewDynamicForwarders(),
+		egress:       NewEgress(),
+		availability: availability,
+		parked:       make(map[int]int),
+		balancer:     NewClientBalancer(),
+		listeners:    make(map[int]net.Listener),
+		certs:        make(map[string]*certificate),
+		bandwidth:    NewBandwidth(metrics),
+		limits:       newSessionLimits(),
+		shares:       NewShares(),
+		ctx:          ctx,
+		cancel:       cancel,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true // Configure based on security needs
@@ -265,6 +655,16 @@ func NewImprovedServer(logger *zap.Logger, authToken string, forwarders []Forwar
 			WriteBufferSize: 1024,
 		},
 	}
+	
+	s.access = NewAccessControl(s, logger)
+	
+	// Forwarders announced by a client and its egress sessions go away with it
+	clients.onRemove = func(client *ImprovedServerClient) {
+		s.releaseServices(client)
+		s.closeEgressSessions(client)
+	}
+	
+	return s
 }
 
 // HandleTunnel handles WebSocket tunnel connections
@@ -276,6 +676,12 @@ func (s *ImprovedServer) HandleTunnel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Send clients to another instance while draining
+	if s.draining.Load() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// Upgrade to WebSocket
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -292,6 +698,7 @@ func (s *ImprovedServer) HandleTunnel(w http.ResponseWriter, r *http.Request) {
 	
 	client := &ImprovedServerClient{
 		ID:     clientID,
+		Group:  r.Header.Get("X-Client-Group"),
 		Conn:   conn,
 		Send:   make(chan []byte, s.config.SendBufferSize),
 		server: s,
@@ -324,17 +731,25 @@ func (s *ImprovedServer) HandleTunnel(w http.ResponseWriter, r *http.Request) {
 // Close safely closes the client connection
 func (c *ImprovedServerClient) Close() {
 	c.closeOnce.Do(func() {
+		// Send is left open so concurrent senders never write to a closed channel;
+		// the write pump stops on context cancellation instead
 		c.cancel()
-		close(c.Send)
 		c.Conn.Close()
 		c.server.logger.Info("Client connection closed", zap.String("clientID", c.ID))
 	})
 }
 
+// CloseWithCode sends a WebSocket close frame before closing the connection
+func (c *ImprovedServerClient) CloseWithCode(code int, reason string) {
+	deadline := time.Now().Add(c.server.config.WriteTimeout)
+	c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.Close()
+}
+
 // readPump handles reading messages from the client
 func (c *ImprovedServerClient) readPump() {
 	defer func() {
-		c.server.clients.Remove(c.ID)
+		c.server.clients.RemoveClient(c)
 	}()
 
 	for {
@@ -347,6 +762,8 @@ func (c *ImprovedServerClient) readPump() {
 			break
 		}
 
+		c.server.metrics.messagesTotal.Add(1)
+
 		select {
 		case <-c.ctx.Done():
 			return
@@ -401,7 +818,7 @@ func (c *ImprovedServerClient) heartbeat() {
 			lastPing := time.Unix(c.lastPing.Load(), 0)
 			if time.Since(lastPing) > 2*c.server.config.PongTimeout {
 				c.server.logger.Warn("Client heartbeat timeout", zap.String("clientID", c.ID))
-				c.server.clients.Remove(c.ID)
+				c.server.clients.RemoveClient(c)
 				return
 			}
 		case <-c.ctx.Done():
@@ -412,23 +829,80 @@ func (c *ImprovedServerClient) heartbeat() {
 
 // StartTCPForwarder starts a TCP forwarder for a specific port
 func (s *ImprovedServer) StartTCPForwarder(port int, clientID string) error {
+	fw, exists := s.forwarderForPort(port)
+	if !exists {
+		// Unconfigured forwarders are started but refuse connections
+		fw = ForwarderConfig{Name: fmt.Sprintf("port-%d", port), Port: port, ClientID: clientID}
+	}
+
+	// Access-controlled forwarders only listen while they are open
+	if fw.Access.enabled() {
+		return s.access.manage(fw, exists)
+	}
+	return s.startListener(fw, exists)
+}
+
+// startListener opens the listener of a forwarder and accepts its connections
+func (s *ImprovedServer) startListener(fw ForwarderConfig, exists bool) error {
+	port := fw.Port
+	if s.draining.Load() {
+		return fmt.Errorf("server is shutting down")
+	}
+	tlsConfig, err := s.forwarderTLS(fw)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate of forwarder %s: %w", fw.Name, err)
+	}
+	trustedProxies, err := parseNetworks(fw.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies of forwarder %s: %w", fw.Name, err)
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return fmt.Errorf("failed to start TCP forwarder on port %d: %w", port, err)
 	}
 
+	s.listenersMu.Lock()
+	s.listeners[port] = listener
+	s.listenersMu.Unlock()
+
+	// Connections are handed out once their PROXY header has been read
+	accepting := listener
+	if fw.AcceptProxyProtocol {
+		accepting = newProxyProtocolListener(listener, trustedProxies, s.logger)
+	}
+	if tlsConfig != nil {
+		accepting = tls.NewListener(accepting, tlsConfig)
+	}
+
+	if fw.Type == ForwarderHTTP {
+		go s.serveHTTPForwarder(accepting, fw)
+		return nil
+	}
+
 	go func() {
 		defer listener.Close()
-		s.logger.Info("TCP forwarder started", zap.Int("port", port), zap.String("clientID", clientID))
+		s.logger.Info("TCP forwarder started",
+			zap.Int("port", port),
+			zap.Strings("clientIDs", fw.clientIDs()),
+			zap.String("clientGroup", fw.ClientGroup))
 
 		for {
-			conn, err := listener.Accept()
+			conn, err := accepting.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					s.logger.Info("TCP forwarder stopped", zap.Int("port", port))
+					return
+				}
 				s.logger.Error("Accept failed", zap.Error(err))
 				continue
 			}
 
-			go s.handleTCPConnection(conn, clientID, port)
+			if fw.Type == ForwarderTLS {
+				go s.handleTLSConnection(conn, fw)
+				continue
+			}
+			go s.handleTCPConnection(conn, fw, exists)
 		}
 	}()
 
@@ -436,71 +910,324 @@ func (s *ImprovedServer) StartTCPForwarder(port int, clientID string) error {
 }
 
 // handleTCPConnection handles an incoming TCP connection
-func (s *ImprovedServer) handleTCPConnection(conn net.Conn, clientID string, remotePort int) {
-	sessionID := fmt.Sprintf("%s-%d-%d", clientID, remotePort, time.Now().UnixNano())
+func (s *ImprovedServer) handleTCPConnection(conn net.Conn, fw ForwarderConfig, authorized bool) {
+	remotePort := fw.Port
 	
-	// Check if client is authorized for this port
-	if !s.clientPorts[clientID] {
+	// Check if the forwarder is configured for port forwarding
+	if !authorized {
 		s.logger.Warn("Client not authorized for port forwarding", 
-			zap.String("clientID", clientID),
+			zap.String("clientID", fw.ClientID),
 			zap.Int("port", remotePort))
 		conn.Close()
 		return
 	}
 
-	// Get the client
-	client, exists := s.clients.Get(clientID)
-	if !exists {
-		s.logger.Warn("Client not found for TCP connection", zap.String("clientID", clientID))
+	// Finish the handshake of forwarders terminating TLS before a client is involved
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := acceptTLS(tlsConn); err != nil {
+			s.logger.Warn("TLS handshake with external client failed",
+				zap.String("forwarder", fw.Name),
+				zap.String("remote", conn.RemoteAddr().String()),
+				zap.Error(err))
+			conn.Close()
+			return
+		}
+	}
+
+	// Get candidate clients
+	candidates := s.balancer.Order(fw, s.candidatesFor(fw), s.sessions.CountByClient())
+	if len(candidates) == 0 && s.cluster != nil && (fw.Type == "" || fw.Type == ForwarderTCP) {
+		// Hand the connection to a peer holding the client; relayed
+		// connections are never relayed again. Peers look forwarders up by
+		// port, which HTTP and TLS routes do not have. The peer admits the
+		// session against its own quota and limits.
+		if _, relayed := conn.(*wsConn); !relayed && s.cluster.relay(conn, fw) {
+			return
+		}
+	}
+
+	// Refuse new sessions once the forwarder has used up its quota
+	if admitted, quota := s.bandwidth.admit(fw); !admitted {
+		s.logger.Warn("Forwarder quota exceeded, rejecting connection",
+			zap.String("forwarder", fw.Name),
+			zap.String("quota", quota),
+			zap.String("remote", conn.RemoteAddr().String()))
+		s.metrics.recordClose(CloseQuotaExceeded)
+		conn.Close()
+		return
+	}
+
+	// Enforce the forwarder's concurrent session limits
+	release, refused := s.limits.acquire(fw, conn.RemoteAddr())
+	if refused != "" {
+		s.logger.Warn("Session limit reached, rejecting connection",
+			zap.String("forwarder", fw.Name),
+			zap.String("reason", refused),
+			zap.String("remote", conn.RemoteAddr().String()))
+		s.metrics.recordClose(refused)
 		conn.Close()
 		return
 	}
+	defer release()
+
+	// Hold the connection briefly if the clients are reconnecting
+	if len(candidates) == 0 {
+		if client, exists := s.awaitClient(fw); exists {
+			candidates = append(candidates, client)
+		}
+	}
+	if len(candidates) == 0 {
+		fields := []zap.Field{zap.String("forwarder", fw.Name), zap.Int("port", remotePort)}
+		if since, down := s.availability.DownSince(fw.availabilityKeys()...); down {
+			fields = append(fields, zap.Duration("offlineFor", time.Since(since).Round(time.Second)))
+		}
+		s.logger.Warn("Client not found for TCP connection", fields...)
+		conn.Close()
+		return
+	}
+
+	// Protocol-aware forwarders answer the startup exchange themselves
+	var metadata SessionMetadata
+	if fw.Protocol == ProtocolPostgres {
+		accepted, meta, err := s.acceptPostgres(conn, fw)
+		if err != nil {
+			s.logger.Warn("PostgreSQL startup failed",
+				zap.String("forwarder", fw.Name),
+				zap.String("remote", conn.RemoteAddr().String()),
+				zap.Error(err))
+			conn.Close()
+			return
+		}
+		conn, metadata = accepted, meta
+	}
+
+	sessionID := fmt.Sprintf("%s-%d-%d", candidates[0].ID, remotePort, time.Now().UnixNano())
 
 	// Create session without specifying target - client will decide
-	session := s.sessions.Create(sessionID, clientID, "", conn, s.logger)
+	session := s.sessions.Create(sessionID, candidates[0].ID, "", conn, s.logger)
+	session.Metadata = metadata
+	session.Forwarder = fw.usageName()
+	if fw.owner != "" {
+		session.route = fw.Name
+	}
+	session.resume = func(client *ImprovedServerClient) {
+		s.sendForwardMessageToClient(client, ForwardMessage{Type: "resume", SessionID: sessionID})
+	}
+	if fw.IdleTimeout > 0 {
+		session.idleTimeout = fw.IdleTimeout
+	}
+	session.maxDuration = fw.MaxDuration
+	connectTimeout := fw.ConnectTimeout
+	if connectTimeout <= 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	
+	// Try candidates in order until one connects to its local service
+	var client *ImprovedServerClient
+	failure := CloseNoClient
+	for _, candidate := range candidates {
+		session.throttle.Store(s.bandwidth.throttle(fw, candidate.ID))
+		connected, reason := s.connectSession(session, candidate, remotePort, connectTimeout)
+		if connected {
+			client = candidate
+			break
+		}
+		failure = reason
+		if session.closed.Load() {
+			break
+		}
+	}
+	if client == nil {
+		s.logger.Warn("No client could serve TCP connection",
+			zap.String("sessionID", sessionID),
+			zap.String("forwarder", fw.Name),
+			zap.String("reason", failure))
+		session.setCloseReason(failure)
+		s.sessions.Remove(sessionID)
+		s.metrics.recordClose(failure)
+		return
+	}
+
+	session.established.Store(true)
+	go s.readFromTCPConnection(session, client)
 	
-	s.logger.Info("Starting TCP session", 
-		zap.String("sessionID", sessionID),
-		zap.String("clientID", clientID),
-		zap.Int("remotePort", remotePort))
+	// Wait for session to complete
+	<-session.ctx.Done()
+	s.sessions.Remove(sessionID)
+	s.auditSession(session, fw)
+}
+
+// auditSession records a finished forwarder session
+func (s *ImprovedServer) auditSession(session *TCPSession, fw ForwarderConfig) {
+	fields := []zap.Field{
+		zap.String("sessionID", session.ID),
+		zap.String("forwarder", fw.Name),
+		zap.String("clientID", session.ClientID),
+		zap.String("remote", session.Conn.RemoteAddr().String()),
+		zap.Int64("bytesIn", session.BytesIn()),
+		zap.Int64("bytesOut", session.BytesOut()),
+		zap.Duration("duration", time.Since(session.CreatedAt)),
+		zap.String("closeReason", session.CloseReason()),
+	}
+	s.metrics.recordClose(session.CloseReason())
+	s.logger.Info("Session audit", append(fields, session.Metadata.fields()...)...)
+}
+
+// connectSession asks a client to connect a session to its local service and
+// reports whether the client confirmed the connection within timeout, or why not
+func (s *ImprovedServer) connectSession(session *TCPSession, client *ImprovedServerClient, remotePort int, timeout time.Duration) (bool, string) {
+	ready, connectErr := s.sessions.Assign(session, client.ID)
+	
+	s.logger.Info("Starting TCP session", append([]zap.Field{
+		zap.String("sessionID", session.ID),
+		zap.String("clientID", client.ID),
+		zap.Int("remotePort", remotePort)}, session.Metadata.fields()...)...)
 
 	// Send connect request to client (no target specified - client decides)
 	connectMsg := ForwardMessage{
-		Type:      "connect",
-		SessionID: sessionID,
-		Port:      remotePort, // Tell client which port was accessed
+		Type:        "connect",
+		SessionID:   session.ID,
+		Port:        remotePort, // Tell client which port was accessed
+		Source:      session.Conn.RemoteAddr().String(),
+		Destination: session.Conn.LocalAddr().String(),
+		IdleTimeout: session.idleTimeout,
 	}
 
 	if err := s.sendForwardMessageToClient(client, connectMsg); err != nil {
-		s.logger.Error("Failed to send connect message", zap.Error(err))
-		s.sessions.Remove(sessionID)
-		return
+		s.logger.Error("Failed to send connect message", zap.String("clientID", client.ID), zap.Error(err))
+		return false, CloseNoClient
 	}
 
 	// Wait for client to confirm connection before starting to read data
 	select {
-	case <-session.ready:
-		s.logger.Info("Client confirmed connection, starting data flow", zap.String("sessionID", sessionID))
-		// Start reading from the TCP connection
-		go s.readFromTCPConnection(session, client)
+	case <-ready:
+		s.logger.Info("Client confirmed connection, starting data flow", zap.String("sessionID", session.ID))
+		return true, ""
+	case reason := <-connectErr:
+		s.logger.Warn("Client failed to connect session",
+			zap.String("sessionID", session.ID),
+			zap.String("clientID", client.ID),
+			zap.String("error", reason))
+		s.abandonSession(session, client)
+		return false, CloseClientError
 	case <-session.ctx.Done():
-		s.logger.Info("Session cancelled before client connected", zap.String("sessionID", sessionID))
-		s.sessions.Remove(sessionID)
-		return
-	case <-time.After(10 * time.Second):
-		s.logger.Warn("Timeout waiting for client connection", zap.String("sessionID", sessionID))
-		s.sessions.Remove(sessionID)
-		return
+		s.logger.Info("Session cancelled before client connected", zap.String("sessionID", session.ID))
+		s.abandonSession(session, client)
+		return false, CloseExternalClosed
+	case <-time.After(timeout):
+		s.logger.Warn("Timeout waiting for client connection",
+			zap.String("sessionID", session.ID),
+			zap.String("clientID", client.ID),
+			zap.Duration("timeout", timeout))
+		s.abandonSession(session, client)
+		return false, CloseConnectTimeout
 	}
+}
+
+// abandonSession tells a client that did not get a session to drop its side,
+// in case it connects to its service after the server has moved on
+func (s *ImprovedServer) abandonSession(session *TCPSession, client *ImprovedServerClient) {
+	s.sendForwardMessageToClient(client, ForwardMessage{Type: "disconnect", SessionID: session.ID})
+}
+
+// StopTCPForwarder closes the listener of a running forwarder
+func (s *ImprovedServer) StopTCPForwarder(port int) error {
+	s.listenersMu.Lock()
+	listener, exists := s.listeners[port]
+	delete(s.listeners, port)
+	s.listenersMu.Unlock()
 	
-	// Wait for session to complete
-	<-session.ctx.Done()
-	s.sessions.Remove(sessionID)
+	if !exists {
+		return fmt.Errorf("no forwarder running on port %d", port)
+	}
+	return listener.Close()
+}
+
+// removeForwarder drops a forwarder from the enabled forwarders by name
+func (s *ImprovedServer) removeForwarder(name string) {
+	s.forwardersMu.Lock()
+	defer s.forwardersMu.Unlock()
+	for i, fw := range s.forwarders {
+		if fw.Name == name {
+			s.forwarders = append(s.forwarders[:i:i], s.forwarders[i+1:]...)
+			return
+		}
+	}
+}
+
+// forwarderList returns a snapshot of the enabled forwarders
+func (s *ImprovedServer) forwarderList() []ForwarderConfig {
+	s.forwardersMu.RLock()
+	defer s.forwardersMu.RUnlock()
+	return append([]ForwarderConfig(nil), s.forwarders...)
+}
+
+// forwarderForPort returns the enabled forwarder configured for a port
+func (s *ImprovedServer) forwarderForPort(port int) (ForwarderConfig, bool) {
+	s.forwardersMu.RLock()
+	defer s.forwardersMu.RUnlock()
+	for _, fw := range s.forwarders {
+		if fw.Port == port {
+			return fw, true
+		}
+	}
+	return ForwarderConfig{}, false
+}
+
+// awaitClient parks a connection until one of the forwarder's clients reconnects,
+// bounded by the forwarder's reconnect wait and queue size
+func (s *ImprovedServer) awaitClient(fw ForwarderConfig) (*ImprovedServerClient, bool) {
+	if fw.ReconnectWait <= 0 {
+		return nil, false
+	}
+	port := fw.Port
+	
+	limit := fw.ReconnectQueue
+	if limit <= 0 {
+		limit = defaultReconnectQueue
+	}
+	
+	s.parkedMu.Lock()
+	if s.parked[port] >= limit {
+		s.parkedMu.Unlock()
+		s.logger.Warn("Reconnect queue full, rejecting connection",
+			zap.String("forwarder", fw.Name),
+			zap.Int("port", port),
+			zap.Int("limit", limit))
+		return nil, false
+	}
+	s.parked[port]++
+	s.parkedMu.Unlock()
+	s.metrics.connectionsParked.Add(1)
+	
+	defer func() {
+		s.parkedMu.Lock()
+		s.parked[port]--
+		s.parkedMu.Unlock()
+		s.metrics.connectionsParked.Add(-1)
+	}()
+	
+	s.logger.Info("Holding connection until client reconnects",
+		zap.String("forwarder", fw.Name),
+		zap.Int("port", port),
+		zap.Duration("wait", fw.ReconnectWait))
+	
+	ctx, cancel := context.WithTimeout(s.ctx, fw.ReconnectWait)
+	defer cancel()
+	
+	client, ok := s.clients.WaitFor(ctx, fw.serves)
+	if ok {
+		s.logger.Info("Client reconnected, dispatching held connection",
+			zap.String("clientID", client.ID),
+			zap.Int("port", port))
+	}
+	return client, ok
 }
 
 // readFromTCPConnection reads data from external TCP connection and forwards to client
 func (s *ImprovedServer) readFromTCPConnection(session *TCPSession, client *ImprovedServerClient) {
 	s.logger.Info("Starting to read from TCP connection", zap.String("sessionID", session.ID))
+	go s.watchSession(session)
 	defer func() {
 		s.logger.Info("Stopping TCP connection reader", zap.String("sessionID", session.ID))
 		// Send disconnect to client
@@ -520,9 +1247,9 @@ func (s *ImprovedServer) readFromTCPConnection(session *TCPSession, client *Impr
 		default:
 		}
 
-		session.Conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 		n, err := session.Conn.Read(buffer)
 		if err != nil {
+			session.setCloseReason(CloseExternalClosed)
 			if err != io.EOF && err != io.ErrClosedPipe {
 				s.logger.Info("TCP read error", zap.String("sessionID", session.ID), zap.Error(err))
 			} else {
@@ -531,6 +1258,11 @@ func (s *ImprovedServer) readFromTCPConnection(session *TCPSession, client *Impr
 			return
 		}
 		
+		session.recordIn(n)
+		s.metrics.bytesTransferred.Add(int64(n))
+		if err := session.throttle.Load().waitUpload(session.ctx, n); err != nil {
+			return
+		}
 		s.logger.Info("Read data from TCP connection", zap.String("sessionID", session.ID), zap.Int("bytes", n))
 
 		dataMsg := ForwardMessage{
@@ -548,15 +1280,100 @@ func (s *ImprovedServer) readFromTCPConnection(session *TCPSession, client *Impr
 	}
 }
 
+// IsDraining reports whether a graceful shutdown is in progress
+func (s *ImprovedServer) IsDraining() bool {
+	return s.draining.Load()
+}
+
+// Shutdown drains the server: it stops accepting forwarder connections, tells
+// clients to reconnect to another instance, lets active sessions finish until
+// ctx is done and then closes everything with a going-away close code.
+// It returns ctx.Err() if sessions had to be cut.
+func (s *ImprovedServer) Shutdown(ctx context.Context) error {
+	if !s.draining.CompareAndSwap(false, true) {
+		return fmt.Errorf("shutdown already in progress")
+	}
+	s.cancel()
+
+	// Stop accepting on forwarders
+	s.listenersMu.Lock()
+	for port, listener := range s.listeners {
+		listener.Close()
+		delete(s.listeners, port)
+	}
+	s.listenersMu.Unlock()
+
+	// Tell clients to reconnect elsewhere once their sessions are done
+	clients := s.clients.Matching(func(*ImprovedServerClient) bool { return true })
+	notice := ShutdownNotice{Reason: "server shutting down"}
+	if deadline, ok := ctx.Deadline(); ok {
+		notice.Deadline = deadline
+	}
+	data, _ := json.Marshal(notice)
+	for _, client := range clients {
+		if err := s.sendMessageToClient(client, Message{Type: "shutdown", Data: data}); err != nil {
+			s.logger.Warn("Failed to notify client of shutdown", zap.String("clientID", client.ID), zap.Error(err))
+		}
+	}
+
+	s.logger.Info("Draining sessions",
+		zap.Int("clients", len(clients)),
+		zap.Int("sessions", s.sessions.Count()))
+
+	// Let active sessions finish
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	var err error
+	for s.sessions.Count() > 0 && err == nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if remaining := s.sessions.IDs(); len(remaining) > 0 {
+		s.logger.Warn("Drain deadline reached, closing remaining sessions", zap.Int("sessions", len(remaining)))
+		for _, sessionID := range remaining {
+			if session, exists := s.sessions.Get(sessionID); exists {
+				session.setCloseReason(CloseShutdown)
+			}
+			s.sessions.Remove(sessionID)
+		}
+	}
+
+	// Close client connections cleanly
+	for _, client := range s.clients.Matching(func(*ImprovedServerClient) bool { return true }) {
+		client.CloseWithCode(websocket.CloseGoingAway, "server shutting down")
+		s.clients.RemoveClient(client)
+	}
+
+	s.logger.Info("Server drained")
+	return err
+}
+
 // handleMessage handles incoming messages from clients
 func (s *ImprovedServer) handleMessage(client *ImprovedServerClient, msg *Message) {
 	switch msg.Type {
 	case "register":
+		var registration Registration
+		if len(msg.Data) > 0 {
+			if err := json.Unmarshal(msg.Data, &registration); err != nil {
+				s.logger.Warn("Invalid registration payload", zap.String("clientID", client.ID), zap.Error(err))
+			}
+		}
+		
 		response := Message{
 			Type: "registered",
 			ID:   client.ID,
 		}
+		statuses := s.registerServices(client, registration.Services)
+		if len(statuses) > 0 {
+			response.Data, _ = json.Marshal(RegistrationResult{Services: statuses})
+		}
 		s.sendMessageToClient(client, response)
+		s.pushMappings(client)
 
 	case "forward":
 		s.handleForwardMessage(client, msg.Data)
@@ -579,47 +1396,98 @@ func (s *ImprovedServer) handleForwardMessage(client *ImprovedServerClient, data
 	}
 
 	switch msg.Type {
+	case "connect":
+		// Client-initiated connection to an external destination
+		s.handleEgressConnect(client, &msg)
+
 	case "connected":
 		s.logger.Info("Client connected to local service", zap.String("sessionID", msg.SessionID))
 		
 		// Signal that the client is ready to receive data
-		session, exists := s.sessions.Get(msg.SessionID)
-		if exists {
-			select {
-			case session.ready <- struct{}{}:
-				s.logger.Info("Signaled session ready", zap.String("sessionID", msg.SessionID))
-			default:
-				// Channel already closed or full
-			}
+		if !s.sessions.signalReady(msg.SessionID, client.ID) {
+			// The session moved on to another client or ended; drop the late connection
+			s.sendForwardMessageToClient(client, ForwardMessage{Type: "disconnect", SessionID: msg.SessionID})
+			return
 		}
+		s.logger.Info("Signaled session ready", zap.String("sessionID", msg.SessionID))
 
 	case "data":
 		// Data from client to forward to external connection
-		session, exists := s.sessions.Get(msg.SessionID)
-		if !exists {
-			s.logger.Warn("Session not found for data", zap.String("sessionID", msg.SessionID))
-			return
-		}
-
 		data, err := base64.StdEncoding.DecodeString(msg.Data)
 		if err != nil {
 			s.logger.Error("Failed to decode data", zap.Error(err))
 			return
 		}
 
+		// Only the client serving a session may write to it
+		session, exists := s.sessions.GetOwned(msg.SessionID, client.ID)
+		if !exists {
+			// Egress sessions buffer data until their destination is dialed
+			buffered, err := s.egress.bufferData(msg.SessionID, data)
+			if err != nil {
+				s.logger.Warn("Dropping egress session", zap.String("sessionID", msg.SessionID), zap.Error(err))
+				s.egress.dropPending(msg.SessionID)
+				s.sendForwardMessageToClient(client, ForwardMessage{Type: "error", SessionID: msg.SessionID, Error: err.Error()})
+				return
+			}
+			if buffered {
+				return
+			}
+			// The session may have been established in the meantime
+			if session, exists = s.sessions.GetOwned(msg.SessionID, client.ID); !exists {
+				s.logger.Warn("Session not found for data", zap.String("sessionID", msg.SessionID))
+				return
+			}
+		}
+
+		s.metrics.bytesTransferred.Add(int64(len(data)))
 		if err := session.Write(data); err != nil {
 			s.logger.Error("Failed to write to TCP connection", zap.Error(err))
 			s.sessions.Remove(msg.SessionID)
+			return
+		}
+		// Hold the client back while the external side catches up
+		if session.resume != nil && len(session.writeQueue) >= writeQueueHighWater && session.pausedBy.CompareAndSwap(nil, client) {
+			s.sendForwardMessageToClient(client, ForwardMessage{Type: "pause", SessionID: msg.SessionID})
 		}
 
+	case "datagram":
+		s.handleEgressDatagram(client, &msg)
+
 	case "disconnect":
 		s.logger.Info("Client disconnecting session", zap.String("sessionID", msg.SessionID))
+		if s.egress.dropPending(msg.SessionID) || s.closeEgressAssociation(msg.SessionID) {
+			return
+		}
+		session, exists := s.sessions.GetOwned(msg.SessionID, client.ID)
+		if !exists {
+			// Sessions served by another client are not this client's to close
+			return
+		}
+		session.setCloseReason(CloseServiceClosed)
+		// Forwarder sessions deliver what the service sent before closing
+		if session.resume != nil && session.established.Load() {
+			session.CloseAfterWrites()
+			return
+		}
 		s.sessions.Remove(msg.SessionID)
 
 	case "error":
 		s.logger.Error("Client error", 
 			zap.String("sessionID", msg.SessionID),
 			zap.String("error", msg.Error))
+		
+		session, exists := s.sessions.GetOwned(msg.SessionID, client.ID)
+		if !exists {
+			return
+		}
+		
+		// A connect error lets the session fail over to another client
+		if !session.established.Load() {
+			s.sessions.signalConnectError(msg.SessionID, client.ID, msg.Error)
+			return
+		}
+		session.setCloseReason(CloseClientError)
 		s.sessions.Remove(msg.SessionID)
 	}
 }
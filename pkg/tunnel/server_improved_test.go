@@ -0,0 +1,304 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// freePort returns a TCP port that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startEchoServer runs a TCP service that writes back what it reads
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startTestClient connects a client to the tunnel endpoint at serverURL,
+// mapping ports to targets, and waits until the server sees it
+func startTestClient(t *testing.T, server *ImprovedServer, serverURL, clientID string, mappings map[int]string) *ImprovedClient {
+	t.Helper()
+	return startTestClientOptions(t, server, serverURL, clientID, mappings, map[int]MappingOptions{})
+}
+
+// startTestClientOptions is startTestClient with options for the mappings
+func startTestClientOptions(t *testing.T, server *ImprovedServer, serverURL, clientID string, mappings map[int]string, options map[int]MappingOptions) *ImprovedClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	client := NewImprovedClient(ImprovedClientConfig{
+		ServerURL:         "ws" + strings.TrimPrefix(serverURL, "http") + "/tunnel",
+		AuthToken:         "secret",
+		ClientID:          clientID,
+		PortMappings:      mappings,
+		MappingOptions:    options,
+		ReconnectInterval: 100 * time.Millisecond,
+		MaxReconnectDelay: time.Second,
+		PingInterval:      10 * time.Second,
+		PongTimeout:       30 * time.Second,
+		WriteTimeout:      5 * time.Second,
+		Logger:            zap.NewNop(),
+	})
+	go client.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := server.clients.Get(clientID); exists {
+			return client
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client %s did not connect", clientID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echo sends a message through conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != message {
+		t.Fatalf("got %q, want %q", reply, message)
+	}
+}
+
+func TestSessionConnectReplies(t *testing.T) {
+	sessions := NewSessionManager(zap.NewNop())
+	client, server := net.Pipe()
+	defer client.Close()
+	session := sessions.Create("s", "", "", server, zap.NewNop())
+	defer session.Close()
+
+	// The first candidate confirms only after the session moved on
+	firstReady, _ := sessions.Assign(session, "first")
+	ready, connectErr := sessions.Assign(session, "second")
+	if sessions.signalReady("s", "first") {
+		t.Error("a former candidate signalled the session")
+	}
+	sessions.signalConnectError("s", "first", "refused")
+	select {
+	case <-ready:
+		t.Fatal("late reply of the first candidate taken for the second")
+	case <-connectErr:
+		t.Fatal("late error of the first candidate taken for the second")
+	case <-firstReady:
+		t.Fatal("signal delivered to a former candidate")
+	default:
+	}
+
+	sessions.signalConnectError("s", "second", "refused")
+	if reason := <-connectErr; reason != "refused" {
+		t.Errorf("connect error %q", reason)
+	}
+	ready, _ = sessions.Assign(session, "third")
+	if !sessions.signalReady("s", "third") || !sessions.signalReady("s", "third") {
+		t.Error("the owning client could not signal the session")
+	}
+	<-ready
+	if sessions.signalReady("missing", "third") {
+		t.Error("signalled an unknown session")
+	}
+}
+
+func TestReconnectHold(t *testing.T) {
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		queue   int
+		held    int           // Connections opened before the one checked
+		connect time.Duration // When the client connects, 0 for never
+		served  bool
+	}{
+		{"client reconnects in time", 5 * time.Second, 0, 0, 200 * time.Millisecond, true},
+		{"holding disabled", 0, 0, 0, 0, false},
+		{"wait expires", 200 * time.Millisecond, 0, 0, 0, false},
+		{"queue full", 5 * time.Second, 1, 1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echoAddr := startEchoServer(t)
+			port := freePort(t)
+			server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+				Name:           "echo",
+				Port:           port,
+				ClientID:       "c1",
+				Enabled:        true,
+				ReconnectWait:  tt.wait,
+				ReconnectQueue: tt.queue,
+			}})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/tunnel", server.HandleTunnel)
+			web := httptest.NewServer(mux)
+			defer web.Close()
+			if err := server.StartTCPForwarder(port, "c1"); err != nil {
+				t.Fatal(err)
+			}
+
+			dial := func() net.Conn {
+				conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { conn.Close() })
+				return conn
+			}
+			for i := 0; i < tt.held; i++ {
+				dial()
+			}
+			time.Sleep(50 * time.Millisecond)
+			conn := dial()
+
+			if tt.connect > 0 {
+				time.Sleep(tt.connect)
+				startTestClient(t, server, web.URL, "c1", map[int]string{port: echoAddr})
+			}
+			if tt.served {
+				echo(t, conn, "held")
+				return
+			}
+
+			// A connection that is not held is closed without a session
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("read on a connection that is not held: %v", err)
+			}
+		})
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		session bool          // Keep a session open during the drain
+		timeout time.Duration // Drain deadline
+		err     error
+	}{
+		{"idle server", false, 5 * time.Second, nil},
+		{"session cut at the deadline", true, 300 * time.Millisecond, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+				Name:     "echo",
+				Port:     port,
+				ClientID: "c1",
+				Enabled:  true,
+			}})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/tunnel", server.HandleTunnel)
+			web := httptest.NewServer(mux)
+			defer web.Close()
+			startTestClient(t, server, web.URL, "c1", map[int]string{port: startEchoServer(t)})
+			if err := server.StartTCPForwarder(port, "c1"); err != nil {
+				t.Fatal(err)
+			}
+
+			var conn net.Conn
+			if tt.session {
+				var err error
+				conn, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				echo(t, conn, "before shutdown")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- server.Shutdown(ctx) }()
+			time.Sleep(100 * time.Millisecond)
+
+			// A draining server turns away new work and reports it
+			if !server.IsDraining() {
+				t.Error("server is not draining")
+			}
+			if readiness := NewImprovedServerMonitor(server).GetReadiness(); readiness.Ready {
+				t.Error("draining server is ready")
+			}
+			if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port)); err == nil {
+				t.Error("forwarder still accepts connections")
+			}
+			if err := server.StartTCPForwarder(freePort(t), "c1"); err == nil {
+				t.Error("started a forwarder while draining")
+			}
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/tunnel", nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			server.HandleTunnel(recorder, req)
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("tunnel endpoint status %d while draining", recorder.Code)
+			}
+			if err := server.Shutdown(ctx); err == nil {
+				t.Error("second shutdown succeeded")
+			}
+
+			select {
+			case err := <-done:
+				if err != tt.err {
+					t.Errorf("Shutdown = %v, want %v", err, tt.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Shutdown did not return")
+			}
+			if count := server.sessions.Count(); count != 0 {
+				t.Errorf("%d sessions left after shutdown", count)
+			}
+			if _, exists := server.clients.Get("c1"); exists {
+				t.Error("client still registered after shutdown")
+			}
+			if conn != nil {
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("read on a cut session: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// srvRefreshInterval bounds how often the SRV record is resolved again
+const srvRefreshInterval = time.Minute
+
+// ServerPool tracks the tunnel servers a client may connect to and picks the
+// next one. The first server is the primary; the client fails over after
+// repeated failed attempts and fails back once the primary is healthy again.
+type ServerPool struct {
+	static        []string // Configured URLs in order of preference
+	srvName       string
+	resolver      *net.Resolver
+	template      url.URL // Scheme and path applied to SRV targets
+	failoverAfter int
+	logger        *zap.Logger
+	probe         *http.Client // Reused for health checks of the primary
+
+	servers      []*serverState
+	current      int
+	srvRefreshed time.Time
+	mu           sync.Mutex
+}
+
+// serverState holds connection statistics for a single server URL
+type serverState struct {
+	url           string
+	failures      int // Consecutive failed attempts
+	lastConnected time.Time
+}
+
+// NewServerPool creates a pool from the client configuration
+func NewServerPool(config ImprovedClientConfig) *ServerPool {
+	static := config.ServerURLs
+	if len(static) == 0 && config.ServerURL != "" {
+		static = []string{config.ServerURL}
+	}
+
+	failoverAfter := config.FailoverAfter
+	if failoverAfter <= 0 {
+		failoverAfter = 1
+	}
+
+	pool := &ServerPool{
+		static:        static,
+		srvName:       config.ServerSRV,
+		resolver:      newSRVResolver(config.SRVResolver),
+		template:      url.URL{Scheme: "wss", Path: "/tunnel"},
+		failoverAfter: failoverAfter,
+		logger:        config.Logger,
+		probe: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: clientTLSConfig(config)},
+		},
+	}
+	if len(static) > 0 {
+		if u, err := url.Parse(static[0]); err == nil {
+			pool.template.Scheme = u.Scheme
+			pool.template.Path = u.Path
+		}
+	}
+	for _, server := range static {
+		pool.servers = append(pool.servers, &serverState{url: server})
+	}
+	return pool
+}
+
+// newSRVResolver returns a resolver using a specific DNS server, or the system resolver
+func newSRVResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Refresh resolves the SRV record if it is due. SRV targets come first, in
+// priority and weight order, followed by the configured URLs.
+func (p *ServerPool) Refresh(ctx context.Context) {
+	p.mu.Lock()
+	due := p.srvName != "" && time.Since(p.srvRefreshed) >= srvRefreshInterval
+	p.mu.Unlock()
+	if !due {
+		return
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, records, err := p.resolver.LookupSRV(lookupCtx, "", "", p.srvName)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.srvRefreshed = time.Now()
+	if err != nil {
+		p.logger.Warn("SRV lookup failed", zap.String("name", p.srvName), zap.Error(err))
+		return
+	}
+
+	urls := make([]string, 0, len(records)+len(p.static))
+	for _, record := range records {
+		u := p.template
+		u.Host = net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		urls = append(urls, u.String())
+	}
+	urls = append(urls, p.static...)
+	p.setServers(urls)
+}
+
+// setServers replaces the server list, keeping statistics and the current server
+func (p *ServerPool) setServers(urls []string) {
+	known := make(map[string]*serverState)
+	for _, server := range p.servers {
+		known[server.url] = server
+	}
+	currentURL := ""
+	if p.current < len(p.servers) {
+		currentURL = p.servers[p.current].url
+	}
+
+	servers := make([]*serverState, 0, len(urls))
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		if server, exists := known[u]; exists {
+			servers = append(servers, server)
+		} else {
+			servers = append(servers, &serverState{url: u})
+		}
+	}
+
+	p.servers = servers
+	p.current = 0
+	for i, server := range servers {
+		if server.url == currentURL {
+			p.current = i
+		}
+	}
+}
+
+// Current returns the URL of the server to connect to
+func (p *ServerPool) Current() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.servers) == 0 {
+		return ""
+	}
+	return p.servers[p.current].url
+}
+
+// IsPrimary reports whether the current server is the preferred one
+func (p *ServerPool) IsPrimary() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current == 0
+}
+
+// Primary returns the URL of the preferred server
+func (p *ServerPool) Primary() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.servers) == 0 {
+		return ""
+	}
+	return p.servers[0].url
+}
+
+// Connected records a successful connection to the current server
+func (p *ServerPool) Connected() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.servers) == 0 {
+		return
+	}
+	p.servers[p.current].failures = 0
+	p.servers[p.current].lastConnected = time.Now()
+}
+
+// Failed records a failed attempt and reports whether the client failed over
+// to another server. It reports false once every server has been tried, so
+// the caller backs off before starting over.
+func (p *ServerPool) Failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.servers) == 0 {
+		return false
+	}
+	p.servers[p.current].failures++
+	if p.servers[p.current].failures < p.failoverAfter {
+		return false
+	}
+	return p.advance()
+}
+
+// Skip moves to the next server right away, e.g. when the current one is draining
+func (p *ServerPool) Skip() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.servers) == 0 {
+		return false
+	}
+	p.servers[p.current].failures = p.failoverAfter
+	return p.advance()
+}
+
+// SelectPrimary switches back to the preferred server
+func (p *ServerPool) SelectPrimary() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = 0
+	if len(p.servers) > 0 {
+		p.servers[0].failures = 0
+	}
+}
+
+// advance moves to the next server that has not exhausted its attempts.
+// Once every server has, all are given a fresh start from the primary and
+// advance reports false: the cycle is exhausted.
+func (p *ServerPool) advance() bool {
+	previous := p.current
+	for i := 1; i < len(p.servers); i++ {
+		next := (previous + i) % len(p.servers)
+		if p.servers[next].failures < p.failoverAfter {
+			p.current = next
+			return true
+		}
+	}
+
+	for _, server := range p.servers {
+		server.failures = 0
+	}
+	p.current = 0
+	return false
+}
+
+// Status returns the servers with their failure counts for metrics
+func (p *ServerPool) Status() []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := make([]map[string]interface{}, 0, len(p.servers))
+	for i, server := range p.servers {
+		entry := map[string]interface{}{
+			"url":      server.url,
+			"failures": server.failures,
+			"current":  i == p.current,
+		}
+		if !server.lastConnected.IsZero() {
+			entry["lastConnected"] = server.lastConnected
+		}
+		status = append(status, entry)
+	}
+	return status
+}
+
+// healthURL returns the readiness endpoint served next to a tunnel URL
+func healthURL(tunnelURL string) (string, error) {
+	u, err := url.Parse(tunnelURL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "wss":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "http"
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	u.Path = "/health/ready"
+	u.RawQuery = ""
+	return u.String(), nil
+}
+
+// Probe reports whether a server is up and not draining. A server that is
+// not ready only because clients such as this one are missing still passes.
+func (p *ServerPool) Probe(ctx context.Context, tunnelURL string) bool {
+	target, err := healthURL(tunnelURL)
+	if err != nil {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := p.probe.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	var readiness ReadinessStatus
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&readiness); err != nil {
+		return resp.StatusCode == http.StatusOK
+	}
+	if readiness.Draining {
+		return false
+	}
+	return resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// failback returns to the primary server once it is healthy and no sessions
+// are active. It runs while the client is connected to another server.
+func (c *ImprovedClient) failback(ctx context.Context) {
+	ticker := time.NewTicker(c.config.FailbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.sessions.Count() > 0 {
+				continue
+			}
+			primary := c.servers.Primary()
+			if !c.servers.Probe(ctx, primary) {
+				continue
+			}
+
+			c.config.Logger.Info("Primary server is healthy again, failing back",
+				zap.String("primary", primary),
+				zap.String("current", c.servers.Current()))
+			c.servers.SelectPrimary()
+			c.failingBack.Store(true)
+			c.connMu.RLock()
+			if c.conn != nil {
+				c.conn.Close()
+			}
+			c.connMu.RUnlock()
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestServerPoolFailover(t *testing.T) {
+	pool := NewServerPool(ImprovedClientConfig{
+		ServerURLs:    []string{"wss://a/tunnel", "wss://b/tunnel", "wss://c/tunnel"},
+		FailoverAfter: 2,
+		Logger:        zap.NewNop(),
+	})
+
+	steps := []struct {
+		name    string
+		action  func() bool
+		moved   bool
+		current string
+	}{
+		{"first failure stays", pool.Failed, false, "wss://a/tunnel"},
+		{"fails over after two", pool.Failed, true, "wss://b/tunnel"},
+		{"failure on b", pool.Failed, false, "wss://b/tunnel"},
+		{"fails over to c", pool.Failed, true, "wss://c/tunnel"},
+		{"failure on c", pool.Failed, false, "wss://c/tunnel"},
+		{"cycle exhausted", pool.Failed, false, "wss://a/tunnel"},
+		{"skip a draining server", pool.Skip, true, "wss://b/tunnel"},
+		{"connected", func() bool { pool.Connected(); return false }, false, "wss://b/tunnel"},
+		{"skip b", pool.Skip, true, "wss://c/tunnel"},
+		{"every server skipped", pool.Skip, false, "wss://a/tunnel"},
+		{"skip after a fresh start", pool.Skip, true, "wss://b/tunnel"},
+		{"fail back", func() bool { pool.SelectPrimary(); return false }, false, "wss://a/tunnel"},
+	}
+	for _, step := range steps {
+		if moved := step.action(); moved != step.moved {
+			t.Errorf("%s: moved %v, want %v", step.name, moved, step.moved)
+		}
+		if current := pool.Current(); current != step.current {
+			t.Errorf("%s: current %s, want %s", step.name, current, step.current)
+		}
+	}
+	if !pool.IsPrimary() || pool.Primary() != "wss://a/tunnel" {
+		t.Error("the primary is not selected")
+	}
+}
+
+func TestServerPoolSetServers(t *testing.T) {
+	pool := NewServerPool(ImprovedClientConfig{
+		ServerURLs: []string{"wss://a/tunnel", "wss://b/tunnel"},
+		Logger:     zap.NewNop(),
+	})
+	pool.Failed() // Moves to b with one failure on a
+
+	pool.setServers([]string{"wss://srv1/tunnel", "wss://b/tunnel", "wss://a/tunnel", "wss://b/tunnel"})
+	var urls []string
+	failures := make(map[string]int)
+	for _, server := range pool.Status() {
+		url := server["url"].(string)
+		urls = append(urls, url)
+		failures[url] = server["failures"].(int)
+	}
+	if strings.Join(urls, " ") != "wss://srv1/tunnel wss://b/tunnel wss://a/tunnel" {
+		t.Errorf("servers %v, want duplicates removed in order", urls)
+	}
+	if pool.Current() != "wss://b/tunnel" || failures["wss://a/tunnel"] != 1 {
+		t.Errorf("current %s, failures %v; want b kept and statistics of a", pool.Current(), failures)
+	}
+
+	// The current server going away falls back to the first
+	pool.setServers([]string{"wss://a/tunnel"})
+	if pool.Current() != "wss://a/tunnel" {
+		t.Errorf("current %s, want a", pool.Current())
+	}
+}
+
+func TestHealthURL(t *testing.T) {
+	tests := []struct {
+		tunnelURL string
+		want      string
+	}{
+		{"wss://tunnel.example.com:8443/tunnel", "https://tunnel.example.com:8443/health/ready"},
+		{"ws://10.0.0.1/tunnel?x=1", "http://10.0.0.1/health/ready"},
+		{"https://tunnel.example.com/tunnel", ""},
+		{"://", ""},
+	}
+	for _, tt := range tests {
+		got, err := healthURL(tt.tunnelURL)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: got %s, want an error", tt.tunnelURL, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %s, %v; want %s", tt.tunnelURL, got, err, tt.want)
+		}
+	}
+}
+
+func TestServerPoolProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    interface{} // Encoded as JSON unless a string
+		healthy bool
+	}{
+		{"ready", http.StatusOK, ReadinessStatus{Ready: true}, true},
+		{"missing clients", http.StatusServiceUnavailable, ReadinessStatus{MissingClients: []string{"c1"}}, true},
+		{"draining", http.StatusServiceUnavailable, ReadinessStatus{Draining: true}, false},
+		{"legacy server", http.StatusOK, "OK", true},
+		{"gateway error", http.StatusBadGateway, "bad gateway", false},
+		{"unavailable without status", http.StatusServiceUnavailable, "down", false},
+	}
+
+	pool := NewServerPool(ImprovedClientConfig{Logger: zap.NewNop()})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/health/ready" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(tt.status)
+				if body, ok := tt.body.(string); ok {
+					w.Write([]byte(body))
+					return
+				}
+				json.NewEncoder(w).Encode(tt.body)
+			}))
+			defer server.Close()
+
+			tunnelURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/tunnel"
+			if healthy := pool.Probe(context.Background(), tunnelURL); healthy != tt.healthy {
+				t.Errorf("healthy %v, want %v", healthy, tt.healthy)
+			}
+		})
+	}
+
+	if pool.Probe(context.Background(), "ws://127.0.0.1:1/tunnel") {
+		t.Error("an unreachable server passed the probe")
+	}
+}
@@ -0,0 +1,567 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Share defaults when the policy leaves them unset
+const (
+	defaultShareTTL    = time.Hour
+	defaultMaxShareTTL = 24 * time.Hour
+)
+
+// Reasons share connections are refused or their sessions end
+const (
+	CloseShareDenied  = "share_denied"  // The source address is not allowed to use the share
+	CloseShareExpired = "share_expired" // The share reached its TTL
+	CloseShareRemoved = "share_removed" // An operator removed the share
+)
+
+// SharePolicy controls temporary share forwarders created through the admin API
+type SharePolicy struct {
+	PortRanges []string      `yaml:"port_ranges"` // Ports shares are allocated from; empty disables shares
+	DefaultTTL time.Duration `yaml:"default_ttl"` // TTL of shares that do not ask for one (default 1h)
+	MaxTTL     time.Duration `yaml:"max_ttl"`     // Longest TTL (default 24h)
+	MaxShares  int           `yaml:"max_shares"`  // Concurrent shares (0 = unlimited)
+	PublicHost string        `yaml:"public_host"` // Host name put in the connection details of shares
+}
+
+// ShareRequest asks for a temporary share of a service
+type ShareRequest struct {
+	Name        string   `json:"name"`
+	Forwarder   string   `json:"forwarder,omitempty"` // Existing TCP forwarder whose service is shared
+	ClientID    string   `json:"clientId,omitempty"`  // Client reaching target, when no forwarder is given
+	Target      string   `json:"target,omitempty"`    // host:port or unix:///path pushed to the client like a central mapping
+	TTL         string   `json:"ttl,omitempty"`       // e.g. "1h"
+	MaxSessions int      `json:"maxSessions,omitempty"`
+	AllowedIPs  []string `json:"allowedIps,omitempty"` // Source addresses or CIDRs allowed to connect
+	Token       bool     `json:"token,omitempty"`      // Require an access token to open the share to a source address
+	Operator    string   `json:"operator"`
+	Reason      string   `json:"reason,omitempty"`
+}
+
+// Share is a temporary forwarder and the details needed to connect to it
+type Share struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Forwarder   string    `json:"forwarder,omitempty"`
+	ClientID    string    `json:"clientId,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Port        int       `json:"port"`
+	Address     string    `json:"address"`            // host:port external users connect to
+	Token       string    `json:"token,omitempty"`    // Only returned when the share is created
+	OpenPath    string    `json:"openPath,omitempty"` // Where token holders open the share for their address
+	AllowedIPs  []string  `json:"allowedIps,omitempty"`
+	OpenedBy    []string  `json:"openedBy,omitempty"` // Addresses that opened the share with its token
+	MaxSessions int       `json:"maxSessions,omitempty"`
+	Operator    string    `json:"operator"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// share is the state of a running share
+type share struct {
+	info     Share
+	token    string
+	allowed  []*net.IPNet
+	opened   map[string]bool // source IPs opened with the token
+	active   int             // Open connections, limited by MaxSessions
+	fw       ForwarderConfig
+	listener net.Listener
+	timer    *time.Timer
+}
+
+// Shares tracks temporary share forwarders
+type Shares struct {
+	policy  SharePolicy
+	ports   []portRange
+	entries map[string]*share // share ID -> share
+	mu      sync.Mutex
+}
+
+// NewShares creates a tracker with shares disabled
+func NewShares() *Shares {
+	return &Shares{entries: make(map[string]*share)}
+}
+
+// SetSharePolicy sets the port ranges and TTLs of temporary shares
+func (s *ImprovedServer) SetSharePolicy(policy SharePolicy) error {
+	ports, err := parsePortRanges(policy.PortRanges)
+	if err != nil {
+		return err
+	}
+	if policy.DefaultTTL < 0 || policy.MaxTTL < 0 || policy.MaxShares < 0 {
+		return fmt.Errorf("ttl and max_shares must not be negative")
+	}
+
+	s.shares.mu.Lock()
+	defer s.shares.mu.Unlock()
+	s.shares.policy = policy
+	s.shares.ports = ports
+	return nil
+}
+
+// randomHex returns n random bytes encoded as hex
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseSources parses source addresses and CIDRs
+func parseSources(specs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", spec)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", spec)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// CreateShare opens a temporary forwarder on a free port of the share
+// ranges. It is removed together with its sessions when its TTL ends.
+func (s *ImprovedServer) CreateShare(request ShareRequest) (Share, error) {
+	s.shares.mu.Lock()
+	policy := s.shares.policy
+	ports := s.shares.ports
+	active := len(s.shares.entries)
+	s.shares.mu.Unlock()
+
+	if len(ports) == 0 {
+		return Share{}, fmt.Errorf("shares are disabled")
+	}
+	if policy.MaxShares > 0 && active >= policy.MaxShares {
+		return Share{}, fmt.Errorf("the maximum of %d shares is reached", policy.MaxShares)
+	}
+	if request.Operator == "" {
+		return Share{}, fmt.Errorf("operator is required")
+	}
+	if request.MaxSessions < 0 {
+		return Share{}, fmt.Errorf("maxSessions must not be negative")
+	}
+	if s.draining.Load() {
+		return Share{}, fmt.Errorf("server is shutting down")
+	}
+
+	ttl := policy.DefaultTTL
+	if ttl <= 0 {
+		ttl = defaultShareTTL
+	}
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 {
+			return Share{}, fmt.Errorf("invalid ttl %q", request.TTL)
+		}
+		ttl = parsed
+	}
+	maxTTL := policy.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultMaxShareTTL
+	}
+	if ttl > maxTTL {
+		return Share{}, fmt.Errorf("ttl must not exceed %s", maxTTL)
+	}
+
+	allowed, err := parseSources(request.AllowedIPs)
+	if err != nil {
+		return Share{}, err
+	}
+
+	id, err := randomHex(6)
+	if err != nil {
+		return Share{}, err
+	}
+	name := request.Name
+	if name == "" {
+		name = id
+	}
+	fw, err := s.shareForwarder(request, "share/"+name)
+	if err != nil {
+		return Share{}, err
+	}
+
+	entry := &share{
+		allowed: allowed,
+		opened:  make(map[string]bool),
+		fw:      fw,
+	}
+	if request.Token {
+		if entry.token, err = randomHex(16); err != nil {
+			return Share{}, err
+		}
+	}
+
+	tlsConfig, err := s.forwarderTLS(fw)
+	if err != nil {
+		return Share{}, err
+	}
+
+	listener, err := s.allocateSharePort(ports)
+	if err != nil {
+		return Share{}, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	if request.Target != "" {
+		// Clients map targets by the port they are pushed for
+		entry.fw.Port = port
+	}
+	entry.listener = listener
+	if tlsConfig != nil {
+		// Shares of forwarders terminating TLS terminate it too
+		entry.listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	now := time.Now()
+	host := policy.PublicHost
+	entry.info = Share{
+		ID:          id,
+		Name:        name,
+		Forwarder:   request.Forwarder,
+		ClientID:    request.ClientID,
+		Target:      request.Target,
+		Port:        port,
+		Address:     net.JoinHostPort(host, strconv.Itoa(port)),
+		AllowedIPs:  request.AllowedIPs,
+		MaxSessions: request.MaxSessions,
+		Operator:    request.Operator,
+		Reason:      request.Reason,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	if entry.token != "" {
+		entry.info.OpenPath = "/share/" + id
+	}
+
+	s.listenersMu.Lock()
+	s.listeners[port] = listener
+	s.listenersMu.Unlock()
+
+	// Concurrent requests may have taken the last share since the check above
+	s.shares.mu.Lock()
+	if policy.MaxShares > 0 && len(s.shares.entries) >= policy.MaxShares {
+		s.shares.mu.Unlock()
+		s.StopTCPForwarder(port)
+		return Share{}, fmt.Errorf("the maximum of %d shares is reached", policy.MaxShares)
+	}
+	for _, other := range s.shares.entries {
+		if other.info.Name == name {
+			s.shares.mu.Unlock()
+			s.StopTCPForwarder(port)
+			return Share{}, fmt.Errorf("share %s already exists", name)
+		}
+	}
+	s.shares.entries[id] = entry
+	entry.timer = time.AfterFunc(ttl, func() {
+		s.removeShare(id, CloseShareExpired)
+	})
+	s.shares.mu.Unlock()
+
+	if request.Target != "" {
+		s.forwardersMu.Lock()
+		s.forwarders = append(s.forwarders, entry.fw)
+		s.forwardersMu.Unlock()
+		if client, exists := s.clients.Get(request.ClientID); exists {
+			s.pushMappings(client)
+		}
+	}
+
+	go s.serveShare(entry)
+
+	s.logger.Info("Share created",
+		zap.String("share", id),
+		zap.String("name", name),
+		zap.String("forwarder", request.Forwarder),
+		zap.String("target", request.Target),
+		zap.Int("port", port),
+		zap.Duration("ttl", ttl),
+		zap.Strings("allowedIps", request.AllowedIPs),
+		zap.Bool("token", entry.token != ""),
+		zap.String("operator", request.Operator),
+		zap.String("reason", request.Reason))
+
+	info := entry.info
+	info.Token = entry.token
+	return info, nil
+}
+
+// shareForwarder builds the forwarder configuration sessions of a share use
+func (s *ImprovedServer) shareForwarder(request ShareRequest, name string) (ForwarderConfig, error) {
+	var fw ForwarderConfig
+	switch {
+	case request.Forwarder != "" && request.Target != "":
+		return fw, fmt.Errorf("forwarder and target are mutually exclusive")
+	case request.Forwarder != "":
+		source, exists := s.forwarderByName(request.Forwarder)
+		if !exists {
+			return fw, fmt.Errorf("unknown forwarder %s", request.Forwarder)
+		}
+		if source.Type != "" && source.Type != ForwarderTCP {
+			return fw, fmt.Errorf("only tcp forwarders can be shared")
+		}
+		if source.Access.enabled() {
+			return fw, fmt.Errorf("forwarder %s has access control and cannot be shared", request.Forwarder)
+		}
+		// Sessions reach the service the same way as the forwarder's own and
+		// count against its quota and session limits
+		fw = source
+		fw.owner = source.usageName()
+		fw.AcceptProxyProtocol = false
+	case request.Target != "":
+		if request.ClientID == "" {
+			return fw, fmt.Errorf("clientId is required with a target")
+		}
+		if err := validateTarget(request.Target); err != nil {
+			return fw, err
+		}
+		fw = ForwarderConfig{ClientID: request.ClientID, Target: request.Target, Enabled: true}
+	default:
+		return fw, fmt.Errorf("forwarder or target is required")
+	}
+	fw.Name = name
+	fw.Description = request.Reason
+	return fw, nil
+}
+
+// forwarderByName returns an enabled forwarder by name
+func (s *ImprovedServer) forwarderByName(name string) (ForwarderConfig, bool) {
+	s.forwardersMu.RLock()
+	defer s.forwardersMu.RUnlock()
+	for _, fw := range s.forwarders {
+		if fw.Name == name {
+			return fw, true
+		}
+	}
+	return ForwarderConfig{}, false
+}
+
+// allocateSharePort listens on the first free port of the share ranges
+func (s *ImprovedServer) allocateSharePort(ports []portRange) (net.Listener, error) {
+	for _, r := range ports {
+		for port := r.first; port <= r.last; port++ {
+			if _, used := s.forwarderForPort(port); used {
+				continue
+			}
+			s.listenersMu.Lock()
+			_, used := s.listeners[port]
+			s.listenersMu.Unlock()
+			if used {
+				continue
+			}
+			if listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port)); err == nil {
+				return listener, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no free port in the share ranges")
+}
+
+// serveShare accepts the connections of a share from its allowed sources
+func (s *ImprovedServer) serveShare(entry *share) {
+	defer entry.listener.Close()
+	for {
+		conn, err := entry.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Error("Accept failed", zap.Error(err))
+			continue
+		}
+
+		if !s.shares.admits(entry, conn.RemoteAddr()) {
+			s.logger.Warn("Share connection from a source that is not allowed",
+				zap.String("share", entry.info.ID),
+				zap.String("remote", conn.RemoteAddr().String()))
+			s.metrics.recordClose(CloseShareDenied)
+			conn.Close()
+			continue
+		}
+		if !s.shares.acquire(entry) {
+			s.logger.Warn("Share session limit reached, rejecting connection",
+				zap.String("share", entry.info.ID),
+				zap.String("remote", conn.RemoteAddr().String()))
+			s.metrics.recordClose(CloseMaxSessions)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.shares.release(entry)
+			s.handleTCPConnection(conn, entry.fw, true)
+		}()
+	}
+}
+
+// acquire reserves one of a share's sessions; the limits of a shared
+// forwarder apply on top
+func (sh *Shares) acquire(entry *share) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if entry.info.MaxSessions > 0 && entry.active >= entry.info.MaxSessions {
+		return false
+	}
+	entry.active++
+	return true
+}
+
+// release frees a session reserved with acquire
+func (sh *Shares) release(entry *share) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	entry.active--
+}
+
+// admits reports whether a share accepts connections from remote. Shares
+// without allowed addresses or a token accept everyone.
+func (sh *Shares) admits(entry *share, remote net.Addr) bool {
+	if len(entry.allowed) == 0 && entry.token == "" {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(remote))
+	if ip == nil {
+		return false
+	}
+	for _, network := range entry.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return entry.opened[ip.String()]
+}
+
+// OpenShare lets the holder of a share's token connect from ip
+func (s *ImprovedServer) OpenShare(id, token, ip string) (Share, error) {
+	s.shares.mu.Lock()
+	defer s.shares.mu.Unlock()
+
+	entry, exists := s.shares.entries[id]
+	if !exists || entry.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(entry.token)) != 1 {
+		return Share{}, fmt.Errorf("unknown share or invalid token")
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Share{}, fmt.Errorf("invalid source address %q", ip)
+	}
+	if !entry.opened[parsed.String()] {
+		entry.opened[parsed.String()] = true
+		entry.info.OpenedBy = append(entry.info.OpenedBy, parsed.String())
+		s.logger.Info("Share opened for source address",
+			zap.String("share", id),
+			zap.String("remote", parsed.String()))
+	}
+	return entry.info, nil
+}
+
+// HandleShareOpen opens a share for the caller's address with its token
+// GET|POST /share/{id}?token=...
+func (s *ImprovedServer) HandleShareOpen(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/share/")
+	token := r.URL.Query().Get("token")
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token == "" && bearer != "" {
+		token = bearer
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	info, err := s.OpenShare(id, token, host)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"address":   info.Address,
+		"source":    host,
+		"expiresAt": info.ExpiresAt,
+	})
+}
+
+// Shares returns the running shares ordered by creation
+func (s *ImprovedServer) Shares() []Share {
+	s.shares.mu.Lock()
+	defer s.shares.mu.Unlock()
+
+	result := make([]Share, 0, len(s.shares.entries))
+	for _, entry := range s.shares.entries {
+		result = append(result, entry.info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
+
+// RemoveShare removes a share before its TTL ends and closes its sessions
+func (s *ImprovedServer) RemoveShare(id string) error {
+	if !s.removeShare(id, CloseShareRemoved) {
+		return fmt.Errorf("no share %s", id)
+	}
+	return nil
+}
+
+// removeShare stops a share's listener, forgets its target and closes its sessions
+func (s *ImprovedServer) removeShare(id, reason string) bool {
+	s.shares.mu.Lock()
+	entry, exists := s.shares.entries[id]
+	delete(s.shares.entries, id)
+	s.shares.mu.Unlock()
+	if !exists {
+		return false
+	}
+	entry.timer.Stop()
+
+	s.StopTCPForwarder(entry.info.Port)
+	if entry.info.Target != "" {
+		s.removeForwarder(entry.fw.Name)
+		if client, exists := s.clients.Get(entry.info.ClientID); exists {
+			s.pushMappings(client)
+		}
+	}
+	closed := s.closeForwarderSessions(entry.fw.Name, reason)
+
+	s.logger.Info("Share removed",
+		zap.String("share", id),
+		zap.String("name", entry.info.Name),
+		zap.Int("port", entry.info.Port),
+		zap.String("reason", reason),
+		zap.Int("sessionsClosed", closed))
+	return true
+}
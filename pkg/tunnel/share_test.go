@@ -0,0 +1,234 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseSources(t *testing.T) {
+	tests := []struct {
+		specs []string
+		ip    string
+		match bool
+		valid bool
+	}{
+		{[]string{"192.0.2.10"}, "192.0.2.10", true, true},
+		{[]string{"192.0.2.10"}, "192.0.2.11", false, true},
+		{[]string{"198.51.100.0/24"}, "198.51.100.200", true, true},
+		{[]string{"2001:db8::1"}, "2001:db8::1", true, true},
+		{[]string{"2001:db8::/32"}, "2001:db8:1::5", true, true},
+		{[]string{"192.0.2.10", "2001:db8::/32"}, "203.0.113.1", false, true},
+		{[]string{"192.0.2"}, "", false, false},
+		{[]string{"192.0.2.0/33"}, "", false, false},
+		{[]string{"example.com"}, "", false, false},
+	}
+
+	for _, tt := range tests {
+		nets, err := parseSources(tt.specs)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%v: expected an error", tt.specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.specs, err)
+			continue
+		}
+		if got := containsIP(nets, net.ParseIP(tt.ip)); got != tt.match {
+			t.Errorf("%v contains %s = %v, want %v", tt.specs, tt.ip, got, tt.match)
+		}
+	}
+}
+
+func TestShareForwarder(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+		{Name: "ssh", Port: 2222, ClientID: "c1", Enabled: true, MaxSessions: 5, AcceptProxyProtocol: true},
+		{Name: "web", Type: ForwarderHTTP, Port: 8080, Enabled: true},
+		{Name: "db", Port: 5432, ClientID: "c1", Enabled: true, Access: AccessConfig{JustInTime: true}},
+	})
+
+	tests := []struct {
+		name    string
+		request ShareRequest
+		valid   bool
+	}{
+		{"forwarder", ShareRequest{Forwarder: "ssh"}, true},
+		{"target", ShareRequest{ClientID: "c1", Target: "localhost:22"}, true},
+		{"both", ShareRequest{Forwarder: "ssh", ClientID: "c1", Target: "localhost:22"}, false},
+		{"neither", ShareRequest{}, false},
+		{"unknown forwarder", ShareRequest{Forwarder: "missing"}, false},
+		{"http forwarder", ShareRequest{Forwarder: "web"}, false},
+		{"access-controlled forwarder", ShareRequest{Forwarder: "db"}, false},
+		{"target without client", ShareRequest{Target: "localhost:22"}, false},
+		{"invalid target", ShareRequest{ClientID: "c1", Target: "localhost"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fw, err := server.shareForwarder(tt.request, "share/x")
+			if !tt.valid {
+				if err == nil {
+					t.Errorf("got %+v, want an error", fw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fw.Name != "share/x" {
+				t.Errorf("name %q", fw.Name)
+			}
+			if tt.request.Forwarder != "" && (fw.usageName() != "ssh" || fw.MaxSessions != 5 || fw.AcceptProxyProtocol) {
+				t.Errorf("shared forwarder %+v does not count against ssh", fw)
+			}
+		})
+	}
+}
+
+func TestCreateShareMaxShares(t *testing.T) {
+	first := freePort(t)
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+		{Name: "ssh", Port: 2222, ClientID: "c1", Enabled: true},
+	})
+	if err := server.SetSharePolicy(SharePolicy{
+		PortRanges: []string{strconv.Itoa(first) + "-" + strconv.Itoa(first+50)},
+		MaxShares:  2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent requests cannot get past the limit together
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var created []Share
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			share, err := server.CreateShare(ShareRequest{Name: "s" + strconv.Itoa(i), Forwarder: "ssh", Operator: "alice"})
+			if err == nil {
+				mu.Lock()
+				created = append(created, share)
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(created) != 2 || len(server.Shares()) != 2 {
+		t.Fatalf("created %d shares, want 2", len(created))
+	}
+	server.listenersMu.Lock()
+	listeners := len(server.listeners)
+	server.listenersMu.Unlock()
+	if listeners != 2 {
+		t.Errorf("%d listeners left open, want 2", listeners)
+	}
+
+	// Removing a share makes room for another; names stay unique
+	if err := server.RemoveShare(created[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RemoveShare(created[0].ID); err == nil {
+		t.Error("removed a share twice")
+	}
+	if _, err := server.CreateShare(ShareRequest{Name: created[1].Name, Forwarder: "ssh", Operator: "alice"}); err == nil {
+		t.Error("created a share with a duplicate name")
+	}
+	share, err := server.CreateShare(ShareRequest{Forwarder: "ssh", Operator: "alice", TTL: "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if share.Name != share.ID || share.ExpiresAt.Sub(share.CreatedAt) != 50*time.Millisecond {
+		t.Errorf("share %+v", share)
+	}
+
+	// The share is removed when its TTL ends
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Shares()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("share did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.RemoveShare(created[1].ID)
+}
+
+func TestCreateShareRequests(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{
+		{Name: "ssh", Port: 2222, ClientID: "c1", Enabled: true},
+	})
+	if _, err := server.CreateShare(ShareRequest{Forwarder: "ssh", Operator: "alice"}); err == nil {
+		t.Error("created a share while shares are disabled")
+	}
+	first := freePort(t)
+	if err := server.SetSharePolicy(SharePolicy{PortRanges: []string{strconv.Itoa(first) + "-" + strconv.Itoa(first+50)}, MaxTTL: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		request ShareRequest
+	}{
+		{"no operator", ShareRequest{Forwarder: "ssh"}},
+		{"negative sessions", ShareRequest{Forwarder: "ssh", Operator: "alice", MaxSessions: -1}},
+		{"invalid ttl", ShareRequest{Forwarder: "ssh", Operator: "alice", TTL: "soon"}},
+		{"ttl above maximum", ShareRequest{Forwarder: "ssh", Operator: "alice", TTL: "2h"}},
+		{"invalid source", ShareRequest{Forwarder: "ssh", Operator: "alice", AllowedIPs: []string{"nowhere"}}},
+	} {
+		if _, err := server.CreateShare(tt.request); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+	if len(server.Shares()) != 0 {
+		t.Errorf("refused requests left shares: %+v", server.Shares())
+	}
+}
+
+func TestShareAdmission(t *testing.T) {
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	allowed, _ := parseSources([]string{"192.0.2.0/24"})
+	open := &share{opened: make(map[string]bool)}
+	locked := &share{allowed: allowed, opened: make(map[string]bool), token: "t0ken"}
+	limited := &share{opened: make(map[string]bool), info: Share{MaxSessions: 1}}
+	server.shares.entries["locked"] = locked
+
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000} }
+	if !server.shares.admits(open, addr("203.0.113.1")) {
+		t.Error("a share without sources or token refused a connection")
+	}
+	if !server.shares.admits(locked, addr("192.0.2.7")) || server.shares.admits(locked, addr("203.0.113.1")) {
+		t.Error("allowed sources not applied")
+	}
+
+	if _, err := server.OpenShare("locked", "wrong", "203.0.113.1"); err == nil {
+		t.Error("opened a share with a wrong token")
+	}
+	if _, err := server.OpenShare("missing", "t0ken", "203.0.113.1"); err == nil {
+		t.Error("opened an unknown share")
+	}
+	if _, err := server.OpenShare("locked", "t0ken", "not-an-ip"); err == nil {
+		t.Error("opened a share for an invalid address")
+	}
+	info, err := server.OpenShare("locked", "t0ken", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.OpenShare("locked", "t0ken", "203.0.113.1")
+	if len(info.OpenedBy) != 1 || !server.shares.admits(locked, addr("203.0.113.1")) {
+		t.Errorf("token holder not admitted: %+v", info)
+	}
+
+	if !server.shares.acquire(limited) || server.shares.acquire(limited) {
+		t.Error("share session limit not applied")
+	}
+	server.shares.release(limited)
+	if !server.shares.acquire(limited) {
+		t.Error("released session not freed")
+	}
+}
@@ -1,44 +1,131 @@
 package tunnel
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 )
 
+// SOCKS5 protocol constants (RFC 1928, RFC 1929)
+const (
+	socks5Version = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xFF
+	socksUserPassVersion    = 0x01
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyNotAllowed         = 0x02
+	socksReplyNetworkUnreachable = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyTTLExpired         = 0x06
+	socksReplyCommandUnsupported = 0x07
+	socksReplyAddressUnsupported = 0x08
+)
+
+// socksConnectTimeout bounds how long the server may take to open a session
+const socksConnectTimeout = 30 * time.Second
+
 // SOCKS5Proxy provides a SOCKS5 proxy that routes through the tunnel
 type SOCKS5Proxy struct {
 	logger       *zap.Logger
 	tunnelClient *ImprovedClient
 	listener     net.Listener
+	credentials  map[string]string // username -> password; nil disables authentication
 	ctx          context.Context
 	cancel       context.CancelFunc
 }
 
 func NewSOCKS5Proxy(logger *zap.Logger, tunnelClient *ImprovedClient) *SOCKS5Proxy {
 	ctx, cancel := context.WithCancel(context.Background())
-	
+
 	return &SOCKS5Proxy{
 		logger:       logger,
 		tunnelClient: tunnelClient,
-		ctx:         ctx,
-		cancel:      cancel,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+// SetCredentials requires username/password authentication with the given accounts
+func (s *SOCKS5Proxy) SetCredentials(credentials map[string]string) {
+	s.credentials = credentials
+}
+
+// LoadProxyCredentials reads a credentials file with one "username:password"
+// per line. Empty lines and lines starting with '#' are ignored.
+func LoadProxyCredentials(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open credentials file: %w", err)
+	}
+	defer file.Close()
+
+	credentials := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:password", path, lineNo)
+		}
+		// RFC 1929 encodes both fields with a one-byte length
+		if len(username) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("%s:%d: username and password are limited to 255 bytes", path, lineNo)
+		}
+		credentials[username] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %w", err)
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("%s: no credentials found", path)
+	}
+	return credentials, nil
+}
+
 func (s *SOCKS5Proxy) Start(port int) error {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return s.Listen(fmt.Sprintf(":%d", port))
+}
+
+// Listen starts the proxy on a host:port address
+func (s *SOCKS5Proxy) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return fmt.Errorf("failed to create SOCKS5 listener: %w", err)
 	}
-	
+
 	s.listener = listener
-	s.logger.Info("SOCKS5 proxy started", zap.Int("port", port))
-	
+	s.logger.Info("SOCKS5 proxy started",
+		zap.String("address", listener.Addr().String()),
+		zap.Bool("authentication", s.credentials != nil))
+
 	go s.acceptConnections()
 	return nil
 }
@@ -51,10 +138,13 @@ func (s *SOCKS5Proxy) acceptConnections() {
 		default:
 			conn, err := s.listener.Accept()
 			if err != nil {
+				if s.ctx.Err() != nil {
+					return
+				}
 				s.logger.Error("SOCKS5 accept failed", zap.Error(err))
 				continue
 			}
-			
+
 			go s.handleSOCKS5Connection(conn)
 		}
 	}
@@ -62,133 +152,391 @@ func (s *SOCKS5Proxy) acceptConnections() {
 
 func (s *SOCKS5Proxy) handleSOCKS5Connection(conn net.Conn) {
 	defer conn.Close()
-	
+
 	// SOCKS5 handshake
+	conn.SetDeadline(time.Now().Add(socksConnectTimeout))
 	if !s.performHandshake(conn) {
 		return
 	}
-	
+
 	// Get connection request
-	targetHost, targetPort, err := s.parseConnectionRequest(conn)
+	command, target, err := s.parseConnectionRequest(conn)
 	if err != nil {
-		s.logger.Error("Failed to parse SOCKS5 request", zap.Error(err))
+		s.logger.Debug("Failed to parse SOCKS5 request", zap.Error(err))
+		if reply, ok := err.(socksRequestError); ok {
+			s.sendConnectionResponse(conn, byte(reply), "")
+		}
 		return
 	}
-	
-	// Connect through tunnel
-	target := fmt.Sprintf("%s:%d", targetHost, targetPort)
+
+	switch command {
+	case socksCmdConnect:
+		s.handleConnect(conn, target)
+	case socksCmdUDPAssociate:
+		s.handleUDPAssociate(conn, target)
+	default:
+		s.sendConnectionResponse(conn, socksReplyCommandUnsupported, "")
+	}
+}
+
+// handleConnect opens a TCP session through the tunnel and relays it
+func (s *SOCKS5Proxy) handleConnect(conn net.Conn, target string) {
 	tunnelConn, err := s.connectThroughTunnel(target)
 	if err != nil {
-		s.logger.Error("Failed to connect through tunnel", zap.Error(err))
-		s.sendConnectionResponse(conn, 0x05) // Connection refused
+		s.logger.Warn("Failed to connect through tunnel", zap.String("target", target), zap.Error(err))
+		s.sendConnectionResponse(conn, socksReplyCode(err), "")
 		return
 	}
 	defer tunnelConn.Close()
-	
-	// Send success response
-	s.sendConnectionResponse(conn, 0x00) // Success
-	
+
+	// Report the address the server connected from
+	if err := s.sendConnectionResponse(conn, socksReplySucceeded, tunnelConn.BoundAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
 	// Start forwarding
-	go io.Copy(tunnelConn, conn)
+	go func() {
+		io.Copy(tunnelConn, conn)
+		tunnelConn.Close()
+	}()
 	io.Copy(conn, tunnelConn)
 }
 
+// handleUDPAssociate relays UDP datagrams through a datagram session for as
+// long as the control connection stays open
+func (s *SOCKS5Proxy) handleUDPAssociate(conn net.Conn, requested string) {
+	ctx, cancel := context.WithTimeout(s.ctx, socksConnectTimeout)
+	session, err := s.tunnelClient.OpenDatagramSession(ctx)
+	cancel()
+	if err != nil {
+		s.logger.Warn("Failed to open datagram session", zap.Error(err))
+		s.sendConnectionResponse(conn, socksReplyCode(err), "")
+		return
+	}
+	defer session.Close()
+
+	// Datagrams are accepted on the interface the client reached us on
+	localIP := conn.LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.logger.Error("Failed to open UDP relay", zap.Error(err))
+		s.sendConnectionResponse(conn, socksReplyGeneralFailure, "")
+		return
+	}
+	defer relay.Close()
+
+	if err := s.sendConnectionResponse(conn, socksReplySucceeded, relay.LocalAddr().String()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	association := &socksUDPAssociation{
+		relay:    relay,
+		session:  session,
+		clientIP: conn.RemoteAddr().(*net.TCPAddr).IP,
+		logger:   s.logger,
+	}
+	// A non-zero address in the request names the client's source port
+	if host, port, err := net.SplitHostPort(requested); err == nil && port != "0" {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			if source, err := net.ResolveUDPAddr("udp", requested); err == nil {
+				association.source.Store(source)
+			}
+		}
+	}
+
+	go association.fromClient()
+	go association.toClient()
+
+	// The association ends with the control connection or the session
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-session.Done():
+	case <-s.ctx.Done():
+	}
+}
+
+// socksUDPAssociation relays between a SOCKS client's UDP socket and a datagram session
+type socksUDPAssociation struct {
+	relay    *net.UDPConn
+	session  *DatagramSession
+	clientIP net.IP
+	source   atomic.Pointer[net.UDPAddr] // Client address datagrams come from, learned from the first one
+	logger   *zap.Logger
+}
+
+// fromClient unwraps datagrams from the client and sends them through the tunnel
+func (a *socksUDPAssociation) fromClient() {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, from, err := a.relay.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) {
+			continue
+		}
+		if source := a.source.Load(); source == nil {
+			a.source.Store(from)
+		} else if source.Port != from.Port {
+			continue
+		}
+
+		// RSV(2) FRAG(1) ATYP ADDR PORT DATA; fragments are not supported
+		if n < 4 || buffer[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buffer[4:n])
+		target, err := readSOCKSAddress(reader, buffer[3])
+		if err != nil {
+			continue
+		}
+		payload := buffer[n-reader.Len() : n]
+		if err := a.session.WriteTo(append([]byte(nil), payload...), target); err != nil {
+			a.logger.Debug("Failed to send datagram through tunnel", zap.Error(err))
+			return
+		}
+	}
+}
+
+// toClient wraps datagrams from the tunnel and sends them to the client
+func (a *socksUDPAssociation) toClient() {
+	for {
+		select {
+		case datagram := <-a.session.Datagrams():
+			source := a.source.Load()
+			if source == nil {
+				continue
+			}
+			header, err := appendSOCKSAddress([]byte{0, 0, 0}, datagram.Addr)
+			if err != nil {
+				continue
+			}
+			a.relay.WriteToUDP(append(header, datagram.Data...), source)
+		case <-a.session.Done():
+			return
+		}
+	}
+}
+
 func (s *SOCKS5Proxy) performHandshake(conn net.Conn) bool {
 	// Read version and method count
 	buffer := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buffer); err != nil {
 		return false
 	}
-	
+
 	version := buffer[0]
 	methodCount := buffer[1]
-	
-	if version != 0x05 {
+
+	if version != socks5Version {
 		return false
 	}
-	
+
 	// Read methods
 	methods := make([]byte, methodCount)
 	if _, err := io.ReadFull(conn, methods); err != nil {
 		return false
 	}
-	
-	// Respond with no authentication required
-	response := []byte{0x05, 0x00}
-	conn.Write(response)
-	
+
+	// Username/password is mandatory once credentials are configured
+	method := byte(socksMethodNoAuth)
+	if s.credentials != nil {
+		method = socksMethodUserPass
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{socks5Version, socksMethodNoAcceptable})
+		return false
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return false
+	}
+
+	if method == socksMethodUserPass {
+		return s.authenticate(conn)
+	}
 	return true
 }
 
-func (s *SOCKS5Proxy) parseConnectionRequest(conn net.Conn) (string, int, error) {
+// authenticate performs the RFC 1929 username/password subnegotiation
+func (s *SOCKS5Proxy) authenticate(conn net.Conn) bool {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socksUserPassVersion {
+		return false
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return false
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return false
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return false
+	}
+
+	expected, exists := s.credentials[string(username)]
+	if !exists || subtle.ConstantTimeCompare(password, []byte(expected)) != 1 {
+		s.logger.Warn("SOCKS5 authentication failed",
+			zap.String("username", string(username)),
+			zap.String("remote", conn.RemoteAddr().String()))
+		conn.Write([]byte{socksUserPassVersion, 0x01})
+		return false
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, 0x00})
+	return err == nil
+}
+
+// socksRequestError is a request failure answered with a reply code
+type socksRequestError byte
+
+func (e socksRequestError) Error() string {
+	return fmt.Sprintf("SOCKS5 request rejected with reply %d", byte(e))
+}
+
+func (s *SOCKS5Proxy) parseConnectionRequest(conn net.Conn) (byte, string, error) {
 	// Read request header
 	buffer := make([]byte, 4)
 	if _, err := io.ReadFull(conn, buffer); err != nil {
-		return "", 0, err
+		return 0, "", err
 	}
-	
+
 	version := buffer[0]
 	command := buffer[1]
 	addressType := buffer[3]
-	
-	if version != 0x05 || command != 0x01 { // CONNECT command
-		return "", 0, fmt.Errorf("invalid SOCKS5 request")
+
+	if version != socks5Version {
+		return 0, "", fmt.Errorf("invalid SOCKS5 request version %d", version)
+	}
+
+	target, err := readSOCKSAddress(conn, addressType)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// BIND would need an inbound listener on the server and is not offered
+	if command != socksCmdConnect && command != socksCmdUDPAssociate {
+		return 0, "", socksRequestError(socksReplyCommandUnsupported)
 	}
-	
+	return command, target, nil
+}
+
+// readSOCKSAddress reads an address of the given type followed by a port
+func readSOCKSAddress(r io.Reader, addressType byte) (string, error) {
 	var host string
-	var port int
-	
+
 	switch addressType {
-	case 0x01: // IPv4
-		addr := make([]byte, 4)
-		if _, err := io.ReadFull(conn, addr); err != nil {
-			return "", 0, err
-		}
-		host = fmt.Sprintf("%d.%d.%d.%d", addr[0], addr[1], addr[2], addr[3])
-		
-	case 0x03: // Domain name
+	case socksAtypIPv4:
+		addr := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+
+	case socksAtypIPv6:
+		addr := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+
+	case socksAtypDomain:
 		lengthByte := make([]byte, 1)
-		if _, err := io.ReadFull(conn, lengthByte); err != nil {
-			return "", 0, err
+		if _, err := io.ReadFull(r, lengthByte); err != nil {
+			return "", err
 		}
-		
-		domainLength := lengthByte[0]
-		domain := make([]byte, domainLength)
-		if _, err := io.ReadFull(conn, domain); err != nil {
-			return "", 0, err
+
+		domain := make([]byte, lengthByte[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
 		}
 		host = string(domain)
-		
+
 	default:
-		return "", 0, fmt.Errorf("unsupported address type: %d", addressType)
+		return "", socksRequestError(socksReplyAddressUnsupported)
 	}
-	
+
 	// Read port
 	portBytes := make([]byte, 2)
-	if _, err := io.ReadFull(conn, portBytes); err != nil {
-		return "", 0, err
+	if _, err := io.ReadFull(r, portBytes); err != nil {
+		return "", err
+	}
+	port := int(binary.BigEndian.Uint16(portBytes))
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// appendSOCKSAddress appends the ATYP, address and port encoding of host:port
+func appendSOCKSAddress(buf []byte, address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(append(buf, socksAtypIPv4), ip4...)
+		} else {
+			buf = append(append(buf, socksAtypIPv6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name too long")
+		}
+		buf = append(append(buf, socksAtypDomain, byte(len(host))), host...)
 	}
-	port = int(binary.BigEndian.Uint16(portBytes))
-	
-	return host, port, nil
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
 }
 
-func (s *SOCKS5Proxy) sendConnectionResponse(conn net.Conn, status byte) {
-	response := []byte{
-		0x05,       // Version
-		status,     // Status
-		0x00,       // Reserved
-		0x01,       // Address type (IPv4)
-		0, 0, 0, 0, // Bind address (0.0.0.0)
-		0, 0,       // Bind port (0)
+// sendConnectionResponse sends a reply with the bound address, 0.0.0.0:0 if unknown
+func (s *SOCKS5Proxy) sendConnectionResponse(conn net.Conn, status byte, bound string) error {
+	header := []byte{
+		socks5Version, // Version
+		status,        // Status
+		0x00,          // Reserved
+	}
+	response, err := appendSOCKSAddress(header, bound)
+	if err != nil {
+		response, _ = appendSOCKSAddress(header, "0.0.0.0:0")
 	}
-	conn.Write(response)
+	_, err = conn.Write(response)
+	return err
 }
 
-func (s *SOCKS5Proxy) connectThroughTunnel(target string) (net.Conn, error) {
-	// This would integrate with the tunnel client
-	// For now, direct connection (would be replaced with tunnel logic)
-	return net.Dial("tcp", target)
+// socksReplyCode maps a tunnel error to a SOCKS5 reply code
+func socksReplyCode(err error) byte {
+	switch errorCode(err) {
+	case ErrCodeNotAllowed:
+		return socksReplyNotAllowed
+	case ErrCodeNetworkUnreachable:
+		return socksReplyNetworkUnreachable
+	case ErrCodeHostUnreachable:
+		return socksReplyHostUnreachable
+	case ErrCodeConnectionRefused:
+		return socksReplyConnectionRefused
+	case ErrCodeTimeout:
+		return socksReplyTTLExpired
+	}
+	return socksReplyGeneralFailure
+}
+
+// connectThroughTunnel asks the server to connect to target
+func (s *SOCKS5Proxy) connectThroughTunnel(target string) (*TunnelConn, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, socksConnectTimeout)
+	defer cancel()
+	return s.tunnelClient.DialTunnel(ctx, target)
 }
 
 func (s *SOCKS5Proxy) Stop() {
@@ -196,4 +544,4 @@ func (s *SOCKS5Proxy) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,225 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// startSOCKS5Proxy runs a proxy on a loopback port and returns its address
+func startSOCKS5Proxy(t *testing.T, client *ImprovedClient, credentials map[string]string) string {
+	t.Helper()
+	proxy := NewSOCKS5Proxy(zap.NewNop(), client)
+	if credentials != nil {
+		proxy.SetCredentials(credentials)
+	}
+	if err := proxy.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(proxy.Stop)
+	return proxy.listener.Addr().String()
+}
+
+// socksRequest encodes a SOCKS5 request for a command and host:port
+func socksRequest(t *testing.T, command byte, address string) []byte {
+	t.Helper()
+	request, err := appendSOCKSAddress([]byte{socks5Version, command, 0x00}, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// readSOCKSReply reads a reply and returns its code and bound address
+func readSOCKSReply(t *testing.T, conn net.Conn) (byte, string) {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bound, err := readSOCKSAddress(conn, header[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header[1], bound
+}
+
+func TestSOCKSAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		encoded []byte
+	}{
+		{"10.1.2.3:80", []byte{socksAtypIPv4, 10, 1, 2, 3, 0, 80}},
+		{"[fd00::1]:443", append(append([]byte{socksAtypIPv6}, net.ParseIP("fd00::1")...), 1, 187)},
+		{"db.internal:5432", append(append([]byte{socksAtypDomain, 11}, "db.internal"...), 0x15, 0x38)},
+	}
+
+	for _, tt := range tests {
+		encoded, err := appendSOCKSAddress(nil, tt.address)
+		if err != nil || !bytes.Equal(encoded, tt.encoded) {
+			t.Errorf("appendSOCKSAddress(%q) = %v, %v; want %v", tt.address, encoded, err, tt.encoded)
+			continue
+		}
+		address, err := readSOCKSAddress(bytes.NewReader(encoded[1:]), encoded[0])
+		if err != nil || address != tt.address {
+			t.Errorf("readSOCKSAddress(%v) = %q, %v", encoded, address, err)
+		}
+	}
+
+	if _, err := readSOCKSAddress(bytes.NewReader([]byte{1, 2, 3, 4, 0, 80}), 0x05); err != socksRequestError(socksReplyAddressUnsupported) {
+		t.Errorf("unknown address type: %v", err)
+	}
+	if _, err := readSOCKSAddress(bytes.NewReader([]byte{10, 1}), socksAtypIPv4); err == nil {
+		t.Error("read a truncated address")
+	}
+}
+
+func TestSOCKSReplyCode(t *testing.T) {
+	tests := []struct {
+		err   error
+		reply byte
+	}{
+		{&TunnelError{Code: ErrCodeNotAllowed}, socksReplyNotAllowed},
+		{&TunnelError{Code: ErrCodeNetworkUnreachable}, socksReplyNetworkUnreachable},
+		{&TunnelError{Code: ErrCodeHostUnreachable}, socksReplyHostUnreachable},
+		{&TunnelError{Code: ErrCodeConnectionRefused}, socksReplyConnectionRefused},
+		{&TunnelError{Code: ErrCodeTimeout}, socksReplyTTLExpired},
+		{io.EOF, socksReplyGeneralFailure},
+	}
+
+	for _, tt := range tests {
+		if got := socksReplyCode(tt.err); got != tt.reply {
+			t.Errorf("socksReplyCode(%v) = %d, want %d", tt.err, got, tt.reply)
+		}
+	}
+}
+
+func TestSOCKSHandshake(t *testing.T) {
+	credentials := map[string]string{"alice": "secret"}
+
+	tests := []struct {
+		name        string
+		credentials map[string]string
+		greeting    []byte
+		method      byte
+		auth        []byte // Username/password subnegotiation, nil to skip
+		authStatus  byte
+	}{
+		{"no authentication", nil, []byte{5, 1, socksMethodNoAuth}, socksMethodNoAuth, nil, 0},
+		{"password offered but not required", nil, []byte{5, 2, socksMethodUserPass, socksMethodNoAuth}, socksMethodNoAuth, nil, 0},
+		{"password required", credentials, []byte{5, 1, socksMethodNoAuth}, socksMethodNoAcceptable, nil, 0},
+		{"valid password", credentials, []byte{5, 2, socksMethodNoAuth, socksMethodUserPass}, socksMethodUserPass, []byte("\x01\x05alice\x06secret"), 0},
+		{"wrong password", credentials, []byte{5, 1, socksMethodUserPass}, socksMethodUserPass, []byte("\x01\x05alice\x05wrong"), 1},
+		{"unknown user", credentials, []byte{5, 1, socksMethodUserPass}, socksMethodUserPass, []byte("\x01\x03bob\x06secret"), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", startSOCKS5Proxy(t, nil, tt.credentials))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			conn.Write(tt.greeting)
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[0] != socks5Version || reply[1] != tt.method {
+				t.Fatalf("method reply %v, want method %d", reply, tt.method)
+			}
+			if tt.method == socksMethodNoAcceptable {
+				return
+			}
+			if tt.auth != nil {
+				conn.Write(tt.auth)
+				if _, err := io.ReadFull(conn, reply); err != nil {
+					t.Fatal(err)
+				}
+				if reply[0] != socksUserPassVersion || reply[1] != tt.authStatus {
+					t.Fatalf("authentication reply %v, want status %d", reply, tt.authStatus)
+				}
+				if tt.authStatus != 0 {
+					if _, err := conn.Read(reply); err != io.EOF {
+						t.Errorf("connection open after failed authentication: %v", err)
+					}
+					return
+				}
+			}
+
+			// BIND is refused once the handshake is done
+			conn.Write(socksRequest(t, socksCmdBind, "10.1.2.3:80"))
+			if code, _ := readSOCKSReply(t, conn); code != socksReplyCommandUnsupported {
+				t.Errorf("BIND reply %d, want %d", code, socksReplyCommandUnsupported)
+			}
+		})
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	if err := server.SetEgressPolicy(EgressPolicy{Enabled: true, Rules: []EgressRule{
+		{Clients: []string{"c1"}, Destinations: TargetAllowlist{"127.0.0.1:" + echoPort}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	client := startTestClient(t, server, web.URL, "c1", map[int]string{})
+	for deadline := time.Now().Add(5 * time.Second); !client.isConnected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not connect")
+		}
+	}
+	proxyAddr := startSOCKS5Proxy(t, client, nil)
+
+	tests := []struct {
+		name   string
+		target string
+		reply  byte
+	}{
+		{"allowed destination", echoAddr, socksReplySucceeded},
+		{"other port", "127.0.0.1:" + strconv.Itoa(freePort(t)), socksReplyNotAllowed},
+		{"other host", "192.0.2.1:" + echoPort, socksReplyNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			conn.Write([]byte{5, 1, socksMethodNoAuth})
+			if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(socksRequest(t, socksCmdConnect, tt.target))
+			code, bound := readSOCKSReply(t, conn)
+			if code != tt.reply {
+				t.Fatalf("reply %d, want %d", code, tt.reply)
+			}
+			if code == socksReplySucceeded {
+				if bound == "0.0.0.0:0" {
+					t.Error("no bound address reported")
+				}
+				echo(t, conn, "through the tunnel")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tlsPeekTimeout bounds how long a client may take to send its ClientHello
+const tlsPeekTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake once the ClientHello has been parsed
+var errHelloRead = errors.New("client hello read")
+
+// handleTLSConnection routes a connection of a TLS forwarder by the SNI
+// hostname of its ClientHello. The server never terminates TLS: the peeked
+// bytes are replayed into the chosen session and the rest is spliced through.
+func (s *ImprovedServer) handleTLSConnection(conn net.Conn, fw ForwarderConfig) {
+	serverName, peeked, err := peekServerName(conn)
+	if err != nil {
+		s.logger.Warn("Failed to read TLS ClientHello",
+			zap.String("forwarder", fw.Name),
+			zap.String("remote", conn.RemoteAddr().String()),
+			zap.Error(err))
+		conn.Close()
+		return
+	}
+
+	var best HTTPRoute
+	bestScore := 0
+	for _, route := range fw.Routes {
+		if score := route.matches(serverName, ""); score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	if bestScore == 0 {
+		s.logger.Warn("No TLS route for server name",
+			zap.String("forwarder", fw.Name),
+			zap.String("serverName", serverName),
+			zap.String("remote", conn.RemoteAddr().String()))
+		conn.Close()
+		return
+	}
+
+	s.logger.Debug("Routing TLS connection",
+		zap.String("forwarder", fw.Name),
+		zap.String("serverName", serverName),
+		zap.String("route", best.String()))
+	s.handleTCPConnection(&prefixedConn{Conn: conn, pending: peeked}, routeForwarder(fw, best), true)
+}
+
+// peekServerName reads the ClientHello of a connection and returns its SNI
+// hostname, lowercased, along with the bytes read. The hostname is empty if
+// the client sent none.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(tlsPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var peeked bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &peeked)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	return strings.ToLower(hello.ServerName), peeked.Bytes(), nil
+}
+
+// readOnlyConn lets crypto/tls parse a ClientHello without writing anything
+// back to the client
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                { return nil }
+func (c readOnlyConn) SetDeadline(time.Time) error { return nil }
+
+func (c readOnlyConn) SetReadDeadline(time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(time.Time) error { return nil }
@@ -0,0 +1,146 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestPeekServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string // Sent by a TLS client; "-" sends plain text instead
+		want       string
+	}{
+		{"server name", "db.example.com", "db.example.com"},
+		{"lowercased", "DB.Example.com", "db.example.com"},
+		{"no server name", "", ""},
+		{"not TLS", "-", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			var sent []byte
+			go func() {
+				if tt.serverName == "-" {
+					client.Write([]byte("GET / HTTP/1.1\r\nHost: db.example.com\r\n\r\n"))
+					return
+				}
+				tls.Client(recordingConn{Conn: client, sent: &sent}, &tls.Config{
+					ServerName:         tt.serverName,
+					InsecureSkipVerify: true,
+				}).Handshake()
+			}()
+
+			serverName, peeked, err := peekServerName(server)
+			if tt.serverName == "-" {
+				if err == nil {
+					t.Errorf("read server name %q from plain text", serverName)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if serverName != tt.want {
+				t.Errorf("server name %q, want %q", serverName, tt.want)
+			}
+			// The peeked bytes are the ClientHello as sent, to be replayed
+			server.Close()
+			if string(peeked) != string(sent) {
+				t.Errorf("peeked %d bytes, client sent %d", len(peeked), len(sent))
+			}
+		})
+	}
+}
+
+// recordingConn keeps a copy of everything written to Conn
+type recordingConn struct {
+	net.Conn
+	sent *[]byte
+}
+
+func (c recordingConn) Write(b []byte) (int, error) {
+	*c.sent = append(*c.sent, b...)
+	return c.Conn.Write(b)
+}
+
+func TestTLSForwarder(t *testing.T) {
+	service := func(name string) string {
+		s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		t.Cleanup(s.Close)
+		return s.Listener.Addr().String()
+	}
+	port, dbPort, webPort := freePort(t), freePort(t), freePort(t)
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:    "tls",
+		Type:    ForwarderTLS,
+		Port:    port,
+		Enabled: true,
+		Routes: []HTTPRoute{
+			{Host: "db.example.com", ClientID: "c1", Port: dbPort},
+			{Host: "*.example.com", ClientID: "c1", Port: webPort},
+		},
+	}})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	startTestClient(t, server, web.URL, "c1", map[int]string{dbPort: service("db"), webPort: service("web")})
+	if err := server.StartTCPForwarder(port, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer server.StopTCPForwarder(port)
+
+	tests := []struct {
+		serverName string
+		body       string // Empty if the connection is refused
+	}{
+		{"db.example.com", "db"},
+		{"www.example.com", "web"},
+		{"db.example.org", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{
+				// The server terminates nothing, so the backend's certificate is seen
+				TLSClientConfig: &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true},
+				DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+					return net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+				},
+			}}
+			resp, err := client.Get("https://" + tt.serverName + "/")
+			if tt.body == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Error("connection without a route was served")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.body {
+				t.Errorf("body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
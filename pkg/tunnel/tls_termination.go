@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake with an external client
+const tlsHandshakeTimeout = 10 * time.Second
+
+// certificate is a certificate and key pair that can be read again from disk
+// while listeners keep using it, so renewed certificates need no restart
+type certificate struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+}
+
+// load reads the pair from disk; the previous certificate stays in use on error
+func (c *certificate) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.current.Store(&cert)
+	return nil
+}
+
+// serverTLS returns the server TLS configuration for a certificate and key,
+// loading each pair once. Handshakes use the pair as last loaded, see
+// ReloadCertificates.
+func (s *ImprovedServer) serverTLS(certFile, keyFile string) (*tls.Config, error) {
+	key := certFile + "\x00" + keyFile
+	s.certsMu.Lock()
+	defer s.certsMu.Unlock()
+	cert, exists := s.certs[key]
+	if !exists {
+		cert = &certificate{certFile: certFile, keyFile: keyFile}
+		if err := cert.load(); err != nil {
+			return nil, err
+		}
+		s.certs[key] = cert
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.current.Load(), nil
+		},
+	}, nil
+}
+
+// ReloadCertificates reads the certificates of forwarders that terminate TLS
+// again. New connections get the reloaded certificates; a pair that fails to
+// load keeps serving its previous certificate.
+func (s *ImprovedServer) ReloadCertificates() (int, error) {
+	s.certsMu.Lock()
+	defer s.certsMu.Unlock()
+	var errs []error
+	for _, cert := range s.certs {
+		if err := cert.load(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", cert.certFile, err))
+		}
+	}
+	return len(s.certs), errors.Join(errs...)
+}
+
+// forwarderTLS returns the TLS configuration a forwarder terminates external
+// connections with, or nil if it forwards them as they are
+func (s *ImprovedServer) forwarderTLS(fw ForwarderConfig) (*tls.Config, error) {
+	if fw.TLSCert == "" {
+		return nil, nil
+	}
+	return s.serverTLS(fw.TLSCert, fw.TLSKey)
+}
+
+// acceptTLS completes the handshake of an external connection so that a
+// failed handshake never reaches a client
+func acceptTLS(conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
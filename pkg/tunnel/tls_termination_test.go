@@ -0,0 +1,111 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeTestCertificate writes a self-signed certificate for name with the
+// given serial number and its key to certFile and keyFile
+func writeTestCertificate(t *testing.T, certFile, keyFile, name string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedSerial completes a handshake with config and returns the serial
+// number of the certificate the server presented
+func servedSerial(t *testing.T, config *tls.Config) int64 {
+	t.Helper()
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	defer serverEnd.Close()
+	go tls.Server(serverEnd, config).Handshake()
+
+	client := tls.Client(clientEnd, &tls.Config{InsecureSkipVerify: true})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return client.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestReloadCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, "db.example.com", 1)
+
+	server := NewImprovedServer(zap.NewNop(), "secret", nil)
+	forwarderConfig, err := server.forwarderTLS(ForwarderConfig{Name: "web", TLSCert: certFile, TLSKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgresConfig, err := server.postgresTLS(PostgresConfig{TLSCert: certFile, TLSKey: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := servedSerial(t, forwarderConfig); serial != 1 {
+		t.Fatalf("served certificate %d, want 1", serial)
+	}
+
+	// Listeners keep their configuration and pick up the renewed pair
+	writeTestCertificate(t, certFile, keyFile, "db.example.com", 2)
+	if count, err := server.ReloadCertificates(); count != 1 || err != nil {
+		t.Fatalf("reloaded %d certificates, %v", count, err)
+	}
+	for name, config := range map[string]*tls.Config{"forwarder": forwarderConfig, "postgres": postgresConfig} {
+		if serial := servedSerial(t, config); serial != 2 {
+			t.Errorf("%s served certificate %d after reload, want 2", name, serial)
+		}
+	}
+
+	// A broken pair keeps the certificate that was loaded last
+	if err := os.WriteFile(keyFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.ReloadCertificates(); err == nil {
+		t.Error("expected an error for a broken key")
+	}
+	if serial := servedSerial(t, forwarderConfig); serial != 2 {
+		t.Errorf("served certificate %d after a failed reload, want 2", serial)
+	}
+	if _, err := server.forwarderTLS(ForwarderConfig{Name: "other", TLSCert: certFile + ".missing", TLSKey: keyFile}); err == nil {
+		t.Error("expected an error for a missing certificate")
+	}
+}
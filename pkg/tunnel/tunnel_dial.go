@@ -0,0 +1,293 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Error classes reported by the server when it cannot open a session
+const (
+	ErrCodeNotAllowed         = "not_allowed"
+	ErrCodeNetworkUnreachable = "network_unreachable"
+	ErrCodeHostUnreachable    = "host_unreachable"
+	ErrCodeConnectionRefused  = "connection_refused"
+	ErrCodeTimeout            = "timeout"
+	ErrCodeUnavailable        = "unavailable"
+)
+
+// TunnelError is a session failure reported through the tunnel
+type TunnelError struct {
+	Code    string
+	Message string
+}
+
+func (e *TunnelError) Error() string {
+	return e.Message
+}
+
+// errorCode returns the class of a session error
+func errorCode(err error) string {
+	var tunnelErr *TunnelError
+	if errors.As(err, &tunnelErr) {
+		return tunnelErr.Code
+	}
+	return ""
+}
+
+// dialErrorCode classifies a failed dial
+func dialErrorCode(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrCodeConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ErrCodeNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrCodeHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrCodeTimeout
+	}
+	return ""
+}
+
+// TunnelConn is a connection to a target opened by the server
+type TunnelConn struct {
+	net.Conn
+	bound string
+}
+
+// BoundAddr returns the local address of the server's connection to the target
+func (c *TunnelConn) BoundAddr() string {
+	return c.bound
+}
+
+// Datagram is a UDP payload exchanged through a datagram session
+type Datagram struct {
+	Addr string // Destination when sending, source when received
+	Data []byte
+}
+
+// DatagramSession relays UDP datagrams through a socket opened by the server
+type DatagramSession struct {
+	ID       string
+	client   *ImprovedClient
+	bound    string
+	incoming chan Datagram
+	closed   atomic.Bool
+	done     chan struct{}
+}
+
+// DialTunnel asks the server to connect to target and waits for the outcome.
+// Failures reported by the server are returned as *TunnelError.
+func (c *ImprovedClient) DialTunnel(ctx context.Context, target string) (*TunnelConn, error) {
+	if !c.isConnected.Load() {
+		return nil, &TunnelError{Code: ErrCodeUnavailable, Message: "tunnel client not connected"}
+	}
+
+	clientConn, proxyConn := net.Pipe()
+	sessionID := fmt.Sprintf("%s-%d", c.config.ClientID, time.Now().UnixNano())
+	session := c.sessions.Create(sessionID, clientConn, target, c)
+
+	reply := c.awaitReply(sessionID)
+	defer c.dropReply(sessionID)
+
+	msg := ForwardMessage{
+		Type:      "connect",
+		SessionID: sessionID,
+		Target:    target,
+	}
+	if err := c.sendForwardMessage(msg); err != nil {
+		c.sessions.Remove(sessionID)
+		proxyConn.Close()
+		return nil, &TunnelError{Code: ErrCodeUnavailable, Message: fmt.Sprintf("failed to send connect message: %v", err)}
+	}
+
+	// Data written before the reply is buffered by the server
+	go session.Start()
+
+	select {
+	case msg := <-reply:
+		if msg.Type == "error" {
+			proxyConn.Close()
+			return nil, &TunnelError{Code: msg.Code, Message: msg.Error}
+		}
+		c.config.Logger.Debug("Tunnel session connected",
+			zap.String("sessionID", sessionID),
+			zap.String("target", target),
+			zap.String("bound", msg.Address))
+		return &TunnelConn{Conn: proxyConn, bound: msg.Address}, nil
+	case <-ctx.Done():
+		c.sessions.Remove(sessionID)
+		proxyConn.Close()
+		return nil, &TunnelError{Code: ErrCodeTimeout, Message: fmt.Sprintf("connect to %s: %v", target, ctx.Err())}
+	}
+}
+
+// OpenDatagramSession asks the server for a UDP socket to relay datagrams through
+func (c *ImprovedClient) OpenDatagramSession(ctx context.Context) (*DatagramSession, error) {
+	if !c.isConnected.Load() {
+		return nil, &TunnelError{Code: ErrCodeUnavailable, Message: "tunnel client not connected"}
+	}
+
+	session := &DatagramSession{
+		ID:       fmt.Sprintf("%s-udp-%d", c.config.ClientID, time.Now().UnixNano()),
+		client:   c,
+		incoming: make(chan Datagram, 256),
+		done:     make(chan struct{}),
+	}
+
+	reply := c.awaitReply(session.ID)
+	defer c.dropReply(session.ID)
+
+	c.dialsMu.Lock()
+	c.datagrams[session.ID] = session
+	c.dialsMu.Unlock()
+
+	msg := ForwardMessage{
+		Type:      "connect",
+		SessionID: session.ID,
+		Network:   "udp",
+	}
+	if err := c.sendForwardMessage(msg); err != nil {
+		c.removeDatagramSession(session.ID)
+		return nil, &TunnelError{Code: ErrCodeUnavailable, Message: fmt.Sprintf("failed to send connect message: %v", err)}
+	}
+
+	select {
+	case msg := <-reply:
+		if msg.Type == "error" {
+			c.removeDatagramSession(session.ID)
+			return nil, &TunnelError{Code: msg.Code, Message: msg.Error}
+		}
+		session.bound = msg.Address
+		return session, nil
+	case <-ctx.Done():
+		session.Close()
+		return nil, &TunnelError{Code: ErrCodeTimeout, Message: fmt.Sprintf("open datagram session: %v", ctx.Err())}
+	}
+}
+
+// BoundAddr returns the address of the server's UDP socket
+func (d *DatagramSession) BoundAddr() string {
+	return d.bound
+}
+
+// WriteTo sends a datagram to target through the server
+func (d *DatagramSession) WriteTo(data []byte, target string) error {
+	if d.closed.Load() {
+		return fmt.Errorf("datagram session closed")
+	}
+	return d.client.sendForwardMessage(ForwardMessage{
+		Type:      "datagram",
+		SessionID: d.ID,
+		Target:    target,
+		Data:      base64.StdEncoding.EncodeToString(data),
+	})
+}
+
+// Datagrams returns the datagrams received by the server's socket
+func (d *DatagramSession) Datagrams() <-chan Datagram {
+	return d.incoming
+}
+
+// Done is closed when the session ends, locally or on the server
+func (d *DatagramSession) Done() <-chan struct{} {
+	return d.done
+}
+
+// Close ends the session and releases the server's socket
+func (d *DatagramSession) Close() {
+	if d.client.removeDatagramSession(d.ID) {
+		d.client.sendForwardMessage(ForwardMessage{Type: "disconnect", SessionID: d.ID})
+	}
+}
+
+// end marks the session closed; the caller holds dialsMu
+func (d *DatagramSession) end() {
+	if d.closed.CompareAndSwap(false, true) {
+		close(d.done)
+	}
+}
+
+// awaitReply registers interest in the "connected" or "error" reply to a session
+func (c *ImprovedClient) awaitReply(sessionID string) <-chan ForwardMessage {
+	reply := make(chan ForwardMessage, 1)
+	c.dialsMu.Lock()
+	c.replies[sessionID] = reply
+	c.dialsMu.Unlock()
+	return reply
+}
+
+// dropReply stops waiting for the reply to a session
+func (c *ImprovedClient) dropReply(sessionID string) {
+	c.dialsMu.Lock()
+	delete(c.replies, sessionID)
+	c.dialsMu.Unlock()
+}
+
+// deliverReply hands a "connected" or "error" message to a waiting dial and
+// reports whether one was waiting
+func (c *ImprovedClient) deliverReply(msg *ForwardMessage) bool {
+	c.dialsMu.Lock()
+	defer c.dialsMu.Unlock()
+	reply, exists := c.replies[msg.SessionID]
+	if !exists {
+		return false
+	}
+	delete(c.replies, msg.SessionID)
+	reply <- *msg
+	return true
+}
+
+// handleRemoteDatagram queues a datagram received by the server's socket
+func (c *ImprovedClient) handleRemoteDatagram(msg *ForwardMessage) {
+	data, err := base64.StdEncoding.DecodeString(msg.Data)
+	if err != nil {
+		c.config.Logger.Error("Failed to decode datagram", zap.Error(err))
+		return
+	}
+
+	c.dialsMu.Lock()
+	defer c.dialsMu.Unlock()
+	session, exists := c.datagrams[msg.SessionID]
+	if !exists {
+		return
+	}
+	c.metrics.bytesTransferred.Add(int64(len(data)))
+	select {
+	case session.incoming <- Datagram{Addr: msg.Target, Data: data}:
+	default:
+		// UDP semantics: drop when the reader falls behind
+	}
+}
+
+// removeDatagramSession forgets a datagram session and reports whether it was open
+func (c *ImprovedClient) removeDatagramSession(sessionID string) bool {
+	c.dialsMu.Lock()
+	defer c.dialsMu.Unlock()
+	session, exists := c.datagrams[sessionID]
+	if exists {
+		delete(c.datagrams, sessionID)
+		session.end()
+	}
+	return exists
+}
+
+// closeDatagramSessions ends every datagram session; the server releases its
+// sockets when the connection they were opened on goes away
+func (c *ImprovedClient) closeDatagramSessions() {
+	c.dialsMu.Lock()
+	defer c.dialsMu.Unlock()
+	for sessionID, session := range c.datagrams {
+		delete(c.datagrams, sessionID)
+		session.end()
+	}
+}
@@ -0,0 +1,66 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// unixScheme prefixes Unix domain socket addresses, e.g. "unix:///var/run/docker.sock"
+const unixScheme = "unix://"
+
+// unixSocketPath returns the socket path of a "unix://" address
+func unixSocketPath(address string) (string, bool) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(address, unixScheme), true
+}
+
+// targetNetwork returns the network and address to dial a mapping target
+func targetNetwork(target string) (string, string) {
+	if socketPath, ok := unixSocketPath(target); ok {
+		return "unix", socketPath
+	}
+	return "tcp", target
+}
+
+// validateSocketPath checks the path of a "unix://" target or listener
+func validateSocketPath(address string) error {
+	socketPath, _ := unixSocketPath(address)
+	if !path.IsAbs(socketPath) {
+		return fmt.Errorf("%q: socket path must be absolute", address)
+	}
+	return nil
+}
+
+// ListenUnix listens on a Unix domain socket with the given file mode. A
+// socket file left behind by a previous run is replaced; one that still
+// accepts connections is not.
+func ListenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(socketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socketPath)
+		}
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
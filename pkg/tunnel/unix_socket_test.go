@@ -0,0 +1,178 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTargetNetwork(t *testing.T) {
+	tests := []struct {
+		target  string
+		network string
+		address string
+		valid   bool
+	}{
+		{"unix:///var/run/docker.sock", "unix", "/var/run/docker.sock", true},
+		{"unix://run/docker.sock", "unix", "run/docker.sock", false},
+		{"db.internal:5432", "tcp", "db.internal:5432", true},
+	}
+
+	for _, tt := range tests {
+		network, address := targetNetwork(tt.target)
+		if network != tt.network || address != tt.address {
+			t.Errorf("targetNetwork(%q) = %s, %s; want %s, %s", tt.target, network, address, tt.network, tt.address)
+		}
+		if err := validateTarget(tt.target); (err == nil) != tt.valid {
+			t.Errorf("validateTarget(%q) = %v", tt.target, err)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("new socket", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "new.sock")
+		listener, err := ListenUnix(socketPath, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		info, err := os.Stat(socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0660 {
+			t.Errorf("mode %v, want 0660", info.Mode().Perm())
+		}
+	})
+
+	t.Run("socket in use", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "used.sock")
+		listener, err := ListenUnix(socketPath, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		if second, err := ListenUnix(socketPath, 0600); err == nil {
+			second.Close()
+			t.Error("listened on a socket in use")
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "stale.sock")
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Leave the socket file behind as a crashed process would
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+		listener, err = ListenUnix(socketPath, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener.Close()
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "file")
+		if err := os.WriteFile(socketPath, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if listener, err := ListenUnix(socketPath, 0600); err == nil {
+			listener.Close()
+			t.Error("replaced a regular file")
+		}
+		if _, err := os.Stat(socketPath); err != nil {
+			t.Errorf("file removed: %v", err)
+		}
+	})
+}
+
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	targetPath := filepath.Join(dir, "target.sock")
+	target, err := net.Listen("unix", targetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echoAddr := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echoAddr)
+	remotePort, _ := strconv.Atoi(echoPort)
+	port := freePort(t)
+
+	server := NewImprovedServer(zap.NewNop(), "secret", []ForwarderConfig{{
+		Name:     "socket",
+		Port:     port,
+		ClientID: "c1",
+		Enabled:  true,
+	}})
+	if err := server.SetEgressPolicy(EgressPolicy{Enabled: true, Rules: []EgressRule{
+		{Destinations: TargetAllowlist{echoAddr}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tunnel", server.HandleTunnel)
+	web := httptest.NewServer(mux)
+	defer web.Close()
+	client := startTestClient(t, server, web.URL, "c1", map[int]string{port: unixScheme + targetPath})
+	for deadline := time.Now().Add(5 * time.Second); !client.isConnected.Load(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not connect")
+		}
+	}
+
+	t.Run("target", func(t *testing.T) {
+		if err := server.StartTCPForwarder(port, ""); err != nil {
+			t.Fatal(err)
+		}
+		defer server.StopTCPForwarder(port)
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "to a socket target")
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		socketPath := filepath.Join(dir, "egress.sock")
+		if err := client.AddUnixForwarder(socketPath, "127.0.0.1", remotePort); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.AddUnixForwarder(socketPath, "127.0.0.1", remotePort); err == nil {
+			t.Error("added the same socket forwarder twice")
+		}
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "from a socket listener")
+	})
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -31,10 +33,15 @@ var (
 // ForwarderConfig moved to tunnel package
 
 type ServerConfig struct {
-	Listen   string `yaml:"listen"`
-	Token    string `yaml:"token"`
-	Improved bool   `yaml:"improved"`
-	TLS      struct {
+	Listen          string                 `yaml:"listen"`
+	Token           string                 `yaml:"token"`
+	Improved        bool                   `yaml:"improved"`
+	RequiredClients []string               `yaml:"required_clients"` // Clients that must be connected for /health/ready
+	DrainTimeout    time.Duration          `yaml:"drain_timeout"`    // How long active sessions may finish on shutdown
+	AdminToken      string                 `yaml:"admin_token"`      // Enables the /admin/ API when set
+	AdminSocket     string                 `yaml:"admin_socket"`     // Unix socket serving the admin API without a token
+	Inspector       tunnel.InspectorConfig `yaml:"inspector"`        // Request inspector for HTTP forwarders with inspect set
+	TLS             struct {
 		Cert string `yaml:"cert"`
 		Key  string `yaml:"key"`
 	} `yaml:"tls"`
@@ -43,6 +50,12 @@ type ServerConfig struct {
 type Config struct {
 	Server     ServerConfig               `yaml:"server"`
 	Forwarders []tunnel.ForwarderConfig `yaml:"forwarders"`
+	Alerts     tunnel.AlertConfig       `yaml:"alerts"`
+	
+	DynamicForwarders tunnel.DynamicForwarderPolicy `yaml:"dynamic_forwarders"`
+	Cluster           tunnel.ClusterConfig          `yaml:"cluster"`
+	Egress            tunnel.EgressPolicy           `yaml:"egress"`
+	Shares            tunnel.SharePolicy            `yaml:"shares"`
 }
 
 func getConfigPath() string {
@@ -83,9 +96,11 @@ func loadConfig(configPath string, logger *zap.Logger) (*Config, error) {
 	config := &Config{
 		Server: ServerConfig{
 			Listen:   ":8443",
-			Token:    "${TUNNEL_TOKEN}",
-			Improved: true,
+			Token:        "${TUNNEL_TOKEN}",
+			Improved:     true,
+			DrainTimeout: 30 * time.Second,
 		},
+		Cluster: tunnel.DefaultClusterConfig(),
 	}
 	
 	// Try to load config file
@@ -107,11 +122,47 @@ func loadConfig(configPath string, logger *zap.Logger) (*Config, error) {
 	// Expand environment variables
 	config.Server.Listen = expandEnvVars(config.Server.Listen)
 	config.Server.Token = expandEnvVars(config.Server.Token)
+	config.Server.AdminToken = expandEnvVars(config.Server.AdminToken)
 	config.Server.TLS.Cert = expandEnvVars(config.Server.TLS.Cert)
 	config.Server.TLS.Key = expandEnvVars(config.Server.TLS.Key)
+	for i := range config.Server.RequiredClients {
+		config.Server.RequiredClients[i] = expandEnvVars(config.Server.RequiredClients[i])
+	}
+	config.Cluster.NodeID = expandEnvVars(config.Cluster.NodeID)
+	config.Cluster.AdvertiseURL = expandEnvVars(config.Cluster.AdvertiseURL)
+	config.Cluster.Token = expandEnvVars(config.Cluster.Token)
+	config.Cluster.RegistryPath = expandEnvVars(config.Cluster.RegistryPath)
+	config.Cluster.CAFile = expandEnvVars(config.Cluster.CAFile)
+	config.Egress.DNS.Resolver = expandEnvVars(config.Egress.DNS.Resolver)
+	for i := range config.DynamicForwarders.Clients {
+		config.DynamicForwarders.Clients[i] = expandEnvVars(config.DynamicForwarders.Clients[i])
+	}
+	for i := range config.Alerts.Webhooks {
+		config.Alerts.Webhooks[i].URL = expandEnvVars(config.Alerts.Webhooks[i].URL)
+		for key, value := range config.Alerts.Webhooks[i].Headers {
+			config.Alerts.Webhooks[i].Headers[key] = expandEnvVars(value)
+		}
+	}
 	
 	for i := range config.Forwarders {
 		config.Forwarders[i].ClientID = expandEnvVars(config.Forwarders[i].ClientID)
+		config.Forwarders[i].ClientGroup = expandEnvVars(config.Forwarders[i].ClientGroup)
+		config.Forwarders[i].Postgres.TLSCert = expandEnvVars(config.Forwarders[i].Postgres.TLSCert)
+		config.Forwarders[i].Postgres.TLSKey = expandEnvVars(config.Forwarders[i].Postgres.TLSKey)
+		config.Forwarders[i].TLSCert = expandEnvVars(config.Forwarders[i].TLSCert)
+		config.Forwarders[i].TLSKey = expandEnvVars(config.Forwarders[i].TLSKey)
+		for j := range config.Forwarders[i].ClientIDs {
+			config.Forwarders[i].ClientIDs[j] = expandEnvVars(config.Forwarders[i].ClientIDs[j])
+		}
+		for j := range config.Forwarders[i].Routes {
+			route := &config.Forwarders[i].Routes[j]
+			route.Host = expandEnvVars(route.Host)
+			route.ClientID = expandEnvVars(route.ClientID)
+			route.ClientGroup = expandEnvVars(route.ClientGroup)
+			for k := range route.ClientIDs {
+				route.ClientIDs[k] = expandEnvVars(route.ClientIDs[k])
+			}
+		}
 		
 		// Apply environment variable overrides
 		envPrefix := fmt.Sprintf("TUNNEL_FORWARDER_%s_", strings.ToUpper(config.Forwarders[i].Name))
@@ -122,13 +173,23 @@ func loadConfig(configPath string, logger *zap.Logger) (*Config, error) {
 			}
 		}
 		
-		// Target configuration removed - handled by client
+		// Targets are pushed to clients that allow them
+		config.Forwarders[i].Target = expandEnvVars(config.Forwarders[i].Target)
+		if target := os.Getenv(envPrefix + "TARGET"); target != "" {
+			config.Forwarders[i].Target = target
+		}
 		
 		if enabledStr := os.Getenv(envPrefix + "ENABLED"); enabledStr != "" {
 			if enabled, err := strconv.ParseBool(enabledStr); err == nil {
 				config.Forwarders[i].Enabled = enabled
 			}
 		}
+		
+		if criticalStr := os.Getenv(envPrefix + "CRITICAL"); criticalStr != "" {
+			if critical, err := strconv.ParseBool(criticalStr); err == nil {
+				config.Forwarders[i].Critical = critical
+			}
+		}
 	}
 	
 	return config, nil
@@ -156,6 +217,72 @@ func validateConfig(config *Config, logger *zap.Logger) []tunnel.ForwarderConfig
 			continue
 		}
 		
+		switch forwarder.Type {
+		case "", tunnel.ForwarderTCP:
+			if forwarder.ClientID == "" && len(forwarder.ClientIDs) == 0 && forwarder.ClientGroup == "" {
+				logger.Error("Forwarder has no client_id, client_ids or client_group", zap.String("name", forwarder.Name))
+				continue
+			}
+			if forwarder.Inspect {
+				logger.Warn("inspect only applies to http forwarders", zap.String("name", forwarder.Name))
+			}
+		case tunnel.ForwarderHTTP, tunnel.ForwarderTLS:
+			if err := validateRoutes(forwarder); err != nil {
+				logger.Error("Invalid routed forwarder", zap.String("name", forwarder.Name), zap.String("type", forwarder.Type), zap.Error(err))
+				continue
+			}
+		default:
+			logger.Error("Unknown forwarder type", zap.String("name", forwarder.Name), zap.String("type", forwarder.Type))
+			continue
+		}
+		
+		switch forwarder.Balance {
+		case "", tunnel.BalanceRoundRobin, tunnel.BalanceLeastSessions, tunnel.BalancePriority:
+		default:
+			logger.Error("Unknown balance policy", zap.String("name", forwarder.Name), zap.String("balance", forwarder.Balance))
+			continue
+		}
+		
+		switch forwarder.Protocol {
+		case "":
+		case tunnel.ProtocolPostgres:
+			if err := forwarder.Postgres.Validate(); err != nil {
+				logger.Error("Invalid PostgreSQL configuration", zap.String("name", forwarder.Name), zap.Error(err))
+				continue
+			}
+		default:
+			logger.Error("Unknown forwarder protocol", zap.String("name", forwarder.Name), zap.String("protocol", forwarder.Protocol))
+			continue
+		}
+		
+		if err := validateProxyProtocol(forwarder); err != nil {
+			logger.Error("Invalid PROXY protocol configuration", zap.String("name", forwarder.Name), zap.Error(err))
+			continue
+		}
+		
+		if forwarder.MaxSessions < 0 || forwarder.MaxSessionsPerIP < 0 || forwarder.IdleTimeout < 0 || forwarder.MaxDuration < 0 || forwarder.ConnectTimeout < 0 {
+			logger.Error("Session limits must not be negative", zap.String("name", forwarder.Name))
+			continue
+		}
+		
+		if err := forwarder.Bandwidth.Validate(); err != nil {
+			logger.Error("Invalid bandwidth configuration", zap.String("name", forwarder.Name), zap.Error(err))
+			continue
+		}
+		
+		if err := validateTLSTermination(forwarder); err != nil {
+			logger.Error("Invalid TLS configuration", zap.String("name", forwarder.Name), zap.Error(err))
+			continue
+		}
+		
+		if err := forwarder.Access.Validate(); err != nil {
+			logger.Error("Invalid access configuration", zap.String("name", forwarder.Name), zap.Error(err))
+			continue
+		}
+		if forwarder.Access.JustInTime && config.Server.AdminToken == "" && config.Server.AdminSocket == "" {
+			logger.Warn("just_in_time access needs admin_token or admin_socket to grant access", zap.String("name", forwarder.Name))
+		}
+		
 		if usedPorts[forwarder.Port] {
 			logger.Error("Port conflict detected", zap.String("name", forwarder.Name), zap.Int("port", forwarder.Port))
 			continue
@@ -168,12 +295,104 @@ func validateConfig(config *Config, logger *zap.Logger) []tunnel.ForwarderConfig
 		logger.Info("Validated forwarder", 
 			zap.String("name", forwarder.Name),
 			zap.Int("port", forwarder.Port),
-			zap.String("clientID", forwarder.ClientID))
+			zap.String("clientID", forwarder.ClientID),
+			zap.Bool("critical", forwarder.Critical))
 	}
 	
 	return validForwarders
 }
 
+// validateRoutes checks the routes of an HTTP or TLS forwarder
+func validateRoutes(forwarder tunnel.ForwarderConfig) error {
+	if len(forwarder.Routes) == 0 {
+		return fmt.Errorf("no routes configured")
+	}
+	if forwarder.Protocol != "" {
+		return fmt.Errorf("protocol %q is not supported on %s forwarders", forwarder.Protocol, forwarder.Type)
+	}
+	var errs []error
+	for _, route := range forwarder.Routes {
+		errs = append(errs, route.Validate())
+		// TLS routes only see the SNI hostname
+		if forwarder.Type == tunnel.ForwarderTLS && (route.PathPrefix != "" || route.Timeout != 0) {
+			errs = append(errs, fmt.Errorf("route %s: path_prefix and timeout are not supported on tls forwarders", route))
+		}
+	}
+	if forwarder.Type == tunnel.ForwarderTLS && forwarder.Inspect {
+		errs = append(errs, fmt.Errorf("inspect is not supported on tls forwarders"))
+	}
+	return errors.Join(errs...)
+}
+
+// validateProxyProtocol checks the load balancers a forwarder reads PROXY headers from
+func validateProxyProtocol(forwarder tunnel.ForwarderConfig) error {
+	if !forwarder.AcceptProxyProtocol {
+		if len(forwarder.TrustedProxies) > 0 {
+			return fmt.Errorf("trusted_proxies is set without accept_proxy_protocol")
+		}
+		return nil
+	}
+	// Anyone who can reach the port could claim any address otherwise
+	if len(forwarder.TrustedProxies) == 0 {
+		return fmt.Errorf("accept_proxy_protocol requires trusted_proxies")
+	}
+	for _, cidr := range forwarder.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("trusted_proxies: invalid network %q", cidr)
+		}
+	}
+	return nil
+}
+
+// validateTLSTermination checks the certificate of a forwarder that terminates TLS
+func validateTLSTermination(forwarder tunnel.ForwarderConfig) error {
+	if forwarder.TLSCert == "" && forwarder.TLSKey == "" {
+		return nil
+	}
+	if forwarder.TLSCert == "" || forwarder.TLSKey == "" {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	// TLS forwarders pass the handshake through to the service
+	if forwarder.Type == tunnel.ForwarderTLS {
+		return fmt.Errorf("tls_cert is not supported on tls forwarders")
+	}
+	if forwarder.Protocol == tunnel.ProtocolPostgres {
+		return fmt.Errorf("postgres forwarders terminate TLS with postgres.tls_cert")
+	}
+	if _, err := tls.LoadX509KeyPair(forwarder.TLSCert, forwarder.TLSKey); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newCluster creates the cluster of an improved server from its configuration
+func newCluster(server *tunnel.ImprovedServer, config *Config) (*tunnel.Cluster, error) {
+	if config.Cluster.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("node_id is required: %w", err)
+		}
+		config.Cluster.NodeID = hostname
+	}
+	if config.Cluster.Token == "" {
+		config.Cluster.Token = config.Server.Token
+	}
+	
+	var registry tunnel.ClusterRegistry
+	switch config.Cluster.Registry {
+	case "", "file":
+		fileRegistry, err := tunnel.NewFileRegistry(config.Cluster.RegistryPath)
+		if err != nil {
+			return nil, err
+		}
+		registry = fileRegistry
+	default:
+		return nil, fmt.Errorf("unknown registry %q", config.Cluster.Registry)
+	}
+	
+	return tunnel.NewCluster(server, config.Cluster, registry)
+}
+
 func startTCPForwarders(server any, configs []tunnel.ForwarderConfig, logger *zap.Logger, useImproved bool) {
 	for _, config := range configs {
 		if useImproved {
@@ -246,28 +465,122 @@ func main() {
 
 	mux := http.NewServeMux()
 	
+	// Cancelled on shutdown so this node leaves the cluster registry
+	clusterCtx, leaveCluster := context.WithCancel(context.Background())
+	defer leaveCluster()
+	
 	// Validate and filter forwarder configurations
 	validConfigs := validateConfig(config, logger)
 	
 	// Create server instance based on implementation choice
 	var server any
+	var improvedServer *tunnel.ImprovedServer
+	var inspectorServer *http.Server
 	implType := "improved"
 	if config.Server.Improved {
 		logger.Info("Using improved tunnel server implementation")
-		server = tunnel.NewImprovedServer(logger, config.Server.Token, config.Forwarders)
-		mux.HandleFunc("/tunnel", server.(*tunnel.ImprovedServer).HandleTunnel)
+		improvedServer = tunnel.NewImprovedServer(logger, config.Server.Token, validConfigs)
+		server = improvedServer
+		mux.HandleFunc("/tunnel", improvedServer.HandleTunnel)
+		
+		// Health endpoints backed by live client and session data
+		monitor := tunnel.NewImprovedServerMonitor(improvedServer)
+		monitor.SetRequiredClients(config.Server.RequiredClients)
+		mux.HandleFunc("/health", monitor.HTTPHealthHandler())
+		mux.HandleFunc("/health/live", monitor.HTTPLivenessHandler())
+		mux.HandleFunc("/health/ready", monitor.HTTPReadinessHandler())
+		
+		// Forwarders announced by clients
+		if err := improvedServer.SetDynamicForwarderPolicy(config.DynamicForwarders); err != nil {
+			logger.Fatal("Invalid dynamic_forwarders configuration", zap.Error(err))
+		}
+		
+		// Client-initiated connections to external destinations
+		if err := improvedServer.SetEgressPolicy(config.Egress); err != nil {
+			logger.Fatal("Invalid egress configuration", zap.Error(err))
+		}
+		
+		// Temporary forwarders created through the admin API
+		if err := improvedServer.SetSharePolicy(config.Shares); err != nil {
+			logger.Fatal("Invalid shares configuration", zap.Error(err))
+		}
+		mux.HandleFunc("/share/", improvedServer.HandleShareOpen)
+		
+		// Administrative API for approvals
+		if config.Server.AdminToken != "" {
+			mux.Handle("/admin/", tunnel.NewAdminAPI(improvedServer, config.Server.AdminToken, logger).Handler())
+		} else if config.DynamicForwarders.RequireApproval && config.Server.AdminSocket == "" {
+			logger.Warn("dynamic_forwarders.require_approval is set but admin_token is empty; services cannot be approved")
+		}
+		
+		// Local admin API; the socket's permissions take the place of the token
+		if config.Server.AdminSocket != "" {
+			adminListener, err := tunnel.ListenUnix(config.Server.AdminSocket, 0660)
+			if err != nil {
+				logger.Fatal("Failed to listen on admin socket", zap.String("socket", config.Server.AdminSocket), zap.Error(err))
+			}
+			defer adminListener.Close()
+			go func() {
+				logger.Info("Admin API listening on Unix socket", zap.String("socket", config.Server.AdminSocket))
+				if err := http.Serve(adminListener, tunnel.NewAdminAPI(improvedServer, "", logger).LocalHandler()); err != nil && !errors.Is(err, net.ErrClosed) {
+					logger.Error("Admin socket failed", zap.Error(err))
+				}
+			}()
+		}
+		
+		// Capture requests of inspected HTTP forwarders for the local web UI,
+		// whose API takes the admin token
+		if config.Server.Inspector.Listen != "" {
+			if config.Server.AdminToken == "" {
+				logger.Fatal("server.inspector requires admin_token")
+			}
+			inspector := tunnel.NewInspector(improvedServer, config.Server.Inspector, logger)
+			inspectorServer = &http.Server{
+				Addr:              config.Server.Inspector.Listen,
+				Handler:           inspector.Handler(config.Server.AdminToken),
+				ReadHeaderTimeout: 30 * time.Second,
+				IdleTimeout:       60 * time.Second,
+			}
+			go func() {
+				logger.Info("Request inspector listening", zap.String("listen", config.Server.Inspector.Listen))
+				if err := inspectorServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					logger.Error("Request inspector failed", zap.Error(err))
+				}
+			}()
+		}
+		
+		// Share attached clients with peers and relay sessions between them
+		if config.Cluster.Enabled {
+			cluster, err := newCluster(improvedServer, config)
+			if err != nil {
+				logger.Fatal("Invalid cluster configuration", zap.Error(err))
+			}
+			mux.HandleFunc("/cluster/relay", cluster.HandleRelay)
+			go cluster.Start(clusterCtx)
+			logger.Info("Cluster mode enabled",
+				zap.String("nodeID", config.Cluster.NodeID),
+				zap.String("advertiseURL", config.Cluster.AdvertiseURL),
+				zap.String("registry", config.Cluster.Registry))
+		}
+		
+		// Alert when critical forwarders lose their client
+		alertManager := tunnel.NewAlertManager(improvedServer, config.Alerts, logger)
+		go alertManager.Start(context.Background())
 	} else {
 		logger.Info("Using original tunnel server implementation")
 		server = tunnel.NewServer(logger, config.Server.Token)
 		mux.HandleFunc("/tunnel", server.(*tunnel.Server).HandleTunnel)
 		implType = "original"
+		
+		legacyHealth := func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(fmt.Sprintf(`{"status":"healthy","implementation":"%s","forwarders":%d}`, implType, len(validConfigs))))
+		}
+		mux.HandleFunc("/health", legacyHealth)
+		mux.HandleFunc("/health/live", legacyHealth)
+		mux.HandleFunc("/health/ready", legacyHealth)
 	}
-	
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf(`{"status":"healthy","implementation":"%s","forwarders":%d}`, implType, len(validConfigs))))
-	})
 
 	// Start TCP forwarders using unified function
 	startTCPForwarders(server, validConfigs, logger, config.Server.Improved)
@@ -293,6 +606,34 @@ func main() {
 		}
 	}
 
+	// Reload forwarder targets, the egress policy and TLS certificates on
+	// SIGHUP and push the targets to connected clients
+	if improvedServer != nil {
+		go func() {
+			hupChan := make(chan os.Signal, 1)
+			signal.Notify(hupChan, syscall.SIGHUP)
+			for range hupChan {
+				reloaded, err := loadConfig(*configFile, logger)
+				if err != nil {
+					logger.Error("Failed to reload configuration", zap.Error(err))
+					continue
+				}
+				changed := improvedServer.UpdateTargets(reloaded.Forwarders)
+				logger.Info("Reloaded forwarder targets", zap.Int("changed", changed))
+				if err := improvedServer.SetEgressPolicy(reloaded.Egress); err != nil {
+					logger.Error("Keeping previous egress policy", zap.Error(err))
+				} else {
+					logger.Info("Reloaded egress policy", zap.Int("rules", len(reloaded.Egress.Rules)))
+				}
+				if count, err := improvedServer.ReloadCertificates(); err != nil {
+					logger.Error("Keeping previous certificates that failed to load", zap.Error(err))
+				} else if count > 0 {
+					logger.Info("Reloaded forwarder certificates", zap.Int("certificates", count))
+				}
+			}
+		}()
+	}
+
 	// Setup graceful shutdown
 	go func() {
 		sigChan := make(chan os.Signal, 1)
@@ -301,7 +642,21 @@ func main() {
 		
 		logger.Info("Shutting down server...")
 		
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		// Drain tunnel sessions before stopping the HTTP server, which does not
+		// track hijacked WebSocket connections or forwarder listeners
+		if improvedServer != nil {
+			leaveCluster()
+			drainCtx, drainCancel := context.WithTimeout(context.Background(), config.Server.DrainTimeout)
+			if inspectorServer != nil {
+				inspectorServer.Shutdown(drainCtx)
+			}
+			if err := improvedServer.Shutdown(drainCtx); err != nil {
+				logger.Warn("Sessions cut at drain deadline", zap.Error(err))
+			}
+			drainCancel()
+		}
+		
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		
 		if err := srv.Shutdown(ctx); err != nil {